@@ -0,0 +1,449 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ociLayoutFile       = "oci-layout"
+	ociIndexFile        = "index.json"
+	dockerManifestFile  = "manifest.json"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+	annotationImageName = "io.containerd.image.name"
+	dockerHubPrefix     = "docker.io/library/"
+)
+
+// archiveManifest is an entry of the manifest.json docker save writes.
+type archiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// registryManifest is the part of an image manifest needed to find its
+// blobs, which Docker and OCI manifests share.
+type registryManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// saveCmd writes images to a tar archive in the layout docker save uses
+// since Docker 25: an OCI image layout with a manifest.json alongside, which
+// both docker load and OCI tools understand. Errors go to stderr, since
+// stdout may be the archive.
+func saveCmd(args []string) int {
+	fs := flag.NewFlagSet("save", flag.ContinueOnError)
+	output := fs.String("o", "", "write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Println("usage: save [-o file] <image>...")
+		return 2
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var images []*Image
+	for _, ref := range fs.Args() {
+		img, err := store.lookup(ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if img == nil {
+			fmt.Fprintf(os.Stderr, "no such image: %s\n", ref)
+			return 1
+		}
+		images = append(images, img)
+	}
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := store.save(images, w); err != nil {
+		if *output != "" {
+			os.Remove(*output)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (s *imageStore) save(images []*Image, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	writeFile := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write archive: %v", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("write archive: %v", err)
+		}
+		return nil
+	}
+	if err := writeFile(ociLayoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	writeBlob := func(digest string) error {
+		if written[digest] {
+			return nil
+		}
+		written[digest] = true
+		return s.writeBlobTo(tw, digest, now)
+	}
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	var manifests []archiveManifest
+	for _, img := range images {
+		data, err := s.readBlob(img.Manifest)
+		if err != nil {
+			return err
+		}
+		var m registryManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("decode manifest: %v", err)
+		}
+		for _, digest := range append([]string{img.Manifest, img.Config}, img.Layers...) {
+			if err := writeBlob(digest); err != nil {
+				return err
+			}
+		}
+		_, tag := parseImageRef(img.Ref)
+		index.Manifests = append(index.Manifests, ociDescriptor{
+			MediaType: m.MediaType,
+			Digest:    img.Manifest,
+			Size:      int64(len(data)),
+			Annotations: map[string]string{
+				annotationImageName: qualifiedRef(img.Ref),
+				annotationRefName:   tag,
+			},
+		})
+		entry := archiveManifest{Config: blobArchivePath(img.Config), RepoTags: []string{img.Ref}}
+		for _, layer := range img.Layers {
+			entry.Layers = append(entry.Layers, blobArchivePath(layer))
+		}
+		manifests = append(manifests, entry)
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("marshal index: %v", err)
+	}
+	if err := writeFile(ociIndexFile, data); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(manifests); err != nil {
+		return fmt.Errorf("marshal manifest: %v", err)
+	}
+	if err := writeFile(dockerManifestFile, data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	return nil
+}
+
+func (s *imageStore) writeBlobTo(tw *tar.Writer, digest string, modTime time.Time) error {
+	f, err := os.Open(s.blobPath(digest))
+	if err != nil {
+		return fmt.Errorf("read blob: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("read blob: %v", err)
+	}
+	hdr := &tar.Header{Name: blobArchivePath(digest), Mode: 0644, Size: fi.Size(), ModTime: modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	return nil
+}
+
+func blobArchivePath(digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algo, hex)
+}
+
+// qualifiedRef spells a Docker Hub ref out in full the way Docker records
+// it in saved archives.
+func qualifiedRef(ref string) string {
+	if strings.Contains(ref, "/") {
+		return ref
+	}
+	return dockerHubPrefix + ref
+}
+
+// loadCmd reads images from an archive written by save or docker save.
+func loadCmd(args []string) int {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	input := fs.String("i", "", "read from this file instead of stdin")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: load [-i file]")
+		return 2
+	}
+	r := io.Reader(os.Stdin)
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	images, err := store.load(r)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, img := range images {
+		fmt.Printf("Loaded image: %s\n", img.Ref)
+	}
+	return 0
+}
+
+// load adds the images in an archive to the store. Every file in the
+// archive other than the index files is stored as a blob under its digest
+// as it is read, so layers never have to fit in memory. Archives with a
+// manifest.json are read through it, so that the older docker save format,
+// which keeps layers outside blobs/, works too; otherwise the OCI index is
+// used.
+func (s *imageStore) load(r io.Reader) ([]*Image, error) {
+	tr := tar.NewReader(r)
+	digests := make(map[string]string)
+	meta := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		switch name {
+		case ociLayoutFile, ociIndexFile, dockerManifestFile:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("read archive: %v", err)
+			}
+			meta[name] = data
+		default:
+			digest, err := s.storeBlob(tr)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %v", name, err)
+			}
+			digests[name] = digest
+		}
+	}
+	var images []*Image
+	var err error
+	if data, ok := meta[dockerManifestFile]; ok {
+		images, err = s.imagesFromDockerManifest(data, digests)
+	} else if data, ok := meta[ociIndexFile]; ok {
+		images, err = s.imagesFromOCIIndex(data)
+	} else {
+		err = fmt.Errorf("archive has neither %s nor %s", dockerManifestFile, ociIndexFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		if err := s.put(img); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// storeBlob copies r into the store under its digest, which it returns.
+func (s *imageStore) storeBlob(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(tmpDir(path.Join(s.dir, "blobs")), "load-")
+	if err != nil {
+		return "", fmt.Errorf("write blob: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return "", fmt.Errorf("write blob: %v", err)
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if s.hasBlob(digest) {
+		return digest, nil
+	}
+	if err := os.Rename(tmp.Name(), s.blobPath(digest)); err != nil {
+		return "", fmt.Errorf("write blob: %v", err)
+	}
+	return digest, nil
+}
+
+// imagesFromDockerManifest builds images from a docker save manifest.json,
+// which has no registry manifest, so one is made up from the config and
+// layers.
+func (s *imageStore) imagesFromDockerManifest(data []byte, digests map[string]string) ([]*Image, error) {
+	var entries []archiveManifest
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("decode %s: %v", dockerManifestFile, err)
+	}
+	blob := func(name string) (ociDescriptor, error) {
+		digest, ok := digests[path.Clean(name)]
+		if !ok {
+			return ociDescriptor{}, fmt.Errorf("archive is missing %s", name)
+		}
+		fi, err := os.Stat(s.blobPath(digest))
+		if err != nil {
+			return ociDescriptor{}, fmt.Errorf("read blob: %v", err)
+		}
+		return ociDescriptor{Digest: digest, Size: fi.Size()}, nil
+	}
+	var images []*Image
+	for _, e := range entries {
+		if len(e.RepoTags) == 0 {
+			return nil, fmt.Errorf("image %s in archive has no tag", e.Config)
+		}
+		m := registryManifest{SchemaVersion: 2, MediaType: mediaTypeDockerManifest}
+		var err error
+		if m.Config, err = blob(e.Config); err != nil {
+			return nil, err
+		}
+		m.Config.MediaType = "application/vnd.docker.container.image.v1+json"
+		for _, name := range e.Layers {
+			layer, err := blob(name)
+			if err != nil {
+				return nil, err
+			}
+			layer.MediaType = s.layerMediaType(layer.Digest)
+			m.Layers = append(m.Layers, layer)
+		}
+		manifest, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("marshal manifest: %v", err)
+		}
+		digest := digestOf(manifest)
+		if err := s.writeBlob(digest, manifest); err != nil {
+			return nil, err
+		}
+		for _, tag := range e.RepoTags {
+			images = append(images, s.newLoadedImage(tag, digest, m))
+		}
+	}
+	return images, nil
+}
+
+func (s *imageStore) imagesFromOCIIndex(data []byte) ([]*Image, error) {
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("decode %s: %v", ociIndexFile, err)
+	}
+	var images []*Image
+	for _, d := range index.Manifests {
+		ref := d.Annotations[annotationImageName]
+		if ref == "" {
+			ref = d.Annotations[annotationRefName]
+		}
+		if ref == "" {
+			return nil, fmt.Errorf("image %s in archive has no name", d.Digest)
+		}
+		data, err := s.readBlob(d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var m registryManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("decode manifest: %v", err)
+		}
+		if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerManifestList {
+			return nil, fmt.Errorf("image %s in archive is a multi-platform index, which load doesn't support", ref)
+		}
+		for _, blob := range append([]ociDescriptor{m.Config}, m.Layers...) {
+			if !s.hasBlob(blob.Digest) {
+				return nil, fmt.Errorf("archive is missing blob %s of %s", blob.Digest, ref)
+			}
+		}
+		images = append(images, s.newLoadedImage(ref, d.Digest, m))
+	}
+	return images, nil
+}
+
+// layerMediaType tells a gzipped layer from a plain tar, which docker save
+// wrote before Docker 25.
+func (s *imageStore) layerMediaType(digest string) string {
+	f, err := os.Open(s.blobPath(digest))
+	if err == nil {
+		defer f.Close()
+		magic := make([]byte, 2)
+		if _, err := io.ReadFull(f, magic); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			return "application/vnd.docker.image.rootfs.diff.tar.gzip"
+		}
+	}
+	return "application/vnd.docker.image.rootfs.diff.tar"
+}
+
+func (s *imageStore) newLoadedImage(ref, manifestDigest string, m registryManifest) *Image {
+	img := &Image{
+		Ref:      normalizeRef(strings.TrimPrefix(ref, dockerHubPrefix)),
+		Digest:   manifestDigest,
+		Manifest: manifestDigest,
+		Config:   m.Config.Digest,
+		PulledAt: time.Now(),
+	}
+	for _, layer := range m.Layers {
+		img.Layers = append(img.Layers, layer.Digest)
+	}
+	return img
+}
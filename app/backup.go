@@ -0,0 +1,503 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What a backup can hold.
+const (
+	backupImages     = "images"
+	backupVolumes    = "volumes"
+	backupContainers = "containers"
+)
+
+const (
+	backupManifestFile = "backup.json"
+	backupImagesFile   = "images.tar"
+	backupVersion      = 1
+)
+
+// backupManifest is the first entry of a backup and says what follows.
+// Images come as a save archive, and each volume as the files under its
+// archive path.
+type backupManifest struct {
+	Version    int               `json:"version"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Images     []string          `json:"images,omitempty"`
+	Volumes    []backupVolume    `json:"volumes,omitempty"`
+	Containers []backupContainer `json:"containers,omitempty"`
+}
+
+// backupVolume is a host path containers mount. There are no named volumes,
+// so these are what holds container data outside the containers.
+type backupVolume struct {
+	Source string `json:"source"`
+	Path   string `json:"path"`
+}
+
+// backupContainer is a container's definition, without its state.
+type backupContainer struct {
+	ID     string          `json:"id"`
+	Config ContainerConfig `json:"config"`
+}
+
+// parseBackupKinds works out what to back up or restore from the
+// comma-separated --include and --exclude lists.
+func parseBackupKinds(include, exclude string) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	parse := func(list string) ([]string, error) {
+		var names []string
+		for _, name := range strings.Split(list, ",") {
+			switch name {
+			case backupImages, backupVolumes, backupContainers:
+				names = append(names, name)
+			case "":
+			default:
+				return nil, fmt.Errorf("unknown kind %q: expected %s, %s or %s", name, backupImages, backupVolumes, backupContainers)
+			}
+		}
+		return names, nil
+	}
+	included, err := parse(include)
+	if err != nil {
+		return nil, err
+	}
+	if len(included) == 0 {
+		included = []string{backupImages, backupVolumes, backupContainers}
+	}
+	for _, name := range included {
+		kinds[name] = true
+	}
+	excluded, err := parse(exclude)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range excluded {
+		delete(kinds, name)
+	}
+	return kinds, nil
+}
+
+// backupCmd writes images, the host paths containers mount and container
+// definitions to a single archive that restore can set up again elsewhere.
+// Errors go to stderr, since stdout may be the archive.
+func backupCmd(args []string) int {
+	fs := flag.NewFlagSet("system backup", flag.ContinueOnError)
+	output := fs.String("o", "", "write to this file instead of stdout")
+	include := fs.String("include", "", "comma-separated kinds to back up: images, volumes, containers (default all)")
+	exclude := fs.String("exclude", "", "comma-separated kinds to leave out")
+	project := addProjectFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: system backup [-o file] [--include KINDS] [--exclude KINDS] [--project NAME]")
+		return 2
+	}
+	kinds, err := parseBackupKinds(*include, *exclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := validateProject(*project); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := store.backup(w, kinds, *project); err != nil {
+		if *output != "" {
+			os.Remove(*output)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// backup writes the archive. With a project, only its containers are
+// included, along with the images and volumes they use.
+func (s *imageStore) backup(w io.Writer, kinds map[string]bool, project string) error {
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+	m := backupManifest{Version: backupVersion, CreatedAt: time.Now().UTC()}
+	usedImages := make(map[string]bool)
+	sources := make(map[string]bool)
+	for _, c := range containers {
+		// Warm sandboxes belong to a pool, not to the user.
+		if c.Status == statusWarm || !c.inProject(project) {
+			continue
+		}
+		usedImages[normalizeRef(c.Config.Image)] = true
+		for _, mount := range c.Config.Mounts {
+			if !strings.HasPrefix(mount.Source, containersDir()+"/") {
+				sources[mount.Source] = true
+			}
+		}
+		if kinds[backupContainers] {
+			m.Containers = append(m.Containers, backupContainer{ID: c.ID, Config: c.Config})
+		}
+	}
+	var images []*Image
+	if kinds[backupImages] {
+		all, err := s.list()
+		if err != nil {
+			return err
+		}
+		for _, img := range all {
+			if project == "" || usedImages[img.Ref] {
+				images = append(images, img)
+				m.Images = append(m.Images, img.Ref)
+			}
+		}
+	}
+	if kinds[backupVolumes] {
+		var names []string
+		for source := range sources {
+			names = append(names, source)
+		}
+		sort.Strings(names)
+		for i, source := range names {
+			m.Volumes = append(m.Volumes, backupVolume{Source: source, Path: fmt.Sprintf("%s/%d", backupVolumes, i+1)})
+		}
+	}
+	tw := tar.NewWriter(w)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal backup: %v", err)
+	}
+	hdr := &tar.Header{Name: backupManifestFile, Mode: 0644, Size: int64(len(data)), ModTime: m.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	if len(images) > 0 {
+		if err := s.backupImages(tw, images); err != nil {
+			return err
+		}
+	}
+	for _, v := range m.Volumes {
+		if err := addTree(tw, v.Source, v.Path); err != nil {
+			return fmt.Errorf("back up %s: %v", v.Source, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	return nil
+}
+
+// backupImages adds a save archive of images. Its size has to be known up
+// front, so it is written to a temporary file first.
+func (s *imageStore) backupImages(tw *tar.Writer, images []*Image) error {
+	tmp, err := os.CreateTemp(tmpDir(s.dir), "backup-")
+	if err != nil {
+		return fmt.Errorf("back up images: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := s.save(images, tmp); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("back up images: %v", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("back up images: %v", err)
+	}
+	hdr := &tar.Header{Name: backupImagesFile, Mode: 0644, Size: size, ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	return nil
+}
+
+// addTree adds root and everything below it to the archive under prefix,
+// keeping ownership, modes and times.
+func addTree(tw *tar.Writer, root, prefix string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			// Sockets and the like can't be archived.
+			return nil
+		}
+		hdr.Name = path.Join(prefix, rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// restoreCmd sets up what a backup holds. Containers come back as created
+// containers with new IDs, and volumes are only written to paths that
+// don't exist yet, so nothing on the host is overwritten.
+func restoreCmd(args []string) int {
+	fs := flag.NewFlagSet("system restore", flag.ContinueOnError)
+	input := fs.String("i", "", "read from this file instead of stdin")
+	include := fs.String("include", "", "comma-separated kinds to restore: images, volumes, containers (default all)")
+	exclude := fs.String("exclude", "", "comma-separated kinds to leave out")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: system restore [-i file] [--include KINDS] [--exclude KINDS]")
+		return 2
+	}
+	kinds, err := parseBackupKinds(*include, *exclude)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	r := io.Reader(os.Stdin)
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := store.restore(r, kinds); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func (s *imageStore) restore(r io.Reader, kinds map[string]bool) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestFile {
+		return fmt.Errorf("not a backup: %s must come first", backupManifestFile)
+	}
+	var m backupManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return fmt.Errorf("decode %s: %v", backupManifestFile, err)
+	}
+	if m.Version != backupVersion {
+		return fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+	// Volumes that already exist on this host are left alone.
+	volumes := make(map[string]string)
+	if kinds[backupVolumes] {
+		for _, v := range m.Volumes {
+			if _, err := os.Lstat(v.Source); err == nil {
+				fmt.Printf("Skipped volume %s: it already exists\n", v.Source)
+				continue
+			}
+			volumes[v.Path] = v.Source
+		}
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read archive: %v", err)
+		}
+		name := path.Clean(hdr.Name)
+		if name == backupImagesFile {
+			if !kinds[backupImages] {
+				continue
+			}
+			images, err := s.load(tr)
+			if err != nil {
+				return err
+			}
+			for _, img := range images {
+				fmt.Printf("Restored image: %s\n", img.Ref)
+			}
+			continue
+		}
+		for prefix, source := range volumes {
+			if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+				continue
+			}
+			if name == prefix {
+				if err := os.MkdirAll(path.Dir(source), 0755); err != nil {
+					return fmt.Errorf("restore %s: %v", source, err)
+				}
+			}
+			if err := extractEntry(tr, hdr, path.Join(source, strings.TrimPrefix(name, prefix))); err != nil {
+				return fmt.Errorf("restore %s: %v", source, err)
+			}
+		}
+	}
+	for _, v := range m.Volumes {
+		if _, ok := volumes[v.Path]; ok {
+			fmt.Printf("Restored volume: %s\n", v.Source)
+		}
+	}
+	if !kinds[backupContainers] {
+		return nil
+	}
+	for _, bc := range m.Containers {
+		c, err := s.restoreContainer(bc.Config)
+		if err != nil {
+			return fmt.Errorf("restore container %s: %v", bc.ID[:12], err)
+		}
+		fmt.Printf("Restored container %s as %s\n", bc.ID[:12], c.ID)
+	}
+	return nil
+}
+
+// extractEntry writes one archive entry to target, whose parent is already
+// in place since directories come before what is in them.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, target string) error {
+	mode := hdr.FileInfo().Mode().Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return applyHeader(target, hdr)
+}
+
+// restoreContainer creates a container from a backed up definition, ready
+// to be started. The definition already has the image config applied, so
+// it is used as it is.
+func (s *imageStore) restoreContainer(cfg ContainerConfig) (*Container, error) {
+	// The container's own files, such as the resolv.conf of one on a
+	// directory rootfs, are made afresh.
+	var mounts []Mount
+	for _, m := range cfg.Mounts {
+		if !strings.HasPrefix(m.Source, containersDir()+"/") {
+			mounts = append(mounts, m)
+		}
+	}
+	cfg.Mounts = mounts
+	// A container restored next to the one it was backed up from gets a
+	// name of its own.
+	if existing, err := findContainer(cfg.Name); err == nil && existing.Config.Name == cfg.Name {
+		cfg.Name = ""
+	}
+	c, err := newContainer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			c.remove()
+		}
+	}()
+	if cfg.RootfsTmpfs {
+		if err := mountRootfsTmpfs(c); err != nil {
+			return nil, err
+		}
+	}
+	img, config, err := provisionRootfs(context.Background(), s, c, PullOptions{MaxConcurrentDownloads: defaultMaxConcurrentDownloads}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if img != nil {
+		c.ImageID = img.ID()
+	}
+	c.ImageConfig = *config
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	if cfg.RootfsPath == "" {
+		if err := prepareRootfs(c.Config.Command, c.Rootfs); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeResolvConf(c); err != nil {
+		return nil, err
+	}
+	ok = true
+	return c, nil
+}
@@ -0,0 +1,360 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The benchmarks system bench runs, in the order it runs them.
+const (
+	benchPull   = "pull"
+	benchUnpack = "unpack"
+	benchStart  = "start"
+	benchExec   = "exec"
+)
+
+var benchNames = []string{benchPull, benchUnpack, benchStart, benchExec}
+
+// benchReport is what system bench found, with enough about the host to
+// tell whether two reports can be compared.
+type benchReport struct {
+	Image      string        `json:"image"`
+	Iterations int           `json:"iterations"`
+	Kernel     string        `json:"kernel"`
+	CPUs       int           `json:"cpus"`
+	GoVersion  string        `json:"goVersion"`
+	StartedAt  time.Time     `json:"startedAt"`
+	Results    []benchResult `json:"results"`
+}
+
+// benchResult sums up the timings of one benchmark. Pull and unpack also
+// say how much they moved, and so how fast.
+type benchResult struct {
+	Name           string  `json:"name"`
+	Iterations     int     `json:"iterations"`
+	MinMs          float64 `json:"minMs"`
+	MedianMs       float64 `json:"medianMs"`
+	MeanMs         float64 `json:"meanMs"`
+	MaxMs          float64 `json:"maxMs"`
+	Bytes          int64   `json:"bytes,omitempty"`
+	BytesPerSecond float64 `json:"bytesPerSecond,omitempty"`
+	Files          int64   `json:"files,omitempty"`
+	FilesPerSecond float64 `json:"filesPerSecond,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// benchCmd times the runtime's hot paths against one image: pulling it
+// afresh, unpacking it, starting a container and exec'ing into one. Start
+// and exec run the CLI as a user would, so they include its own startup.
+func benchCmd(args []string) int {
+	fs := flag.NewFlagSet("system bench", flag.ContinueOnError)
+	image := fs.String("image", "alpine:latest", "image to benchmark with; it needs the command and sleep")
+	iterations := fs.Int("iterations", 5, "times to run each benchmark")
+	only := fs.String("only", "", "comma-separated benchmarks to run: pull, unpack, start, exec (default all)")
+	command := fs.String("command", "true", "command the start and exec benchmarks run")
+	network := fs.String("network", networkHost, "network mode of the benchmark containers")
+	format := fs.String("format", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || *iterations < 1 {
+		fmt.Println("usage: system bench [options]")
+		return 2
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Printf("invalid --format %q: expected table or json\n", *format)
+		return 2
+	}
+	names := benchNames
+	if *only != "" {
+		names = strings.Split(*only, ",")
+		for _, name := range names {
+			if !slices.Contains(benchNames, name) {
+				fmt.Printf("unknown benchmark %q: expected %s\n", name, strings.Join(benchNames, ", "))
+				return 2
+			}
+		}
+	}
+	b, err := newBench(*image, *iterations, strings.Fields(*command), *network)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer b.close()
+	report := benchReport{
+		Image:      *image,
+		Iterations: *iterations,
+		Kernel:     kernelRelease(),
+		CPUs:       runtime.NumCPU(),
+		GoVersion:  runtime.Version(),
+		StartedAt:  time.Now().UTC(),
+	}
+	code := 0
+	for _, name := range benchNames {
+		if !slices.Contains(names, name) {
+			continue
+		}
+		r := b.run(name)
+		if r.Error != "" {
+			code = 1
+		}
+		report.Results = append(report.Results, r)
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return code
+	}
+	printBenchReport(report)
+	return code
+}
+
+type bench struct {
+	store      *imageStore
+	img        *Image
+	iterations int
+	command    []string
+	network    string
+	// scratch holds what the benchmarks make, on the same filesystem as
+	// the state so that the rates are those containers get.
+	scratch string
+}
+
+func newBench(ref string, iterations int, command []string, network string) (*bench, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("--command is empty")
+	}
+	store, err := openImageStore()
+	if err != nil {
+		return nil, err
+	}
+	img, err := ensureImage(context.Background(), store, ref, PullOptions{Quiet: true, MaxConcurrentDownloads: defaultMaxConcurrentDownloads}, nil)
+	if err != nil {
+		return nil, err
+	}
+	scratch, err := os.MkdirTemp(stateDir(), "bench-")
+	if err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	return &bench{store: store, img: img, iterations: iterations, command: command, network: network, scratch: scratch}, nil
+}
+
+func (b *bench) close() {
+	os.RemoveAll(b.scratch)
+}
+
+// run runs the named benchmark, timing each of its iterations.
+func (b *bench) run(name string) benchResult {
+	r := benchResult{Name: name}
+	var samples []time.Duration
+	var err error
+	switch name {
+	case benchPull:
+		samples, r.Bytes, err = b.pull()
+	case benchUnpack:
+		samples, r.Bytes, r.Files, err = b.unpack()
+	case benchStart:
+		samples, err = b.start()
+	case benchExec:
+		samples, err = b.exec()
+	}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Iterations = len(samples)
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+	r.MinMs = milliseconds(samples[0])
+	r.MedianMs = milliseconds(samples[len(samples)/2])
+	r.MeanMs = milliseconds(total / time.Duration(len(samples)))
+	r.MaxMs = milliseconds(samples[len(samples)-1])
+	// Rates are of what one iteration moves, at its mean duration.
+	mean := (total / time.Duration(len(samples))).Seconds()
+	if r.Bytes > 0 && mean > 0 {
+		r.BytesPerSecond = float64(r.Bytes) / mean
+	}
+	if r.Files > 0 && mean > 0 {
+		r.FilesPerSecond = float64(r.Files) / mean
+	}
+	return r
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pull pulls the image into a store of its own each time, so that no layer
+// is already there. It returns how much the layers weigh.
+func (b *bench) pull() ([]time.Duration, int64, error) {
+	var samples []time.Duration
+	var size int64
+	for i := 0; i < b.iterations; i++ {
+		dir := path.Join(b.scratch, fmt.Sprintf("store-%d", i))
+		s := &imageStore{dir: dir, repositories: path.Join(dir, repositoriesFileName)}
+		if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755); err != nil {
+			return nil, 0, fmt.Errorf("mkdir: %v", err)
+		}
+		client, err := newPullClient(b.img.Ref, s, PullOptions{Quiet: true, MaxConcurrentDownloads: defaultMaxConcurrentDownloads})
+		if err != nil {
+			return nil, 0, err
+		}
+		start := time.Now()
+		img, err := client.Pull(context.Background())
+		if err != nil {
+			return nil, 0, err
+		}
+		samples = append(samples, time.Since(start))
+		size = 0
+		for _, layer := range img.Layers {
+			if fi, err := os.Stat(s.blobPath(layer)); err == nil {
+				size += fi.Size()
+			}
+		}
+		os.RemoveAll(dir)
+	}
+	return samples, size, nil
+}
+
+// unpack unpacks the image into a fresh rootfs each time. It returns how
+// many files the rootfs has and how much they weigh.
+func (b *bench) unpack() ([]time.Duration, int64, int64, error) {
+	var samples []time.Duration
+	var size, files int64
+	for i := 0; i < b.iterations; i++ {
+		rootfs := path.Join(b.scratch, fmt.Sprintf("rootfs-%d", i))
+		if err := os.Mkdir(rootfs, 0755); err != nil {
+			return nil, 0, 0, fmt.Errorf("mkdir: %v", err)
+		}
+		start := time.Now()
+		if err := b.store.unpack(b.img, rootfs); err != nil {
+			return nil, 0, 0, err
+		}
+		samples = append(samples, time.Since(start))
+		size, files = 0, 0
+		filepath.WalkDir(rootfs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+				files++
+			}
+			return nil
+		})
+		os.RemoveAll(rootfs)
+	}
+	return samples, size, files, nil
+}
+
+// start times a foreground run of the command, from the CLI starting to
+// it exiting with the container removed.
+func (b *bench) start() ([]time.Duration, error) {
+	var samples []time.Duration
+	for i := 0; i < b.iterations; i++ {
+		start := time.Now()
+		if _, err := b.cli(append([]string{"run", "--rm", "--network", b.network, b.img.Ref}, b.command...)...); err != nil {
+			return nil, err
+		}
+		samples = append(samples, time.Since(start))
+	}
+	return samples, nil
+}
+
+// exec times exec'ing the command into a container that is already up.
+func (b *bench) exec() ([]time.Duration, error) {
+	out, err := b.cli("run", "-d", "--network", b.network, b.img.Ref, "sleep", "3600")
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimSpace(out)
+	defer b.cli("rm", "-f", id)
+	// The shim starts the container after run -d has returned.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c, err := findContainer(id)
+		if err != nil {
+			return nil, err
+		}
+		if c.running() {
+			break
+		}
+		if c.Status == statusExited || time.Now().After(deadline) {
+			return nil, fmt.Errorf("container %s didn't start", c.shortID())
+		}
+	}
+	var samples []time.Duration
+	for i := 0; i < b.iterations; i++ {
+		start := time.Now()
+		if _, err := b.cli(append([]string{"exec", id}, b.command...)...); err != nil {
+			return nil, err
+		}
+		samples = append(samples, time.Since(start))
+	}
+	return samples, nil
+}
+
+// cli runs this program with args, returning what it printed.
+func (b *bench) cli(args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+func printBenchReport(report benchReport) {
+	fmt.Printf("image: %s, %d iterations, kernel %s, %d CPUs\n", report.Image, report.Iterations, report.Kernel, report.CPUs)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "BENCHMARK\tMIN\tMEDIAN\tMEAN\tMAX\tRATE")
+	var failed []benchResult
+	for _, r := range report.Results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%s\tfailed\t\t\t\t\n", r.Name)
+			failed = append(failed, r)
+			continue
+		}
+		var rate []string
+		if r.BytesPerSecond > 0 {
+			rate = append(rate, formatBytes(int64(r.BytesPerSecond))+"/s")
+		}
+		if r.FilesPerSecond > 0 {
+			rate = append(rate, fmt.Sprintf("%.0f files/s", r.FilesPerSecond))
+		}
+		fmt.Fprintf(tw, "%s\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%s\n", r.Name, r.MinMs, r.MedianMs, r.MeanMs, r.MaxMs, strings.Join(rate, ", "))
+	}
+	tw.Flush()
+	for _, r := range failed {
+		fmt.Printf("%s: %s\n", r.Name, r.Error)
+	}
+}
+
+func kernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
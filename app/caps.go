@@ -0,0 +1,237 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const linuxCapabilityVersion3 = 0x20080522
+
+// capabilities maps capability names, without the CAP_ prefix, to their
+// numbers.
+var capabilities = map[string]uint{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// defaultCapabilities is what a container keeps unless told otherwise, the
+// same list Docker uses.
+var defaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW",
+	"SETGID", "SETUID", "SETFCAP", "SETPCAP", "NET_BIND_SERVICE",
+	"SYS_CHROOT", "KILL", "AUDIT_WRITE",
+}
+
+// normalizeCapability turns net_admin, CAP_NET_ADMIN and NET_ADMIN into
+// NET_ADMIN, and accepts ALL.
+func normalizeCapability(name string) (string, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+	if _, ok := capabilities[name]; !ok && name != "ALL" {
+		return "", fmt.Errorf("unknown capability %q", name)
+	}
+	return name, nil
+}
+
+func parseCapabilities(names []string) ([]string, error) {
+	var caps []string
+	for _, name := range names {
+		c, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// capabilitySet works out the capabilities a container gets: the defaults,
+// minus what was dropped, plus what was added. ALL stands for every
+// capability, so --cap-drop ALL --cap-add X leaves just X.
+func capabilitySet(add, drop []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, c := range defaultCapabilities {
+		set[c] = true
+	}
+	for _, c := range drop {
+		if c == "ALL" {
+			set = make(map[string]bool)
+			break
+		}
+		delete(set, c)
+	}
+	for _, c := range add {
+		if c == "ALL" {
+			for name := range capabilities {
+				set[name] = true
+			}
+			break
+		}
+		set[c] = true
+	}
+	return set
+}
+
+// dropBoundingSet removes every capability not in keep from the bounding
+// set, so that nothing exec'd later can regain it. The calling process keeps
+// its own capabilities until limitCapabilities. Dropping needs CAP_SETPCAP,
+// and finding out how many capabilities there are needs /proc, so this
+// happens first thing in init.
+func dropBoundingSet(keep map[string]bool) error {
+	last, err := lastCapability()
+	if err != nil {
+		return err
+	}
+	allowed := make(map[uint]bool)
+	for name := range keep {
+		allowed[capabilities[name]] = true
+	}
+	for c := uint(0); c <= last; c++ {
+		if allowed[c] {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0)
+		if errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("drop capability %d from bounding set: %v", c, errno)
+		}
+	}
+	return nil
+}
+
+// Arguments of prctl not in the syscall package.
+const (
+	prCapAmbient      = 47
+	prCapAmbientRaise = 2
+)
+
+// ambientCapabilities returns the capabilities to raise in the ambient set
+// of a container command run as user: the ones given to --cap-add, when the
+// user isn't root. Without them, a non-root command loses every capability
+// when it is exec'd, so --cap-add NET_BIND_SERVICE wouldn't let it bind
+// port 80.
+func ambientCapabilities(add []string, user containerUser) map[string]bool {
+	if user.uid == 0 || len(add) == 0 {
+		return nil
+	}
+	return capabilitySet(add, []string{"ALL"})
+}
+
+// keepCapabilities makes the calling thread keep its permitted
+// capabilities when it switches to a non-root user, so that some of them
+// can be made ambient afterwards.
+func keepCapabilities() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+		return fmt.Errorf("keep capabilities: %v", errno)
+	}
+	return nil
+}
+
+// raiseAmbient adds caps to the calling thread's ambient set, which passes
+// them on to a program exec'd by a non-root user. They must already be
+// permitted and inheritable.
+func raiseAmbient(caps map[string]bool) error {
+	for name := range caps {
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, uintptr(capabilities[name]), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("raise ambient capability %s: %v", name, errno)
+		}
+	}
+	return nil
+}
+
+func capabilityMask(caps map[string]bool) [2]uint32 {
+	var mask [2]uint32
+	for name := range caps {
+		c := capabilities[name]
+		mask[c/32] |= 1 << (c % 32)
+	}
+	return mask
+}
+
+// limitCapabilities narrows the calling process's effective and permitted
+// sets to keep and its inheritable set to ambient, which is empty unless
+// the command is to get ambient capabilities. Capabilities are only ever
+// removed, so this also works after switching to a user with fewer.
+func limitCapabilities(keep, ambient map[string]bool) error {
+	mask := capabilityMask(keep)
+	inheritable := capabilityMask(ambient)
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %v", errno)
+	}
+	for i := range data {
+		data[i].effective &= mask[i]
+		data[i].permitted &= mask[i]
+		data[i].inheritable = inheritable[i] & data[i].permitted
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	return nil
+}
+
+// lastCapability is the highest capability the running kernel knows.
+func lastCapability() (uint, error) {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, fmt.Errorf("read cap_last_cap: %v", err)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("parse cap_last_cap: %v", err)
+	}
+	return uint(last), nil
+}
@@ -0,0 +1,196 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ethPAll          = 0x0003
+	pcapMagic        = 0xa1b2c3d4
+	linktypeEthernet = 1
+)
+
+func networkCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: network capture <id> [-o file.pcap]")
+		return 2
+	}
+	switch args[0] {
+	case "capture":
+		return captureCmd(args[1:])
+	default:
+		fmt.Printf("unknown network command: %s\n", args[0])
+		return 2
+	}
+}
+
+// captureCmd writes the packets seen in a container's network namespace to
+// a pcap file. The socket is opened from inside the namespace, so nothing
+// needs to be installed in the image.
+func captureCmd(args []string) int {
+	fs := flag.NewFlagSet("network capture", flag.ContinueOnError)
+	output := fs.String("o", "-", "write packets to this pcap file (- for stdout)")
+	iface := fs.String("i", "", "capture on this interface only (default all)")
+	count := fs.Int("c", 0, "stop after this many packets (0 for no limit)")
+	snaplen := fs.Int("s", 65535, "bytes to keep from each packet")
+	var ref string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		ref, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if ref == "" && fs.NArg() == 1 {
+		ref = fs.Arg(0)
+	} else if ref == "" || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: network capture <id> [-o file.pcap] [-i iface] [-c count]")
+		return 2
+	}
+	c, err := findContainer(ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !c.running() {
+		fmt.Fprintf(os.Stderr, "container %s is not running\n", c.shortID())
+		return 1
+	}
+	fd, err := openCaptureSocket(c.Pid, *iface)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer syscall.Close(fd)
+
+	out := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "create file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	sigs, stopNotify := notifySignals()
+	defer stopNotify()
+	n, err := capturePackets(fd, w, *snaplen, *count, sigs)
+	fmt.Fprintf(os.Stderr, "%d packets captured\n", n)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// openCaptureSocket opens an AF_PACKET socket inside the network namespace
+// of pid. The socket stays bound to that namespace after the thread that
+// created it is gone.
+func openCaptureSocket(pid int, iface string) (int, error) {
+	type result struct {
+		fd  int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		fd, err := func() (int, error) {
+			if err := setns(fmt.Sprintf("/proc/%d/ns/net", pid), syscall.CLONE_NEWNET); err != nil {
+				return -1, fmt.Errorf("join net namespace: %v", err)
+			}
+			fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPAll)))
+			if err != nil {
+				return -1, fmt.Errorf("socket: %v", err)
+			}
+			if iface == "" {
+				return fd, nil
+			}
+			ifi, err := net.InterfaceByName(iface)
+			if err != nil {
+				syscall.Close(fd)
+				return -1, err
+			}
+			addr := &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: ifi.Index}
+			if err := syscall.Bind(fd, addr); err != nil {
+				syscall.Close(fd)
+				return -1, fmt.Errorf("bind %s: %v", iface, err)
+			}
+			return fd, nil
+		}()
+		done <- result{fd, err}
+	}()
+	r := <-done
+	return r.fd, r.err
+}
+
+func capturePackets(fd int, w io.Writer, snaplen, count int, sigs <-chan os.Signal) (int, error) {
+	// Wake up periodically so that a signal can end the capture.
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return 0, fmt.Errorf("setsockopt: %v", err)
+	}
+	if err := writePcapHeader(w, snaplen); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, snaplen)
+	n := 0
+	for count == 0 || n < count {
+		select {
+		case <-sigs:
+			return n, nil
+		default:
+		}
+		size, _, err := syscall.Recvfrom(fd, buf, syscall.MSG_TRUNC)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("recvfrom: %v", err)
+		}
+		if err := writePcapRecord(w, time.Now(), buf[:min(size, len(buf))], size); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func writePcapHeader(w io.Writer, snaplen int) error {
+	// Version 2.4 is two little-endian uint16s packed into one word.
+	hdr := []uint32{pcapMagic, 2 | 4<<16, 0, 0, uint32(snaplen), linktypeEthernet}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return fmt.Errorf("write pcap header: %v", err)
+	}
+	return nil
+}
+
+func writePcapRecord(w io.Writer, ts time.Time, data []byte, origLen int) error {
+	hdr := []uint32{uint32(ts.Unix()), uint32(ts.Nanosecond() / 1000), uint32(len(data)), uint32(origLen)}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return fmt.Errorf("write packet: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("write packet: %v", err)
+	}
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,343 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// cgroupParent is the directory under the cgroup v2 root that containers'
+// cgroups are created in.
+const cgroupParent = "diy-docker"
+
+// DeviceRule allows a container access to devices, as in the devices
+// cgroup: Type is a for all, b for block or c for character devices, Major
+// and Minor are -1 to match any, and Access is a combination of r, w and
+// m for mknod.
+type DeviceRule struct {
+	Type   string `json:"type"`
+	Major  int64  `json:"major"`
+	Minor  int64  `json:"minor"`
+	Access string `json:"access"`
+}
+
+// deviceRulePattern is the --device-cgroup-rule syntax Docker accepts.
+var deviceRulePattern = regexp.MustCompile(`^([abc]) ([0-9]+|\*):([0-9]+|\*) ([rwm]{1,3})$`)
+
+// defaultDeviceRules are what every unprivileged container may use: mknod
+// of any device, which is harmless since it can't be opened, the devices
+// setupDev creates, the console and pseudo-terminals.
+var defaultDeviceRules = func() []DeviceRule {
+	rules := []DeviceRule{
+		{Type: "c", Major: -1, Minor: -1, Access: "m"},
+		{Type: "b", Major: -1, Minor: -1, Access: "m"},
+	}
+	for _, d := range defaultDevices {
+		rules = append(rules, DeviceRule{Type: "c", Major: int64(d.major), Minor: int64(d.minor), Access: "rwm"})
+	}
+	return append(rules,
+		DeviceRule{Type: "c", Major: 5, Minor: 1, Access: "rwm"},    // console
+		DeviceRule{Type: "c", Major: 5, Minor: 2, Access: "rwm"},    // ptmx
+		DeviceRule{Type: "c", Major: 136, Minor: -1, Access: "rwm"}, // pts
+	)
+}()
+
+// parseDeviceRule parses a --device-cgroup-rule such as "c 1:3 rwm".
+func parseDeviceRule(spec string) (DeviceRule, error) {
+	m := deviceRulePattern.FindStringSubmatch(spec)
+	if m == nil {
+		return DeviceRule{}, fmt.Errorf("invalid device cgroup rule %q: expected TYPE MAJOR:MINOR ACCESS, as in \"c 1:3 rwm\"", spec)
+	}
+	rule := DeviceRule{Type: m[1], Major: -1, Minor: -1, Access: m[4]}
+	for _, part := range []struct {
+		s string
+		n *int64
+	}{{m[2], &rule.Major}, {m[3], &rule.Minor}} {
+		if part.s == "*" {
+			continue
+		}
+		n, err := strconv.ParseUint(part.s, 10, 32)
+		if err != nil {
+			return DeviceRule{}, fmt.Errorf("invalid device cgroup rule %q: %v", spec, err)
+		}
+		*part.n = int64(n)
+	}
+	return rule, nil
+}
+
+func parseDeviceRules(specs []string) ([]DeviceRule, error) {
+	var rules []DeviceRule
+	for _, spec := range specs {
+		rule, err := parseDeviceRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// cgroup2Root returns where the cgroup v2 hierarchy is mounted, which is
+// /sys/fs/cgroup on unified hosts and usually /sys/fs/cgroup/unified on
+// hybrid ones, or "" if it isn't.
+func cgroup2Root() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", fmt.Errorf("read mountinfo: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return unescapeMountinfo(fields[4]), nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read mountinfo: %v", err)
+	}
+	return "", nil
+}
+
+// setupCgroup puts the container's init, which hasn't been released yet,
+// in a cgroup of its own that allows only the default devices and those
+// of the container's --device-cgroup-rule flags, and that enforces its
+// soft memory limits. Privileged containers may use any device, and only
+// get a cgroup for their memory limits. Creating cgroups takes root, so
+// containers started by other users are confined by their user namespace
+// alone, as are those on hosts without cgroup v2.
+func setupCgroup(c *Container) error {
+	if (c.Config.Privileged && !c.Config.Memory.set()) || os.Geteuid() != 0 {
+		return nil
+	}
+	root, err := cgroup2Root()
+	if err != nil {
+		return err
+	}
+	if root == "" {
+		if len(c.Config.DeviceRules) > 0 {
+			return fmt.Errorf("device cgroup rules require cgroup v2")
+		}
+		if c.Config.Memory.set() {
+			return fmt.Errorf("memory limits require cgroup v2")
+		}
+		return nil
+	}
+	dir := path.Join(root, cgroupParent, c.ID)
+	if err := c.track(resourceCgroup, dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create cgroup: %v", err)
+	}
+	c.Cgroup = dir
+	if c.Config.Memory.set() {
+		if err := enableMemoryController(root, path.Dir(dir)); err != nil {
+			return err
+		}
+		if err := setMemoryLimits(dir, c.Config.Memory); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(c.Pid)), 0); err != nil {
+		return fmt.Errorf("join cgroup: %v", err)
+	}
+	if !c.Config.Privileged {
+		rules := append(append([]DeviceRule{}, defaultDeviceRules...), c.Config.DeviceRules...)
+		if err := attachDeviceFilter(dir, rules); err != nil {
+			return fmt.Errorf("device filter: %v", err)
+		}
+	}
+	return c.save()
+}
+
+// removeCgroup removes a container's cgroup once its processes are gone,
+// and with it the device filter attached to it.
+func removeCgroup(dir string) error {
+	if err := syscall.Rmdir(dir); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// eBPF instruction encodings the device filter uses, from linux/bpf.h.
+const (
+	ebpfLdxMemW   = 0x61 // dst = *(u32 *)(src + off)
+	ebpfAnd32Imm  = 0x54 // dst &= imm
+	ebpfRsh32Imm  = 0x74 // dst >>= imm
+	ebpfMov32Reg  = 0xbc // dst = src
+	ebpfMov64Imm  = 0xb7 // dst = imm
+	ebpfJneImm    = 0x55 // if dst != imm goto +off
+	ebpfJneReg    = 0x5d // if dst != src goto +off
+	ebpfExit      = 0x95
+	bpfProgLoad   = 5
+	bpfProgAttach = 8
+	// bpfProgTypeCgroupDevice and bpfCgroupDevice are the program and
+	// attach types of a device filter.
+	bpfProgTypeCgroupDevice = 15
+	bpfCgroupDevice         = 6
+)
+
+// Device types and access bits in struct bpf_cgroup_dev_ctx, whose
+// access_type holds the access in its upper half and the type in its lower.
+const (
+	bpfDevcgDevBlock = 1
+	bpfDevcgDevChar  = 2
+	bpfDevcgAccMknod = 1
+	bpfDevcgAccRead  = 2
+	bpfDevcgAccWrite = 4
+)
+
+type ebpfInsn struct {
+	code uint8
+	regs uint8 // src in the upper four bits, dst in the lower
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) ebpfInsn {
+	return ebpfInsn{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+// deviceFilter compiles rules into a cgroup device program that allows an
+// access if any rule matches it and denies it otherwise. The context in r1
+// is unpacked into r2 to r5 first; each rule then jumps to the next one as
+// soon as a field doesn't match.
+func deviceFilter(rules []DeviceRule) []ebpfInsn {
+	prog := []ebpfInsn{
+		insn(ebpfLdxMemW, 2, 1, 0, 0), // r2 = type
+		insn(ebpfAnd32Imm, 2, 0, 0, 0xffff),
+		insn(ebpfLdxMemW, 3, 1, 0, 0), // r3 = access
+		insn(ebpfRsh32Imm, 3, 0, 0, 16),
+		insn(ebpfLdxMemW, 4, 1, 4, 0), // r4 = major
+		insn(ebpfLdxMemW, 5, 1, 8, 0), // r5 = minor
+	}
+	for _, rule := range rules {
+		var checks [][]ebpfInsn
+		switch rule.Type {
+		case "b":
+			checks = append(checks, []ebpfInsn{insn(ebpfJneImm, 2, 0, 0, bpfDevcgDevBlock)})
+		case "c":
+			checks = append(checks, []ebpfInsn{insn(ebpfJneImm, 2, 0, 0, bpfDevcgDevChar)})
+		}
+		access := int32(0)
+		for _, a := range rule.Access {
+			access |= map[rune]int32{'m': bpfDevcgAccMknod, 'r': bpfDevcgAccRead, 'w': bpfDevcgAccWrite}[a]
+		}
+		if access != bpfDevcgAccMknod|bpfDevcgAccRead|bpfDevcgAccWrite {
+			// Every bit asked for has to be allowed: (access & allowed) == access.
+			checks = append(checks, []ebpfInsn{
+				insn(ebpfMov32Reg, 1, 3, 0, 0),
+				insn(ebpfAnd32Imm, 1, 0, 0, access),
+				insn(ebpfJneReg, 1, 3, 0, 0),
+			})
+		}
+		if rule.Major >= 0 {
+			checks = append(checks, []ebpfInsn{insn(ebpfJneImm, 4, 0, 0, int32(rule.Major))})
+		}
+		if rule.Minor >= 0 {
+			checks = append(checks, []ebpfInsn{insn(ebpfJneImm, 5, 0, 0, int32(rule.Minor))})
+		}
+		var block []ebpfInsn
+		for _, check := range checks {
+			block = append(block, check...)
+		}
+		block = append(block, insn(ebpfMov64Imm, 0, 0, 0, 1), insn(ebpfExit, 0, 0, 0, 0))
+		// A rule that matches everything makes the rest unreachable, which
+		// the verifier rejects.
+		if len(checks) == 0 {
+			return append(prog, block...)
+		}
+		// The jumps, each the last instruction of its check, skip the rest
+		// of the block.
+		n := 0
+		for _, check := range checks {
+			n += len(check)
+			block[n-1].off = int16(len(block) - n)
+		}
+		prog = append(prog, block...)
+	}
+	return append(prog, insn(ebpfMov64Imm, 0, 0, 0, 0), insn(ebpfExit, 0, 0, 0, 0))
+}
+
+// attachDeviceFilter loads the device program for rules and attaches it to
+// the cgroup at dir, where it stays until the cgroup is removed.
+func attachDeviceFilter(dir string, rules []DeviceRule) error {
+	trap, ok := syscallNumbers[runtime.GOARCH]["bpf"]
+	if !ok {
+		return fmt.Errorf("not supported on %s", runtime.GOARCH)
+	}
+	prog := deviceFilter(rules)
+	fd, err := loadDeviceFilter(trap, prog, nil)
+	if err == syscall.EACCES || err == syscall.EINVAL {
+		// Load it again to get the verifier's reasons.
+		logBuf := make([]byte, 64*1024)
+		if _, err := loadDeviceFilter(trap, prog, logBuf); err != nil {
+			if msg := strings.TrimRight(string(logBuf), "\x00\n"); msg != "" {
+				return fmt.Errorf("load: %v: %s", err, msg)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("load: %v", err)
+	}
+	defer syscall.Close(fd)
+	cgroup, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer cgroup.Close()
+	attach := struct {
+		targetFd, attachBpfFd, attachType, attachFlags uint32
+	}{
+		targetFd:    uint32(cgroup.Fd()),
+		attachBpfFd: uint32(fd),
+		attachType:  bpfCgroupDevice,
+	}
+	if _, _, errno := syscall.Syscall(uintptr(trap), bpfProgAttach, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); errno != 0 {
+		return fmt.Errorf("attach: %v", errno)
+	}
+	return nil
+}
+
+// loadDeviceFilter loads prog into the kernel and returns its fd. The
+// verifier's log is written to logBuf unless it is nil.
+func loadDeviceFilter(trap uint32, prog []ebpfInsn, logBuf []byte) (int, error) {
+	license := []byte("MIT\x00")
+	attr := struct {
+		progType, insnCnt uint32
+		insns, license    uint64
+		logLevel, logSize uint32
+		logBuf            uint64
+	}{
+		progType: bpfProgTypeCgroupDevice,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	if logBuf != nil {
+		attr.logLevel = 1
+		attr.logSize = uint32(len(logBuf))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+	}
+	fd, _, errno := syscall.Syscall(uintptr(trap), bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
@@ -0,0 +1,422 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commitCmd saves a container's changes to its rootfs as a new image in the
+// local store. With --squash, the image has a single layer holding the
+// whole rootfs instead.
+func commitCmd(args []string) int {
+	fs := flag.NewFlagSet("commit", flag.ContinueOnError)
+	squash := fs.Bool("squash", false, "flatten the image into a single layer, leaving out what the image's layers deleted or replaced")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Println("usage: commit [--squash] <id> <name:tag>")
+		return 2
+	}
+	c, err := findContainer(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	img, err := commitContainer(store, c, fs.Arg(1), *squash)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(img.ID())
+	return 0
+}
+
+// commitContainer adds a layer holding what c changed on top of its image
+// and stores the result as ref. The rootfs isn't layered on disk, so the
+// changes are found by comparing it with the image's layers. If squash is
+// set, the rootfs is stored whole as the image's only layer instead. A
+// running container is paused meanwhile.
+func commitContainer(s *imageStore, c *Container, ref string, squash bool) (*Image, error) {
+	base, err := s.imageByID(c.ImageID)
+	if err != nil {
+		return nil, err
+	}
+	var baseFiles map[string]*tar.Header
+	if base != nil && !squash {
+		if baseFiles, err = s.indexLayers(base.Layers); err != nil {
+			return nil, err
+		}
+	}
+	if c.running() {
+		resume, err := pauseContainer(c)
+		if err != nil {
+			return nil, err
+		}
+		defer resume()
+	}
+	layer, diffID, err := s.writeDiffLayer(c.Rootfs, baseFiles)
+	if err != nil {
+		return nil, err
+	}
+	config, err := s.commitConfig(c, base, diffID, squash)
+	if err != nil {
+		return nil, err
+	}
+	configDigest := digestOf(config)
+	if err := s.writeBlob(configDigest, config); err != nil {
+		return nil, err
+	}
+	m := registryManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config: ociDescriptor{
+			MediaType: "application/vnd.docker.container.image.v1+json",
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+	}
+	var layers []string
+	if base != nil && !squash {
+		layers = append(layers, base.Layers...)
+	}
+	layers = append(layers, layer)
+	for _, digest := range layers {
+		fi, err := os.Stat(s.blobPath(digest))
+		if err != nil {
+			return nil, fmt.Errorf("read blob: %v", err)
+		}
+		m.Layers = append(m.Layers, ociDescriptor{MediaType: s.layerMediaType(digest), Digest: digest, Size: fi.Size()})
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("marshal manifest: %v", err)
+	}
+	manifestDigest := digestOf(manifest)
+	if err := s.writeBlob(manifestDigest, manifest); err != nil {
+		return nil, err
+	}
+	img := &Image{
+		Ref:      normalizeRef(ref),
+		Digest:   manifestDigest,
+		Manifest: manifestDigest,
+		Config:   configDigest,
+		Layers:   layers,
+		PulledAt: time.Now(),
+	}
+	if err := s.put(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// imageByID finds the stored image with the given ID, or nil if there is
+// none, as for a container run on a directory.
+func (s *imageStore) imageByID(id string) (*Image, error) {
+	if id == "" {
+		return nil, nil
+	}
+	images, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		if img.ID() == id {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("image %s of the container is no longer in the store", id)
+}
+
+// indexLayers lists the files the layers leave behind once applied in
+// order, keyed by their path relative to the root.
+func (s *imageStore) indexLayers(layers []string) (map[string]*tar.Header, error) {
+	files := make(map[string]*tar.Header)
+	for _, layer := range layers {
+		if err := s.indexLayer(layer, files); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func (s *imageStore) indexLayer(digest string, files map[string]*tar.Header) error {
+	r, err := openLayer(s.blobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read layer %s: %v", digest, err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+		dir, base := path.Split(name)
+		switch {
+		case base == whiteoutOpaque:
+			removeTree(files, path.Clean(dir), false)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removeTree(files, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+		case hdr.Typeflag == tar.TypeLink:
+			// A hard link has the attributes of what it links to.
+			target, ok := files[path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))]
+			if !ok {
+				continue
+			}
+			linked := *target
+			linked.Name = name
+			files[name] = &linked
+		default:
+			removeTree(files, name, false)
+			files[name] = hdr
+		}
+	}
+}
+
+// removeTree drops what is below name from files, and name itself too if
+// self is set.
+func removeTree(files map[string]*tar.Header, name string, self bool) {
+	if self {
+		delete(files, name)
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	for p := range files {
+		if strings.HasPrefix(p, prefix) {
+			delete(files, p)
+		}
+	}
+}
+
+// writeDiffLayer stores a gzipped tar of what differs in rootfs from base
+// and returns its digest along with that of the uncompressed tar, which is
+// what the image config lists.
+func (s *imageStore) writeDiffLayer(rootfs string, base map[string]*tar.Header) (string, string, error) {
+	pr, pw := io.Pipe()
+	diffHash := sha256.New()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := writeDiff(io.MultiWriter(gz, diffHash), rootfs, base)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	digest, err := s.storeBlob(pr)
+	pr.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("write layer: %v", err)
+	}
+	return digest, "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), nil
+}
+
+func writeDiff(w io.Writer, rootfs string, base map[string]*tar.Header) error {
+	tw := tar.NewWriter(w)
+	seen := make(map[string]bool)
+	links := make(map[uint64]string)
+	err := filepath.WalkDir(rootfs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(rootfs, p)
+		if err != nil || name == "." {
+			return err
+		}
+		// Written by run for each container, not part of its changes.
+		if name == "etc/resolv.conf" {
+			seen[name] = true
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		seen[name] = true
+		if old, ok := base[name]; ok && !changed(old, fi) {
+			return nil
+		}
+		link := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		st := fi.Sys().(*syscall.Stat_t)
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[st.Ino] = name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeWhiteouts(tw, base, seen); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeWhiteouts marks the files of base that are gone from the rootfs as
+// deleted. A directory's whiteout covers what was in it.
+func writeWhiteouts(tw *tar.Writer, base map[string]*tar.Header, seen map[string]bool) error {
+	var deleted []string
+	for name := range base {
+		if !seen[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	covered := ""
+	for _, name := range deleted {
+		if covered != "" && strings.HasPrefix(name, covered+"/") {
+			continue
+		}
+		covered = name
+		dir, file := path.Split(name)
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(dir, whiteoutPrefix+file),
+			Mode:     0600,
+			ModTime:  time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changed tells whether fi differs from the file the image had at the same
+// path. Directories only count as changed if their attributes did, since
+// any change to what is in them shows up as files of their own.
+func changed(old *tar.Header, fi fs.FileInfo) bool {
+	st := fi.Sys().(*syscall.Stat_t)
+	if old.Uid != int(st.Uid) || old.Gid != int(st.Gid) || fs.FileMode(old.Mode).Perm() != fi.Mode().Perm() {
+		return true
+	}
+	oldType := old.FileInfo().Mode().Type()
+	if oldType != fi.Mode().Type() {
+		return true
+	}
+	if fi.IsDir() {
+		return false
+	}
+	return old.Size != fi.Size() || old.ModTime.Unix() != fi.ModTime().Unix()
+}
+
+// commitConfig derives the new image's config from that of the base,
+// adding the layer and a history entry. Fields this tool doesn't know are
+// kept as they are. A container without an image gets a config of its own
+// that runs the container's command. A squashed image's layer replaces the
+// base's, whose history is kept but marked as having no layers of its own.
+func (s *imageStore) commitConfig(c *Container, base *Image, diffID string, squash bool) ([]byte, error) {
+	config := map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Env": c.Config.Env,
+			"Cmd": append([]string{c.Config.Command}, c.Config.Args...),
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []interface{}{}},
+	}
+	if base != nil {
+		data, err := s.readBlob(base.Config)
+		if err != nil {
+			return nil, err
+		}
+		config = nil
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("decode config: %v", err)
+		}
+	}
+	now := time.Now().UTC()
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+		config["rootfs"] = rootfs
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	history, _ := config["history"].([]interface{})
+	comment := "commit of container " + c.shortID()
+	if squash {
+		diffIDs = nil
+		for _, h := range history {
+			if entry, ok := h.(map[string]interface{}); ok {
+				entry["empty_layer"] = true
+			}
+		}
+		comment = "squashed commit of container " + c.shortID()
+	}
+	rootfs["diff_ids"] = append(diffIDs, diffID)
+	config["history"] = append(history, map[string]interface{}{
+		"created":    now,
+		"created_by": strings.Join(append([]string{c.Config.Command}, c.Config.Args...), " "),
+		"comment":    comment,
+	})
+	config["created"] = now
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("marshal config: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,543 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Transports image copy reads and writes images with, as in skopeo.
+const (
+	transportDocker = "docker://"
+	transportOCI    = "oci:"
+)
+
+// imageCopyCmd copies an image from one registry to another, or into an OCI
+// image layout directory, without going through the image store: blobs are
+// streamed from source to destination and checked against their digests on
+// the way. A multi-arch image is copied whole, every platform's manifest
+// with it, so that the copy has the same digest as the original.
+func imageCopyCmd(args []string) int {
+	fs := flag.NewFlagSet("image copy", flag.ContinueOnError)
+	quiet := fs.Bool("q", false, "only report errors")
+	var o PullOptions
+	fs.StringVar(&o.RegistryMirror, "registry-mirror", "", "registry `URL` to read library images from before trying Docker Hub")
+	fs.Var((*stringsFlag)(&o.CACerts), "registry-ca", "PEM `file` of CA certificates to trust for registries (repeatable)")
+	fs.Var((*stringsFlag)(&o.InsecureRegistries), "insecure-registry", "`host` whose certificate isn't verified, or which is spoken to over plain HTTP if it doesn't do HTTPS (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Println("usage: image copy [-q] [--registry-mirror URL] [--registry-ca FILE]... [--insecure-registry HOST]... docker://SRC docker://DST|oci:DIR[:TAG]")
+		return 2
+	}
+	ctx := context.Background()
+	src, err := openCopySource(ctx, fs.Arg(0), o)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	dst, err := openCopyDest(ctx, fs.Arg(1), o)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	c := &imageCopier{src: src, dst: dst, quiet: *quiet}
+	digest, err := c.copyManifest(ctx, src.reference, true)
+	if err != nil {
+		fmt.Printf("copy %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	if !*quiet {
+		fmt.Printf("Copied %s to %s (%s)\n", fs.Arg(0), fs.Arg(1), digest)
+	}
+	return 0
+}
+
+// copyDest is where image copy writes an image: blobs first, then the
+// manifests that refer to them, the image's own last.
+type copyDest interface {
+	hasBlob(ctx context.Context, digest string) (bool, error)
+	putBlob(ctx context.Context, digest string, size int64, r io.Reader) error
+	// putManifest stores a manifest or index. The image's own, top, is
+	// stored under the destination's tag, and the others by digest only.
+	putManifest(ctx context.Context, raw []byte, mediaType string, top bool) error
+}
+
+type imageCopier struct {
+	src   *registryRepo
+	dst   copyDest
+	quiet bool
+	mu    sync.Mutex
+}
+
+func (c *imageCopier) logf(format string, args ...interface{}) {
+	if c.quiet {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Printf(format, args...)
+}
+
+// copyManifest copies the manifest or index reference names, and everything
+// it refers to before it, returning its digest.
+func (c *imageCopier) copyManifest(ctx context.Context, reference string, top bool) (string, error) {
+	raw, m, err := c.src.manifest(ctx, reference)
+	if err != nil {
+		return "", fmt.Errorf("get manifest: %v", err)
+	}
+	isIndex, err := m.isIndex()
+	if err != nil {
+		return "", err
+	}
+	mediaType := m.MediaType
+	if isIndex {
+		if mediaType == "" {
+			mediaType = mediaTypeOCIIndex
+		}
+		for _, child := range m.Manifests {
+			if _, err := c.copyManifest(ctx, child.Digest, false); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		if mediaType == "" {
+			mediaType = mediaTypeOCIManifest
+		}
+		var eg errgroup.Group
+		eg.SetLimit(defaultMaxConcurrentDownloads)
+		for _, blob := range append([]Layer{m.Config}, m.Layers...) {
+			eg.Go(func() error {
+				return c.copyBlob(ctx, blob)
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return "", err
+		}
+	}
+	c.logf("Writing manifest %s\n", m.digest)
+	if err := c.dst.putManifest(ctx, raw, mediaType, top); err != nil {
+		return "", fmt.Errorf("write manifest %s: %v", m.digest, err)
+	}
+	return m.digest, nil
+}
+
+func (c *imageCopier) copyBlob(ctx context.Context, blob Layer) error {
+	exists, err := c.dst.hasBlob(ctx, blob.Digest)
+	if err != nil {
+		return fmt.Errorf("check blob %s: %v", blob.Digest, err)
+	}
+	if exists {
+		c.logf("Blob %s already exists\n", shortDigest(blob.Digest))
+		return nil
+	}
+	body, err := c.src.blob(ctx, blob.Digest)
+	if err != nil {
+		return fmt.Errorf("get blob %s: %v", blob.Digest, err)
+	}
+	defer body.Close()
+	c.logf("Copying blob %s (%s)\n", shortDigest(blob.Digest), formatBytes(int64(blob.Size)))
+	if err := c.dst.putBlob(ctx, blob.Digest, int64(blob.Size), newVerifyingReader(body, blob.Digest, int64(blob.Size))); err != nil {
+		return fmt.Errorf("copy blob %s: %v", blob.Digest, err)
+	}
+	return nil
+}
+
+// verifyingReader fails at the end of a blob that isn't the size or doesn't
+// have the digest it should, rather than reporting EOF, so that whatever it
+// is being copied to never sees the end of it.
+type verifyingReader struct {
+	r      io.Reader
+	h      hash.Hash
+	digest string
+	size   int64
+	n      int64
+}
+
+func newVerifyingReader(r io.Reader, digest string, size int64) *verifyingReader {
+	return &verifyingReader{r: r, h: sha256.New(), digest: digest, size: size}
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		if v.n != v.size {
+			return n, fmt.Errorf("%w: expected %d bytes, got %d", errDigestMismatch, v.size, v.n)
+		}
+		if got := "sha256:" + hex.EncodeToString(v.h.Sum(nil)); got != v.digest {
+			return n, fmt.Errorf("%w: expected %s, got %s", errDigestMismatch, v.digest, got)
+		}
+	}
+	return n, err
+}
+
+// registryRepo is a repository in a registry, spoken to with the
+// distribution API: enough to read an image from and push one to, where
+// DockerImageClient only pulls library images.
+type registryRepo struct {
+	http      *http.Client
+	base      string
+	name      string
+	reference string
+	headers   map[string]string
+}
+
+// splitRegistryRef splits a docker:// reference into the registry host, if
+// it names one, and the rest. As in Docker, the first component is a host
+// if it has a dot or a port in it, or is localhost.
+func splitRegistryRef(ref string) (host, rest string) {
+	first, after, ok := strings.Cut(ref, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first, after
+	}
+	return "", ref
+}
+
+// openCopySource opens the repository image copy reads from.
+func openCopySource(ctx context.Context, arg string, o PullOptions) (*registryRepo, error) {
+	ref, ok := strings.CutPrefix(arg, transportDocker)
+	if !ok {
+		return nil, fmt.Errorf("invalid source %q: expected docker://IMAGE", arg)
+	}
+	host, rest := splitRegistryRef(ref)
+	if host != "" {
+		return openRegistryRepo(ctx, host, rest, o, "pull")
+	}
+	if strings.Contains(rest, "/") {
+		return nil, fmt.Errorf("invalid source %q: only library images can be copied from Docker Hub", arg)
+	}
+	// Library images come from Docker Hub or the mirror, as they are
+	// pulled, and which of them has the image is only known once it has
+	// been asked for it.
+	o.Quiet = true
+	o.Progress = progressAuto
+	d, err := newPullClient(rest, nil, o)
+	if err != nil {
+		return nil, err
+	}
+	err = d.fromRegistry(ctx, func() error {
+		_, _, err := d.fetchRawManifest(ctx, d.reference)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %v", err)
+	}
+	return &registryRepo{http: d.http, base: d.registry, name: "library/" + d.name, reference: d.reference, headers: d.authHeaders()}, nil
+}
+
+func openCopyDest(ctx context.Context, arg string, o PullOptions) (copyDest, error) {
+	if dir, ok := strings.CutPrefix(arg, transportOCI); ok {
+		return openOCILayout(dir)
+	}
+	ref, ok := strings.CutPrefix(arg, transportDocker)
+	if !ok {
+		return nil, fmt.Errorf("invalid destination %q: expected docker://REGISTRY/IMAGE or oci:DIR[:TAG]", arg)
+	}
+	host, rest := splitRegistryRef(ref)
+	if host == "" {
+		return nil, fmt.Errorf("invalid destination %q: name the registry to copy to, as in docker://registry.example.com/%s", arg, rest)
+	}
+	return openRegistryRepo(ctx, host, rest, o, "pull,push")
+}
+
+// openRegistryRepo opens the repository of host named in ref, and asks for
+// an anonymous token with the given scope if the registry wants one.
+// Registries given with --insecure-registry, and localhost, are spoken to
+// over plain HTTP if they don't do HTTPS, as Docker does.
+func openRegistryRepo(ctx context.Context, host, ref string, o PullOptions, actions string) (*registryRepo, error) {
+	client, err := newRegistryHTTPClient(o)
+	if err != nil {
+		return nil, err
+	}
+	name, reference := parseImageRef(ref)
+	r := &registryRepo{http: client, base: "https://" + host, name: name, reference: reference, headers: map[string]string{}}
+	resp, err := r.do(ctx, "GET", r.base+"/v2/", nil, -1, nil)
+	insecure := slices.Contains(o.InsecureRegistries, host) || slices.Contains(o.InsecureRegistries, registryHost(host)) || registryHost(host) == "localhost" || registryHost(host) == "127.0.0.1"
+	if err != nil && insecure && errors.As(err, new(tls.RecordHeaderError)) {
+		r.base = "http://" + host
+		resp, err = r.do(ctx, "GET", r.base+"/v2/", nil, -1, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		if err := r.authorize(ctx, resp.Header.Get("WWW-Authenticate"), actions); err != nil {
+			return nil, fmt.Errorf("%s: authorize: %v", host, err)
+		}
+	}
+	return r, nil
+}
+
+// authorize gets a token for the repository from the realm a Bearer
+// challenge names.
+func (r *registryRepo) authorize(ctx context.Context, challenge, actions string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported authentication %q", scheme)
+	}
+	values := map[string]string{}
+	for _, p := range strings.Split(params, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok {
+			values[k] = strings.Trim(v, `"`)
+		}
+	}
+	if values["realm"] == "" {
+		return fmt.Errorf("no realm in %q", challenge)
+	}
+	q := url.Values{"scope": {"repository:" + r.name + ":" + actions}}
+	if values["service"] != "" {
+		q.Set("service", values["service"])
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := doGet(ctx, r.http, values["realm"]+"?"+q.Encode(), nil, &token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.headers["Authorization"] = "Bearer " + token.Token
+	return nil
+}
+
+func (r *registryRepo) do(ctx context.Context, method, url string, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %v", err)
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return r.http.Do(req)
+}
+
+func (r *registryRepo) url(kind, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/%s/%s", r.base, r.name, kind, reference)
+}
+
+func (r *registryRepo) manifest(ctx context.Context, reference string) ([]byte, *ManifestListResponse, error) {
+	resp, err := r.do(ctx, "GET", r.url("manifests", reference), nil, -1, map[string]string{"Accept": manifestAccept})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &httpStatusError{resp.StatusCode}
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read body: %v", err)
+	}
+	var m ManifestListResponse
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, nil, fmt.Errorf("decode: %v", err)
+	}
+	m.digest = digestOf(raw)
+	if strings.Contains(reference, ":") && reference != m.digest {
+		return nil, nil, fmt.Errorf("%w: expected %s, got %s", errDigestMismatch, reference, m.digest)
+	}
+	return raw, &m, nil
+}
+
+func (r *registryRepo) blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := r.do(ctx, "GET", r.url("blobs", digest), nil, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &httpStatusError{resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+func (r *registryRepo) hasBlob(ctx context.Context, digest string) (bool, error) {
+	resp, err := r.do(ctx, "HEAD", r.url("blobs", digest), nil, -1, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, &httpStatusError{resp.StatusCode}
+	}
+}
+
+// putBlob uploads a blob in one request, which every registry takes.
+func (r *registryRepo) putBlob(ctx context.Context, digest string, size int64, body io.Reader) error {
+	resp, err := r.do(ctx, "POST", r.url("blobs", "uploads/"), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return &httpStatusError{resp.StatusCode}
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("upload location: %v", err)
+	}
+	base, _ := url.Parse(r.base)
+	upload := base.ResolveReference(location)
+	q := upload.Query()
+	q.Set("digest", digest)
+	upload.RawQuery = q.Encode()
+	resp, err = r.do(ctx, "PUT", upload.String(), body, size, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return &httpStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+func (r *registryRepo) putManifest(ctx context.Context, raw []byte, mediaType string, top bool) error {
+	reference := digestOf(raw)
+	if top {
+		reference = r.reference
+	}
+	resp, err := r.do(ctx, "PUT", r.url("manifests", reference), bytes.NewReader(raw), int64(len(raw)), map[string]string{"Content-Type": mediaType})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return &httpStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// ociLayout is an OCI image layout directory image copy writes to. Its
+// images are listed in index.json under the name given after the
+// directory, if there is one.
+type ociLayout struct {
+	dir string
+	tag string
+}
+
+func openOCILayout(arg string) (*ociLayout, error) {
+	dir, tag := arg, ""
+	if i := strings.LastIndex(arg, ":"); i > strings.LastIndex(arg, "/") {
+		dir, tag = arg[:i], arg[i+1:]
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("invalid destination %q: expected oci:DIR[:TAG]", transportOCI+arg)
+	}
+	l := &ociLayout{dir: dir, tag: tag}
+	if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path.Join(dir, ociLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return nil, fmt.Errorf("write %s: %v", ociLayoutFile, err)
+	}
+	return l, nil
+}
+
+func (l *ociLayout) blobPath(digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return path.Join(l.dir, "blobs", algo, hex)
+}
+
+func (l *ociLayout) hasBlob(ctx context.Context, digest string) (bool, error) {
+	_, err := os.Stat(l.blobPath(digest))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// putBlob writes the blob beside where it goes and moves it into place
+// once all of it has arrived and checked out.
+func (l *ociLayout) putBlob(ctx context.Context, digest string, size int64, r io.Reader) error {
+	tmp := l.blobPath(digest) + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create blob: %v", err)
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, l.blobPath(digest))
+}
+
+func (l *ociLayout) putManifest(ctx context.Context, raw []byte, mediaType string, top bool) error {
+	digest := digestOf(raw)
+	if err := os.WriteFile(l.blobPath(digest), raw, 0644); err != nil {
+		return fmt.Errorf("write blob: %v", err)
+	}
+	if !top {
+		return nil
+	}
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	data, err := os.ReadFile(path.Join(l.dir, ociIndexFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("decode %s: %v", ociIndexFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read %s: %v", ociIndexFile, err)
+	}
+	// The image takes the place of whatever had its name, or, without
+	// one, of itself.
+	desc := ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+	if l.tag != "" {
+		desc.Annotations = map[string]string{annotationRefName: l.tag}
+	}
+	index.Manifests = slices.DeleteFunc(index.Manifests, func(d ociDescriptor) bool {
+		if l.tag != "" {
+			return d.Annotations[annotationRefName] == l.tag
+		}
+		return d.Digest == digest && d.Annotations[annotationRefName] == ""
+	})
+	index.Manifests = append(index.Manifests, desc)
+	if data, err = json.MarshalIndent(index, "", "  "); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(l.dir, ociIndexFile), data, 0644); err != nil {
+		return fmt.Errorf("write %s: %v", ociIndexFile, err)
+	}
+	return nil
+}
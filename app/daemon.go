@@ -0,0 +1,834 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	daemonSocketName = "daemon.sock"
+	// daemonAPIVersion is the Docker Engine API version whose subset the
+	// daemon serves.
+	daemonAPIVersion = "1.43"
+)
+
+// apiVersionPrefix matches the version Docker clients put in front of
+// every path.
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9]+\.[0-9]+/`)
+
+// daemonCmd serves a subset of the Docker Engine API on a unix socket until
+// it is interrupted: pulling images, and creating, starting, stopping,
+// inspecting and reading the logs of containers. Containers are started
+// detached, the way run -d does. With --read-only, only the containers
+// already created can be started and stopped. With --multi-user, each
+// user who connects has images and containers of their own, and root sees
+// them all. SIGUSR1 has it dump diagnostics to its log. Run by systemd as
+// a Type=notify service, it reports ready once it serves the API, and
+// keeps the watchdog fed if the service has one.
+func daemonCmd(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := fs.String("socket", path.Join(stateDir(), daemonSocketName), "unix socket to listen on")
+	keyFile := fs.String("key-file", "", "key to unlock an encrypted store with (default prompt for the passphrase)")
+	readOnly := fs.Bool("read-only", false, "refuse to pull images or create containers, for hosts whose containers are provisioned beforehand")
+	rateLimit := fs.Float64("rate-limit", 0, "requests a second each user may make, 0 for no limit")
+	maxActive := fs.Int("max-concurrent", 0, "pulls and container creations to run at once, 0 for no limit")
+	maxQueued := fs.Int("max-queued", 16, "pulls and container creations to keep waiting for --max-concurrent before turning more away")
+	policyFile := fs.String("policy", "", "JSON file of rules saying which images may be pulled and run")
+	multiUser := fs.Bool("multi-user", false, "let every user on the host connect, each seeing only their own images and containers")
+	logLevel := fs.String("log-level", logLevelInfo, "log level: info, or debug to log every request too (changed while running by writing "+logLevelFileName+" in the state directory)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: daemon [--socket PATH] [--key-file FILE] [--read-only] [--multi-user] [--rate-limit N] [--max-concurrent N] [--max-queued N] [--policy FILE] [--log-level info|debug]")
+		return 2
+	}
+	if err := validateLogLevel(*logLevel); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if *rateLimit < 0 || *maxActive < 0 || *maxQueued < 0 {
+		fmt.Println("--rate-limit, --max-concurrent and --max-queued can't be negative")
+		return 2
+	}
+	// Picked up before anything is started that would inherit it.
+	sd := newSystemdNotifier()
+	if encryptedStoreExists() {
+		if err := unlockEncryptedStore(*keyFile); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if err := migrateState(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := checkWorkDirs(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var policy *imagePolicy
+	if *policyFile != "" {
+		var err error
+		if policy, err = loadImagePolicy(*policyFile); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	sigs, stopNotify := notifySignals()
+	defer stopNotify()
+	recoverContainers()
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	os.Remove(*socket)
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		fmt.Printf("listen: %v\n", err)
+		return 1
+	}
+	defer os.Remove(*socket)
+	if *multiUser {
+		// Who is who is told apart by the credentials of the connecting
+		// process, so anyone may connect.
+		if err := os.Chmod(*socket, 0666); err != nil {
+			fmt.Printf("chmod socket: %v\n", err)
+			return 1
+		}
+	}
+	d := &daemon{store: store, readOnly: *readOnly, multiUser: *multiUser, policy: policy, admission: newAdmission(*maxActive, *maxQueued), defaultLogLevel: *logLevel}
+	if *rateLimit > 0 {
+		d.limiter = newRateLimiter(*rateLimit)
+	}
+	stopWatch, err := d.watchLogLevel()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer stopWatch()
+	defer d.dumpOnSignal()()
+	srv := &http.Server{Handler: d.handler(), ConnContext: d.connContext}
+	go func() {
+		<-sigs
+		srv.Close()
+	}()
+	status := "Serving the API on " + *socket
+	if *readOnly {
+		status = "Serving the API read-only on " + *socket
+	}
+	fmt.Println(status)
+	// The socket is listening and the containers left behind have been
+	// dealt with, so whatever is ordered after the service can use it.
+	defer sd.ready(status)()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+type daemon struct {
+	store *imageStore
+	// readOnly refuses the requests that change what is in the store:
+	// pulls and container creation.
+	readOnly bool
+	// multiUser gives each user who connects images and containers of
+	// their own.
+	multiUser bool
+	// policy is nil unless the images that can be used are restricted.
+	policy *imagePolicy
+	// limiter is nil unless requests are rate limited.
+	limiter   *rateLimiter
+	admission *admission
+	// debug logs every request. It starts out as defaultLogLevel says,
+	// and can be changed while the daemon runs.
+	debug           atomic.Bool
+	defaultLogLevel string
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_ping", d.ping)
+	mux.HandleFunc("HEAD /_ping", d.ping)
+	mux.HandleFunc("GET /version", d.version)
+	mux.HandleFunc("GET /metrics", d.metrics)
+	mux.HandleFunc("GET /log-level", d.getLogLevel)
+	mux.HandleFunc("POST /log-level", d.setLogLevelAPI)
+	mux.HandleFunc("POST /images/create", d.mutating(d.limited(d.createImage)))
+	mux.HandleFunc("POST /containers/create", d.mutating(d.limited(d.createContainer)))
+	mux.HandleFunc("POST /containers/{id}/start", d.startContainer)
+	mux.HandleFunc("POST /containers/{id}/stop", d.stopContainer)
+	mux.HandleFunc("GET /containers/{id}/json", d.inspectContainer)
+	mux.HandleFunc("GET /containers/{id}/spec", d.containerSpec)
+	mux.HandleFunc("GET /containers/{id}/logs", d.containerLogs)
+	limited := d.logRequests(d.rateLimit(mux))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if loc := apiVersionPrefix.FindStringIndex(r.URL.Path); loc != nil {
+			r.URL.Path = r.URL.Path[loc[1]-1:]
+		}
+		w.Header().Set("Api-Version", daemonAPIVersion)
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// mutating wraps a handler that changes the store so that a read-only
+// daemon refuses it before it reads the request.
+func (d *daemon) mutating(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.readOnly {
+			apiError(w, http.StatusForbidden, fmt.Errorf("the daemon is read-only: %s %s is disabled", r.Method, r.URL.Path))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// apiError writes an error the way Docker's API does.
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (d *daemon) ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "OK")
+}
+
+func (d *daemon) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"Version":    "diy-docker",
+		"ApiVersion": daemonAPIVersion,
+		"Os":         "linux",
+		"Arch":       runtime.GOARCH,
+		"GoVersion":  runtime.Version(),
+	})
+}
+
+// createImage pulls fromImage, always checking the registry as docker pull
+// does. Progress goes out as a stream of JSON messages, the last of which
+// carries the error if the pull failed.
+func (d *daemon) createImage(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("fromImage")
+	if ref == "" {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("fromImage is required"))
+		return
+	}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		if strings.HasPrefix(tag, "sha256:") {
+			ref += "@" + tag
+		} else {
+			ref += ":" + tag
+		}
+	}
+	ref = normalizeRef(ref)
+	if err := d.checkPolicy(r, ref, "pull"); err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]string{"status": "Pulling " + ref})
+	store, err := d.store.forTenant(requestTenant(r))
+	var client *DockerImageClient
+	if err == nil {
+		client, err = newPullClient(ref, store, PullOptions{Quiet: true})
+	}
+	var img *Image
+	if err == nil {
+		img, err = client.Pull(r.Context())
+	}
+	if err != nil {
+		enc.Encode(map[string]interface{}{
+			"error":       err.Error(),
+			"errorDetail": map[string]string{"message": err.Error()},
+		})
+		return
+	}
+	enc.Encode(map[string]string{"status": "Digest: " + img.Digest})
+	enc.Encode(map[string]string{"status": "Status: Image is up to date for " + img.Ref})
+}
+
+// createContainerRequest is the part of Docker's container create body the
+// daemon understands.
+type createContainerRequest struct {
+	Image      string   `json:"Image"`
+	Cmd        []string `json:"Cmd"`
+	Entrypoint []string `json:"Entrypoint"`
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+	User       string   `json:"User"`
+	// Healthcheck overrides the image's, as the --health flags of run do.
+	Healthcheck *HealthConfig `json:"Healthcheck"`
+	HostConfig  struct {
+		Binds             []string                    `json:"Binds"`
+		NetworkMode       string                      `json:"NetworkMode"`
+		PortBindings      map[string][]apiPortBinding `json:"PortBindings"`
+		PublishAllPorts   bool                        `json:"PublishAllPorts"`
+		AutoRemove        bool                        `json:"AutoRemove"`
+		RestartPolicy     apiRestartPolicy            `json:"RestartPolicy"`
+		Privileged        bool                        `json:"Privileged"`
+		CapAdd            []string                    `json:"CapAdd"`
+		CapDrop           []string                    `json:"CapDrop"`
+		Annotations       map[string]string           `json:"Annotations"`
+		DeviceCgroupRules []string                    `json:"DeviceCgroupRules"`
+		MemoryReservation int64                       `json:"MemoryReservation"`
+		ReadonlyRootfs    bool                        `json:"ReadonlyRootfs"`
+		Tmpfs             map[string]string           `json:"Tmpfs"`
+		LogConfig         struct {
+			Type string `json:"Type"`
+		} `json:"LogConfig"`
+	} `json:"HostConfig"`
+}
+
+type apiRestartPolicy struct {
+	Name              string `json:"Name"`
+	MaximumRetryCount int    `json:"MaximumRetryCount"`
+}
+
+type apiHealth struct {
+	Status        string            `json:"Status"`
+	FailingStreak int               `json:"FailingStreak"`
+	Log           []apiHealthResult `json:"Log"`
+}
+
+type apiHealthResult struct {
+	Start    time.Time `json:"Start"`
+	End      time.Time `json:"End"`
+	ExitCode int       `json:"ExitCode"`
+	Output   string    `json:"Output"`
+}
+
+type apiPortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+// containerConfig turns a create request from t into what run would have
+// made of the equivalent flags.
+func (req *createContainerRequest) containerConfig(t tenant) (*ContainerConfig, error) {
+	if req.Image == "" {
+		return nil, fmt.Errorf("Image is required")
+	}
+	hc := req.HostConfig
+	network := hc.NetworkMode
+	if network == "" || network == "default" {
+		network = networkHost
+	}
+	if err := validateNetworkMode(network); err != nil {
+		return nil, err
+	}
+	addCaps, err := parseCapabilities(hc.CapAdd)
+	if err != nil {
+		return nil, err
+	}
+	dropCaps, err := parseCapabilities(hc.CapDrop)
+	if err != nil {
+		return nil, err
+	}
+	seccomp, err := parseSecurityOpts(nil, hc.Privileged)
+	if err != nil {
+		return nil, err
+	}
+	restart := RestartPolicy{Name: restartNo}
+	if hc.RestartPolicy.Name != "" {
+		if restart, err = parseRestartPolicy(hc.RestartPolicy.Name); err != nil {
+			return nil, err
+		}
+	}
+	if restart.Name == restartOnFailure {
+		restart.MaxRetries = hc.RestartPolicy.MaximumRetryCount
+	}
+	if restart.enabled() && hc.AutoRemove {
+		return nil, fmt.Errorf("AutoRemove and a restart policy can't be combined")
+	}
+	devices, err := parseDeviceRules(hc.DeviceCgroupRules)
+	if err != nil {
+		return nil, err
+	}
+	if hc.MemoryReservation < 0 {
+		return nil, fmt.Errorf("MemoryReservation can't be negative")
+	}
+	memory := MemoryLimits{Reservation: hc.MemoryReservation}
+	if memory.set() && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("memory limits require root")
+	}
+	if len(devices) > 0 && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("device cgroup rules require root")
+	}
+	logDriver := hc.LogConfig.Type
+	if logDriver == "" {
+		logDriver = logDriverJSONFile
+	}
+	logConfig, err := parseLogConfig(logDriver, nil)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []Mount
+	for _, b := range hc.Binds {
+		m, err := parseVolume(b)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	var tmpfsSpecs []string
+	for dest, opts := range hc.Tmpfs {
+		spec := dest
+		if opts != "" {
+			spec += ":" + opts
+		}
+		tmpfsSpecs = append(tmpfsSpecs, spec)
+	}
+	// Mounted in order, so that nested ones come out the same every time.
+	sort.Strings(tmpfsSpecs)
+	tmpfs, err := parseTmpfsMounts(tmpfsSpecs, mounts)
+	if err != nil {
+		return nil, err
+	}
+	var ports []PortMapping
+	for containerPort, bindings := range hc.PortBindings {
+		for _, b := range bindings {
+			spec := b.HostPort + ":" + containerPort
+			if b.HostIP != "" {
+				spec = b.HostIP + ":" + spec
+			}
+			p, err := parsePortMapping(spec)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, p...)
+		}
+	}
+	if (len(ports) > 0 || hc.PublishAllPorts) && network != networkBridge {
+		return nil, fmt.Errorf("publishing ports requires the bridge network")
+	}
+	if network == networkBridge && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("bridge networking requires root")
+	}
+	if _, ok := hc.Annotations[""]; ok {
+		return nil, fmt.Errorf("annotation keys can't be empty")
+	}
+	cfg := &ContainerConfig{
+		Image:       req.Image,
+		StopTimeout: 10,
+		Detach:      true,
+		AutoRemove:  hc.AutoRemove,
+		Restart:     restart,
+		Log:         logConfig,
+		Mounts:      mounts,
+		ReadOnly:    hc.ReadonlyRootfs,
+		Tmpfs:       tmpfs,
+		Env:         req.Env,
+		WorkingDir:  req.WorkingDir,
+		User:        req.User,
+		Network:     network,
+		Ports:       ports,
+		PublishAll:  hc.PublishAllPorts,
+		Rootless:    os.Geteuid() != 0 || !t.root(),
+		CapAdd:      addCaps,
+		CapDrop:     dropCaps,
+		Privileged:  hc.Privileged,
+		Seccomp:     seccomp,
+		DeviceRules: devices,
+		Memory:      memory,
+		Healthcheck: req.Healthcheck,
+		Annotations: hc.Annotations,
+		Owner:       t.uid,
+		OwnerGid:    t.gid,
+	}
+	// An empty Entrypoint leaves the image's, as null does.
+	if len(req.Entrypoint) > 0 {
+		cfg.Entrypoint = req.Entrypoint
+	}
+	if len(req.Cmd) > 0 {
+		cfg.Command, cfg.Args = req.Cmd[0], req.Cmd[1:]
+	}
+	// Checked before validateMounts creates anything for t.
+	if err := checkTenantConfig(cfg, t); err != nil {
+		return nil, err
+	}
+	// Docker creates missing bind sources for Binds.
+	if err := validateMounts(mounts, bindPolicy{create: true, uid: -1, gid: -1}); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// createContainer creates a container ready to be started. Like Docker, it
+// doesn't pull: an image that isn't in the store is a 404, which clients
+// answer by pulling it and trying again.
+func (d *daemon) createContainer(w http.ResponseWriter, r *http.Request) {
+	var req createContainerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("decode request: %v", err))
+		return
+	}
+	t := requestTenant(r)
+	cfg, err := req.containerConfig(t)
+	if err == nil {
+		cfg.Name = strings.TrimPrefix(r.URL.Query().Get("name"), "/")
+		err = validateContainerName(cfg.Name)
+	}
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := d.checkPolicy(r, cfg.Image, "create"); err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+	var img *Image
+	store, err := d.store.forTenant(t)
+	if err == nil {
+		img, err = store.lookup(cfg.Image)
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if img == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("No such image: %s", cfg.Image))
+		return
+	}
+	defaults, err := runDefaultsFor(store, img, cfg.Image)
+	if err == nil && len(defaults) > 0 {
+		var dcfg *ContainerConfig
+		if dcfg, err = parseRunDefaults(defaults, cfg.Image); err == nil {
+			applyRunDefaults(cfg, dcfg)
+		}
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	c, err := newContainer(*cfg)
+	var conflict *nameConflictError
+	if errors.As(err, &conflict) {
+		apiError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	img, config, err := provisionRootfs(r.Context(), store, c, PullOptions{Quiet: true}, nil)
+	if err == nil {
+		err = configureContainer(c, img, config)
+	}
+	if err != nil {
+		c.remove()
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"Id": c.ID, "Warnings": []string{}})
+}
+
+// findAPIContainer looks up the container named in the path, writing a 404
+// if there is none.
+func findAPIContainer(w http.ResponseWriter, r *http.Request) *Container {
+	c, err := findContainer(r.PathValue("id"))
+	// Another tenant's container is as good as missing.
+	if err == nil && !requestTenant(r).owns(c) {
+		err = fmt.Errorf("no such container: %s", r.PathValue("id"))
+	}
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return nil
+	}
+	return c
+}
+
+func (d *daemon) startContainer(w http.ResponseWriter, r *http.Request) {
+	c := findAPIContainer(w, r)
+	if c == nil {
+		return
+	}
+	switch c.Status {
+	case statusRunning:
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case statusCreated:
+	default:
+		apiError(w, http.StatusConflict, fmt.Errorf("container %s can't be started again", c.shortID()))
+		return
+	}
+	if err := startShim(c); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stopContainer stops a container the way stop does, waiting t seconds, or
+// the container's --stop-timeout, before killing it.
+func (d *daemon) stopContainer(w http.ResponseWriter, r *http.Request) {
+	c := findAPIContainer(w, r)
+	if c == nil {
+		return
+	}
+	if !c.running() && c.Status != statusRestarting {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	t := c.Config.StopTimeout
+	if s := r.URL.Query().Get("t"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid t %q", s))
+			return
+		}
+		t = n
+	}
+	if err := stopContainer(c, time.Duration(t)*time.Second); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// containerJSON is the part of Docker's container inspect response the
+// daemon fills in.
+type containerJSON struct {
+	ID      string    `json:"Id"`
+	Name    string    `json:"Name"`
+	Created time.Time `json:"Created"`
+	Path    string    `json:"Path"`
+	Args    []string  `json:"Args"`
+	State   struct {
+		Status     string     `json:"Status"`
+		Running    bool       `json:"Running"`
+		Restarting bool       `json:"Restarting"`
+		Pid        int        `json:"Pid"`
+		ExitCode   int        `json:"ExitCode"`
+		StartedAt  time.Time  `json:"StartedAt"`
+		FinishedAt time.Time  `json:"FinishedAt"`
+		Health     *apiHealth `json:"Health,omitempty"`
+	} `json:"State"`
+	Image        string `json:"Image"`
+	RestartCount int    `json:"RestartCount"`
+	ProcessLabel string `json:"ProcessLabel"`
+	MountLabel   string `json:"MountLabel"`
+	Config       struct {
+		Image      string   `json:"Image"`
+		Cmd        []string `json:"Cmd"`
+		Env        []string `json:"Env"`
+		WorkingDir string   `json:"WorkingDir"`
+		User       string   `json:"User"`
+		// ExposedPorts come from the image, and Healthcheck is the
+		// image's with the container's overrides.
+		ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+		Healthcheck  *HealthConfig       `json:"Healthcheck,omitempty"`
+	} `json:"Config"`
+	HostConfig struct {
+		NetworkMode     string            `json:"NetworkMode"`
+		AutoRemove      bool              `json:"AutoRemove"`
+		RestartPolicy   apiRestartPolicy  `json:"RestartPolicy"`
+		Privileged      bool              `json:"Privileged"`
+		Binds           []string          `json:"Binds"`
+		Annotations     map[string]string `json:"Annotations,omitempty"`
+		ReadonlyRootfs  bool              `json:"ReadonlyRootfs"`
+		PublishAllPorts bool              `json:"PublishAllPorts"`
+		Tmpfs           map[string]string `json:"Tmpfs,omitempty"`
+		// MemoryReservation is memory.low. Docker has no field for
+		// memory.high.
+		MemoryReservation int64 `json:"MemoryReservation"`
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		IPAddress   string `json:"IPAddress"`
+		IPPrefixLen int    `json:"IPPrefixLen"`
+		Gateway     string `json:"Gateway"`
+		// Ports has every exposed or published port, with null bindings
+		// for the ones that aren't published.
+		Ports map[string][]apiPortBinding `json:"Ports"`
+	} `json:"NetworkSettings"`
+}
+
+func (d *daemon) inspectContainer(w http.ResponseWriter, r *http.Request) {
+	c := findAPIContainer(w, r)
+	if c == nil {
+		return
+	}
+	var resp containerJSON
+	resp.ID = c.ID
+	resp.Name = "/" + c.name()
+	resp.Created = c.CreatedAt
+	resp.Path = c.Config.Command
+	resp.Args = c.Config.Args
+	resp.State.Status = c.Status
+	if c.Status == statusWarm {
+		resp.State.Status = statusCreated
+	}
+	resp.State.Running = c.running()
+	resp.State.Restarting = c.Status == statusRestarting
+	if c.running() {
+		resp.State.Pid = c.Pid
+	}
+	resp.State.ExitCode = c.ExitCode
+	resp.State.StartedAt = c.StartedAt
+	resp.State.FinishedAt = c.FinishedAt
+	resp.Image = c.ImageID
+	resp.RestartCount = c.RestartCount
+	resp.ProcessLabel = c.ProcessLabel
+	resp.MountLabel = c.MountLabel
+	resp.Config.Image = c.Config.Image
+	resp.Config.Cmd = append([]string{c.Config.Command}, c.Config.Args...)
+	resp.Config.Env = c.Config.Env
+	resp.Config.WorkingDir = c.Config.WorkingDir
+	resp.Config.User = c.Config.User
+	resp.Config.Healthcheck = healthConfig(c)
+	if h := c.health(); h != nil {
+		resp.State.Health = &apiHealth{Status: h.Status, FailingStreak: h.FailingStreak}
+		for _, r := range h.Log {
+			resp.State.Health.Log = append(resp.State.Health.Log, apiHealthResult(r))
+		}
+	}
+	resp.NetworkSettings.Ports = make(map[string][]apiPortBinding)
+	for _, p := range exposedPorts(&c.ImageConfig) {
+		if resp.Config.ExposedPorts == nil {
+			resp.Config.ExposedPorts = make(map[string]struct{})
+		}
+		resp.Config.ExposedPorts[p] = struct{}{}
+		resp.NetworkSettings.Ports[p] = nil
+	}
+	for _, p := range c.Config.Ports {
+		port := fmt.Sprintf("%d/%s", p.ContainerPort, p.proto())
+		binding := apiPortBinding{HostIP: p.HostIP, HostPort: strconv.Itoa(p.HostPort)}
+		if binding.HostIP == "" {
+			binding.HostIP = "0.0.0.0"
+		}
+		resp.NetworkSettings.Ports[port] = append(resp.NetworkSettings.Ports[port], binding)
+	}
+	resp.HostConfig.NetworkMode = c.Config.Network
+	resp.HostConfig.AutoRemove = c.Config.AutoRemove
+	resp.HostConfig.RestartPolicy = apiRestartPolicy{Name: c.Config.Restart.Name, MaximumRetryCount: c.Config.Restart.MaxRetries}
+	if !c.Config.Restart.enabled() {
+		resp.HostConfig.RestartPolicy.Name = restartNo
+	}
+	resp.HostConfig.Privileged = c.Config.Privileged
+	resp.HostConfig.Annotations = c.Config.Annotations
+	resp.HostConfig.ReadonlyRootfs = c.Config.ReadOnly
+	resp.HostConfig.PublishAllPorts = c.Config.PublishAll
+	resp.HostConfig.MemoryReservation = c.Config.Memory.Reservation
+	for _, t := range c.Config.Tmpfs {
+		if resp.HostConfig.Tmpfs == nil {
+			resp.HostConfig.Tmpfs = make(map[string]string)
+		}
+		resp.HostConfig.Tmpfs[t.Destination] = t.Options
+	}
+	for _, m := range c.Config.Mounts {
+		bind := m.Source + ":" + m.Destination
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		resp.HostConfig.Binds = append(resp.HostConfig.Binds, bind)
+	}
+	if c.Network != nil {
+		resp.NetworkSettings.IPAddress = c.Network.IPAddress
+		resp.NetworkSettings.IPPrefixLen = c.Network.PrefixLen
+		resp.NetworkSettings.Gateway = c.Network.Gateway
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// containerSpec serves the runtime spec of a container, as inspect --spec
+// prints it. Docker has no such endpoint, so it keeps the CLI's layout.
+func (d *daemon) containerSpec(w http.ResponseWriter, r *http.Request) {
+	c := findAPIContainer(w, r)
+	if c == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, containerSpec(c))
+}
+
+// containerLogs writes the container's log in the multiplexed format
+// Docker uses for containers without a TTY, each chunk framed with the
+// stream it came from and its length.
+func (d *daemon) containerLogs(w http.ResponseWriter, r *http.Request) {
+	c := findAPIContainer(w, r)
+	if c == nil {
+		return
+	}
+	q := r.URL.Query()
+	if !apiBool(q.Get("stdout")) && !apiBool(q.Get("stderr")) {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("you must choose at least one stream"))
+		return
+	}
+	if c.Config.Log.Driver == logDriverNone {
+		apiError(w, http.StatusNotImplemented, fmt.Errorf("configured logging driver does not support reading"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+	w.WriteHeader(http.StatusOK)
+	mu := &sync.Mutex{}
+	stream := func(id byte, enabled bool) io.Writer {
+		if !enabled {
+			return io.Discard
+		}
+		return &frameWriter{w: w, stream: id, mu: mu}
+	}
+	stdout, stderr := stream(1, apiBool(q.Get("stdout"))), stream(2, apiBool(q.Get("stderr")))
+	if apiBool(q.Get("follow")) {
+		followLogs(c, stdout, stderr)
+	} else {
+		readLogs(c, stdout, stderr)
+	}
+}
+
+// apiBool parses a boolean query parameter, which Docker clients send as
+// 1, true or the like.
+func apiBool(s string) bool {
+	b, err := strconv.ParseBool(s)
+	return err == nil && b
+}
+
+// frameWriter writes each chunk as a frame of a multiplexed stream and
+// flushes it, so that followers see output as it comes.
+type frameWriter struct {
+	w      http.ResponseWriter
+	stream byte
+	mu     *sync.Mutex
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	header := make([]byte, 8)
+	header[0] = f.stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	if _, err := f.w.Write(header); err != nil {
+		return 0, err
+	}
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+const defaultDebugImage = "busybox"
+
+// debugCmd starts a throwaway helper container that shares the PID,
+// network, IPC and UTS namespaces of a running container and sees its
+// rootfs at /target. This gives a shell and tools next to images that ship
+// neither. Mounts made inside the target after it started, such as -v
+// volumes, are not visible under /target.
+func debugCmd(args []string) int {
+	fs := flag.NewFlagSet("debug", flag.ContinueOnError)
+	image := fs.String("image", defaultDebugImage, "image providing the debugging tools")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fmt.Println("usage: debug [--image IMAGE] <id> [command] [args...]")
+		return 2
+	}
+	target, err := findContainer(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !target.running() {
+		fmt.Printf("container %s is not running\n", target.shortID())
+		return 1
+	}
+	cfg := &ContainerConfig{
+		Image:          *image,
+		StopTimeout:    target.Config.StopTimeout,
+		AutoRemove:     true,
+		Mounts:         []Mount{{Source: target.Rootfs, Destination: "/target"}},
+		JoinNamespaces: target.ID,
+	}
+	if fs.NArg() > 1 {
+		cfg.Command = fs.Arg(1)
+		cfg.Args = fs.Args()[2:]
+	}
+	return runContainer(cfg)
+}
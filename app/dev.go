@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// device is a character device every container gets in /dev.
+type device struct {
+	name         string
+	major, minor uint32
+	mode         uint32
+}
+
+var defaultDevices = []device{
+	{"null", 1, 3, 0666},
+	{"zero", 1, 5, 0666},
+	{"full", 1, 7, 0666},
+	{"random", 1, 8, 0666},
+	{"urandom", 1, 9, 0666},
+	{"tty", 5, 0, 0666},
+}
+
+// setupDev mounts a fresh tmpfs over the rootfs's /dev and fills it the way
+// Docker does: the standard character devices, a private devpts instance
+// for pseudo-terminals and a tmpfs /dev/shm. It must run inside the
+// container's mount namespace, before the root is switched.
+func setupDev(rootfs string) error {
+	dev, err := securePath(rootfs, "/dev")
+	if err != nil {
+		return fmt.Errorf("resolve /dev: %v", err)
+	}
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("mount /dev: %v", err)
+	}
+	for _, d := range defaultDevices {
+		if err := createDevice(dev, d); err != nil {
+			return err
+		}
+	}
+	if err := mountDevpts(path.Join(dev, "pts")); err != nil {
+		return err
+	}
+	if err := os.Symlink("pts/ptmx", path.Join(dev, "ptmx")); err != nil {
+		return fmt.Errorf("symlink ptmx: %v", err)
+	}
+	shm := path.Join(dev, "shm")
+	if err := os.Mkdir(shm, 01777); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("shm", shm, "tmpfs", flags, "mode=1777,size=65536k"); err != nil {
+		return fmt.Errorf("mount /dev/shm: %v", err)
+	}
+	return nil
+}
+
+// createDevice makes d in dev. A user namespace may not create device
+// nodes, so rootless containers get the host's device bind-mounted instead.
+func createDevice(dev string, d device) error {
+	target := path.Join(dev, d.name)
+	// The umask would otherwise strip the write bits for group and others.
+	old := syscall.Umask(0)
+	err := syscall.Mknod(target, syscall.S_IFCHR|d.mode, mkdev(d.major, d.minor))
+	syscall.Umask(old)
+	if err == nil {
+		return nil
+	}
+	if err != syscall.EPERM {
+		return fmt.Errorf("mknod %s: %v", d.name, err)
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("create %s: %v", d.name, err)
+	}
+	f.Close()
+	if err := syscall.Mount(path.Join("/dev", d.name), target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %v", d.name, err)
+	}
+	return nil
+}
+
+// mkdev encodes a device number the way the kernel's new_encode_dev does,
+// which holds majors above 255 and minors above 255 that major<<8|minor
+// can't.
+func mkdev(major, minor uint32) int {
+	ma, mi := uint64(major), uint64(minor)
+	return int(mi&0xff | (ma&0xfff)<<8 | (mi&^0xff)<<12 | (ma&^0xfff)<<32)
+}
+
+// mountDevpts mounts a devpts instance of the container's own, so that its
+// terminals are separate from the host's.
+func mountDevpts(target string) error {
+	if err := os.Mkdir(target, 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC)
+	err := syscall.Mount("devpts", target, "devpts", flags, "newinstance,ptmxmode=0666,mode=0620,gid=5")
+	if err == syscall.EINVAL {
+		// The tty group doesn't exist in a user namespace that maps only
+		// the calling user's group.
+		err = syscall.Mount("devpts", target, "devpts", flags, "newinstance,ptmxmode=0666,mode=0620")
+	}
+	if err != nil {
+		return fmt.Errorf("mount devpts: %v", err)
+	}
+	return nil
+}
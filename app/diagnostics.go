@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+)
+
+// logLevelFileName, in the state directory, sets the daemon's log level
+// while it runs: writing debug or info to it takes effect at once, and
+// removing it goes back to the daemon's --log-level.
+const logLevelFileName = "daemon-log-level"
+
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+func validateLogLevel(level string) error {
+	if level != logLevelInfo && level != logLevelDebug {
+		return fmt.Errorf("invalid log level %q: must be %s or %s", level, logLevelInfo, logLevelDebug)
+	}
+	return nil
+}
+
+// logf writes a line to the daemon's log, which is its standard output.
+func (d *daemon) logf(format string, args ...interface{}) {
+	fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+// debugf writes a line to the daemon's log at debug level.
+func (d *daemon) debugf(format string, args ...interface{}) {
+	if d.debug.Load() {
+		d.logf(format, args...)
+	}
+}
+
+func (d *daemon) logLevel() string {
+	if d.debug.Load() {
+		return logLevelDebug
+	}
+	return logLevelInfo
+}
+
+func (d *daemon) setLogLevel(level string) {
+	if d.debug.Swap(level == logLevelDebug) != (level == logLevelDebug) {
+		d.logf("log level set to %s", level)
+	}
+}
+
+// loadLogLevel sets the log level from logLevelFileName, or to the
+// daemon's own if there is no such file.
+func (d *daemon) loadLogLevel() {
+	data, err := os.ReadFile(path.Join(stateDir(), logLevelFileName))
+	if os.IsNotExist(err) {
+		d.setLogLevel(d.defaultLogLevel)
+		return
+	}
+	if err != nil {
+		d.logf("read log level: %v", err)
+		return
+	}
+	level := strings.TrimSpace(string(data))
+	if err := validateLogLevel(level); err != nil {
+		d.logf("%s: %v", logLevelFileName, err)
+		return
+	}
+	d.setLogLevel(level)
+}
+
+// watchLogLevel loads the log level, and again whenever logLevelFileName is
+// written, moved into place or removed, until the returned function is
+// called.
+func (d *daemon) watchLogLevel() (func(), error) {
+	d.loadLogLevel()
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %v", err)
+	}
+	// Non-blocking, the file goes through the runtime's poller, so closing
+	// it ends the read below.
+	f := os.NewFile(uintptr(fd), "inotify")
+	if _, err := syscall.InotifyAddWatch(fd, stateDir(), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_DELETE); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("watch %s: %v", stateDir(), err)
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+				if string(bytes.TrimRight(name, "\x00")) == logLevelFileName {
+					d.loadLogLevel()
+				}
+				off += syscall.SizeofInotifyEvent + int(ev.Len)
+			}
+		}
+	}()
+	return func() { f.Close() }, nil
+}
+
+// logRequests logs every request at debug level, once it is answered.
+func (d *daemon) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.debug.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		client, _ := r.Context().Value(clientKey{}).(int)
+		d.debugf("%s %s: %d in %s (uid %d)", r.Method, r.URL.RequestURI(), sw.status, time.Since(start).Round(time.Microsecond), client)
+	})
+}
+
+// statusWriter remembers the status a handler answered with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps the streams that flush as they go, such as followed logs,
+// doing so.
+func (w *statusWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// getLogLevel and setLogLevelAPI are GET and POST /log-level. Changing the
+// level lasts until the daemon exits, or until logLevelFileName is written.
+func (d *daemon) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"Level": d.logLevel()})
+}
+
+func (d *daemon) setLogLevelAPI(w http.ResponseWriter, r *http.Request) {
+	if !requestTenant(r).root() {
+		apiError(w, http.StatusForbidden, fmt.Errorf("only root can change the log level"))
+		return
+	}
+	level := r.URL.Query().Get("level")
+	if err := validateLogLevel(level); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.setLogLevel(level)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// dumpOnSignal writes a diagnostics dump to the log on every SIGUSR1,
+// until the returned function is called.
+func (d *daemon) dumpOnSignal() func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				// Written at once, so that requests logged meanwhile
+				// don't end up in the middle of it.
+				var buf bytes.Buffer
+				d.dumpDiagnostics(&buf)
+				os.Stdout.Write(buf.Bytes())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// dumpDiagnostics writes what is needed to tell what a daemon in trouble is
+// up to: the stacks of its goroutines, the mounts it sees, the state of
+// every container and how busy it is.
+func (d *daemon) dumpDiagnostics(out io.Writer) {
+	fmt.Fprintf(out, "%s diagnostics dump\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintln(out, "--- goroutines ---")
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			out.Write(buf[:n])
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	fmt.Fprintln(out, "--- mounts ---")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if mounts, err := readMountinfo("/proc/self/mountinfo"); err != nil {
+		fmt.Fprintf(w, "read mounts: %v\n", err)
+	} else {
+		for _, m := range mounts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Destination, m.Type, m.Source, strings.Join(m.Options, ","))
+		}
+	}
+	w.Flush()
+	fmt.Fprintln(out, "--- containers ---")
+	if containers, err := listContainers(); err != nil {
+		fmt.Fprintf(w, "list containers: %v\n", err)
+	} else {
+		fmt.Fprintln(w, "CONTAINER ID\tNAME\tIMAGE\tSTATUS\tPID\tEXIT CODE\tRESTARTS\tHEALTH\tSTARTED")
+		for _, c := range containers {
+			health := "-"
+			if state := c.health(); state != nil {
+				health = state.Status
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s ago\n", c.shortID(), c.name(), c.Config.Image, c.Status, c.Pid, c.ExitCode, c.RestartCount, health, since(c.StartedAt))
+		}
+	}
+	w.Flush()
+	fmt.Fprintln(out, "--- daemon ---")
+	a := d.admission
+	a.mu.Lock()
+	busy := map[string]interface{}{"Active": a.active, "Queued": a.queued, "QueueFull": a.full, "LogLevel": d.logLevel()}
+	a.mu.Unlock()
+	data, _ := json.Marshal(busy)
+	fmt.Fprintf(out, "%s\n--- end of dump ---\n", data)
+}
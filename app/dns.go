@@ -0,0 +1,470 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dnsFileName holds the encrypted upstreams of the embedded resolver. With
+// any set, a bridged container's DNS goes through the resolver to them,
+// rather than in plaintext to the host's nameservers.
+const dnsFileName = "dns.json"
+
+// resolverAddr is where the embedded resolver listens in a container's
+// network namespace, the address Docker uses for its own.
+const resolverAddr = "127.0.0.11"
+
+const (
+	// dnsTimeout bounds each exchange with an upstream.
+	dnsTimeout = 5 * time.Second
+	// maxUDPMessage is the largest reply to a query that doesn't say it
+	// can take more, as EDNS lets it.
+	maxUDPMessage = 512
+	dnsTypeOPT    = 41
+)
+
+type dnsConfig struct {
+	// Upstreams are tried in order: tls://HOST[:PORT][#NAME] for DNS over
+	// TLS, with NAME the name to check the certificate for when it isn't
+	// HOST, and https:// URLs for DNS over HTTPS.
+	Upstreams []string `json:"upstreams,omitempty"`
+}
+
+func dnsConfigPath() string {
+	return path.Join(stateDir(), dnsFileName)
+}
+
+func loadDNSConfig() (*dnsConfig, error) {
+	var d dnsConfig
+	data, err := os.ReadFile(dnsConfigPath())
+	if os.IsNotExist(err) {
+		return &d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read dns config: %v", err)
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("decode dns config: %v", err)
+	}
+	return &d, nil
+}
+
+func (d *dnsConfig) save() error {
+	if len(d.Upstreams) == 0 {
+		if err := os.Remove(dnsConfigPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove dns config: %v", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(dnsConfigPath(), data, 0644); err != nil {
+		return fmt.Errorf("write dns config: %v", err)
+	}
+	return nil
+}
+
+// dnsUpstream is an encrypted DNS server: addr and serverName are set for
+// one over TLS, and url for one over HTTPS.
+type dnsUpstream struct {
+	spec       string
+	addr       string
+	serverName string
+	url        string
+}
+
+func parseDNSUpstream(spec string) (*dnsUpstream, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid DNS upstream %q: expected tls://HOST[:PORT][#NAME] or an https:// URL", spec)
+	}
+	switch u.Scheme {
+	case "tls":
+		port := u.Port()
+		if port == "" {
+			port = "853"
+		}
+		name := u.Fragment
+		if name == "" {
+			name = u.Hostname()
+		}
+		return &dnsUpstream{spec: spec, addr: net.JoinHostPort(u.Hostname(), port), serverName: name}, nil
+	case "https":
+		return &dnsUpstream{spec: spec, url: spec}, nil
+	default:
+		return nil, fmt.Errorf("invalid DNS upstream %q: expected tls://HOST[:PORT][#NAME] or an https:// URL", spec)
+	}
+}
+
+// resolver is the embedded resolver of one container. It answers on
+// resolverAddr in the container's network namespace and forwards queries
+// from the host's to the upstreams.
+type resolver struct {
+	upstreams []*dnsUpstream
+	udp       net.PacketConn
+	tcp       net.Listener
+	client    *http.Client
+	tlsConfig *tls.Config
+	wg        sync.WaitGroup
+}
+
+// listenResolver opens the embedded resolver's sockets in the network
+// namespace of pid. Once open, queries wait in them for serve.
+func listenResolver(pid int, upstreams []string) (*resolver, error) {
+	r := &resolver{
+		client:    &http.Client{Timeout: dnsTimeout},
+		tlsConfig: &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)},
+	}
+	for _, spec := range upstreams {
+		u, err := parseDNSUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	// The sockets stay in the namespace they were created in after the
+	// thread that joined it, which is never let go, has gone.
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := setns(fmt.Sprintf("/proc/%d/ns/net", pid), syscall.CLONE_NEWNET); err != nil {
+			done <- fmt.Errorf("join net namespace: %v", err)
+			return
+		}
+		addr := net.JoinHostPort(resolverAddr, "53")
+		var err error
+		if r.udp, err = net.ListenPacket("udp", addr); err != nil {
+			done <- fmt.Errorf("embedded resolver: %v", err)
+			return
+		}
+		if r.tcp, err = net.Listen("tcp", addr); err != nil {
+			r.udp.Close()
+			done <- fmt.Errorf("embedded resolver: %v", err)
+			return
+		}
+		done <- nil
+	}()
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openResolver opens the container's embedded resolver if it has upstreams
+// to forward to. The resolver is served by publishPorts.
+func (c *Container) openResolver() error {
+	if len(c.Config.DNSUpstreams) == 0 || c.Config.Network != networkBridge || c.resolver != nil {
+		return nil
+	}
+	r, err := listenResolver(c.Pid, c.Config.DNSUpstreams)
+	if err != nil {
+		return err
+	}
+	c.resolver = r
+	return nil
+}
+
+func (c *Container) closeResolver() {
+	if c.resolver != nil {
+		c.resolver.close()
+		c.resolver = nil
+	}
+}
+
+// serve answers queries until close is called.
+func (r *resolver) serve() {
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := r.udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := bytes.Clone(buf[:n])
+			go func() {
+				reply, err := r.exchange(query)
+				if err != nil {
+					return
+				}
+				if len(reply) > udpLimit(query) {
+					reply = truncated(reply)
+				}
+				r.udp.WriteTo(reply, addr)
+			}()
+		}
+	}()
+	go func() {
+		defer r.wg.Done()
+		for {
+			conn, err := r.tcp.Accept()
+			if err != nil {
+				return
+			}
+			go r.serveConn(conn)
+		}
+	}()
+}
+
+// serveConn answers the queries that come over a TCP connection, each
+// with its length in front, as in RFC 1035.
+func (r *resolver) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(2 * dnsTimeout))
+		query, err := readDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		reply, err := r.exchange(query)
+		if err != nil {
+			return
+		}
+		if err := writeDNSMessage(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (r *resolver) close() {
+	r.udp.Close()
+	r.tcp.Close()
+	r.wg.Wait()
+}
+
+// exchange sends query to the upstreams in turn until one answers.
+func (r *resolver) exchange(query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, fmt.Errorf("short DNS message")
+	}
+	var err error
+	for _, u := range r.upstreams {
+		var reply []byte
+		if reply, err = u.exchange(query, r.client, r.tlsConfig); err == nil {
+			return reply, nil
+		}
+	}
+	return nil, err
+}
+
+func (u *dnsUpstream) exchange(query []byte, client *http.Client, tlsConfig *tls.Config) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	if u.url != "" {
+		// RFC 8484 asks for an ID of 0, which makes answers cacheable,
+		// so the client's is put back into the reply.
+		id := binary.BigEndian.Uint16(query)
+		msg := bytes.Clone(query)
+		binary.BigEndian.PutUint16(msg, 0)
+		req, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(msg))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", u.spec, resp.Status)
+		}
+		reply, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) < 12 {
+			return nil, fmt.Errorf("%s: short DNS message", u.spec)
+		}
+		binary.BigEndian.PutUint16(reply, id)
+		return reply, nil
+	}
+	config := tlsConfig.Clone()
+	config.ServerName = u.serverName
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := writeDNSMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSMessage(conn)
+}
+
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+	if err == nil {
+		_, err = w.Write(msg)
+	}
+	return err
+}
+
+// udpLimit returns the largest reply query can take over UDP, which is
+// more than maxUDPMessage if it has an EDNS OPT record that says so.
+func udpLimit(query []byte) int {
+	counts := func(i int) int { return int(binary.BigEndian.Uint16(query[4+2*i:])) }
+	off := 12
+	for i := 0; i < counts(0); i++ {
+		if off = skipDNSName(query, off) + 4; off > len(query) {
+			return maxUDPMessage
+		}
+	}
+	for i := 0; i < counts(1)+counts(2)+counts(3); i++ {
+		off = skipDNSName(query, off)
+		if off+10 > len(query) {
+			return maxUDPMessage
+		}
+		if binary.BigEndian.Uint16(query[off:]) == dnsTypeOPT {
+			return max(maxUDPMessage, int(binary.BigEndian.Uint16(query[off+2:])))
+		}
+		off += 10 + int(binary.BigEndian.Uint16(query[off+8:]))
+	}
+	return maxUDPMessage
+}
+
+// skipDNSName returns the offset past the name at off, or past the end of
+// msg if the name runs off it.
+func skipDNSName(msg []byte, off int) int {
+	for off < len(msg) {
+		switch n := int(msg[off]); {
+		case n == 0:
+			return off + 1
+		case n&0xc0 == 0xc0:
+			return off + 2
+		default:
+			off += n + 1
+		}
+	}
+	return len(msg) + 1
+}
+
+// truncated cuts reply down to its header with the TC bit set, which has
+// the client ask again over TCP.
+func truncated(reply []byte) []byte {
+	header := bytes.Clone(reply[:12])
+	header[2] |= 0x02
+	clear(header[4:])
+	return header
+}
+
+// dnsCmd shows or changes the embedded resolver's upstreams, and with --test
+// asks each of them for a name to check that they answer.
+func dnsCmd(args []string) int {
+	fs := flag.NewFlagSet("system dns", flag.ContinueOnError)
+	var upstreams stringsFlag
+	fs.Var(&upstreams, "upstream", "encrypted DNS server for bridged containers: tls://HOST[:PORT][#NAME] or an https:// URL (repeatable, tried in order)")
+	off := fs.Bool("off", false, "stop using the embedded resolver")
+	test := fs.String("test", "", "look up this name through each upstream")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: system dns [--upstream URL]... [--off] [--test NAME]")
+		return 2
+	}
+	for _, spec := range upstreams {
+		if _, err := parseDNSUpstream(spec); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	d, err := loadDNSConfig()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *off || len(upstreams) > 0 {
+		d.Upstreams = upstreams
+		if err := d.save(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("Containers created from now on use the new setting")
+	}
+	if *test != "" {
+		return testDNSUpstreams(d.Upstreams, *test)
+	}
+	if *off || len(upstreams) > 0 {
+		return 0
+	}
+	if len(d.Upstreams) == 0 {
+		fmt.Println("The embedded resolver is off: bridged containers use the host's nameservers")
+		return 0
+	}
+	for _, spec := range d.Upstreams {
+		fmt.Println(spec)
+	}
+	return 0
+}
+
+func testDNSUpstreams(upstreams []string, name string) int {
+	if len(upstreams) == 0 {
+		fmt.Println("no DNS upstreams are set")
+		return 1
+	}
+	query := make([]byte, 12, 512)
+	rand.Read(query[:2])
+	query[2] = 0x01 // recursion desired
+	query[5] = 1
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		query = append(append(query, byte(len(label))), label...)
+	}
+	query = append(query, 0, 0, 1, 0, 1) // A, IN
+	client := &http.Client{Timeout: dnsTimeout}
+	code := 0
+	for _, spec := range upstreams {
+		u, _ := parseDNSUpstream(spec)
+		start := time.Now()
+		reply, err := u.exchange(query, client, &tls.Config{})
+		if err != nil {
+			fmt.Printf("%s: %v\n", spec, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: rcode %d, %d answers in %s\n", spec, reply[3]&0x0f, binary.BigEndian.Uint16(reply[6:]), time.Since(start).Round(time.Millisecond))
+	}
+	return code
+}
@@ -0,0 +1,281 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// vethPattern matches the host-side veth names setupNetwork picks.
+var vethPattern = regexp.MustCompile(`^veth[0-9a-f]{8}$`)
+
+func systemCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: system <doctor|graph|backup|restore|prune|encrypt|bench|migrate|notify|dns> [args...]")
+		return 2
+	}
+	switch args[0] {
+	case "doctor":
+		return doctorCmd(args[1:])
+	case "graph":
+		return graphCmd(args[1:])
+	case "backup":
+		return backupCmd(args[1:])
+	case "restore":
+		return restoreCmd(args[1:])
+	case "prune":
+		return systemPruneCmd(args[1:])
+	case "encrypt":
+		return encryptCmd(args[1:])
+	case "bench":
+		return benchCmd(args[1:])
+	case "migrate":
+		return migrateCmd(args[1:])
+	case "notify":
+		return notifyCmd(args[1:])
+	case "dns":
+		return dnsCmd(args[1:])
+	default:
+		fmt.Printf("unknown system command: %s\n", args[0])
+		return 2
+	}
+}
+
+// leak is something on the host that looks like ours but that no running
+// container owns, along with how to get rid of it.
+type leak struct {
+	kind   string
+	desc   string
+	repair func() error
+}
+
+// doctorCmd looks for host resources left behind by containers that are
+// gone and, with --fix, removes them.
+func doctorCmd(args []string) int {
+	fs := flag.NewFlagSet("system doctor", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "remove the leaks found")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	containers, err := listContainers()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var leaks []leak
+	for _, find := range []func([]*Container) ([]leak, error){findLeakedMounts, findLeakedVeths, findUnreleasedResources, findOrphanedDirs} {
+		found, err := find(containers)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		leaks = append(leaks, found...)
+	}
+	if len(leaks) == 0 {
+		fmt.Println("No problems found.")
+		return 0
+	}
+	code := 0
+	for _, l := range leaks {
+		fmt.Printf("%s: %s\n", l.kind, l.desc)
+		if !*fix {
+			continue
+		}
+		if err := l.repair(); err != nil {
+			fmt.Printf("  fix failed: %v\n", err)
+			code = 1
+			continue
+		}
+		fmt.Println("  fixed")
+	}
+	if !*fix {
+		fmt.Printf("%d problems found, run with --fix to repair them\n", len(leaks))
+		return 1
+	}
+	return code
+}
+
+// findLeakedMounts reports mounts in our namespace below a container's
+// directory whose container isn't running. Mounts are listed deepest first
+// so that unmounting them in order works.
+func findLeakedMounts(containers []*Container) ([]leak, error) {
+	running := make(map[string]bool)
+	for _, c := range containers {
+		if c.active() {
+			running[c.ID] = true
+		}
+	}
+	mounts, err := readMountpoints()
+	if err != nil {
+		return nil, err
+	}
+	prefix := containersDir() + "/"
+	var leaks []leak
+	for i := len(mounts) - 1; i >= 0; i-- {
+		mp := mounts[i]
+		if !strings.HasPrefix(mp, prefix) {
+			continue
+		}
+		id, _, _ := strings.Cut(strings.TrimPrefix(mp, prefix), "/")
+		if running[id] {
+			continue
+		}
+		leaks = append(leaks, leak{
+			kind: "leaked mount",
+			desc: mp,
+			repair: func() error {
+				return syscall.Unmount(mp, syscall.MNT_DETACH)
+			},
+		})
+	}
+	return leaks, nil
+}
+
+// readMountpoints lists the mount points in /proc/self/mountinfo in the
+// order they were mounted.
+func readMountpoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("read mountinfo: %v", err)
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountinfo(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read mountinfo: %v", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountinfo undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in mountinfo paths.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// findLeakedVeths reports host veths named like ours that no running
+// container lists among its resources.
+func findLeakedVeths(containers []*Container) ([]leak, error) {
+	owned := make(map[string]bool)
+	for _, c := range containers {
+		if !c.active() {
+			continue
+		}
+		for _, r := range c.Resources {
+			if r.Kind == resourceVeth {
+				owned[r.ID] = true
+			}
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %v", err)
+	}
+	var leaks []leak
+	for _, ifi := range ifaces {
+		name := ifi.Name
+		if !vethPattern.MatchString(name) || owned[name] {
+			continue
+		}
+		leaks = append(leaks, leak{
+			kind: "leaked veth",
+			desc: name,
+			repair: func() error {
+				return releaseResource(Resource{Kind: resourceVeth, ID: name})
+			},
+		})
+	}
+	return leaks, nil
+}
+
+// findUnreleasedResources reports exited containers that still list
+// resources. The resources themselves may be gone already, in which case
+// repairing only updates the record.
+func findUnreleasedResources(containers []*Container) ([]leak, error) {
+	var leaks []leak
+	for _, c := range containers {
+		if c.active() || len(c.Resources) == 0 {
+			continue
+		}
+		var names []string
+		for _, r := range c.Resources {
+			names = append(names, r.Kind+" "+r.ID)
+		}
+		leaks = append(leaks, leak{
+			kind:   "unreleased resources",
+			desc:   fmt.Sprintf("container %s: %s", c.shortID(), strings.Join(names, ", ")),
+			repair: c.releaseResources,
+		})
+	}
+	return leaks, nil
+}
+
+// findOrphanedDirs reports container directories without a readable
+// record, which listContainers skips and rm therefore can't remove.
+func findOrphanedDirs(containers []*Container) ([]leak, error) {
+	known := make(map[string]bool)
+	for _, c := range containers {
+		known[c.ID] = true
+	}
+	entries, err := os.ReadDir(containersDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state dir: %v", err)
+	}
+	var leaks []leak
+	for _, e := range entries {
+		if !e.IsDir() || known[e.Name()] {
+			continue
+		}
+		dir := path.Join(containersDir(), e.Name())
+		leaks = append(leaks, leak{
+			kind: "orphaned directory",
+			desc: dir,
+			repair: func() error {
+				// Removing files through a mount would delete them from
+				// whatever is mounted there.
+				mounts, err := readMountpoints()
+				if err != nil {
+					return err
+				}
+				for _, mp := range mounts {
+					if strings.HasPrefix(mp, dir+"/") {
+						return fmt.Errorf("%s is still mounted", mp)
+					}
+				}
+				return os.RemoveAll(dir)
+			},
+		})
+	}
+	return leaks, nil
+}
@@ -0,0 +1,211 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxConcurrentDownloads = 3
+	defaultDownloadRetries        = 5
+	initialBackoff                = 500 * time.Millisecond
+	maxBackoff                    = 10 * time.Second
+
+	// requestTimeout bounds requests for small documents such as tokens and
+	// manifests, responseHeaderTimeout how long the registry may take to
+	// start answering any request, and blobStallTimeout how long a blob
+	// download may go without receiving anything.
+	requestTimeout        = 30 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+	blobStallTimeout      = 60 * time.Second
+)
+
+// httpStatusError is an unexpected response status from the registry.
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
+
+// errBlobStalled means the registry stopped sending a blob part way. The
+// download is retried from where it stopped.
+var errBlobStalled = errors.New("download stalled")
+
+// errDigestMismatch means the downloaded bytes are corrupt. The partial file
+// is dropped so that the retry starts from scratch.
+var errDigestMismatch = errors.New("digest mismatch")
+
+// retryable reports whether a failed download is worth another attempt:
+// network errors, throttling and server-side failures are, while client
+// errors such as a missing blob or bad credentials are not.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.code
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// downloadLayer fetches a layer blob into the store, retrying with
+// exponential backoff. Retries resume from the bytes already on disk with a
+// Range request, and the finished file is checked against the layer's
+// digest before it is moved into place. A partial file is kept after a
+// network failure so that the next pull can resume it too.
+func (d *DockerImageClient) downloadLayer(ctx context.Context, layer Layer, lp *layerProgress) error {
+	filePath := d.store.partialPath(layer.Digest)
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := d.fetchBlob(ctx, layer.Digest, filePath, lp)
+		if err == nil {
+			err = verifyDigest(filePath, layer.Digest)
+		}
+		if err == nil {
+			return d.store.commitBlob(layer.Digest)
+		}
+		if errors.Is(err, errDigestMismatch) {
+			os.Remove(filePath)
+		}
+		if attempt >= d.retries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		d.progress.setStatus(lp, fmt.Sprintf("Retrying in %s", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// fetchBlob appends the rest of a blob to filePath, asking the registry for
+// only the bytes that are missing.
+func (d *DockerImageClient) fetchBlob(ctx context.Context, digest, filePath string, lp *layerProgress) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create file: %v", err)
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seek: %v", err)
+	}
+	// The request is cancelled if nothing arrives for blobStallTimeout,
+	// which the client's own timeouts don't cover once the body has
+	// started.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stall := time.AfterFunc(blobStallTimeout, func() { cancel(errBlobStalled) })
+	defer stall.Stop()
+	url := fmt.Sprintf(dockerBlobsURL, d.registry, d.name, digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("new request: %v", err)
+	}
+	for k, v := range d.authHeaders() {
+		req.Header.Set(k, v)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.http.Do(req)
+	if err != nil {
+		if context.Cause(ctx) == errBlobStalled {
+			err = errBlobStalled
+		}
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The registry ignored the range, so start over.
+		if offset > 0 {
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("truncate: %v", err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("seek: %v", err)
+			}
+			offset = 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing is missing; the digest check has the final word.
+		return nil
+	default:
+		return &httpStatusError{resp.StatusCode}
+	}
+	d.progress.resume(lp, offset)
+	// Flush whatever arrived even if the copy fails, so a retry can resume
+	// from it.
+	w := bufio.NewWriter(file)
+	body := &stallReader{ctx: ctx, r: resp.Body, stall: stall}
+	_, copyErr := io.Copy(w, d.progress.reader(lp, body))
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write file: %v", err)
+	}
+	if copyErr != nil {
+		if context.Cause(ctx) == errBlobStalled {
+			copyErr = errBlobStalled
+		}
+		return fmt.Errorf("copy file: %w", copyErr)
+	}
+	return nil
+}
+
+// stallReader stops reading once ctx is done and pushes back the stall
+// timer each time data arrives.
+type stallReader struct {
+	ctx   context.Context
+	r     io.Reader
+	stall *time.Timer
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.stall.Reset(blobStallTimeout)
+	}
+	return n, err
+}
+
+func verifyDigest(filePath, digest string) error {
+	algo, want, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" {
+		return nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file: %v", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hash file: %v", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%w: got sha256:%s", errDigestMismatch, got)
+	}
+	return nil
+}
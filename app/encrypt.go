@@ -0,0 +1,304 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// The encrypted store is a LUKS volume in a file next to the state
+// directory, mounted over it while unlocked. It holds everything the state
+// directory does: image layers, container rootfses and their logs.
+const (
+	encryptedStoreSuffix = ".luks"
+	defaultEncryptedSize = "20g"
+)
+
+func encryptedStorePath() string {
+	return filepath.Clean(stateDir()) + encryptedStoreSuffix
+}
+
+// encryptedMapperName is the device-mapper name of the unlocked volume. It
+// is derived from the state directory so that several roots can be
+// unlocked at once.
+func encryptedMapperName() string {
+	sum := sha256.Sum256([]byte(filepath.Clean(stateDir())))
+	return "diy-docker-" + hex.EncodeToString(sum[:4])
+}
+
+func encryptedStoreExists() bool {
+	_, err := os.Stat(encryptedStorePath())
+	return err == nil
+}
+
+// encryptedStoreUnlocked reports whether the encrypted volume is mounted on
+// the state directory.
+func encryptedStoreUnlocked() (bool, error) {
+	mounts, err := readMountpoints()
+	if err != nil {
+		return false, err
+	}
+	dir := filepath.Clean(stateDir())
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	for _, m := range mounts {
+		if m == dir {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkStoreUnlocked fails if the state directory is encrypted but locked,
+// since anything written to it then would go to the unencrypted directory
+// underneath.
+func checkStoreUnlocked() error {
+	if !encryptedStoreExists() {
+		return nil
+	}
+	unlocked, err := encryptedStoreUnlocked()
+	if err != nil {
+		return err
+	}
+	if !unlocked {
+		return fmt.Errorf("%s is encrypted and locked: unlock it with system encrypt unlock or start the daemon with --key-file", stateDir())
+	}
+	return nil
+}
+
+func encryptCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: system encrypt <init|unlock|lock|status> [args...]")
+		return 2
+	}
+	switch args[0] {
+	case "init":
+		return encryptInitCmd(args[1:])
+	case "unlock":
+		return encryptUnlockCmd(args[1:])
+	case "lock":
+		return encryptLockCmd(args[1:])
+	case "status":
+		return encryptStatusCmd(args[1:])
+	default:
+		fmt.Printf("unknown encrypt command: %s\n", args[0])
+		return 2
+	}
+}
+
+// encryptInitCmd creates the encrypted volume and leaves it unlocked. The
+// state directory has to be empty, since what is in it would be hidden
+// under the volume rather than moved into it.
+func encryptInitCmd(args []string) int {
+	fs := flag.NewFlagSet("system encrypt init", flag.ContinueOnError)
+	size := fs.String("size", defaultEncryptedSize, "size of the volume, with an optional k, m or g suffix; the file is sparse")
+	keyFile := fs.String("key-file", "", "file holding the key (default prompt for a passphrase)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	n, err := parseByteSize(*size)
+	if err != nil || n <= 0 {
+		fmt.Printf("invalid --size %q\n", *size)
+		return 2
+	}
+	if err := checkEncryptPrereqs(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if encryptedStoreExists() {
+		fmt.Printf("%s already exists\n", encryptedStorePath())
+		return 1
+	}
+	if entries, err := os.ReadDir(stateDir()); err == nil && len(entries) > 0 {
+		fmt.Printf("%s is not empty: back it up with system backup, remove it and restore into the encrypted store\n", stateDir())
+		return 1
+	}
+	if err := initEncryptedStore(n, *keyFile); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Encrypted %s with %s\n", stateDir(), encryptedStorePath())
+	return 0
+}
+
+func initEncryptedStore(size int64, keyFile string) (err error) {
+	backing := encryptedStorePath()
+	f, err := os.OpenFile(backing, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create %s: %v", backing, err)
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(backing)
+		return fmt.Errorf("create %s: %v", backing, err)
+	}
+	defer func() {
+		if err != nil {
+			runCommand("cryptsetup", "close", encryptedMapperName())
+			os.Remove(backing)
+		}
+	}()
+	format := []string{"luksFormat", "--batch-mode", "--type", "luks2"}
+	if keyFile == "" {
+		format = append(format, "--verify-passphrase")
+	}
+	if err := runCryptsetup(append(format, backing), keyFile); err != nil {
+		return err
+	}
+	if err := runCryptsetup([]string{"open", backing, encryptedMapperName()}, keyFile); err != nil {
+		return err
+	}
+	if err := runCommand("mkfs.ext4", "-q", "/dev/mapper/"+encryptedMapperName()); err != nil {
+		return err
+	}
+	return mountEncryptedStore()
+}
+
+// unlockEncryptedStore opens and mounts the encrypted volume if it isn't
+// already, reading the key from keyFile, or prompting for it if that is
+// empty.
+func unlockEncryptedStore(keyFile string) error {
+	if unlocked, err := encryptedStoreUnlocked(); err != nil || unlocked {
+		return err
+	}
+	if err := checkEncryptPrereqs(); err != nil {
+		return err
+	}
+	// It may have been opened by an unlock that failed to mount.
+	if _, err := os.Stat("/dev/mapper/" + encryptedMapperName()); err != nil {
+		if err := runCryptsetup([]string{"open", encryptedStorePath(), encryptedMapperName()}, keyFile); err != nil {
+			return err
+		}
+	}
+	return mountEncryptedStore()
+}
+
+func mountEncryptedStore() error {
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	if err := syscall.Mount("/dev/mapper/"+encryptedMapperName(), stateDir(), "ext4", syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("mount encrypted store: %v", err)
+	}
+	return nil
+}
+
+// runCryptsetup runs cryptsetup with the key from keyFile. Without one,
+// cryptsetup prompts on the terminal, so it gets ours.
+func runCryptsetup(args []string, keyFile string) error {
+	if keyFile != "" {
+		return runCommand("cryptsetup", append([]string{"--key-file", keyFile}, args...)...)
+	}
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cryptsetup %s: %v", args[0], err)
+	}
+	return nil
+}
+
+func checkEncryptPrereqs() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("encrypting the store requires root")
+	}
+	for _, tool := range []string{"cryptsetup", "mkfs.ext4"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("encrypting the store needs %s", tool)
+		}
+	}
+	return nil
+}
+
+func encryptUnlockCmd(args []string) int {
+	fs := flag.NewFlagSet("system encrypt unlock", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "file holding the key (default prompt for the passphrase)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !encryptedStoreExists() {
+		fmt.Printf("%s is not encrypted\n", stateDir())
+		return 1
+	}
+	if err := unlockEncryptedStore(*keyFile); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// encryptLockCmd unmounts and closes the encrypted volume. Containers have
+// their rootfs in it, so it stays unlocked while any of them runs.
+func encryptLockCmd(args []string) int {
+	fs := flag.NewFlagSet("system encrypt lock", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !encryptedStoreExists() {
+		fmt.Printf("%s is not encrypted\n", stateDir())
+		return 1
+	}
+	unlocked, err := encryptedStoreUnlocked()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if unlocked {
+		containers, err := listContainers()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, c := range containers {
+			if c.active() || c.Status == statusRestarting {
+				fmt.Printf("container %s is running: stop it first\n", c.shortID())
+				return 1
+			}
+		}
+		if err := syscall.Unmount(stateDir(), 0); err != nil {
+			fmt.Printf("unmount %s: %v\n", stateDir(), err)
+			return 1
+		}
+	}
+	if _, err := os.Stat("/dev/mapper/" + encryptedMapperName()); err == nil {
+		if err := runCommand("cryptsetup", "close", encryptedMapperName()); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func encryptStatusCmd(args []string) int {
+	fs := flag.NewFlagSet("system encrypt status", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !encryptedStoreExists() {
+		fmt.Printf("%s: not encrypted\n", stateDir())
+		return 0
+	}
+	unlocked, err := encryptedStoreUnlocked()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	state := "locked"
+	if unlocked {
+		state = "unlocked"
+	}
+	fmt.Printf("%s: encrypted, %s\n", stateDir(), state)
+	fmt.Printf("volume: %s\n", encryptedStorePath())
+	fmt.Printf("device: %s\n", path.Join("/dev/mapper", encryptedMapperName()))
+	return 0
+}
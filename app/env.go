@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// parseEnvFile reads KEY=VALUE lines from file, skipping blank lines and
+// comments. A bare KEY takes its value from the host, as with -e.
+func parseEnvFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("open env file: %v", err)
+	}
+	defer f.Close()
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if kv, ok := resolveEnv(line); ok {
+			env = append(env, kv)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read env file: %v", err)
+	}
+	return env, nil
+}
+
+// resolveEnv fills in the host value for a bare KEY. It reports false when
+// the key is unset on the host, in which case it is left out entirely.
+func resolveEnv(kv string) (string, bool) {
+	if strings.Contains(kv, "=") {
+		return kv, true
+	}
+	v, ok := os.LookupEnv(kv)
+	if !ok {
+		return "", false
+	}
+	return kv + "=" + v, true
+}
+
+// containerEnv builds the container command's environment from scratch
+// rather than inheriting the host's. Later entries win over earlier ones.
+func containerEnv(env []string, home string) []string {
+	base := []string{"PATH=" + defaultPath, "HOME=" + home}
+	return mergeEnv(base, env)
+}
+
+func mergeEnv(base, overrides []string) []string {
+	merged := append([]string{}, base...)
+	index := make(map[string]int, len(merged))
+	for i, kv := range merged {
+		k, _, _ := strings.Cut(kv, "=")
+		index[k] = i
+	}
+	for _, kv := range overrides {
+		k, _, _ := strings.Cut(kv, "=")
+		if i, ok := index[k]; ok {
+			merged[i] = kv
+			continue
+		}
+		index[k] = len(merged)
+		merged = append(merged, kv)
+	}
+	return merged
+}
@@ -0,0 +1,310 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// eventsFileName is the log of events under the state directory, one JSON
+// object per line. Events are only ever appended to it.
+const eventsFileName = "events.jsonl"
+
+// Kinds of object events are about.
+const (
+	eventContainer = "container"
+	eventImage     = "image"
+)
+
+// Actions events record.
+const (
+	eventPull   = "pull"
+	eventCreate = "create"
+	eventStart  = "start"
+	eventDie    = "die"
+	eventStop   = "stop"
+	eventRemove = "remove"
+	// eventRestore is a container brought back from the trash.
+	eventRestore = "restore"
+	eventOOM     = "oom"
+	// eventMemoryHigh is a container going above its --memory-high and
+	// being throttled.
+	eventMemoryHigh = "memory_high"
+	// eventHealthStatus is a container's healthcheck changing its health.
+	eventHealthStatus = "health_status"
+	// eventDeny is an image the daemon's policy kept from being pulled or
+	// run.
+	eventDeny = "deny"
+)
+
+// eventsFormat is the --format that prints each event as it is logged.
+const eventsFormat = "json"
+
+// Event is a lifecycle transition of a container or an image.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Action string    `json:"action"`
+	// ID is the container ID or the image reference.
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func eventsPath() string {
+	return path.Join(stateDir(), eventsFileName)
+}
+
+// recordEvent appends an event to the log. Events are a record of what
+// happened, not part of making it happen, so failing to record one is
+// ignored.
+func recordEvent(typ, action, id string, attrs map[string]string) {
+	data, err := json.Marshal(Event{Time: time.Now().UTC(), Type: typ, Action: action, ID: id, Attributes: attrs})
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(eventsPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	// A single write with O_APPEND keeps lines from concurrent writers
+	// whole.
+	f.Write(append(data, '\n'))
+}
+
+// recordContainerEvent records an event about c, which carries its name
+// and image.
+func recordContainerEvent(c *Container, action string, attrs map[string]string) {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs["name"] = c.name()
+	if c.Config.Image != "" {
+		attrs["image"] = c.Config.Image
+	}
+	recordEvent(eventContainer, action, c.ID, attrs)
+}
+
+// recordExit records that c's process exited with code, and before that
+// whether the kernel killed anything in it for running out of memory, and
+// notifies of it if it failed. It must be called before c's cgroup is
+// removed.
+func recordExit(c *Container, code int) {
+	oomKilled := c.Cgroup != "" && oomKills(c.Cgroup) > 0
+	if oomKilled {
+		recordContainerEvent(c, eventOOM, nil)
+	}
+	attrs := map[string]string{"exitCode": strconv.Itoa(code)}
+	if c.TimedOut {
+		attrs["timedOut"] = "true"
+	}
+	recordContainerEvent(c, eventDie, attrs)
+	notifyExit(c, code, oomKilled)
+}
+
+// oomKills reads how many processes in cgroup were killed for running out
+// of memory. It is 0 where the memory controller isn't enabled.
+func oomKills(cgroup string) int {
+	return int(memoryEvents(cgroup)["oom_kill"])
+}
+
+// eventFilter keeps the events that match at least one value of every key,
+// as docker events --filter does.
+type eventFilter map[string][]string
+
+func parseEventFilters(specs []string) (eventFilter, error) {
+	f := make(eventFilter)
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid filter %q: expected KEY=VALUE", spec)
+		}
+		switch key {
+		case "type", "event", "container", "image":
+		default:
+			return nil, fmt.Errorf("invalid filter %q: expected type, event, container or image", spec)
+		}
+		f[key] = append(f[key], value)
+	}
+	return f, nil
+}
+
+func (f eventFilter) match(e *Event) bool {
+	for key, values := range f {
+		matched := false
+		for _, v := range values {
+			switch key {
+			case "type":
+				matched = e.Type == v
+			case "event":
+				matched = e.Action == v
+			case "container":
+				matched = e.Type == eventContainer && (strings.HasPrefix(e.ID, v) || e.Attributes["name"] == v)
+			case "image":
+				matched = (e.Type == eventImage && e.ID == normalizeRef(v)) || e.Attributes["image"] == v
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// parseEventTime parses --since: an RFC 3339 time, a Unix timestamp, or a
+// duration such as 10m meaning that long ago.
+func parseEventTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected an RFC 3339 time, a Unix timestamp or a duration", value)
+}
+
+func (e *Event) String() string {
+	var attrs []string
+	for k, v := range e.Attributes {
+		attrs = append(attrs, k+"="+v)
+	}
+	sort.Strings(attrs)
+	s := fmt.Sprintf("%s %s %s %s", e.Time.Format(time.RFC3339Nano), e.Type, e.Action, e.ID)
+	if len(attrs) > 0 {
+		s += " (" + strings.Join(attrs, ", ") + ")"
+	}
+	return s
+}
+
+// eventsCmd prints events as they happen, after the ones since --since if
+// it is given, until it is interrupted.
+func eventsCmd(args []string) int {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	since := fs.String("since", "", "also print the events since this time: RFC 3339, a Unix timestamp or a duration such as 10m")
+	format := fs.String("format", "", "print each event as json, or with a Go template such as {{.action}}")
+	var filters stringsFlag
+	fs.Var(&filters, "filter", "only print matching events: type=, event=, container= or image= (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: events [--since TIME] [--filter KEY=VALUE]... [--format json|TEMPLATE]")
+		return 2
+	}
+	filter, err := parseEventFilters(filters)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	start := time.Now()
+	if *since != "" {
+		if start, err = parseEventTime(*since); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	var tmpl *template.Template
+	if *format != "" && *format != eventsFormat {
+		if tmpl, err = template.New("format").Funcs(inspectFuncs).Option("missingkey=zero").Parse(*format); err != nil {
+			fmt.Printf("invalid --format: %v\n", err)
+			return 2
+		}
+	}
+	printEvent := func(e *Event) error {
+		switch {
+		case *format == eventsFormat:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		case tmpl != nil:
+			out, err := executeInspectTemplate(tmpl, e)
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+		default:
+			fmt.Println(e)
+		}
+		return nil
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	if err := followEvents(start, filter, printEvent, sigs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// followEvents passes each event from start on that matches filter to fn,
+// waiting for more once it has caught up with the log, until a signal
+// arrives on stop.
+func followEvents(start time.Time, filter eventFilter, fn func(*Event) error, stop <-chan os.Signal) error {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var pending []byte
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(eventsPath()); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("open events: %v", err)
+			}
+		}
+		if f != nil {
+			data, err := io.ReadAll(f)
+			if err != nil {
+				return fmt.Errorf("read events: %v", err)
+			}
+			pending = append(pending, data...)
+			// Only whole lines are read. The rest is an event still being
+			// written.
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				var e Event
+				err := json.Unmarshal(pending[:i], &e)
+				pending = pending[i+1:]
+				if err != nil || e.Time.Before(start) || !filter.match(&e) {
+					continue
+				}
+				if err := fn(&e); err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
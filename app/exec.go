@@ -0,0 +1,190 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// namespaceType is a kind of namespace, by its name under /proc/<pid>/ns.
+type namespaceType struct {
+	name   string
+	nstype int
+}
+
+// execNamespaces are the namespaces of another container that a container
+// started to join them shares, all but the mount namespace, which it gets
+// a new one of. An exec'd process joins the mount namespace too.
+var execNamespaces = []namespaceType{
+	{"ipc", syscall.CLONE_NEWIPC},
+	{"uts", syscall.CLONE_NEWUTS},
+	{"net", syscall.CLONE_NEWNET},
+	{"pid", syscall.CLONE_NEWPID},
+}
+
+// setnsTrap holds the setns syscall number per architecture, since the
+// syscall package's amd64 table predates setns.
+var setnsTrap = map[string]uintptr{
+	"amd64": 308,
+	"arm64": 268,
+}
+
+func execCmd(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 0, "stop the command once it has run this long, exiting with 124 (default no limit)")
+	user := fs.String("u", "", "user to run as: name|uid[:group|gid] (default the container's)")
+	workdir := fs.String("w", "", "working directory inside the container (default the container's)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 2 || *timeout < 0 {
+		fmt.Println("usage: exec [--timeout DURATION] [-u USER] [-w DIR] <id> <command> [args...]")
+		return 2
+	}
+	if *workdir != "" && !path.IsAbs(*workdir) {
+		fmt.Printf("invalid -w %q: must be absolute\n", *workdir)
+		return 2
+	}
+	c, err := findContainer(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !c.running() {
+		fmt.Printf("container %s is not running\n", c.shortID())
+		return 1
+	}
+	// -u and -w apply to this command only.
+	target := *c
+	if *user != "" {
+		target.Config.User = *user
+	}
+	if *workdir != "" {
+		target.Config.WorkingDir = *workdir
+	}
+	sigs, stopNotify := notifySignals()
+	defer stopNotify()
+	p, err := startInContainer(&target, fs.Args()[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exec: %v\n", err)
+		return commandErrorCode(err)
+	}
+	stopForward := forwardSignals(sigs, p, time.Duration(c.Config.StopTimeout)*time.Second)
+	stopTimeout := enforceTimeout(p, *timeout, time.Duration(c.Config.StopTimeout)*time.Second)
+	state, _ := p.Wait()
+	timedOut := stopTimeout()
+	stopForward()
+	if timedOut {
+		fmt.Fprintf(os.Stderr, "exec timed out after %s\n", *timeout)
+		return exitTimedOut
+	}
+	return exitCode(state)
+}
+
+// startInContainer starts args inside the running container c, with the
+// given standard input, output and error, and returns the process, which
+// is ours to wait for. It joins all of the container's namespaces and its
+// cgroup, gets a process group of its own and is confined the way the
+// container command is, as the container's user in its working directory
+// and with its environment. The command is looked up in the container's
+// PATH and rootfs.
+func startInContainer(c *Container, args []string, stdin, stdout, stderr *os.File) (*os.Process, error) {
+	root := fmt.Sprintf("/proc/%d/root", c.Pid)
+	user, err := lookupUserIn(root, c.Config.User)
+	if err != nil {
+		return nil, err
+	}
+	env := containerEnv(c.Config.Env, user.home)
+	command, err := lookPathIn(root, args[0], envPath(env))
+	if err != nil {
+		return nil, err
+	}
+	conf, err := confineLike(c, user)
+	if err != nil {
+		return nil, err
+	}
+	dir := c.Config.WorkingDir
+	if dir == "" {
+		dir = "/"
+	}
+	return spawnInNamespaces(c.Pid, c.Cgroup, command, dir, args, env, conf, []*os.File{stdin, stdout, stderr})
+}
+
+// startInNamespacesOf starts cmd from a thread that has joined the
+// namespaces of pid, so that cmd is created inside them. The thread is never
+// unlocked, so it is discarded along with its namespaces afterwards.
+func startInNamespacesOf(pid int, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := joinNamespaces(pid); err != nil {
+			done <- err
+			return
+		}
+		done <- cmd.Start()
+	}()
+	return <-done
+}
+
+// joinNamespaces moves the calling thread into the namespaces of pid. The
+// caller must have locked the goroutine to its OS thread. A thread can't
+// join a user namespace, so pid must be in ours.
+func joinNamespaces(pid int) error {
+	same, err := sameNamespace(fmt.Sprintf("/proc/%d/ns/user", pid), "/proc/self/ns/user")
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("the container has a user namespace of its own, which can only be joined by exec")
+	}
+	for _, ns := range execNamespaces {
+		target := fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name)
+		same, err := sameNamespace(target, "/proc/thread-self/ns/"+ns.name)
+		if err != nil {
+			return err
+		}
+		if same {
+			continue
+		}
+		if err := setns(target, ns.nstype); err != nil {
+			return fmt.Errorf("join %s namespace: %v", ns.name, err)
+		}
+	}
+	return nil
+}
+
+func sameNamespace(a, b string) (bool, error) {
+	la, err := os.Readlink(a)
+	if err != nil {
+		return false, fmt.Errorf("read namespace: %v", err)
+	}
+	lb, err := os.Readlink(b)
+	if err != nil {
+		return false, fmt.Errorf("read namespace: %v", err)
+	}
+	return la == lb, nil
+}
+
+func setns(path string, nstype int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	trap, ok := setnsTrap[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	if _, _, errno := syscall.RawSyscall(trap, f.Fd(), uintptr(nstype), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// firstPreservedFd is where the file descriptors passed to a container
+// start, after stdio, as in systemd's socket activation.
+const firstPreservedFd = 3
+
+// preservedFdsEnv tells the shim and init how many file descriptors they
+// were passed, from firstPreservedFd on. Only a run that has them passes
+// them, so a container started again later goes without.
+const preservedFdsEnv = "_DIY_DOCKER_PRESERVED_FDS"
+
+// socketActivation reports the sockets systemd passed us, if it did: their
+// number and their names, as LISTEN_FDS and LISTEN_FDNAMES. LISTEN_PID
+// says which process they are for, so that they aren't taken for ours when
+// the variables are inherited by one of its children.
+func socketActivation() (int, string, bool) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return 0, "", false
+	}
+	return n, os.Getenv("LISTEN_FDNAMES"), true
+}
+
+// checkPreservedFds makes sure we were passed the n file descriptors from
+// firstPreservedFd on. Being open isn't enough, since the Go runtime opens
+// files of its own at the lowest numbers free, but those are closed on
+// exec, which one we inherited can't have been.
+func checkPreservedFds(n int) error {
+	for fd := firstPreservedFd; fd < firstPreservedFd+n; fd++ {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno != 0 || flags&syscall.FD_CLOEXEC != 0 {
+			return fmt.Errorf("can't preserve file descriptor %d: it wasn't passed to us", fd)
+		}
+	}
+	return nil
+}
+
+// inheritFiles takes the n file descriptors from firstPreservedFd on to pass
+// to the container. They are closed on exec so that nothing else we run
+// gets them by accident.
+func inheritFiles(n int) ([]*os.File, error) {
+	if err := checkPreservedFds(n); err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, 0, n)
+	for fd := firstPreservedFd; fd < firstPreservedFd+n; fd++ {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "fd"+strconv.Itoa(fd)))
+	}
+	return files, nil
+}
+
+// passFiles has cmd start with files from firstPreservedFd on, followed by
+// extra, and tells it how many of them there are.
+func passFiles(cmd *exec.Cmd, files []*os.File, extra ...*os.File) {
+	cmd.ExtraFiles = append(append(cmd.ExtraFiles, files...), extra...)
+	if len(files) == 0 {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, preservedFdsEnv+"="+strconv.Itoa(len(files)))
+}
+
+// preservedFds returns how many file descriptors the process that started
+// us passed from firstPreservedFd on.
+func preservedFds() int {
+	n, _ := strconv.Atoi(os.Getenv(preservedFdsEnv))
+	return max(n, 0)
+}
+
+// listenEnv tells the container command about systemd's sockets, which it
+// was passed n file descriptors along with. Init's PID is the command's,
+// since it execs it.
+func listenEnv(c *Container, n int) []string {
+	if c.Config.ListenFDs == 0 || n < c.Config.ListenFDs {
+		return nil
+	}
+	env := []string{
+		"LISTEN_FDS=" + strconv.Itoa(c.Config.ListenFDs),
+		"LISTEN_PID=" + strconv.Itoa(os.Getpid()),
+	}
+	if c.Config.ListenFDNames != "" {
+		env = append(env, "LISTEN_FDNAMES="+c.Config.ListenFDNames)
+	}
+	return env
+}
@@ -0,0 +1,188 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func containerCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: container <fork|prune|restore|trash> [args...]")
+		return 2
+	}
+	switch args[0] {
+	case "fork":
+		return forkCmd(args[1:])
+	case "prune":
+		return containerPruneCmd(args[1:])
+	case "restore":
+		return containerRestoreCmd(args[1:])
+	case "trash":
+		return containerTrashCmd(args[1:])
+	default:
+		fmt.Printf("unknown container command: %s\n", args[0])
+		return 2
+	}
+}
+
+// forkCmd starts a detached copy of a running container on a snapshot of
+// its rootfs. Process state can't be cloned without checkpointing, so the
+// copy runs the container's command from the start against the files the
+// original had at the time. It gets namespaces and, with bridge networking,
+// an address of its own; published ports stay with the original, and
+// volumes are shared rather than copied.
+func forkCmd(args []string) int {
+	fs := flag.NewFlagSet("container fork", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: container fork <id>")
+		return 2
+	}
+	c, err := findContainer(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !c.running() {
+		fmt.Printf("container %s is not running\n", c.shortID())
+		return 1
+	}
+	clone, err := forkContainer(c)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(clone.ID)
+	return 0
+}
+
+func forkContainer(c *Container) (*Container, error) {
+	cfg := c.Config
+	cfg.Name = ""
+	cfg.Detach = true
+	cfg.AutoRemove = false
+	cfg.Ports = nil
+	// The copy gets a rootfs of its own even if the original ran on a
+	// directory, and with it a resolv.conf of its own.
+	cfg.RootfsPath = ""
+	cfg.Mounts = nil
+	for _, m := range c.Config.Mounts {
+		if !strings.HasPrefix(m.Source, c.dir()+"/") {
+			cfg.Mounts = append(cfg.Mounts, m)
+		}
+	}
+	clone, err := newContainer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			clone.remove()
+		}
+	}()
+	if cfg.RootfsTmpfs {
+		if err := mountRootfsTmpfs(clone); err != nil {
+			return nil, err
+		}
+	}
+	if err := snapshotRootfs(c, clone.Rootfs); err != nil {
+		return nil, err
+	}
+	clone.ImageID = c.ImageID
+	clone.ImageConfig = c.ImageConfig
+	if err := clone.save(); err != nil {
+		return nil, err
+	}
+	if err := writeResolvConf(clone); err != nil {
+		return nil, err
+	}
+	if err := startShim(clone); err != nil {
+		return nil, err
+	}
+	started = true
+	return clone, nil
+}
+
+// snapshotRootfs copies c's rootfs to dest while c is paused, so that the
+// copy doesn't catch files half written. Copies share data blocks on
+// filesystems that support reflinks.
+func snapshotRootfs(c *Container, dest string) error {
+	resume, err := pauseContainer(c)
+	if err != nil {
+		return err
+	}
+	defer resume()
+	if err := runCommand("cp", "-a", "--reflink=auto", c.Rootfs+"/.", dest); err != nil {
+		return fmt.Errorf("copy rootfs: %v", err)
+	}
+	return nil
+}
+
+// pauseContainer stops every process in c with SIGSTOP and returns a
+// function that lets them continue.
+func pauseContainer(c *Container) (func(), error) {
+	stopped := make(map[int]bool)
+	resume := func() {
+		for pid := range stopped {
+			syscall.Kill(pid, syscall.SIGCONT)
+		}
+	}
+	// Processes may fork while we go, so keep looking until no new ones
+	// turn up.
+	for {
+		pids, err := containerPids(c)
+		if err != nil {
+			resume()
+			return nil, err
+		}
+		found := false
+		for _, pid := range pids {
+			if stopped[pid] {
+				continue
+			}
+			if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil && err != syscall.ESRCH {
+				resume()
+				return nil, fmt.Errorf("pause container: %v", err)
+			}
+			stopped[pid] = true
+			found = true
+		}
+		if !found {
+			return resume, nil
+		}
+	}
+}
+
+// containerPids lists the processes in c's PID namespace, as seen from the
+// host.
+func containerPids(c *Container) ([]int, error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", c.Pid))
+	if err != nil {
+		return nil, fmt.Errorf("read pid namespace: %v", err)
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("read /proc: %v", err)
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid)); err == nil && link == ns {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,271 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Kinds of nodes in a system graph.
+const (
+	graphContainer = "container"
+	graphNetwork   = "network"
+	graphVolume    = "volume"
+	graphPort      = "port"
+)
+
+type graphNode struct {
+	id    string
+	label string
+	kind  string
+}
+
+type graphEdge struct {
+	from, to string
+	label    string
+	// dependency marks an edge between containers, drawn dashed.
+	dependency bool
+}
+
+// systemGraph describes containers and what connects them: the networks
+// they are on, the ports they publish, the volumes they mount and the
+// containers whose namespaces they join. Containers are grouped by
+// project.
+type systemGraph struct {
+	nodes    []graphNode
+	edges    []graphEdge
+	projects map[string][]string
+	seen     map[string]bool
+}
+
+// graphCmd prints the system graph as Graphviz dot or as a Mermaid
+// flowchart.
+func graphCmd(args []string) int {
+	fs := flag.NewFlagSet("system graph", flag.ContinueOnError)
+	format := fs.String("format", "dot", "output format: dot or mermaid")
+	all := fs.Bool("a", false, "include containers that aren't running")
+	project := addProjectFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || (*format != "dot" && *format != "mermaid") {
+		fmt.Println("usage: system graph [--format dot|mermaid] [-a] [--project NAME]")
+		return 2
+	}
+	if err := validateProject(*project); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	containers, err := listContainers()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var selected []*Container
+	for _, c := range containers {
+		if (*all || c.running()) && c.inProject(*project) {
+			selected = append(selected, c)
+		}
+	}
+	g := buildGraph(selected)
+	if *format == "mermaid" {
+		g.writeMermaid(os.Stdout)
+	} else {
+		g.writeDot(os.Stdout)
+	}
+	return 0
+}
+
+func buildGraph(containers []*Container) *systemGraph {
+	g := &systemGraph{projects: make(map[string][]string), seen: make(map[string]bool)}
+	ids := make(map[string]string)
+	volumes := make(map[string]string)
+	for _, c := range containers {
+		ids[c.ID] = "c_" + c.shortID()
+	}
+	for _, c := range containers {
+		id := ids[c.ID]
+		image := c.Config.Image
+		if image == "" {
+			image = c.Config.RootfsPath
+		}
+		g.addNode(id, fmt.Sprintf("%s\n%s\n%s", c.name(), image, strings.ToLower(statusString(c))), graphContainer)
+		if c.Config.Project != "" {
+			g.projects[c.Config.Project] = append(g.projects[c.Config.Project], id)
+		}
+		if target, ok := ids[c.Config.JoinNamespaces]; ok {
+			g.edges = append(g.edges, graphEdge{from: id, to: target, label: "shares namespaces", dependency: true})
+		} else if c.Config.JoinNamespaces == "" {
+			network := c.Config.Network
+			if network == "" {
+				network = networkHost
+			}
+			label := ""
+			if c.Network != nil {
+				label = c.Network.IPAddress
+			}
+			g.addNode("net_"+network, network, graphNetwork)
+			g.edges = append(g.edges, graphEdge{from: id, to: "net_" + network, label: label})
+		}
+		for _, p := range c.Config.Ports {
+			hostIP := p.HostIP
+			if hostIP == "" {
+				hostIP = "0.0.0.0"
+			}
+			port := fmt.Sprintf("port_%s_%d_%s", strings.NewReplacer(".", "_", ":", "_").Replace(hostIP), p.HostPort, p.proto())
+			g.addNode(port, fmt.Sprintf("%s:%d/%s", hostIP, p.HostPort, p.proto()), graphPort)
+			g.edges = append(g.edges, graphEdge{from: port, to: id, label: fmt.Sprintf("%d/%s", p.ContainerPort, p.proto())})
+		}
+		for _, m := range c.Config.Mounts {
+			// Files of containers, such as a container's resolv.conf or
+			// the rootfs a debug container mounts, aren't volumes.
+			if strings.HasPrefix(m.Source, containersDir()+"/") {
+				continue
+			}
+			volume, ok := volumes[m.Source]
+			if !ok {
+				volume = fmt.Sprintf("vol_%d", len(volumes)+1)
+				volumes[m.Source] = volume
+			}
+			g.addNode(volume, m.Source, graphVolume)
+			label := m.Destination
+			if m.ReadOnly {
+				label += " (ro)"
+			}
+			g.edges = append(g.edges, graphEdge{from: id, to: volume, label: label})
+		}
+	}
+	return g
+}
+
+func (g *systemGraph) addNode(id, label, kind string) {
+	if g.seen[id] {
+		return
+	}
+	g.seen[id] = true
+	g.nodes = append(g.nodes, graphNode{id: id, label: label, kind: kind})
+}
+
+// inProject maps each grouped node to its project.
+func (g *systemGraph) inProject() map[string]string {
+	grouped := make(map[string]string)
+	for project, ids := range g.projects {
+		for _, id := range ids {
+			grouped[id] = project
+		}
+	}
+	return grouped
+}
+
+func (g *systemGraph) sortedProjects() []string {
+	var names []string
+	for name := range g.projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *systemGraph) writeDot(w io.Writer) {
+	shapes := map[string]string{
+		graphContainer: "box",
+		graphNetwork:   "ellipse",
+		graphVolume:    "cylinder",
+		graphPort:      "diamond",
+	}
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+	node := func(indent string, n graphNode) {
+		fmt.Fprintf(w, "%s%s [label=%s, shape=%s];\n", indent, n.id, quote(n.label), shapes[n.kind])
+	}
+	grouped := g.inProject()
+	byID := make(map[string]graphNode)
+	for _, n := range g.nodes {
+		byID[n.id] = n
+	}
+	fmt.Fprintln(w, "digraph diy_docker {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, project := range g.sortedProjects() {
+		fmt.Fprintf(w, "  subgraph %s {\n", quote("cluster_"+project))
+		fmt.Fprintf(w, "    label=%s;\n", quote(project))
+		for _, id := range g.projects[project] {
+			node("    ", byID[id])
+		}
+		fmt.Fprintln(w, "  }")
+	}
+	for _, n := range g.nodes {
+		if _, ok := grouped[n.id]; !ok {
+			node("  ", n)
+		}
+	}
+	for _, e := range g.edges {
+		attrs := []string{}
+		if e.label != "" {
+			attrs = append(attrs, "label="+quote(e.label))
+		}
+		if e.dependency {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(w, "  %s -> %s", e.from, e.to)
+		if len(attrs) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintln(w, ";")
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func (g *systemGraph) writeMermaid(w io.Writer) {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`"`, "#quot;", "\n", "<br/>").Replace(s) + `"`
+	}
+	node := func(indent string, n graphNode) {
+		label := quote(n.label)
+		switch n.kind {
+		case graphNetwork:
+			fmt.Fprintf(w, "%s%s((%s))\n", indent, n.id, label)
+		case graphVolume:
+			fmt.Fprintf(w, "%s%s[(%s)]\n", indent, n.id, label)
+		case graphPort:
+			fmt.Fprintf(w, "%s%s{{%s}}\n", indent, n.id, label)
+		default:
+			fmt.Fprintf(w, "%s%s[%s]\n", indent, n.id, label)
+		}
+	}
+	grouped := g.inProject()
+	byID := make(map[string]graphNode)
+	for _, n := range g.nodes {
+		byID[n.id] = n
+	}
+	fmt.Fprintln(w, "flowchart LR")
+	for _, project := range g.sortedProjects() {
+		fmt.Fprintf(w, "  subgraph project_%s[%s]\n", project, quote(project))
+		for _, id := range g.projects[project] {
+			node("    ", byID[id])
+		}
+		fmt.Fprintln(w, "  end")
+	}
+	for _, n := range g.nodes {
+		if _, ok := grouped[n.id]; !ok {
+			node("  ", n)
+		}
+	}
+	for _, e := range g.edges {
+		arrow := "-->"
+		if e.dependency {
+			arrow = "-.->"
+		}
+		if e.label != "" {
+			fmt.Fprintf(w, "  %s %s|%s| %s\n", e.from, arrow, quote(e.label), e.to)
+		} else {
+			fmt.Fprintf(w, "  %s %s %s\n", e.from, arrow, e.to)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Health statuses, as in Docker.
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// Defaults for what neither the image nor the flags set, the same as
+// Docker's.
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+const (
+	// healthFileName holds the container's HealthState. Like the stopped
+	// marker, it is kept out of the record, which the supervising process
+	// saves from its own copy.
+	healthFileName = "health.json"
+	// healthLogSize is how many check results are kept.
+	healthLogSize = 5
+	// healthOutputSize limits the output kept from each check.
+	healthOutputSize = 4096
+	// suspendThreshold is how much longer than the monotonic clock the
+	// boot clock has to have run for the host to count as having been
+	// suspended, rather than the two being read a moment apart.
+	suspendThreshold = time.Second
+)
+
+const (
+	clockMonotonic = 1
+	clockBoottime  = 7
+)
+
+// HealthState is what the healthchecks of a running container have found.
+type HealthState struct {
+	Status        string         `json:"status"`
+	FailingStreak int            `json:"failingStreak"`
+	Log           []HealthResult `json:"log"`
+}
+
+// HealthResult is the outcome of one check.
+type HealthResult struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"`
+	Output   string    `json:"output"`
+}
+
+// healthConfig returns the check c runs: the image's HEALTHCHECK with
+// whatever the flags set in place of its fields. It returns nil if there
+// is none or the image disables it.
+func healthConfig(c *Container) *HealthConfig {
+	var hc HealthConfig
+	if img := c.ImageConfig.Config.Healthcheck; img != nil {
+		hc = *img
+	}
+	if o := c.Config.Healthcheck; o != nil {
+		if len(o.Test) > 0 {
+			hc.Test = o.Test
+		}
+		if o.Interval != 0 {
+			hc.Interval = o.Interval
+		}
+		if o.Timeout != 0 {
+			hc.Timeout = o.Timeout
+		}
+		if o.StartPeriod != 0 {
+			hc.StartPeriod = o.StartPeriod
+		}
+		if o.Retries != 0 {
+			hc.Retries = o.Retries
+		}
+	}
+	if len(hc.Test) == 0 || hc.Test[0] == "NONE" {
+		return nil
+	}
+	if hc.Interval == 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defaultHealthTimeout
+	}
+	if hc.Retries == 0 {
+		hc.Retries = defaultHealthRetries
+	}
+	return &hc
+}
+
+// healthArgv returns the command a check runs, or nil if test isn't one
+// Docker would run.
+func healthArgv(test []string) []string {
+	if len(test) < 2 {
+		return nil
+	}
+	switch test[0] {
+	case "CMD":
+		return test[1:]
+	case "CMD-SHELL":
+		return []string{"/bin/sh", "-c", test[1]}
+	default:
+		return nil
+	}
+}
+
+// health returns what c's healthchecks have found, or nil if it has none.
+func (c *Container) health() *HealthState {
+	data, err := os.ReadFile(path.Join(c.dir(), healthFileName))
+	if err != nil {
+		return nil
+	}
+	var h HealthState
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil
+	}
+	return &h
+}
+
+func (c *Container) saveHealth(h *HealthState) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal health: %v", err)
+	}
+	tmp := path.Join(c.dir(), healthFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write health: %v", err)
+	}
+	if err := os.Rename(tmp, path.Join(c.dir(), healthFileName)); err != nil {
+		return fmt.Errorf("write health: %v", err)
+	}
+	return nil
+}
+
+// monitorHealth runs c's healthcheck every interval while c runs, starting
+// over from starting each time c is started. It must be called by the
+// process that waits on the container, which calls the returned function
+// once the container has exited.
+func monitorHealth(c *Container) func() {
+	hc := healthConfig(c)
+	if hc == nil {
+		os.Remove(path.Join(c.dir(), healthFileName))
+		return func() {}
+	}
+	state := &HealthState{Status: healthStarting}
+	c.saveHealth(state)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		// The timers and time.Since go by the monotonic clock, which
+		// stops while the host is suspended, so a laptop's lid being
+		// closed doesn't make checks overdue.
+		started := time.Now()
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		suspended := suspendedFor()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			result := runHealthcheck(c, hc)
+			now := suspendedFor()
+			resumed := now-suspended > suspendThreshold
+			suspended = now
+			state.Log = append(state.Log, result)
+			if len(state.Log) > healthLogSize {
+				state.Log = state.Log[len(state.Log)-healthLogSize:]
+			}
+			previous := state.Status
+			switch {
+			case result.ExitCode == 0:
+				state.Status = healthHealthy
+				state.FailingStreak = 0
+			// Failures while the container is still starting up don't
+			// count against it.
+			case state.Status == healthStarting && time.Since(started) < hc.StartPeriod:
+			// Nor do those right after the host resumed from suspend,
+			// when the network and whatever the check talks to may not
+			// be back yet. The next check has the say.
+			case resumed:
+			default:
+				state.FailingStreak++
+				if state.FailingStreak >= hc.Retries {
+					state.Status = healthUnhealthy
+				}
+			}
+			c.saveHealth(state)
+			if state.Status != previous {
+				recordContainerEvent(c, eventHealthStatus, map[string]string{"healthStatus": state.Status})
+				if state.Status == healthUnhealthy {
+					notifyUnhealthy(c, state)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// suspendedFor returns how long the host has spent suspended since it
+// booted: the boot clock counts that time, and the monotonic clock doesn't.
+func suspendedFor() time.Duration {
+	var boot, mono syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockBoottime, uintptr(unsafe.Pointer(&boot)), 0)
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&mono)), 0)
+	return time.Duration(boot.Nano() - mono.Nano())
+}
+
+// runHealthcheck runs hc's command in c the way exec would, killing it if
+// it runs past the timeout. Like Docker, it reports a check that couldn't
+// run or timed out with exit code -1.
+func runHealthcheck(c *Container, hc *HealthConfig) HealthResult {
+	result := HealthResult{Start: time.Now(), ExitCode: -1}
+	argv := healthArgv(hc.Test)
+	if argv == nil {
+		result.Output = fmt.Sprintf("unsupported healthcheck %q", hc.Test)
+		result.End = time.Now()
+		return result
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		result.Output = err.Error()
+		result.End = time.Now()
+		return result
+	}
+	defer devNull.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		result.Output = err.Error()
+		result.End = time.Now()
+		return result
+	}
+	defer r.Close()
+	p, err := startInContainer(c, argv, devNull, w, w)
+	w.Close()
+	if err != nil {
+		result.Output = err.Error()
+		result.End = time.Now()
+		return result
+	}
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		close(copied)
+	}()
+	timer := time.AfterFunc(hc.Timeout, func() {
+		syscall.Kill(-p.Pid, syscall.SIGKILL)
+	})
+	state, err := p.Wait()
+	<-copied
+	result.End = time.Now()
+	output := out.Bytes()
+	if len(output) > healthOutputSize {
+		output = output[:healthOutputSize]
+	}
+	result.Output = string(output)
+	if !timer.Stop() {
+		result.Output = fmt.Sprintf("health check exceeded timeout (%s)", hc.Timeout)
+		return result
+	}
+	if err != nil {
+		result.Output = err.Error()
+		return result
+	}
+	result.ExitCode = state.ExitCode()
+	return result
+}
@@ -4,49 +4,130 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
-	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
 const (
 	dockerAuthURL      = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:library/%s:pull" // repo
-	dockerManifestsURL = "https://registry.hub.docker.com/v2/library/%s/manifests/%s"                               // repo, tag
-	dockerBlobsURL     = "https://registry.hub.docker.com/v2/library/%s/blobs/%s"                                   // repo, digest
-	layerFileName      = "%s.tar"
+	dockerManifestsURL = "%s/v2/library/%s/manifests/%s"                                                            // registry, repo, tag
+	dockerBlobsURL     = "%s/v2/library/%s/blobs/%s"                                                                // registry, repo, digest
+
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
 )
 
+// manifestAccept lists every manifest and index type the client can parse.
+// Registries pick the best match, so an index is returned for multi-arch
+// images whether it was published in Docker or OCI format.
+var manifestAccept = strings.Join([]string{
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+}, ", ")
+
 type DockerImageClient struct {
-	http  *http.Client
-	name  string
-	tag   string
-	token string
-	dir   string
+	http                   *http.Client
+	registry               string
+	mirror                 string
+	quiet                  bool
+	name                   string
+	reference              string
+	token                  string
+	store                  *imageStore
+	progress               *pullProgress
+	maxConcurrentDownloads int
+	retries                int
+	timeout                time.Duration
+	// platform is what to pick from a multi-arch image. explicitPlatform
+	// records that it was asked for, in which case a single-arch image
+	// has to match it too.
+	platform         Platform
+	explicitPlatform bool
+}
+
+// PullOptions tune how an image is fetched. They only affect the pull and
+// are not persisted with the container.
+type PullOptions struct {
+	Quiet                  bool
+	MaxConcurrentDownloads int
+	// Progress is auto, plain, tty or json.
+	Progress string
+	// Timeout bounds the whole pull, or is 0 for no limit.
+	Timeout time.Duration
+	// RegistryMirror is tried before Docker Hub. CACerts are extra CA
+	// certificate files to trust, and InsecureRegistries are hosts whose
+	// certificates aren't verified.
+	RegistryMirror     string
+	CACerts            []string
+	InsecureRegistries []string
+	// Platform is os/arch[/variant] to pull instead of the host's.
+	Platform string
 }
 
-func newDockerImageClient(name, dir string) *DockerImageClient {
-	parts := strings.Split(name, ":")
-	var nam, tag string
-	if len(parts) == 1 {
-		nam = parts[0]
-		tag = "latest"
+func addPullFlags(fs *flag.FlagSet, o *PullOptions) {
+	fs.BoolVar(&o.Quiet, "q", false, "suppress pull progress output")
+	fs.BoolVar(&o.Quiet, "quiet", false, "suppress pull progress output")
+	fs.StringVar(&o.Progress, "progress", progressAuto, "how to show pull progress: auto, plain, tty, or json for one JSON object per line on stdout")
+	fs.IntVar(&o.MaxConcurrentDownloads, "max-concurrent-downloads", defaultMaxConcurrentDownloads, "maximum number of layers to download at once")
+	fs.DurationVar(&o.Timeout, "pull-timeout", 0, "give up on a pull that takes longer than this (0 for no limit)")
+	fs.StringVar(&o.RegistryMirror, "registry-mirror", "", "registry `URL` to pull library images from before trying Docker Hub")
+	fs.Var((*stringsFlag)(&o.CACerts), "registry-ca", "PEM `file` of CA certificates to trust for registries (repeatable)")
+	fs.Var((*stringsFlag)(&o.InsecureRegistries), "insecure-registry", "`host` whose certificate isn't verified (repeatable)")
+	fs.StringVar(&o.Platform, "platform", "", "pull the image for `os/arch[/variant]` instead of the host's platform")
+}
+
+func newPullClient(ref string, store *imageStore, o PullOptions) (*DockerImageClient, error) {
+	if err := validateProgressMode(o.Progress); err != nil {
+		return nil, err
+	}
+	client, err := newRegistryHTTPClient(o)
+	if err != nil {
+		return nil, err
 	}
-	return &DockerImageClient{
-		http: &http.Client{},
-		name: nam,
-		tag:  tag,
-		dir:  dir,
+	name, reference := parseImageRef(ref)
+	d := &DockerImageClient{
+		http:                   client,
+		registry:               dockerHubURL,
+		quiet:                  o.Quiet,
+		name:                   name,
+		reference:              reference,
+		store:                  store,
+		progress:               newPullProgress(o.Progress, o.Quiet),
+		maxConcurrentDownloads: defaultMaxConcurrentDownloads,
+		retries:                defaultDownloadRetries,
+		timeout:                o.Timeout,
+		platform:               hostPlatform(),
 	}
+	if o.MaxConcurrentDownloads > 0 {
+		d.maxConcurrentDownloads = o.MaxConcurrentDownloads
+	}
+	if o.RegistryMirror != "" {
+		if d.mirror, err = parseRegistryMirror(o.RegistryMirror); err != nil {
+			return nil, err
+		}
+	}
+	if o.Platform != "" {
+		if d.platform, err = parsePlatform(o.Platform); err != nil {
+			return nil, err
+		}
+		d.explicitPlatform = true
+	}
+	return d, nil
 }
 
 type TokenResponse struct {
@@ -54,14 +135,79 @@ type TokenResponse struct {
 }
 
 type Manifest struct {
-	Platform  Platform `json:"platform"`
-	Digest    string   `json:"digest"`
-	MediaType string   `json:"mediaType"`
+	Platform    Platform          `json:"platform"`
+	Digest      string            `json:"digest"`
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 type Platform struct {
-	Arch string `json:"architecture"`
-	Os   string `json:"os"`
+	Arch    string `json:"architecture"`
+	Os      string `json:"os"`
+	Variant string `json:"variant,omitempty"`
+}
+
+// hostPlatform is the platform images are pulled for.
+func hostPlatform() Platform {
+	p := Platform{Os: runtime.GOOS, Arch: runtime.GOARCH}
+	if p.Arch == "arm" {
+		p.Variant = "v7"
+	}
+	return p
+}
+
+// archAliases maps the names uname and others use for architectures to
+// the ones images use.
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"armhf":   "arm",
+	"i386":    "386",
+}
+
+// parsePlatform parses os/arch[/variant]. A 32-bit arm platform without a
+// variant means v7, as on the host.
+func parsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid --platform %q: expected os/arch[/variant]", s)
+	}
+	p := Platform{Os: parts[0], Arch: parts[1]}
+	if alias, ok := archAliases[p.Arch]; ok {
+		p.Arch = alias
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	} else if p.Arch == "arm" {
+		p.Variant = "v7"
+	}
+	return p, nil
+}
+
+// matches reports whether an image built for q runs on p. An arm64 image
+// without a variant is the same as arm64/v8.
+func (p Platform) matches(q Platform) bool {
+	if p.Os != q.Os || p.Arch != q.Arch {
+		return false
+	}
+	return normalizeVariant(p.Arch, p.Variant) == normalizeVariant(q.Arch, q.Variant)
+}
+
+func normalizeVariant(arch, variant string) string {
+	if arch == "arm64" && variant == "" {
+		return "v8"
+	}
+	return variant
+}
+
+func (p Platform) String() string {
+	s := p.Os + "/" + p.Arch
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
 }
 
 type Layer struct {
@@ -70,160 +216,390 @@ type Layer struct {
 	Digest    string `json:"digest"`
 }
 
+// ManifestListResponse holds either an index (Docker manifest list or OCI
+// image index), in which case Manifests is set, or an image manifest.
 type ManifestListResponse struct {
+	MediaType string     `json:"mediaType"`
 	Manifests []Manifest `json:"manifests"`
+	Config    Layer      `json:"config"`
 	Layers    []Layer    `json:"layers"`
+
+	digest string
 }
 
-func (d *DockerImageClient) Pull() error {
-	if err := d.authorize(); err != nil {
-		return err
+// isIndex tells an index from an image manifest by media type. The field is
+// optional in OCI documents, in which case the shape of the body decides.
+func (m *ManifestListResponse) isIndex() (bool, error) {
+	switch m.MediaType {
+	case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+		return true, nil
+	case mediaTypeDockerManifest, mediaTypeOCIManifest:
+		return false, nil
+	case "":
+		return len(m.Manifests) > 0, nil
+	default:
+		return false, fmt.Errorf("unsupported manifest media type %s", m.MediaType)
+	}
+}
+
+// ImageConfig is the part of the image config blob that describes how to
+// run the image.
+type ImageConfig struct {
+	Config struct {
+		User       string       `json:"User"`
+		Env        []string     `json:"Env"`
+		Entrypoint imageCommand `json:"Entrypoint"`
+		Cmd        imageCommand `json:"Cmd"`
+		// Shell runs shell-form commands, /bin/sh -c unless the image
+		// sets another with SHELL.
+		Shell      []string `json:"Shell,omitempty"`
+		WorkingDir string   `json:"WorkingDir"`
+		// ExposedPorts has keys such as 80/tcp for the ports the image
+		// declares with EXPOSE.
+		ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+		Healthcheck  *HealthConfig       `json:"Healthcheck,omitempty"`
+		Labels       map[string]string   `json:"Labels,omitempty"`
+	} `json:"config"`
+}
+
+// defaultShell runs shell-form commands in images that don't set a SHELL.
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// imageCommand is an image's Entrypoint or Cmd. Docker writes the exec
+// form, an array that is run as it is, but a config may hold the shell
+// form instead, a string that is run with the image's Shell.
+type imageCommand struct {
+	Argv []string
+	// ShellForm says Argv is the one command line of the shell form.
+	ShellForm bool
+}
+
+func (c *imageCommand) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		*c = imageCommand{Argv: []string{line}, ShellForm: true}
+		return nil
 	}
-	layers, err := d.getLayers()
+	var argv []string
+	if err := json.Unmarshal(data, &argv); err != nil {
+		return fmt.Errorf("decode command: %v", err)
+	}
+	*c = imageCommand{Argv: argv}
+	return nil
+}
+
+func (c imageCommand) MarshalJSON() ([]byte, error) {
+	if c.ShellForm {
+		return json.Marshal(c.Argv[0])
+	}
+	return json.Marshal(c.Argv)
+}
+
+// argv returns the command to run, wrapping the shell form in shell.
+func (c imageCommand) argv(shell []string) []string {
+	if !c.ShellForm {
+		return c.Argv
+	}
+	return append(append([]string{}, shell...), c.Argv[0])
+}
+
+// HealthConfig is the image's HEALTHCHECK. Test is NONE to disable a check
+// inherited from a base image, or CMD or CMD-SHELL followed by the command.
+// Durations are nanoseconds in the config, as time.Duration already is.
+type HealthConfig struct {
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// Pull fetches the image into the store, skipping layers it already has,
+// and records the reference as pointing to it. It stops when ctx is done or
+// the client's timeout passes, keeping partial layers for the next pull.
+func (d *DockerImageClient) Pull(ctx context.Context) (*Image, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	img, err := d.pull(ctx)
+	if err != nil && d.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("pull %s: timed out after %s", canonicalRef(d.name, d.reference), d.timeout)
+	}
+	return img, err
+}
+
+func (d *DockerImageClient) pull(ctx context.Context) (*Image, error) {
+	digest, manifest, err := d.resolve(ctx)
 	if err != nil {
+		return nil, err
+	}
+	err = d.pullLayers(ctx, manifest.Layers)
+	d.progress.close()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.getConfig(ctx, manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	if err := d.checkPlatform(manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	img := &Image{
+		Ref:      canonicalRef(d.name, d.reference),
+		Digest:   digest,
+		Manifest: manifest.digest,
+		Config:   manifest.Config.Digest,
+		PulledAt: time.Now(),
+	}
+	for _, layer := range manifest.Layers {
+		img.Layers = append(img.Layers, layer.Digest)
+	}
+	if err := d.store.put(img); err != nil {
+		return nil, err
+	}
+	recordEvent(eventImage, eventPull, img.Ref, map[string]string{"digest": img.Digest})
+	return img, nil
+}
+
+// resolve gets the image manifest from the mirror, if there is one, or
+// else from Docker Hub, and leaves the client set up to fetch the rest of
+// the image from the same registry.
+func (d *DockerImageClient) resolve(ctx context.Context) (string, *ManifestListResponse, error) {
+	var digest string
+	var manifest *ManifestListResponse
+	err := d.fromRegistry(ctx, func() error {
+		var err error
+		digest, manifest, err = d.getManifest(ctx)
+		return err
+	})
+	return digest, manifest, err
+}
+
+// fromRegistry runs fetch against the mirror, if there is one, and against
+// Docker Hub if there isn't or it fails, leaving the client set up for the
+// registry that worked.
+func (d *DockerImageClient) fromRegistry(ctx context.Context, fetch func() error) error {
+	if d.mirror != "" {
+		// Mirrors serve library images without a Docker Hub token.
+		d.registry = d.mirror
+		err := fetch()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !d.quiet {
+			fmt.Fprintf(os.Stderr, "Mirror %s failed, pulling from Docker Hub: %v\n", d.mirror, err)
+		}
+		d.registry = dockerHubURL
+	}
+	if err := d.authorize(ctx); err != nil {
 		return err
 	}
-	return d.pullLayers(layers)
+	return fetch()
 }
 
-func (d *DockerImageClient) authorize() error {
-	url := fmt.Sprintf(dockerAuthURL, d.name)	
+func (d *DockerImageClient) authorize(ctx context.Context) error {
+	url := fmt.Sprintf(dockerAuthURL, d.name)
 	var tokenRes TokenResponse
-	if err := doGet(d.http, url, nil, &tokenRes); err != nil {
+	if err := doGet(ctx, d.http, url, nil, &tokenRes); err != nil {
 		return fmt.Errorf("authorize: %v", err)
 	}
 	d.token = tokenRes.Token
 	return nil
 }
 
-func (d *DockerImageClient) getLayers() ([]Layer, error) {
-	url := fmt.Sprintf(dockerManifestsURL, d.name, d.tag)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", d.token),
-		"Accept":        "application/vnd.docker.distribution.manifest.v2+json",
+// getManifest resolves the client's reference to an image manifest for the
+// host platform. It also returns the digest the reference resolved to,
+// which for multi-arch images is the index's.
+func (d *DockerImageClient) getManifest(ctx context.Context) (string, *ManifestListResponse, error) {
+	mRes, err := d.fetchManifest(ctx, d.reference)
+	if err != nil {
+		return "", nil, fmt.Errorf("get manifest: %v", err)
 	}
-	var mRes ManifestListResponse
-	if err := doGet(d.http, url, headers, &mRes); err != nil {
-		return nil, fmt.Errorf("get layers: %v", err)
+	digest := mRes.digest
+	isIndex, err := mRes.isIndex()
+	if err != nil {
+		return "", nil, err
 	}
-	if len(mRes.Manifests) > 0 {
-		ms, err := d.getLayersFromManifests(mRes.Manifests)
+	if isIndex {
+		mRes, err = d.getManifestFromList(ctx, mRes.Manifests)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-		return ms, nil
 	}
 	if len(mRes.Layers) == 0 {
-		return nil, fmt.Errorf("no layers found in manifest")
+		return "", nil, fmt.Errorf("no layers found in manifest")
 	}
-	return mRes.Layers, nil
+	return digest, mRes, nil
 }
 
-func (d *DockerImageClient) getLayersFromManifests(manifests []Manifest) ([]Layer, error) {
-	manifest, err := findArchMatchingManifest(manifests)
+func (d *DockerImageClient) getManifestFromList(ctx context.Context, manifests []Manifest) (*ManifestListResponse, error) {
+	manifest, err := findArchMatchingManifest(manifests, d.platform)
+	if err != nil {
+		var available []string
+		for _, m := range manifests {
+			// Attestations and the like are listed as unknown/unknown.
+			if m.Platform.Os != "unknown" {
+				available = append(available, m.Platform.String())
+			}
+		}
+		return nil, fmt.Errorf("no manifest found for %s, the image is available for %s", d.platform, strings.Join(available, ", "))
+	}
+	mRes, err := d.fetchManifest(ctx, manifest.Digest)
 	if err != nil {
-		return nil, fmt.Errorf("no manifest found for %s/%s", runtime.GOOS, runtime.GOARCH)
+		return nil, fmt.Errorf("get manifest from list: %v", err)
 	}
-	url := fmt.Sprintf(dockerManifestsURL, d.name, manifest.Digest)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", d.token),
-		"Accept":        "application/vnd.docker.distribution.manifest.v2+json",
+	if isIndex, err := mRes.isIndex(); err != nil || isIndex {
+		return nil, fmt.Errorf("manifest %s is not an image manifest", manifest.Digest)
+	}
+	return mRes, nil
+}
+
+// fetchManifest fetches a manifest or index by tag or digest and keeps the
+// raw document in the store, since its digest covers the exact bytes.
+func (d *DockerImageClient) fetchManifest(ctx context.Context, reference string) (*ManifestListResponse, error) {
+	raw, mRes, err := d.fetchRawManifest(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.store.writeBlob(mRes.digest, raw); err != nil {
+		return nil, err
+	}
+	return mRes, nil
+}
+
+// fetchRawManifest fetches a manifest or index by tag or digest, returning
+// the document as it was served along with what it says.
+func (d *DockerImageClient) fetchRawManifest(ctx context.Context, reference string) ([]byte, *ManifestListResponse, error) {
+	url := fmt.Sprintf(dockerManifestsURL, d.registry, d.name, reference)
+	headers := d.authHeaders()
+	headers["Accept"] = manifestAccept
+	raw, err := doGetRaw(ctx, d.http, url, headers)
+	if err != nil {
+		return nil, nil, err
 	}
 	var mRes ManifestListResponse
-	if err := doGet(d.http, url, headers, &mRes); err != nil {
-		return nil, fmt.Errorf("get layers from manifests: %v", err)
+	if err := json.Unmarshal(raw, &mRes); err != nil {
+		return nil, nil, fmt.Errorf("decode: %v", err)
 	}
-	if len(mRes.Layers) == 0 {
-		return nil, fmt.Errorf("no layers found in image manifest")
+	mRes.digest = digestOf(raw)
+	if strings.Contains(reference, ":") && reference != mRes.digest {
+		return nil, nil, fmt.Errorf("manifest digest mismatch: expected %s, got %s", reference, mRes.digest)
 	}
-	return mRes.Layers, nil
+	return raw, &mRes, nil
 }
 
-func findArchMatchingManifest(manifests []Manifest) (*Manifest, error) {
+func (d *DockerImageClient) getConfig(ctx context.Context, digest string) error {
+	if d.store.hasBlob(digest) {
+		return nil
+	}
+	url := fmt.Sprintf(dockerBlobsURL, d.registry, d.name, digest)
+	raw, err := doGetRaw(ctx, d.http, url, d.authHeaders())
+	if err != nil {
+		return fmt.Errorf("get config: %v", err)
+	}
+	return d.store.writeBlob(digest, raw)
+}
+
+// checkPlatform makes sure a single-arch image is for the platform asked
+// for with --platform. Without it, any image is taken as it is, since the
+// host may be able to run it under emulation.
+func (d *DockerImageClient) checkPlatform(configDigest string) error {
+	if !d.explicitPlatform {
+		return nil
+	}
+	raw, err := d.store.readBlob(configDigest)
+	if err != nil {
+		return err
+	}
+	var p Platform
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("decode image config: %v", err)
+	}
+	if p.Os != "" && !d.platform.matches(p) {
+		return fmt.Errorf("image %s is for %s, not %s", canonicalRef(d.name, d.reference), p, d.platform)
+	}
+	return nil
+}
+
+// authHeaders returns the headers that authorize a request to the
+// registry, if it needs any.
+func (d *DockerImageClient) authHeaders() map[string]string {
+	headers := make(map[string]string)
+	if d.token != "" {
+		headers["Authorization"] = "Bearer " + d.token
+	}
+	return headers
+}
+
+func findArchMatchingManifest(manifests []Manifest, platform Platform) (*Manifest, error) {
 	for _, m := range manifests {
-		if m.Platform.Os == runtime.GOOS && m.Platform.Arch == runtime.GOARCH {
+		if platform.matches(m.Platform) {
 			return &m, nil
 		}
 	}
 	return nil, fmt.Errorf("no matching manifest found")
 }
 
-func (d *DockerImageClient) pullLayers(layers []Layer) error {
-	eg, ctx := errgroup.WithContext(context.Background())
-	for _, layer := range layers {
+func (d *DockerImageClient) pullLayers(ctx context.Context, layers []Layer) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(d.maxConcurrentDownloads)
+	progress := make([]*layerProgress, len(layers))
+	for i, layer := range layers {
+		progress[i] = d.progress.add(layer.Digest, int64(layer.Size))
+	}
+	for i, layer := range layers {
+		lp := progress[i]
+		if d.store.hasBlob(layer.Digest) {
+			d.progress.setStatus(lp, "Already exists")
+			continue
+		}
 		eg.Go(func() error {
-			select {
-			case <-ctx.Done():
-				return nil
-			default:
-				url := fmt.Sprintf(dockerBlobsURL, d.name, layer.Digest)
-				req, err := http.NewRequest("GET", url, nil)
-				if err != nil {
-					return fmt.Errorf("pull layers: %v", err)
-				}
-				req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", d.token))
-				resp, err := d.http.Do(req)
-				if err != nil {
-					return fmt.Errorf("pull layers: %v", err)
-				}
-				defer resp.Body.Close()
-				if resp.StatusCode != http.StatusOK {
-					return fmt.Errorf("pull layers: %v", resp.StatusCode)
-				}
-				if err := d.saveLayer(layer.Digest, resp.Body); err != nil {
-					return fmt.Errorf("save layer: %v", err)
-				}
-				return nil
+			if err := d.downloadLayer(ctx, layer, lp); err != nil {
+				return fmt.Errorf("pull layer %s: %v", shortDigest(layer.Digest), err)
 			}
+			d.progress.setStatus(lp, "Pull complete")
+			return nil
 		})
 	}
-	if err := eg.Wait(); err != nil {
-		return err
-	}
-	return nil
+	return eg.Wait()
 }
 
-func (d *DockerImageClient) saveLayer(name string, content io.Reader) error {
-	fileName := fmt.Sprintf(layerFileName, name)
-	filePath := path.Join(d.dir, fileName)
-	file, err := os.Create(filePath)
+func doGet[T any](ctx context.Context, client *http.Client, url string, headers map[string]string, res *T) error {
+	raw, err := doGetRaw(ctx, client, url, headers)
 	if err != nil {
-		return fmt.Errorf("create file: %v", err)
-	}
-	defer file.Close()
-	fileWriter := bufio.NewWriter(file)
-	if _, err = io.Copy(fileWriter, content); err != nil {
-		return fmt.Errorf("copy file: %v", err)
+		return err
 	}
-	return d.extractLayer(filePath)
-}
-
-func (d *DockerImageClient) extractLayer(fileName string) error {
-	cmd := exec.Command("tar", "xvvf", fileName, "-C", d.dir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error while running tar command: %v", err)
+	if err := json.Unmarshal(raw, res); err != nil {
+		return fmt.Errorf("decode: %v", err)
 	}
-	return os.Remove(fileName)
+	return nil
 }
 
-func doGet[T any](client *http.Client, url string, headers map[string]string, res *T) (error) {
-	req, err := http.NewRequest("GET", url, nil)
+// doGetRaw fetches a small document such as a token or manifest, giving up
+// after requestTimeout.
+func doGetRaw(ctx context.Context, client *http.Client, url string, headers map[string]string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("new request: %v", err)
+		return nil, fmt.Errorf("new request: %v", err)
 	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("do request: %v", err)
+		return nil, fmt.Errorf("do request: %v", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("do request: %v", resp.StatusCode)
+		return nil, fmt.Errorf("do request: %v", resp.StatusCode)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
-		return fmt.Errorf("decode: %v", err)
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %v", err)
 	}
-	return nil
+	return raw, nil
 }
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Orders images lists images in.
+const (
+	imageSortName     = "name"
+	imageSortPulled   = "pulled"
+	imageSortLastUsed = "last-used"
+	imageSortSize     = "size"
+)
+
+// imagesCmd lists the images in the store. Sorted by last use, the least
+// recently used come first, in the order image prune --max-size would
+// remove them.
+func imagesCmd(args []string) int {
+	fs := flag.NewFlagSet("images", flag.ContinueOnError)
+	sortBy := fs.String("sort", imageSortName, "order to list images in: name, pulled (newest first), last-used (least recently used first) or size (largest first)")
+	quiet := fs.Bool("q", false, "only print image IDs")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: images [--sort name|pulled|last-used|size] [-q]")
+		return 2
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	images, err := store.list()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	switch *sortBy {
+	case imageSortName, imageSortPulled, imageSortLastUsed, imageSortSize:
+	default:
+		fmt.Printf("invalid --sort %q: must be name, pulled, last-used or size\n", *sortBy)
+		return 2
+	}
+	t := newTable("REPOSITORY", "TAG", "IMAGE ID", "PULLED", "LAST USED", "SIZE")
+	for _, img := range images {
+		// A registry's port comes before the last slash, and a tag after.
+		name, tag := img.Ref, "<none>"
+		if i := strings.LastIndex(name, ":"); !strings.Contains(name, "@") && i > strings.LastIndex(name, "/") {
+			name, tag = name[:i], name[i+1:]
+		} else {
+			name, _, _ = strings.Cut(name, "@")
+		}
+		lastUsed := "never"
+		if !img.LastUsed.IsZero() {
+			lastUsed = since(img.LastUsed) + " ago"
+		}
+		size := store.imageSize(img)
+		t.add(name, tag, shortDigest(img.ID()), since(img.PulledAt)+" ago", lastUsed, formatBytes(size)).
+			key(imageSortPulled, img.PulledAt).key(imageSortLastUsed, img.lastUsed()).key(imageSortSize, size)
+	}
+	switch *sortBy {
+	case imageSortPulled, imageSortSize:
+		t.sort(*sortBy, true)
+	case imageSortLastUsed:
+		t.sort(*sortBy, false)
+	}
+	if *quiet {
+		for _, r := range t.rows {
+			fmt.Println(r.cells[2])
+		}
+		return 0
+	}
+	t.write(os.Stdout, useColor(os.Stdout))
+	return 0
+}
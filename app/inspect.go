@@ -0,0 +1,325 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Kinds of object inspect can look up.
+const (
+	inspectContainer = "container"
+	inspectImage     = "image"
+)
+
+// inspectNamespaces are the namespaces of a running container's init that
+// inspect reports.
+var inspectNamespaces = []string{"cgroup", "ipc", "mnt", "net", "pid", "user", "uts"}
+
+// containerInspect is what inspect prints for a container.
+type containerInspect struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Path    string    `json:"path"`
+	Args    []string  `json:"args"`
+	State   struct {
+		Status       string       `json:"status"`
+		Running      bool         `json:"running"`
+		Restarting   bool         `json:"restarting"`
+		Pid          int          `json:"pid"`
+		ExitCode     int          `json:"exitCode"`
+		TimedOut     bool         `json:"timedOut,omitempty"`
+		StartedAt    time.Time    `json:"startedAt"`
+		FinishedAt   time.Time    `json:"finishedAt"`
+		RestartCount int          `json:"restartCount"`
+		Health       *HealthState `json:"health,omitempty"`
+	} `json:"state"`
+	Image struct {
+		ID     string   `json:"id"`
+		Ref    string   `json:"ref,omitempty"`
+		Digest string   `json:"digest,omitempty"`
+		Layers []string `json:"layers,omitempty"`
+	} `json:"image"`
+	Rootfs string  `json:"rootfs"`
+	Mounts []Mount `json:"mounts"`
+	// Namespaces maps each namespace type to the namespace init is in,
+	// while the container runs.
+	Namespaces   map[string]string `json:"namespaces,omitempty"`
+	Cgroup       string            `json:"cgroup,omitempty"`
+	Network      *NetworkSettings  `json:"network,omitempty"`
+	Ports        []string          `json:"ports,omitempty"`
+	Healthcheck  *HealthConfig     `json:"healthcheck,omitempty"`
+	Resources    []Resource        `json:"resources,omitempty"`
+	ProcessLabel string            `json:"processLabel,omitempty"`
+	MountLabel   string            `json:"mountLabel,omitempty"`
+	LogPath      string            `json:"logPath"`
+	Config       ContainerConfig   `json:"config"`
+}
+
+// imageInspect is what inspect prints for an image.
+type imageInspect struct {
+	ID       string    `json:"id"`
+	Ref      string    `json:"ref"`
+	Digest   string    `json:"digest"`
+	Manifest string    `json:"manifest"`
+	Layers   []string  `json:"layers"`
+	Size     int64     `json:"size"`
+	PulledAt time.Time `json:"pulledAt"`
+	LastUsed time.Time `json:"lastUsed,omitempty"`
+	// Config is the image's config blob as the registry served it.
+	Config json.RawMessage `json:"config"`
+}
+
+// inspectCmd prints detailed information about containers and images as a
+// JSON array, or with --format, the result of a Go template run over each
+// of them in turn. The template sees the same fields the JSON has, as in
+// {{.state.pid}} or {{.image.digest}}. With --spec, it prints the runtime
+// spec of containers instead.
+func inspectCmd(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	format := fs.String("format", "", "Go template to print for each object instead of JSON")
+	kind := fs.String("type", "", "only look for a container or an image")
+	spec := fs.Bool("spec", false, "print the runtime spec of containers: the process, mounts, capabilities and namespaces their flags make, and once running, what they got")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Println("usage: inspect [--format TEMPLATE] [--type container|image] [--spec] <container|image>...")
+		return 2
+	}
+	if *kind != "" && *kind != inspectContainer && *kind != inspectImage {
+		fmt.Printf("invalid --type %q: expected %s or %s\n", *kind, inspectContainer, inspectImage)
+		return 2
+	}
+	if *spec && *kind == inspectImage {
+		fmt.Println("--spec is only for containers")
+		return 2
+	}
+	var tmpl *template.Template
+	if *format != "" {
+		var err error
+		tmpl, err = template.New("format").Funcs(inspectFuncs).Option("missingkey=error").Parse(*format)
+		if err != nil {
+			fmt.Printf("invalid --format: %v\n", err)
+			return 2
+		}
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var docs []interface{}
+	code := 0
+	for _, ref := range fs.Args() {
+		var doc interface{}
+		if *spec {
+			var c *Container
+			if c, err = findContainer(ref); err == nil {
+				doc = containerSpec(c)
+			}
+		} else {
+			doc, err = inspectObject(store, ref, *kind)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if tmpl == nil {
+		data, err := json.MarshalIndent(docs, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if docs != nil {
+			fmt.Println(string(data))
+		}
+		return code
+	}
+	for _, doc := range docs {
+		out, err := executeInspectTemplate(tmpl, doc)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(out)
+	}
+	return code
+}
+
+// inspectObject looks ref up as a container and then as an image, unless
+// kind says which it is.
+func inspectObject(store *imageStore, ref, kind string) (interface{}, error) {
+	if kind != inspectImage {
+		c, err := findContainer(ref)
+		if err == nil {
+			return inspectContainerDoc(store, c), nil
+		}
+		if kind == inspectContainer {
+			return nil, err
+		}
+	}
+	img, err := findImage(store, ref)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		if kind == inspectImage {
+			return nil, fmt.Errorf("no such image: %s", ref)
+		}
+		return nil, fmt.Errorf("no such object: %s", ref)
+	}
+	return inspectImageDoc(store, img)
+}
+
+func inspectContainerDoc(store *imageStore, c *Container) *containerInspect {
+	doc := &containerInspect{
+		ID:           c.ID,
+		Name:         c.name(),
+		Created:      c.CreatedAt,
+		Path:         c.Config.Command,
+		Args:         c.Config.Args,
+		Rootfs:       c.Rootfs,
+		Mounts:       c.Config.Mounts,
+		Cgroup:       c.Cgroup,
+		Network:      c.Network,
+		Ports:        c.ports(),
+		Healthcheck:  healthConfig(c),
+		Resources:    c.Resources,
+		ProcessLabel: c.ProcessLabel,
+		MountLabel:   c.MountLabel,
+		LogPath:      c.logPath(),
+		Config:       c.Config,
+	}
+	doc.State.Status = c.Status
+	doc.State.Running = c.running()
+	doc.State.Restarting = c.Status == statusRestarting
+	doc.State.ExitCode = c.ExitCode
+	doc.State.TimedOut = c.TimedOut
+	doc.State.StartedAt = c.StartedAt
+	doc.State.FinishedAt = c.FinishedAt
+	doc.State.RestartCount = c.RestartCount
+	doc.State.Health = c.health()
+	if c.running() {
+		doc.State.Pid = c.Pid
+		doc.Namespaces = make(map[string]string)
+		for _, ns := range inspectNamespaces {
+			if link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", c.Pid, ns)); err == nil {
+				doc.Namespaces[ns] = link
+			}
+		}
+	}
+	doc.Image.ID = c.ImageID
+	if c.ImageID == "" {
+		return doc
+	}
+	// The image the container was created from may have been pulled again
+	// or removed since, so only one with the same ID counts.
+	images, _ := store.list()
+	for _, img := range images {
+		if img.ID() != c.ImageID {
+			continue
+		}
+		if doc.Image.Ref == "" || img.Ref == normalizeRef(c.Config.Image) {
+			doc.Image.Ref = img.Ref
+			doc.Image.Digest = img.Digest
+			doc.Image.Layers = img.Layers
+		}
+	}
+	return doc
+}
+
+func inspectImageDoc(store *imageStore, img *Image) (*imageInspect, error) {
+	config, err := store.readBlob(img.Config)
+	if err != nil {
+		return nil, err
+	}
+	doc := &imageInspect{
+		ID:       img.ID(),
+		Ref:      img.Ref,
+		Digest:   img.Digest,
+		Manifest: img.Manifest,
+		Layers:   img.Layers,
+		Size:     store.imageSize(img),
+		PulledAt: img.PulledAt,
+		LastUsed: img.LastUsed,
+		Config:   config,
+	}
+	return doc, nil
+}
+
+// findImage resolves an image reference, or failing that an image ID or a
+// unique prefix of one, with or without its sha256: prefix. It returns nil
+// if nothing matches.
+func findImage(store *imageStore, ref string) (*Image, error) {
+	if img, err := store.lookup(ref); err != nil || img != nil {
+		return img, err
+	}
+	images, err := store.list()
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimPrefix(ref, "sha256:")
+	var match *Image
+	for _, img := range images {
+		if id == "" || !strings.HasPrefix(strings.TrimPrefix(img.ID(), "sha256:"), id) {
+			continue
+		}
+		if match != nil && match.ID() != img.ID() {
+			return nil, fmt.Errorf("multiple images match prefix %q", ref)
+		}
+		match = img
+	}
+	return match, nil
+}
+
+// inspectFuncs are the functions --format templates can use besides the
+// built-in ones.
+var inspectFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join": func(v []interface{}, sep string) string {
+		parts := make([]string, len(v))
+		for i, p := range v {
+			parts[i] = fmt.Sprint(p)
+		}
+		return strings.Join(parts, sep)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// executeInspectTemplate runs tmpl over doc as it appears in the JSON
+// output, so that templates use the same field names. Numbers are kept as
+// they were written rather than turned into floats.
+func executeInspectTemplate(tmpl *template.Template, doc interface{}) (string, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, v); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
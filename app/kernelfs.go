@@ -0,0 +1,149 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// kernelFSFlags are the flags /proc and /sys are mounted with.
+const kernelFSFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+
+// maskedPaths are hidden from a container that isn't privileged, as Docker
+// does: they expose the host's memory, keys and hardware, which a
+// container's own procfs and sysfs don't namespace.
+var maskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// readOnlyPaths are what a container that isn't privileged can read but
+// not change, since writing to them would change the host.
+var readOnlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// mountKernelFS mounts a procfs for the container's PID namespace at /proc
+// and sysfs at /sys, read-only unless the container is privileged, then
+// masks the parts of them that belong to the host. It must run inside the
+// container's mount namespace, before the root is switched.
+func mountKernelFS(c *Container) error {
+	proc, err := securePath(c.Rootfs, "/proc")
+	if err != nil {
+		return fmt.Errorf("resolve /proc: %v", err)
+	}
+	if err := os.MkdirAll(proc, 0555); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	if err := syscall.Mount("proc", proc, "proc", kernelFSFlags, ""); err != nil {
+		return fmt.Errorf("mount /proc: %v", err)
+	}
+	if err := mountSysfs(c); err != nil {
+		return err
+	}
+	if c.Config.Privileged {
+		return nil
+	}
+	for _, p := range maskedPaths {
+		if err := maskPath(c.Rootfs, p); err != nil {
+			return err
+		}
+	}
+	for _, p := range readOnlyPaths {
+		if err := readOnlyPath(c.Rootfs, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountSysfs mounts sysfs at /sys. Only the owner of the network namespace
+// may mount sysfs, so a rootless container on the host's network gets the
+// host's /sys bind-mounted instead.
+func mountSysfs(c *Container) error {
+	sys, err := securePath(c.Rootfs, "/sys")
+	if err != nil {
+		return fmt.Errorf("resolve /sys: %v", err)
+	}
+	if err := os.MkdirAll(sys, 0555); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	flags := uintptr(kernelFSFlags)
+	if !c.Config.Privileged {
+		flags |= syscall.MS_RDONLY
+	}
+	err = syscall.Mount("sysfs", sys, "sysfs", flags, "")
+	if err == syscall.EPERM {
+		if err := syscall.Mount("/sys", sys, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount /sys: %v", err)
+		}
+		err = syscall.Mount("", sys, "", flags|syscall.MS_BIND|syscall.MS_REMOUNT, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mount /sys: %v", err)
+	}
+	return nil
+}
+
+// maskPath hides p under rootfs, covering a file with /dev/null and a
+// directory with an empty read-only tmpfs. Paths the kernel doesn't have
+// are left alone.
+func maskPath(rootfs, p string) error {
+	target, err := securePath(rootfs, p)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %v", p, err)
+	}
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("mask %s: %v", p, err)
+	}
+	if fi.IsDir() {
+		err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "size=0")
+	} else {
+		err = syscall.Mount("/dev/null", target, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mask %s: %v", p, err)
+	}
+	return nil
+}
+
+// readOnlyPath makes p under rootfs read-only by remounting a bind mount of
+// it onto itself.
+func readOnlyPath(rootfs, p string) error {
+	target, err := securePath(rootfs, p)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %v", p, err)
+	}
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return nil
+	}
+	if err := syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %v", p, err)
+	}
+	flags := uintptr(kernelFSFlags | syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %v", p, err)
+	}
+	return nil
+}
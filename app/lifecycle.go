@@ -0,0 +1,321 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Orders ps lists containers in, besides the order they were listed in.
+const (
+	psSortCreated = "created"
+	psSortSize    = "size"
+	psSortName    = "name"
+)
+
+func psCmd(args []string) int {
+	fs := flag.NewFlagSet("ps", flag.ContinueOnError)
+	all := fs.Bool("a", false, "show all containers, not just running ones")
+	sortBy := fs.String("sort", "", "order to list containers in: created (newest first), size (largest first, with a SIZE column) or name")
+	project := addProjectFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := validateProject(*project); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	switch *sortBy {
+	case "", psSortCreated, psSortSize, psSortName:
+	default:
+		fmt.Printf("invalid --sort %q: must be created, size or name\n", *sortBy)
+		return 2
+	}
+	containers, err := listContainers()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	header := []string{"CONTAINER ID", "IMAGE", "COMMAND", "CREATED", "STATUS", "PORTS", "NAMES"}
+	// Adding up a container's files takes a walk of its rootfs, so it is
+	// only done when asked for.
+	withSize := *sortBy == psSortSize
+	if withSize {
+		header = append(header, "SIZE")
+	}
+	t := newTable(header...)
+	for _, c := range containers {
+		if !*all && !c.running() && c.Status != statusRestarting {
+			continue
+		}
+		if !c.inProject(*project) {
+			continue
+		}
+		command := strings.Join(append([]string{c.Config.Command}, c.Config.Args...), " ")
+		image := c.Config.Image
+		if image == "" {
+			image = c.Config.RootfsPath
+		}
+		cells := []string{c.shortID(), image, fmt.Sprintf("%q", command), since(c.CreatedAt) + " ago", statusString(c), strings.Join(c.ports(), ", "), c.name()}
+		var size int64
+		if withSize {
+			size = c.diskUsage()
+			cells = append(cells, formatBytes(size))
+		}
+		r := t.add(cells...).key(psSortCreated, c.CreatedAt).key(psSortSize, size).key(psSortName, c.name())
+		if color := statusColor(c); color != "" {
+			r.color(4, color)
+		}
+	}
+	switch *sortBy {
+	case psSortCreated, psSortSize:
+		t.sort(*sortBy, true)
+	case psSortName:
+		t.sort(*sortBy, false)
+	}
+	t.write(os.Stdout, useColor(os.Stdout))
+	return 0
+}
+
+// statusColor is the color of c's status in ps: green while it runs, yellow
+// while it is unhealthy or restarting and red once it has exited.
+func statusColor(c *Container) string {
+	switch c.Status {
+	case statusRunning:
+		if h := c.health(); h != nil && h.Status == healthUnhealthy {
+			return colorYellow
+		}
+		return colorGreen
+	case statusRestarting:
+		return colorYellow
+	case statusExited:
+		return colorRed
+	}
+	return ""
+}
+
+func statusString(c *Container) string {
+	switch c.Status {
+	case statusRunning:
+		status := fmt.Sprintf("Up %s", since(c.StartedAt))
+		if c.RestartCount > 0 {
+			status += fmt.Sprintf(" (restarted %d times)", c.RestartCount)
+		}
+		if h := c.health(); h != nil {
+			if h.Status == healthStarting {
+				return status + " (health: starting)"
+			}
+			return status + " (" + h.Status + ")"
+		}
+		return status
+	case statusRestarting:
+		return fmt.Sprintf("Restarting (%d) %s ago", c.ExitCode, since(c.FinishedAt))
+	case statusExited:
+		status := "Exited"
+		if c.TimedOut {
+			status = "Timed out"
+		}
+		if c.FinishedAt.IsZero() {
+			return fmt.Sprintf("%s (%d)", status, c.ExitCode)
+		}
+		return fmt.Sprintf("%s (%d) %s ago", status, c.ExitCode, since(c.FinishedAt))
+	case statusWarm:
+		return "Warm"
+	default:
+		return "Created"
+	}
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return formatAge(time.Since(t))
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%d seconds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+}
+
+func stopCmd(args []string) int {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	timeout := fs.Int("time", -1, "seconds to wait before killing the container (defaults to its --stop-timeout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: stop [--time N] <id>")
+		return 2
+	}
+	c, err := findContainer(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	t := c.Config.StopTimeout
+	if *timeout >= 0 {
+		t = *timeout
+	}
+	if err := stopContainer(c, time.Duration(t)*time.Second); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(c.ID)
+	return 0
+}
+
+// stopContainer sends SIGTERM to the container's process group and falls
+// back to SIGKILL once timeout has passed. The container is marked as
+// stopped first so that its shim neither restarts it nor reports its exit
+// as a failure, and one waiting to be restarted is only marked.
+func stopContainer(c *Container, timeout time.Duration) error {
+	if c.running() || c.Status == statusRestarting {
+		if err := c.markStopped(); err != nil {
+			return err
+		}
+	}
+	if c.Status == statusRestarting {
+		return c.markExited(c.ExitCode)
+	}
+	if !c.running() {
+		return nil
+	}
+	if err := signalContainer(c, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("stop: %v", err)
+	}
+	if waitExited(c, timeout) {
+		recordContainerEvent(c, eventStop, nil)
+		return nil
+	}
+	if err := signalContainer(c, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("kill: %v", err)
+	}
+	if !waitExited(c, 5*time.Second) {
+		return fmt.Errorf("container %s did not exit", c.shortID())
+	}
+	recordContainerEvent(c, eventStop, nil)
+	return nil
+}
+
+// signalContainer signals the container's process group, falling back to
+// the process itself if it is no longer a group leader.
+func signalContainer(c *Container, sig syscall.Signal) error {
+	err := syscall.Kill(-c.Pid, sig)
+	if err == syscall.ESRCH {
+		err = syscall.Kill(c.Pid, sig)
+	}
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+func waitExited(c *Container, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !processAlive(c.Pid) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func rmCmd(args []string) int {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	force := fs.Bool("f", false, "kill the container first if it is running")
+	purge := fs.Bool("purge", false, "delete the container for good instead of moving it to the trash")
+	retention := fs.Duration("retention", defaultTrashRetention, "how long the trash keeps the container for container restore")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Println("usage: rm [-f] [--purge] <id>...")
+		return 2
+	}
+	if *retention <= 0 {
+		*purge = true
+	}
+	code := 0
+	for _, ref := range fs.Args() {
+		if err := removeContainer(ref, *force, *purge, *retention); err != nil {
+			fmt.Println(err)
+			code = 1
+			continue
+		}
+		fmt.Println(ref)
+	}
+	if err := purgeTrash(false); err != nil {
+		fmt.Println(err)
+		code = 1
+	}
+	return code
+}
+
+// removeContainer removes the container ref names, into the trash for
+// retention unless purge is set.
+func removeContainer(ref string, force, purge bool, retention time.Duration) error {
+	c, err := findContainer(ref)
+	if err != nil {
+		return err
+	}
+	if c.running() || c.Status == statusRestarting {
+		if !force {
+			return fmt.Errorf("container %s is %s: stop it first or use rm -f", c.shortID(), c.Status)
+		}
+		if err := stopContainer(c, 0); err != nil {
+			return err
+		}
+	}
+	if err := c.releaseResources(); err != nil && !force {
+		return err
+	}
+	if purge {
+		return c.remove()
+	}
+	return c.moveToTrash(retention)
+}
+
+func logsCmd(args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "keep printing output as it is logged until the container exits")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: logs [-f] <id>")
+		return 2
+	}
+	c, err := findContainer(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *follow {
+		err = followLogs(c, os.Stdout, os.Stderr)
+	} else {
+		err = readLogs(c, os.Stdout, os.Stderr)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,384 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Log drivers a container can use.
+const (
+	logDriverJSONFile = "json-file"
+	logDriverNone     = "none"
+)
+
+// LogConfig says where a container's output is kept.
+type LogConfig struct {
+	Driver string `json:"driver"`
+	// MaxSize is the size in bytes at which the log is rotated, or 0 to
+	// let it grow. MaxFile is how many files, the current one included,
+	// are kept when it is.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	MaxFile int   `json:"maxFile,omitempty"`
+}
+
+// parseLogConfig parses --log-driver and the key=value --log-opt flags.
+func parseLogConfig(driver string, opts []string) (LogConfig, error) {
+	cfg := LogConfig{Driver: driver, MaxFile: 1}
+	if driver != logDriverJSONFile && driver != logDriverNone {
+		return cfg, fmt.Errorf("invalid --log-driver %q: expected %s or %s", driver, logDriverJSONFile, logDriverNone)
+	}
+	for _, opt := range opts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid --log-opt %q: expected key=value", opt)
+		}
+		if driver == logDriverNone {
+			return cfg, fmt.Errorf("invalid --log-opt %q: the %s driver takes no options", opt, driver)
+		}
+		switch key {
+		case "max-size":
+			size, err := parseByteSize(value)
+			if err != nil || size <= 0 {
+				return cfg, fmt.Errorf("invalid --log-opt %q: expected a size such as 10m", opt)
+			}
+			cfg.MaxSize = size
+		case "max-file":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return cfg, fmt.Errorf("invalid --log-opt %q: expected a positive number", opt)
+			}
+			cfg.MaxFile = n
+		default:
+			return cfg, fmt.Errorf("invalid --log-opt %q: unknown option %q", opt, key)
+		}
+	}
+	if cfg.MaxFile > 1 && cfg.MaxSize == 0 {
+		return cfg, fmt.Errorf("invalid --log-opt: max-file needs max-size")
+	}
+	return cfg, nil
+}
+
+// parseByteSize parses a number of bytes with an optional k, m or g suffix,
+// in powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// logEntry is one line of a json-file log, in the format Docker uses.
+type logEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// containerLogger writes a container's output to its log, one entry per
+// line, rotating the file as it grows.
+type containerLogger struct {
+	config LogConfig
+	path   string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newContainerLogger(c *Container) (*containerLogger, error) {
+	l := &containerLogger{config: c.Config.Log, path: c.logPath()}
+	if l.config.Driver == logDriverNone {
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *containerLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open log: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open log: %v", err)
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *containerLogger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+func (l *containerLogger) log(stream string, line []byte) error {
+	if l.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(logEntry{Log: string(line), Stream: stream, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.MaxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// rotate moves the current file to path.1, shifting the older ones up and
+// dropping the oldest, and starts a new one.
+func (l *containerLogger) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if l.config.MaxFile <= 1 {
+		os.Remove(l.path)
+	} else {
+		for i := l.config.MaxFile - 1; i > 1; i-- {
+			os.Rename(rotatedLogPath(l.path, i-1), rotatedLogPath(l.path, i))
+		}
+		if err := os.Rename(l.path, rotatedLogPath(l.path, 1)); err != nil {
+			return fmt.Errorf("rotate log: %v", err)
+		}
+	}
+	return l.open()
+}
+
+func rotatedLogPath(p string, i int) string {
+	return fmt.Sprintf("%s.%d", p, i)
+}
+
+// stream returns a writer that logs what is written to it as the named
+// stream and copies it unchanged to tee if that is set. Output is logged a
+// line at a time; Close logs whatever is left of a line without an end.
+func (l *containerLogger) stream(name string, tee io.Writer) *logStream {
+	return &logStream{logger: l, name: name, tee: tee}
+}
+
+type logStream struct {
+	logger  *containerLogger
+	name    string
+	tee     io.Writer
+	pending []byte
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	if s.tee != nil {
+		// A reader gone away shouldn't stop the container's output from
+		// being logged.
+		s.tee.Write(p)
+	}
+	s.pending = append(s.pending, p...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
+			break
+		}
+		if err := s.logger.log(s.name, s.pending[:i+1]); err != nil {
+			return 0, err
+		}
+		s.pending = s.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+func (s *logStream) Close() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	err := s.logger.log(s.name, s.pending)
+	s.pending = nil
+	return err
+}
+
+// pipeTo returns the write end of a pipe whose output goes to w, for a
+// process that needs its output to be a file. The returned function closes
+// the parent's copy of the write end and waits for the process's copies to
+// be closed too and everything written to reach w.
+func pipeTo(w io.WriteCloser) (*os.File, func(), error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("pipe: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(w, pr)
+		pr.Close()
+		w.Close()
+		close(done)
+	}()
+	return pw, func() {
+		pw.Close()
+		<-done
+	}, nil
+}
+
+// readLogs writes the container's logged output to stdout and stderr
+// according to the stream it came from, oldest first.
+func readLogs(c *Container, stdout, stderr io.Writer) error {
+	if c.Config.Log.Driver == logDriverNone {
+		return fmt.Errorf("container %s was run with the %s log driver, which keeps no logs", c.shortID(), logDriverNone)
+	}
+	for i := max(c.Config.Log.MaxFile, 1) - 1; i >= 0; i-- {
+		p := c.logPath()
+		if i > 0 {
+			p = rotatedLogPath(p, i)
+		}
+		t, err := openLogTail(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = t.copy(stdout, stderr)
+		t.f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followLogs writes the container's output as it is logged, after what
+// was logged before, until the container exits. It carries on in the new
+// file when the log is rotated.
+func followLogs(c *Container, stdout, stderr io.Writer) error {
+	if c.Config.Log.Driver == logDriverNone {
+		return readLogs(c, stdout, stderr)
+	}
+	for i := c.Config.Log.MaxFile - 1; i > 0; i-- {
+		t, err := openLogTail(rotatedLogPath(c.logPath(), i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = t.copy(stdout, stderr)
+		t.f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	var t *logTail
+	defer func() {
+		if t != nil {
+			t.f.Close()
+		}
+	}()
+	for {
+		if t != nil {
+			if err := t.copy(stdout, stderr); err != nil {
+				return err
+			}
+		}
+		current, err := os.Stat(c.logPath())
+		if err == nil && (t == nil || !sameFile(t.f, current)) {
+			// The log was created or rotated. What was written to the old
+			// file before that has been copied above.
+			if t != nil {
+				t.f.Close()
+			}
+			if t, err = openLogTail(c.logPath()); err != nil {
+				return err
+			}
+			continue
+		}
+		if latest, err := loadContainer(c.ID); err != nil || !latest.running() {
+			if t == nil {
+				return nil
+			}
+			return t.copy(stdout, stderr)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func sameFile(f *os.File, fi os.FileInfo) bool {
+	open, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	a, b := open.Sys().(*syscall.Stat_t), fi.Sys().(*syscall.Stat_t)
+	return a.Dev == b.Dev && a.Ino == b.Ino
+}
+
+// logTail reads a log file that may still be written to.
+type logTail struct {
+	f *os.File
+	// pending is the start of an entry that isn't completely written yet.
+	pending []byte
+}
+
+func openLogTail(p string) (*logTail, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &logTail{f: f}, nil
+}
+
+// copy writes out the entries written to the file since the last call.
+func (t *logTail) copy(stdout, stderr io.Writer) error {
+	data, err := io.ReadAll(t.f)
+	if err != nil {
+		return fmt.Errorf("read log: %v", err)
+	}
+	t.pending = append(t.pending, data...)
+	for {
+		i := bytes.IndexByte(t.pending, '\n')
+		if i < 0 {
+			return nil
+		}
+		var e logEntry
+		if err := json.Unmarshal(t.pending[:i], &e); err != nil {
+			// Logs written before the json-file format are plain text.
+			e = logEntry{Log: string(t.pending[:i+1]), Stream: "stdout"}
+		}
+		t.pending = t.pending[i+1:]
+		w := stdout
+		if e.Stream == "stderr" {
+			w = stderr
+		}
+		io.WriteString(w, e.Log)
+	}
+}
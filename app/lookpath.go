@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks is how many symlinks resolveInRoot follows before giving up,
+// as the kernel does with ELOOP.
+const maxSymlinks = 40
+
+// lookPathIn finds file in the directories of pathEnv the way the
+// container would, in the filesystem under root. It returns the path to
+// run in the container, and fails with the error exec.LookPath gives, which
+// is what Docker prints. A file with a slash in it is left for exec to
+// find or not. Relative PATH entries are skipped, as exec.LookPath refuses
+// what they find.
+func lookPathIn(root, file, pathEnv string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	if file != "" {
+		for _, dir := range filepath.SplitList(pathEnv) {
+			if !path.IsAbs(dir) {
+				continue
+			}
+			candidate := path.Join(dir, file)
+			resolved, err := resolveInRoot(root, candidate)
+			if err != nil {
+				continue
+			}
+			fi, err := os.Stat(path.Join(root, resolved))
+			if err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+				return candidate, nil
+			}
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+// resolveInRoot resolves the symlinks in p as if root were the root
+// directory, so that an absolute link such as /bin/ls -> /bin/busybox
+// leads to root's busybox rather than the host's. It returns the resolved
+// path relative to root.
+func resolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		switch name := parts[i]; name {
+		case "", ".":
+		case "..":
+			resolved = path.Dir(resolved)
+		default:
+			next := path.Join(resolved, name)
+			fi, err := os.Lstat(path.Join(root, next))
+			if err != nil {
+				return "", err
+			}
+			if fi.Mode()&os.ModeSymlink == 0 {
+				resolved = next
+				continue
+			}
+			if links++; links > maxSymlinks {
+				return "", &os.PathError{Op: "resolve", Path: p, Err: syscall.ELOOP}
+			}
+			target, err := os.Readlink(path.Join(root, next))
+			if err != nil {
+				return "", err
+			}
+			if path.IsAbs(target) {
+				resolved = "/"
+			}
+			parts = append(strings.Split(target, "/"), parts[i+1:]...)
+			i = -1
+		}
+	}
+	return resolved, nil
+}
+
+// envPath returns the PATH env sets, or the default PATH if it sets none.
+func envPath(env []string) string {
+	pathEnv := defaultPath
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			pathEnv = value
+		}
+	}
+	return pathEnv
+}
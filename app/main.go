@@ -6,46 +6,128 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"syscall"
 )
 
-// Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...
+// Usage: your_docker.sh <command> [options] [args...]
+//
+//	run [options] <image> <command> <arg1> <arg2> ...
+//	pull [options] [--path PATH... -o DIR] <image>
+//	save [-o file] <image>...
+//	load [-i file]
+//	ps [-a] [--sort created|size|name] [--project NAME]
+//	stop [--time N] <id>
+//	rm [-f] [--purge] [--retention DURATION] <id>...
+//	logs [-f] <id>
+//	exec [--timeout DURATION] [-u USER] [-w DIR] <id> <command> <arg1> <arg2> ...
+//	inspect [--format TEMPLATE] [--type container|image] [--spec] <container|image>...
+//	events [--since TIME] [--filter KEY=VALUE]... [--format json|TEMPLATE]
+//	debug [--image IMAGE] <id> [command] [args...]
+//	network capture <id> [-o file.pcap] [-i iface] [-c count]
+//	system doctor [--fix]
+//	system graph [--format dot|mermaid] [-a] [--project NAME]
+//	system backup [-o file] [--include KINDS] [--exclude KINDS] [--project NAME]
+//	system restore [-i file] [--include KINDS] [--exclude KINDS]
+//	system prune [-a] [--project NAME]
+//	system encrypt init [--size SIZE] [--key-file FILE]
+//	system encrypt unlock [--key-file FILE]
+//	system encrypt lock
+//	system encrypt status
+//	system migrate [--dry-run]
+//	system notify [--desktop] [--ntfy URL] [--ntfy-token TOKEN] [--gotify URL] [--gotify-token TOKEN] [--off] [--test]
+//	system dns [--upstream URL]... [--off] [--test NAME]
+//	system bench [--image IMAGE] [--iterations N] [--only LIST] [--command CMD] [--format table|json]
+//	pool [--size N] [--network MODE] [--rootless] <image>...
+//	container prune [--project NAME]
+//	container restore [--name NAME] <id>
+//	container trash [--empty]
+//	images [--sort name|pulled|last-used|size] [-q]
+//	manifest inspect [--raw] [--registry-mirror URL] [--registry-ca FILE]... [--insecure-registry HOST]... <image>
+//	image ls [--sort name|pulled|last-used|size] [-q]
+//	image prune [-a] [--max-size SIZE]
+//	image copy [-q] [--registry-mirror URL] [--registry-ca FILE]... [--insecure-registry HOST]... docker://SRC docker://DST|oci:DIR[:TAG]
+//	commit [--squash] <id> <name:tag>
+//	stats [--no-stream] [id...]
+//	daemon [--socket PATH] [--key-file FILE] [--read-only] [--multi-user] [--rate-limit N] [--max-concurrent N] [--max-queued N] [--policy FILE] [--log-level info|debug]
 func main() {
-	imageName, command,	args := parseArgs(os.Args[1:])
-	dir, err := os.MkdirTemp("", "tmp")
-	if err != nil {
-		fmt.Printf("mkdir: %v", err)
-		os.Exit(1)
+	if len(os.Args) < 2 {
+		fmt.Println("usage: your_docker.sh <run|pull|save|load|ps|stop|rm|logs|exec|inspect|events|debug|network|system|pool|container|image|images|manifest|commit|stats|daemon> [args...]")
+		os.Exit(2)
 	}
-	imageClient := newDockerImageClient(imageName, dir)
-	err = imageClient.Pull()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	args := os.Args[2:]
+	// The daemon unlocks the store itself, and init runs in a container
+	// whose store is already unlocked.
+	manageStore := os.Args[1] == "system" && len(args) > 0 && args[0] == "encrypt"
+	if os.Args[1] != "daemon" && os.Args[1] != "init" && !manageStore {
+		if err := checkStoreUnlocked(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// system migrate --dry-run looks at the state as it is.
+		migrating := os.Args[1] == "system" && len(args) > 0 && args[0] == "migrate"
+		if !migrating {
+			if err := migrateState(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if err := checkWorkDirs(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
-	err = chroot(command, dir)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	switch os.Args[1] {
+	case "run":
+		os.Exit(runCmd(args))
+	case "pull":
+		os.Exit(pullCmd(args))
+	case "save":
+		os.Exit(saveCmd(args))
+	case "load":
+		os.Exit(loadCmd(args))
+	case "ps":
+		os.Exit(psCmd(args))
+	case "stop":
+		os.Exit(stopCmd(args))
+	case "rm":
+		os.Exit(rmCmd(args))
+	case "logs":
+		os.Exit(logsCmd(args))
+	case "exec":
+		os.Exit(execCmd(args))
+	case "inspect":
+		os.Exit(inspectCmd(args))
+	case "events":
+		os.Exit(eventsCmd(args))
+	case "debug":
+		os.Exit(debugCmd(args))
+	case "network":
+		os.Exit(networkCmd(args))
+	case "system":
+		os.Exit(systemCmd(args))
+	case "pool":
+		os.Exit(poolCmd(args))
+	case "container":
+		os.Exit(containerCmd(args))
+	case "image":
+		os.Exit(imageCmd(args))
+	case "commit":
+		os.Exit(commitCmd(args))
+	case "stats":
+		os.Exit(statsCmd(args))
+	case "images":
+		os.Exit(imagesCmd(args))
+	case "manifest":
+		os.Exit(manifestCmd(args))
+	case "daemon":
+		os.Exit(daemonCmd(args))
+	case "init":
+		os.Exit(initCmd(args))
+	case "shim":
+		os.Exit(shimCmd(args))
+	case "reap":
+		os.Exit(reapCmd(args))
+	default:
+		fmt.Printf("unknown command: %s\n", os.Args[1])
+		os.Exit(2)
 	}
-	cmd := exec.Command(command, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
-	}
-	err = cmd.Run()
-	if err != nil {
-		fmt.Printf("cmd run: %v", err)
-		os.Exit(cmd.ProcessState.ExitCode())
-	}
-}
-
-func parseArgs(args []string) (string, string, []string) {
-	imageName := args[1]
-	command := args[2]
-	args = args[3:]
-	return imageName, command, args
 }
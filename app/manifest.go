@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifestCmd dispatches the manifest subcommands.
+func manifestCmd(args []string) int {
+	if len(args) < 1 || args[0] != "inspect" {
+		fmt.Println("usage: manifest inspect [--raw] [--registry-mirror URL] <image>")
+		return 2
+	}
+	return manifestInspectCmd(args[1:])
+}
+
+// manifestInspectCmd shows what the registry serves for an image: for a
+// multi-arch image the index, with every platform's manifest, and otherwise
+// the manifest with its config and layers. It fetches the document without
+// pulling anything, which makes it the way to check what a multi-arch
+// publication actually put in the registry.
+func manifestInspectCmd(args []string) int {
+	fs := flag.NewFlagSet("manifest inspect", flag.ContinueOnError)
+	raw := fs.Bool("raw", false, "print the document exactly as the registry served it")
+	var o PullOptions
+	fs.StringVar(&o.RegistryMirror, "registry-mirror", "", "registry `URL` to ask for library images before trying Docker Hub")
+	fs.Var((*stringsFlag)(&o.CACerts), "registry-ca", "PEM `file` of CA certificates to trust for registries (repeatable)")
+	fs.Var((*stringsFlag)(&o.InsecureRegistries), "insecure-registry", "`host` whose certificate isn't verified (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: manifest inspect [--raw] [--registry-mirror URL] <image>")
+		return 2
+	}
+	o.Quiet = true
+	o.Progress = progressAuto
+	client, err := newPullClient(fs.Arg(0), nil, o)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	ctx := context.Background()
+	var doc []byte
+	var m *ManifestListResponse
+	err = client.fromRegistry(ctx, func() error {
+		var err error
+		doc, m, err = client.fetchRawManifest(ctx, client.reference)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("get manifest: %v\n", err)
+		return 1
+	}
+	if *raw {
+		os.Stdout.Write(doc)
+		if len(doc) > 0 && doc[len(doc)-1] != '\n' {
+			fmt.Println()
+		}
+		return 0
+	}
+	isIndex, err := m.isIndex()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = "-"
+	}
+	fmt.Printf("Name:       %s\n", canonicalRef(client.name, client.reference))
+	fmt.Printf("Registry:   %s\n", client.registry)
+	fmt.Printf("Digest:     %s\n", m.digest)
+	fmt.Printf("Media type: %s\n", mediaType)
+	fmt.Printf("Size:       %s\n\n", formatBytes(int64(len(doc))))
+	if isIndex {
+		t := newTable("PLATFORM", "DIGEST", "SIZE", "MEDIA TYPE", "ANNOTATIONS")
+		for _, e := range m.Manifests {
+			t.add(e.Platform.String(), e.Digest, strconv.FormatInt(e.Size, 10), e.MediaType, formatAnnotations(e.Annotations))
+		}
+		t.write(os.Stdout, false)
+		return 0
+	}
+	t := newTable("TYPE", "DIGEST", "SIZE", "MEDIA TYPE")
+	t.add("config", m.Config.Digest, strconv.Itoa(m.Config.Size), m.Config.MediaType)
+	for _, l := range m.Layers {
+		t.add("layer", l.Digest, strconv.Itoa(l.Size), l.MediaType)
+	}
+	t.write(os.Stdout, false)
+	return 0
+}
+
+// formatAnnotations lists annotations as KEY=VALUE, sorted by key, or -
+// if there are none.
+func formatAnnotations(annotations map[string]string) string {
+	if len(annotations) == 0 {
+		return "-"
+	}
+	pairs := make([]string, 0, len(annotations))
+	for k, v := range annotations {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,165 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memoryPollInterval is how often the memory events of a container with a
+// soft limit are checked.
+const memoryPollInterval = time.Second
+
+// MemoryLimits are a container's soft memory limits, in bytes, 0 being
+// none. Neither has the kernel kill anything: Reservation is memory.low,
+// which the kernel leaves the container when it reclaims memory unless
+// there is nothing else left to reclaim, and High is memory.high, above
+// which the container is throttled and its memory reclaimed hard.
+type MemoryLimits struct {
+	Reservation int64 `json:"reservation,omitempty"`
+	High        int64 `json:"high,omitempty"`
+}
+
+func (m MemoryLimits) set() bool {
+	return m.Reservation > 0 || m.High > 0
+}
+
+// parseMemoryLimits parses --memory-reservation and --memory-high, either
+// of which may be empty.
+func parseMemoryLimits(reservation, high string) (MemoryLimits, error) {
+	var m MemoryLimits
+	for _, f := range []struct {
+		flag, value string
+		n           *int64
+	}{{"--memory-reservation", reservation, &m.Reservation}, {"--memory-high", high, &m.High}} {
+		if f.value == "" {
+			continue
+		}
+		n, err := parseByteSize(f.value)
+		if err != nil || n <= 0 {
+			return m, fmt.Errorf("invalid %s %q: expected a positive size such as 256m", f.flag, f.value)
+		}
+		*f.n = n
+	}
+	if m.High > 0 && m.Reservation > m.High {
+		return m, fmt.Errorf("--memory-reservation can't be above --memory-high")
+	}
+	if m.set() && os.Geteuid() != 0 {
+		return m, fmt.Errorf("memory limits require root")
+	}
+	return m, nil
+}
+
+// enableMemoryController makes the memory controller available to the
+// cgroups in parent, enabling it in each cgroup from root down to it.
+func enableMemoryController(root, parent string) error {
+	rel := strings.TrimPrefix(parent, root)
+	dir := root
+	for _, part := range append([]string{""}, strings.Split(strings.Trim(rel, "/"), "/")...) {
+		dir = path.Join(dir, part)
+		if err := os.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte("+memory"), 0); err != nil {
+			return fmt.Errorf("enable the memory controller in %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// setMemoryLimits writes soft memory limits to the cgroup at dir.
+func setMemoryLimits(dir string, m MemoryLimits) error {
+	for _, f := range []struct {
+		file string
+		n    int64
+	}{{"memory.low", m.Reservation}, {"memory.high", m.High}} {
+		if f.n == 0 {
+			continue
+		}
+		if err := os.WriteFile(path.Join(dir, f.file), []byte(strconv.FormatInt(f.n, 10)), 0); err != nil {
+			return fmt.Errorf("set %s: %v", f.file, err)
+		}
+	}
+	return nil
+}
+
+// memoryEvents reads the counters in cgroup's memory.events, such as how
+// many times it was throttled for going above memory.high and how many of
+// its processes were killed for running out of memory. It is empty where
+// the memory controller isn't enabled.
+func memoryEvents(cgroup string) map[string]int64 {
+	events := make(map[string]int64)
+	data, err := os.ReadFile(path.Join(cgroup, "memory.events"))
+	if err != nil {
+		return events
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, " "); ok {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			events[key] = n
+		}
+	}
+	return events
+}
+
+// readCgroupInt reads a cgroup file holding a single number, such as
+// memory.current. A file holding "max" reads as 0, for no limit.
+func readCgroupInt(cgroup, file string) (int64, error) {
+	data, err := os.ReadFile(path.Join(cgroup, file))
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// monitorMemory records an event each time c goes above its memory.high,
+// that is, when a check finds it throttled after one that didn't. It must
+// be called by the process that waits on the container, which calls the
+// returned function once the container has exited.
+func monitorMemory(c *Container) func() {
+	if c.Cgroup == "" || c.Config.Memory.High == 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(memoryPollInterval)
+		defer ticker.Stop()
+		last := memoryEvents(c.Cgroup)["high"]
+		throttled := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			high := memoryEvents(c.Cgroup)["high"]
+			// Only crossings are recorded, not every check that finds
+			// the container still above it.
+			if high > last && !throttled {
+				attrs := map[string]string{
+					"high":      strconv.FormatInt(c.Config.Memory.High, 10),
+					"throttled": strconv.FormatInt(high, 10),
+				}
+				if usage, err := readCgroupInt(c.Cgroup, "memory.current"); err == nil {
+					attrs["usage"] = strconv.FormatInt(usage, 10)
+				}
+				recordContainerEvent(c, eventMemoryHigh, attrs)
+			}
+			throttled = high > last
+			last = high
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
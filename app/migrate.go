@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+)
+
+// stateVersionFileName records the layout of the metadata in the state
+// directory: the container records, the image indexes and the trash. A
+// network has no record of its own, its allocations being kept in the
+// records of the containers on it.
+const stateVersionFileName = "version.json"
+
+// currentStateVersion is the layout this build reads and writes. A change
+// to the format of any of the metadata bumps it and adds the migration
+// that brings older state up to it.
+const currentStateVersion = 1
+
+type stateVersion struct {
+	Version int `json:"version"`
+}
+
+// migration brings the state from the version before its own to its
+// version. Run with dryRun, it only describes what it would change.
+type migration struct {
+	version     int
+	description string
+	apply       func(dryRun bool) ([]string, error)
+}
+
+// migrations are in version order. Version 1 is the layout from before the
+// state was versioned, so there is nothing to run to get to it.
+var migrations []migration
+
+func stateVersionPath() string {
+	return path.Join(stateDir(), stateVersionFileName)
+}
+
+// readStateVersion returns the version the state is at, and whether it
+// says so. State from before versioning is version 1, and a state directory
+// that doesn't exist yet is at the current one, since it will be written
+// in this build's layout.
+func readStateVersion() (int, bool, error) {
+	data, err := os.ReadFile(stateVersionPath())
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(stateDir()); os.IsNotExist(err) {
+			return currentStateVersion, false, nil
+		}
+		return 1, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("read state version: %v", err)
+	}
+	var v stateVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, false, fmt.Errorf("decode state version: %v", err)
+	}
+	if v.Version > currentStateVersion {
+		return 0, false, fmt.Errorf("%s was written by a newer version (state version %d, this one reads up to %d): upgrade to use it", stateDir(), v.Version, currentStateVersion)
+	}
+	return v.Version, true, nil
+}
+
+func writeStateVersion(version int) error {
+	data, err := json.Marshal(stateVersion{Version: version})
+	if err != nil {
+		return err
+	}
+	tmp := stateVersionPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write state version: %v", err)
+	}
+	if err := os.Rename(tmp, stateVersionPath()); err != nil {
+		return fmt.Errorf("write state version: %v", err)
+	}
+	return nil
+}
+
+// migrateState brings the state up to currentStateVersion, recording each
+// version as it gets there so that a migration that fails is picked up
+// where it stopped. State written by a newer build is refused rather than
+// misread. It runs before any command that touches the state.
+func migrateState() error {
+	version, stamped, err := readStateVersion()
+	if err != nil || stamped && version == currentStateVersion {
+		return err
+	}
+	unlock, err := lockState("migrate")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Another process may have migrated while we waited for the lock.
+	if version, stamped, err = readStateVersion(); err != nil || stamped && version == currentStateVersion {
+		return err
+	}
+	for _, m := range pendingMigrations(version) {
+		if _, err := m.apply(false); err != nil {
+			return fmt.Errorf("migrate state to version %d: %v", m.version, err)
+		}
+		if err := writeStateVersion(m.version); err != nil {
+			return err
+		}
+	}
+	return writeStateVersion(currentStateVersion)
+}
+
+func pendingMigrations(version int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// migrateCmd runs the migrations the state needs, which every command does
+// by itself, or with --dry-run shows what they would change.
+func migrateCmd(args []string) int {
+	fs := flag.NewFlagSet("system migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "show what would be migrated without changing anything")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: system migrate [--dry-run]")
+		return 2
+	}
+	version, _, err := readStateVersion()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !*dryRun {
+		if err := migrateState(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if version == currentStateVersion {
+		fmt.Printf("State is at version %d, nothing to migrate\n", version)
+		return 0
+	}
+	if !*dryRun {
+		fmt.Printf("Migrated state from version %d to %d\n", version, currentStateVersion)
+		return 0
+	}
+	fmt.Printf("State is at version %d, this build uses %d\n", version, currentStateVersion)
+	for _, m := range pendingMigrations(version) {
+		fmt.Printf("version %d: %s\n", m.version, m.description)
+		changes, err := m.apply(true)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, change := range changes {
+			fmt.Printf("  %s\n", change)
+		}
+	}
+	return 0
+}
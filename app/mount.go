@@ -0,0 +1,501 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Mount is a host path bind-mounted into the container.
+type Mount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly"`
+	// Relabel is z or Z to relabel the source for SELinux, or empty to
+	// leave it as it is.
+	Relabel string `json:"relabel,omitempty"`
+}
+
+// parseVolume parses a -v flag of the form
+// /host/path:/container/path[:OPTIONS], where the options are a comma
+// separated list of ro or rw and z or Z.
+func parseVolume(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Mount{}, fmt.Errorf("invalid volume %q: expected /host:/container[:ro]", spec)
+	}
+	m := Mount{Source: parts[0], Destination: parts[1]}
+	if !path.IsAbs(m.Source) || !path.IsAbs(m.Destination) {
+		return Mount{}, fmt.Errorf("invalid volume %q: paths must be absolute", spec)
+	}
+	if len(parts) < 3 {
+		return m, nil
+	}
+	for _, opt := range strings.Split(parts[2], ",") {
+		switch opt {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		case relabelShared, relabelPrivate:
+			if m.Relabel != "" {
+				return Mount{}, fmt.Errorf("invalid volume %q: z and Z can't be combined", spec)
+			}
+			m.Relabel = opt
+		default:
+			return Mount{}, fmt.Errorf("invalid volume %q: unknown option %q", spec, opt)
+		}
+	}
+	return m, nil
+}
+
+// What to do about a -v host path that doesn't exist.
+const (
+	bindMissingError  = "error"
+	bindMissingCreate = "create"
+)
+
+// bindPolicy says how -v host paths are checked before a container is
+// created.
+type bindPolicy struct {
+	// create makes missing host paths as directories owned by uid and gid,
+	// which are -1 to leave them owned by the caller.
+	create   bool
+	uid, gid int
+}
+
+// parseBindPolicy parses --bind-missing and --bind-owner UID[:GID].
+func parseBindPolicy(missing, owner string) (bindPolicy, error) {
+	policy := bindPolicy{uid: -1, gid: -1}
+	switch missing {
+	case bindMissingError:
+	case bindMissingCreate:
+		policy.create = true
+	default:
+		return policy, fmt.Errorf("invalid --bind-missing %q: expected %s or %s", missing, bindMissingError, bindMissingCreate)
+	}
+	if owner == "" {
+		return policy, nil
+	}
+	if !policy.create {
+		return policy, fmt.Errorf("--bind-owner needs --bind-missing %s", bindMissingCreate)
+	}
+	uid, gid, hasGID := strings.Cut(owner, ":")
+	var err error
+	if policy.uid, err = strconv.Atoi(uid); err != nil || policy.uid < 0 {
+		return policy, fmt.Errorf("invalid --bind-owner %q: expected UID[:GID]", owner)
+	}
+	policy.gid = policy.uid
+	if hasGID {
+		if policy.gid, err = strconv.Atoi(gid); err != nil || policy.gid < 0 {
+			return policy, fmt.Errorf("invalid --bind-owner %q: expected UID[:GID]", owner)
+		}
+	}
+	return policy, nil
+}
+
+// validateMounts checks that the host paths of mounts can be mounted,
+// creating missing ones if the policy allows, so that mistakes are
+// reported before the container is created rather than as a failed mount
+// when it starts.
+func validateMounts(mounts []Mount, policy bindPolicy) error {
+	state := stateDir()
+	if resolved, err := filepath.EvalSymlinks(state); err == nil {
+		state = resolved
+	}
+	destinations := make(map[string]bool)
+	for _, m := range mounts {
+		dest := path.Clean(m.Destination)
+		if destinations[dest] {
+			return fmt.Errorf("invalid volume %s:%s: %s is already mounted", m.Source, m.Destination, dest)
+		}
+		destinations[dest] = true
+		if err := checkRelabel(m); err != nil {
+			return err
+		}
+		if err := checkOutsideState(m.Source, m.Source, state); err != nil {
+			return err
+		}
+		_, err := os.Stat(m.Source)
+		if os.IsNotExist(err) {
+			if !policy.create {
+				return fmt.Errorf("bind source %s does not exist: create it or pass --bind-missing %s", m.Source, bindMissingCreate)
+			}
+			if err := createBindSource(m.Source, policy.uid, policy.gid); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("bind source %s can't be used: %v", m.Source, err)
+		}
+		source, err := filepath.EvalSymlinks(m.Source)
+		if err != nil {
+			return fmt.Errorf("bind source %s can't be used: %v", m.Source, err)
+		}
+		if err := checkOutsideState(m.Source, source, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOutsideState rejects a bind source within the state directory,
+// through which a container could tamper with the runtime's own files or
+// with other containers.
+func checkOutsideState(source, resolved, state string) error {
+	resolved = path.Clean(resolved)
+	if resolved == state || strings.HasPrefix(resolved, state+"/") {
+		return fmt.Errorf("bind source %s is inside the runtime's state directory %s: mount a path outside it", source, state)
+	}
+	return nil
+}
+
+// createBindSource creates dir and any missing parents, and gives the
+// directories it created to uid and gid.
+func createBindSource(dir string, uid, gid int) error {
+	var created []string
+	for p := path.Clean(dir); p != "/"; p = path.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		}
+		created = append(created, p)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create bind source: %v", err)
+	}
+	if uid < 0 {
+		return nil
+	}
+	for _, p := range created {
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return fmt.Errorf("create bind source: %v", err)
+		}
+	}
+	return nil
+}
+
+// bindMounts mounts each host path onto its destination under rootfs. It
+// must run inside the container's mount namespace. A container created for
+// a daemon tenant only gets sources it owns: each is opened and checked,
+// and what is mounted is the descriptor that was checked, so that the path
+// can't be swapped for another in between.
+func bindMounts(rootfs string, mounts []Mount, tenantOwned bool) error {
+	for _, m := range mounts {
+		fd, err := openBindSource(m.Source, tenantOwned)
+		if err != nil {
+			return err
+		}
+		err = bindMount(rootfs, m, fmt.Sprintf("/proc/self/fd/%d", fd))
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// oPath is O_PATH, which the syscall package lacks.
+const oPath = 0x200000
+
+// openBindSource opens source as an O_PATH descriptor. When the container
+// is tenantOwned, source must be owned by the user we run as on the host,
+// who is the tenant.
+func openBindSource(source string, tenantOwned bool) (int, error) {
+	fd, err := syscall.Open(source, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("bind source %s: %v", source, err)
+	}
+	if !tenantOwned {
+		return fd, nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("bind source %s: %v", source, err)
+	}
+	if int(st.Uid) != os.Geteuid() {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("bind source %s is not yours", source)
+	}
+	return fd, nil
+}
+
+// bindMount mounts m, whose source has been opened as source, onto its
+// destination under rootfs.
+func bindMount(rootfs string, m Mount, source string) error {
+	target, err := securePath(rootfs, m.Destination)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %v", m.Destination, err)
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("bind source %s: %v", m.Source, err)
+	}
+	if err := createMountpoint(fi, m.Source, target, m.Destination); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %v", m.Source, err)
+	}
+	if !m.ReadOnly {
+		return nil
+	}
+	// MS_RDONLY is ignored on the initial bind, so it takes a remount.
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %v", m.Destination, err)
+	}
+	return nil
+}
+
+// TmpfsMount is a tmpfs mounted at Destination inside the container, for
+// scratch space that is gone when the container exits.
+type TmpfsMount struct {
+	Destination string `json:"destination"`
+	// Options are comma separated mount options, as given to --tmpfs.
+	Options string `json:"options,omitempty"`
+}
+
+// parseTmpfs parses a --tmpfs flag of the form /path[:OPTIONS].
+func parseTmpfs(spec string) (TmpfsMount, error) {
+	dest, opts, _ := strings.Cut(spec, ":")
+	m := TmpfsMount{Destination: dest, Options: opts}
+	if err := m.validate(); err != nil {
+		return TmpfsMount{}, fmt.Errorf("invalid --tmpfs %q: %v", spec, err)
+	}
+	return m, nil
+}
+
+// parseTmpfsMounts parses --tmpfs flags, which can't share a destination
+// with each other or with a volume.
+func parseTmpfsMounts(specs []string, volumes []Mount) ([]TmpfsMount, error) {
+	seen := make(map[string]bool)
+	for _, v := range volumes {
+		seen[path.Clean(v.Destination)] = true
+	}
+	var mounts []TmpfsMount
+	for _, spec := range specs {
+		m, err := parseTmpfs(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[path.Clean(m.Destination)] {
+			return nil, fmt.Errorf("duplicate mount point %s", m.Destination)
+		}
+		seen[path.Clean(m.Destination)] = true
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+func (m TmpfsMount) validate() error {
+	if !path.IsAbs(m.Destination) || path.Clean(m.Destination) == "/" {
+		return fmt.Errorf("the path must be absolute and not /")
+	}
+	_, _, err := m.mountOptions()
+	return err
+}
+
+// mountOptions turns the options into mount flags and tmpfs data. Like
+// Docker, a tmpfs is noexec, nosuid and nodev unless the options say
+// otherwise.
+func (m TmpfsMount) mountOptions() (uintptr, string, error) {
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	var data []string
+	if m.Options == "" {
+		return flags, "", nil
+	}
+	for _, opt := range strings.Split(m.Options, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "size":
+			if !tmpfsSizePattern.MatchString(value) {
+				return 0, "", fmt.Errorf("bad size %q", value)
+			}
+			data = append(data, opt)
+		case "mode":
+			if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+				return 0, "", fmt.Errorf("bad mode %q: expected octal", value)
+			}
+			data = append(data, opt)
+		case "ro":
+			flags |= syscall.MS_RDONLY
+		case "rw":
+			flags &^= syscall.MS_RDONLY
+		case "exec":
+			flags &^= syscall.MS_NOEXEC
+		case "noexec":
+			flags |= syscall.MS_NOEXEC
+		case "suid":
+			flags &^= syscall.MS_NOSUID
+		case "nosuid":
+			flags |= syscall.MS_NOSUID
+		case "dev":
+			flags &^= syscall.MS_NODEV
+		case "nodev":
+			flags |= syscall.MS_NODEV
+		default:
+			return 0, "", fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	return flags, strings.Join(data, ","), nil
+}
+
+// mountTmpfs mounts each tmpfs onto its destination under rootfs. It must
+// run inside the container's mount namespace.
+func mountTmpfs(rootfs string, mounts []TmpfsMount) error {
+	for _, m := range mounts {
+		target, err := securePath(rootfs, m.Destination)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %v", m.Destination, err)
+		}
+		if fi, err := os.Stat(target); err == nil && !fi.IsDir() {
+			return fmt.Errorf("can't mount a tmpfs onto %s, which is a file in the container", m.Destination)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("mkdir: %v", err)
+		}
+		flags, data, err := m.mountOptions()
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", target, "tmpfs", flags, data); err != nil {
+			return fmt.Errorf("mount tmpfs on %s: %v", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// tmpfsSizePattern matches the sizes tmpfs accepts: bytes, with an
+// optional k, m or g suffix, or a percentage of memory.
+var tmpfsSizePattern = regexp.MustCompile(`^[0-9]+[kKmMgG%]?$`)
+
+// rootfsOption is a parsed --rootfs flag.
+type rootfsOption struct {
+	Tmpfs bool
+	Size  string
+	Path  string
+}
+
+// parseRootfsFlag parses --rootfs, which is tmpfs[:size] or the absolute
+// path of an existing directory.
+func parseRootfsFlag(value string) (rootfsOption, error) {
+	if value == "" {
+		return rootfsOption{}, nil
+	}
+	if path.IsAbs(value) {
+		fi, err := os.Stat(value)
+		if err != nil {
+			return rootfsOption{}, fmt.Errorf("invalid --rootfs: %v", err)
+		}
+		if !fi.IsDir() {
+			return rootfsOption{}, fmt.Errorf("invalid --rootfs %q: not a directory", value)
+		}
+		return rootfsOption{Path: path.Clean(value)}, nil
+	}
+	kind, size, _ := strings.Cut(value, ":")
+	if kind != "tmpfs" {
+		return rootfsOption{}, fmt.Errorf("invalid --rootfs %q: expected tmpfs[:size] or an absolute path", value)
+	}
+	if size != "" && !tmpfsSizePattern.MatchString(size) {
+		return rootfsOption{}, fmt.Errorf("invalid --rootfs %q: bad size %q", value, size)
+	}
+	return rootfsOption{Tmpfs: true, Size: size}, nil
+}
+
+// mountRootfsTmpfs puts the container's rootfs on a tmpfs of its own
+// before the image is unpacked into it. The tmpfs is a resource of the
+// container, so its contents go away once the container exits.
+func mountRootfsTmpfs(c *Container) error {
+	if err := c.track(resourceMount, c.Rootfs); err != nil {
+		return err
+	}
+	opts := "mode=755"
+	if c.Config.RootfsSize != "" {
+		opts += ",size=" + c.Config.RootfsSize
+	}
+	if err := syscall.Mount("tmpfs", c.Rootfs, "tmpfs", 0, opts); err != nil {
+		return fmt.Errorf("mount tmpfs rootfs: %v", err)
+	}
+	return nil
+}
+
+// createMountpoint creates target, the host path of dest, as a directory
+// or an empty file to match source, which is fi.
+func createMountpoint(fi os.FileInfo, source, target, dest string) error {
+	if existing, err := os.Stat(target); err == nil && existing.IsDir() != fi.IsDir() {
+		return fmt.Errorf("can't mount %s %s onto %s, which is a %s in the container",
+			fileKind(fi), source, dest, fileKind(existing))
+	}
+	if fi.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("mkdir: %v", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("create mountpoint: %v", err)
+	}
+	return f.Close()
+}
+
+func fileKind(fi os.FileInfo) string {
+	if fi.IsDir() {
+		return "directory"
+	}
+	return "file"
+}
+
+// securePath joins p onto root, resolving symlinks as if root were "/", so
+// a link inside the image cannot point a mount at the host filesystem.
+func securePath(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(path.Join(root, next))
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+		link, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(link, "/"), parts...)
+	}
+	return path.Join(root, resolved), nil
+}
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+)
+
+// containerNamePattern is what Docker accepts for container names.
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+var (
+	nameAdjectives = []string{
+		"admiring", "agitated", "amazing", "angry", "awesome", "blissful",
+		"bold", "brave", "busy", "charming", "clever", "cool", "dazzling",
+		"determined", "eager", "ecstatic", "elastic", "elegant", "epic",
+		"focused", "friendly", "frosty", "gallant", "gifted", "happy",
+		"hungry", "infallible", "inspiring", "jolly", "keen", "kind",
+		"laughing", "loving", "modest", "nervous", "nifty", "nostalgic",
+		"peaceful", "pensive", "quirky", "relaxed", "serene", "sharp",
+		"silly", "stoic", "sweet", "tender", "trusting", "upbeat", "vibrant",
+		"wizardly", "wonderful", "youthful", "zealous",
+	}
+	nameSurnames = []string{
+		"agnesi", "babbage", "bardeen", "bell", "bohr", "cerf", "curie",
+		"darwin", "dijkstra", "einstein", "euclid", "euler", "fermat",
+		"feynman", "franklin", "galileo", "gauss", "goldberg", "hamilton",
+		"hopper", "hypatia", "jemison", "kepler", "knuth", "lamport",
+		"liskov", "lovelace", "maxwell", "meitner", "mendel", "newton",
+		"noether", "pascal", "pike", "ritchie", "shannon", "sinoussi",
+		"thompson", "torvalds", "turing", "wescoff", "wilson", "wozniak",
+		"yalow",
+	}
+)
+
+func validateContainerName(name string) error {
+	if name != "" && !containerNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid container name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	return nil
+}
+
+// nameConflictError means a container already has the name asked for.
+type nameConflictError struct {
+	name, id string
+}
+
+func (e *nameConflictError) Error() string {
+	return fmt.Sprintf("container name %q is already in use by container %s: remove it or choose another name", e.name, e.id[:12])
+}
+
+// generateName returns a random adjective_surname name that isn't taken,
+// adding a digit once the plain names start colliding, as Docker does.
+func generateName(taken map[string]bool) string {
+	for i := 0; ; i++ {
+		name := nameAdjectives[rand.IntN(len(nameAdjectives))] + "_" + nameSurnames[rand.IntN(len(nameSurnames))]
+		if i > 10 {
+			name += fmt.Sprint(rand.IntN(10))
+		}
+		if !taken[name] {
+			return name
+		}
+	}
+}
+
+// assignName gives c the name, or a generated one if name is empty, and
+// saves it. Names are unique among containers, which the lock guarantees
+// for containers being created at the same time.
+func (c *Container) assignName(name string) error {
+	unlock, err := lockState("names")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+	taken := make(map[string]bool)
+	for _, other := range containers {
+		if other.ID == c.ID {
+			continue
+		}
+		if other.Config.Name == name && name != "" {
+			return &nameConflictError{name: name, id: other.ID}
+		}
+		taken[other.Config.Name] = true
+	}
+	if name == "" {
+		name = generateName(taken)
+	}
+	c.Config.Name = name
+	return c.save()
+}
+
+// name returns the container's name, or its short ID if it was created
+// before containers had names.
+func (c *Container) name() string {
+	if c.Config.Name != "" {
+		return c.Config.Name
+	}
+	return c.shortID()
+}
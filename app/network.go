@@ -0,0 +1,358 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	networkBridge = "bridge"
+	networkHost   = "host"
+	networkNone   = "none"
+
+	bridgeName    = "diy0"
+	defaultSubnet = "172.29.0.0/16"
+	subnetEnv     = "DIY_DOCKER_SUBNET"
+)
+
+// NetworkSettings records how a bridged container is attached to the host.
+type NetworkSettings struct {
+	IPAddress string `json:"ipAddress"`
+	PrefixLen int    `json:"prefixLen"`
+	Gateway   string `json:"gateway"`
+	HostVeth  string `json:"hostVeth"`
+}
+
+func validateNetworkMode(mode string) error {
+	switch mode {
+	case networkBridge, networkHost, networkNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid network mode %q: expected bridge, host or none", mode)
+	}
+}
+
+// networkCloneflags returns the namespace flags init needs for mode. Only
+// host networking shares the host's namespace.
+func networkCloneflags(mode string) uintptr {
+	if mode == networkHost || mode == "" {
+		return 0
+	}
+	return syscall.CLONE_NEWNET
+}
+
+// setupNetwork configures the container's network namespace from the host
+// side. It runs after init has started, while init is still waiting to exec
+// the container command.
+func setupNetwork(c *Container) error {
+	if c.Config.JoinNamespaces != "" {
+		return nil
+	}
+	switch c.Config.Network {
+	case networkBridge:
+	case networkNone:
+		return netnsRun(c.Pid, "ip", "link", "set", "lo", "up")
+	default:
+		return nil
+	}
+	subnet, err := bridgeSubnet()
+	if err != nil {
+		return err
+	}
+	gateway := nthIP(subnet, 1)
+	if err := ensureBridge(subnet, gateway); err != nil {
+		return err
+	}
+	if err := ensureMasquerade(subnet); err != nil {
+		return err
+	}
+	if err := allocateIP(c, subnet, gateway); err != nil {
+		return err
+	}
+	n := c.Network
+	// Tracked before the veth so that it is released after it, when
+	// nothing can add entries any more.
+	if err := c.track(resourceConntrack, n.IPAddress); err != nil {
+		return err
+	}
+	if err := c.track(resourceVeth, n.HostVeth); err != nil {
+		return err
+	}
+	if err := runCommand("ip", "link", "add", n.HostVeth, "type", "veth", "peer", "name", "eth0", "netns", strconv.Itoa(c.Pid)); err != nil {
+		return err
+	}
+	if err := runCommand("ip", "link", "set", n.HostVeth, "master", bridgeName, "up"); err != nil {
+		return err
+	}
+	steps := [][]string{
+		{"ip", "link", "set", "lo", "up"},
+		{"ip", "addr", "add", fmt.Sprintf("%s/%d", n.IPAddress, n.PrefixLen), "dev", "eth0"},
+		{"ip", "link", "set", "eth0", "up"},
+		{"ip", "route", "add", "default", "via", n.Gateway},
+	}
+	for _, step := range steps {
+		if err := netnsRun(c.Pid, step[0], step[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bridgeSubnet() (*net.IPNet, error) {
+	cidr := os.Getenv(subnetEnv)
+	if cidr == "" {
+		cidr = defaultSubnet
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %v", cidr, err)
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid subnet %q: only IPv4 is supported", cidr)
+	}
+	return subnet, nil
+}
+
+// ensureBridge creates the bridge with the gateway address the first time
+// any container needs it, and turns on forwarding.
+func ensureBridge(subnet *net.IPNet, gateway net.IP) error {
+	if _, err := net.InterfaceByName(bridgeName); err != nil {
+		ones, _ := subnet.Mask.Size()
+		if err := runCommand("ip", "link", "add", bridgeName, "type", "bridge"); err != nil {
+			return err
+		}
+		if err := runCommand("ip", "addr", "add", fmt.Sprintf("%s/%d", gateway, ones), "dev", bridgeName); err != nil {
+			return err
+		}
+	}
+	if err := runCommand("ip", "link", "set", bridgeName, "up"); err != nil {
+		return err
+	}
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable ip forwarding: %v", err)
+	}
+	return nil
+}
+
+// ensureMasquerade installs NAT for traffic leaving the subnet through any
+// interface but the bridge, using iptables when available and nftables
+// otherwise. Both paths check for existing rules first so that they are
+// only added once.
+func ensureMasquerade(subnet *net.IPNet) error {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		rules := [][]string{
+			{"-t", "nat", "POSTROUTING", "-s", subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE"},
+			{"-t", "filter", "FORWARD", "-i", bridgeName, "-j", "ACCEPT"},
+			{"-t", "filter", "FORWARD", "-o", bridgeName, "-j", "ACCEPT"},
+		}
+		for _, rule := range rules {
+			if err := ensureIptablesRule(rule[:2], rule[2], rule[3:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		if runCommand("nft", "list", "table", "ip", "diy-docker") == nil {
+			return nil
+		}
+		cmd := exec.Command("nft", "-f", "-")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(nftRuleset, subnet, bridgeName, bridgeName, bridgeName))
+		return runExternal(cmd)
+	}
+	return fmt.Errorf("bridge networking needs iptables or nft to set up NAT")
+}
+
+const nftRuleset = `table ip diy-docker {
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr %s oifname != "%s" masquerade
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		iifname "%s" accept
+		oifname "%s" accept
+	}
+}
+`
+
+func ensureIptablesRule(table []string, chain string, rule []string) error {
+	check := append(append(append([]string{}, table...), "-C", chain), rule...)
+	if runCommand("iptables", check...) == nil {
+		return nil
+	}
+	add := append(append(append([]string{}, table...), "-A", chain), rule...)
+	return runCommand("iptables", add...)
+}
+
+// allocateIP picks the lowest free address in subnet for c and records it.
+// The choice and the save happen under a lock so that containers started
+// at the same time don't get the same address.
+func allocateIP(c *Container, subnet *net.IPNet, gateway net.IP) error {
+	unlock, err := lockState("network")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{gateway.String(): true}
+	for _, other := range containers {
+		if other.ID != c.ID && other.Network != nil && other.Status != statusExited {
+			used[other.Network.IPAddress] = true
+		}
+	}
+	ones, bits := subnet.Mask.Size()
+	size := 1 << (bits - ones)
+	for i := 1; i < size-1; i++ {
+		ip := nthIP(subnet, i)
+		if used[ip.String()] {
+			continue
+		}
+		c.Network = &NetworkSettings{
+			IPAddress: ip.String(),
+			PrefixLen: ones,
+			Gateway:   gateway.String(),
+			HostVeth:  "veth" + c.ID[:8],
+		}
+		return c.save()
+	}
+	return fmt.Errorf("no free addresses left in %s", subnet)
+}
+
+func nthIP(subnet *net.IPNet, n int) net.IP {
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base+uint32(n))
+	return ip
+}
+
+// writeResolvConf gives the container the host's DNS configuration. A
+// loopback resolver such as systemd-resolved's stub is unreachable from a
+// separate network namespace, so public resolvers are used instead. With
+// encrypted upstreams set by system dns, a bridged container asks the
+// embedded resolver instead. A directory rootfs is the user's to keep, so
+// rather than overwrite its resolv.conf, the container gets one
+// bind-mounted over it.
+func writeResolvConf(c *Container) error {
+	if c.Config.Network == networkNone || c.Config.JoinNamespaces != "" {
+		return nil
+	}
+	conf, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read resolv.conf: %v", err)
+	}
+	if c.Config.Network == networkBridge {
+		d, err := loadDNSConfig()
+		if err != nil {
+			return err
+		}
+		c.Config.DNSUpstreams = d.Upstreams
+		if len(d.Upstreams) > 0 {
+			// Saved for the shim, which starts the resolver of a
+			// detached container.
+			if err := c.save(); err != nil {
+				return err
+			}
+			conf = []byte("nameserver " + resolverAddr + "\n")
+		} else if usesLoopbackResolver(conf) {
+			conf = []byte("nameserver 8.8.8.8\nnameserver 8.8.4.4\n")
+		}
+	}
+	if c.Config.RootfsPath != "" {
+		file := path.Join(c.dir(), "resolv.conf")
+		if err := os.WriteFile(file, conf, 0644); err != nil {
+			return fmt.Errorf("write resolv.conf: %v", err)
+		}
+		c.Config.Mounts = append(c.Config.Mounts, Mount{Source: file, Destination: "/etc/resolv.conf"})
+		return c.save()
+	}
+	target, err := securePath(c.Rootfs, "/etc/resolv.conf")
+	if err != nil {
+		return fmt.Errorf("resolve resolv.conf: %v", err)
+	}
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	os.Remove(target)
+	if err := os.WriteFile(target, conf, 0644); err != nil {
+		return fmt.Errorf("write resolv.conf: %v", err)
+	}
+	return nil
+}
+
+func usesLoopbackResolver(conf []byte) bool {
+	for _, line := range strings.Split(string(conf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil && ip.IsLoopback() {
+				return true
+			}
+		}
+	}
+	return len(bytes.TrimSpace(conf)) == 0
+}
+
+// netnsRun runs a host command inside the network namespace of pid, leaving
+// every other namespace, including the mount namespace, as it is.
+func netnsRun(pid int, name string, args ...string) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := setns(fmt.Sprintf("/proc/%d/ns/net", pid), syscall.CLONE_NEWNET); err != nil {
+			done <- fmt.Errorf("join net namespace: %v", err)
+			return
+		}
+		done <- runCommand(name, args...)
+	}()
+	return <-done
+}
+
+// flushConntrack deletes the connection tracking entries of ip. Published
+// ports go through a proxy on the host rather than DNAT, so no entry sends
+// traffic for a port to a container that is gone. The entries of the
+// container's own masqueraded flows do outlive it, though, UDP ones in
+// particular, and the next container given its address would be sent the
+// replies meant for the old one. Without the conntrack tool they are left
+// to time out.
+func flushConntrack(ip string) error {
+	if _, err := exec.LookPath("conntrack"); err != nil {
+		return nil
+	}
+	for _, flag := range []string{"--orig-src", "--orig-dst"} {
+		err := runCommand("conntrack", "-D", flag, ip)
+		// conntrack fails when there was nothing to delete.
+		if err != nil && !strings.Contains(err.Error(), "0 flow entries have been deleted") {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCommand(name string, args ...string) error {
+	return runExternal(exec.Command(name, args...))
+}
+
+// runExternal runs cmd and folds its output into the error if it fails, since
+// that is where tools like ip explain what went wrong.
+func runExternal(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(cmd.Args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// notifyFileName holds where failures of detached containers are sent. It
+// is kept 0600, since it can hold tokens.
+const notifyFileName = "notify.json"
+
+// notifyTimeout bounds each attempt to notify. Notifications are sent by
+// whatever saw the failure, often a shim on its way out, so a slow endpoint
+// must not hold it up for long.
+const notifyTimeout = 5 * time.Second
+
+// notifyConfig says where notifications go. Any number of the targets can
+// be set; with none, nothing is sent.
+type notifyConfig struct {
+	// Desktop runs notify-send, which needs the session bus of whoever is
+	// logged in, so it suits rootless use.
+	Desktop bool `json:"desktop,omitempty"`
+	// Ntfy is a topic URL, such as https://ntfy.sh/mytopic.
+	Ntfy      string `json:"ntfy,omitempty"`
+	NtfyToken string `json:"ntfyToken,omitempty"`
+	// Gotify is the server's base URL, to which messages are posted with
+	// an application token.
+	Gotify      string `json:"gotify,omitempty"`
+	GotifyToken string `json:"gotifyToken,omitempty"`
+}
+
+func (n *notifyConfig) empty() bool {
+	return !n.Desktop && n.Ntfy == "" && n.Gotify == ""
+}
+
+func notifyConfigPath() string {
+	return path.Join(stateDir(), notifyFileName)
+}
+
+func loadNotifyConfig() (*notifyConfig, error) {
+	var n notifyConfig
+	data, err := os.ReadFile(notifyConfigPath())
+	if os.IsNotExist(err) {
+		return &n, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read notify config: %v", err)
+	}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, fmt.Errorf("decode notify config: %v", err)
+	}
+	return &n, nil
+}
+
+func (n *notifyConfig) save() error {
+	if n.empty() {
+		if err := os.Remove(notifyConfigPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove notify config: %v", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(notifyConfigPath(), data, 0600); err != nil {
+		return fmt.Errorf("write notify config: %v", err)
+	}
+	return nil
+}
+
+// send delivers a notification to every target, returning the errors of
+// those it couldn't reach.
+func (n *notifyConfig) send(title, message string) []error {
+	var errs []error
+	if n.Desktop {
+		if out, err := exec.Command("notify-send", "--urgency=critical", "--app-name=diy-docker", title, message).CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("desktop: %v: %s", err, strings.TrimSpace(string(out))))
+		}
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	if n.Ntfy != "" {
+		req, err := http.NewRequest("POST", n.Ntfy, strings.NewReader(message))
+		if err == nil {
+			req.Header.Set("Title", title)
+			req.Header.Set("Priority", "high")
+			req.Header.Set("Tags", "warning")
+			if n.NtfyToken != "" {
+				req.Header.Set("Authorization", "Bearer "+n.NtfyToken)
+			}
+			err = postNotification(client, req)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ntfy: %v", err))
+		}
+	}
+	if n.Gotify != "" {
+		body, _ := json.Marshal(map[string]any{"title": title, "message": message, "priority": 8})
+		req, err := http.NewRequest("POST", strings.TrimSuffix(n.Gotify, "/")+"/message", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gotify-Key", n.GotifyToken)
+			err = postNotification(client, req)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("gotify: %v", err))
+		}
+	}
+	return errs
+}
+
+func postNotification(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// notifyFailure tells the configured targets that c failed. Only detached
+// containers are reported: a foreground one fails in front of whoever ran
+// it. Like recording an event, failing to notify is ignored.
+func notifyFailure(c *Container, title, message string) {
+	if !c.Config.Detach {
+		return
+	}
+	n, err := loadNotifyConfig()
+	if err != nil || n.empty() {
+		return
+	}
+	n.send(title, message)
+}
+
+// notifyExit reports that c exited with code, unless it was stopped by
+// hand or exited cleanly. Being killed for running out of memory or
+// stopped for timing out is reported as that rather than as the exit it
+// caused.
+func notifyExit(c *Container, code int, oomKilled bool) {
+	switch {
+	case oomKilled:
+		notifyFailure(c, fmt.Sprintf("%s ran out of memory", c.name()),
+			fmt.Sprintf("Container %s (%s, %s) was killed for running out of memory and exited with code %d.", c.name(), c.shortID(), c.Config.Image, code))
+	case c.TimedOut:
+		notifyFailure(c, fmt.Sprintf("%s timed out", c.name()),
+			fmt.Sprintf("Container %s (%s, %s) was stopped for running past its timeout of %s.", c.name(), c.shortID(), c.Config.Image, c.Config.Timeout))
+	case code != 0 && !c.stoppedManually():
+		notifyFailure(c, fmt.Sprintf("%s exited with code %d", c.name(), code),
+			fmt.Sprintf("Container %s (%s, %s) exited with code %d.", c.name(), c.shortID(), c.Config.Image, code))
+	}
+}
+
+// notifyUnhealthy reports that c's healthcheck has failed often enough for
+// it to be unhealthy, with what the last check printed.
+func notifyUnhealthy(c *Container, state *HealthState) {
+	message := fmt.Sprintf("Container %s (%s, %s) is unhealthy after %d failed checks.", c.name(), c.shortID(), c.Config.Image, state.FailingStreak)
+	if len(state.Log) > 0 {
+		if output := strings.TrimSpace(state.Log[len(state.Log)-1].Output); output != "" {
+			message += "\n" + output
+		}
+	}
+	notifyFailure(c, fmt.Sprintf("%s is unhealthy", c.name()), message)
+}
+
+// notifyCmd shows or changes where failures are sent, and with --test sends
+// a notification to check that they arrive.
+func notifyCmd(args []string) int {
+	fs := flag.NewFlagSet("system notify", flag.ContinueOnError)
+	desktop := fs.Bool("desktop", false, "show notifications on the desktop with notify-send")
+	ntfy := fs.String("ntfy", "", "ntfy topic URL to publish notifications to")
+	ntfyToken := fs.String("ntfy-token", "", "access token for the ntfy topic")
+	gotify := fs.String("gotify", "", "gotify server URL to send notifications to")
+	gotifyToken := fs.String("gotify-token", "", "gotify application token")
+	off := fs.Bool("off", false, "stop sending notifications")
+	test := fs.Bool("test", false, "send a test notification")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: system notify [--desktop] [--ntfy URL] [--ntfy-token TOKEN] [--gotify URL] [--gotify-token TOKEN] [--off] [--test]")
+		return 2
+	}
+	n, err := loadNotifyConfig()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	changed := *off
+	if *off {
+		n = &notifyConfig{}
+	}
+	if flagPassed(fs, "desktop") {
+		n.Desktop, changed = *desktop, true
+	}
+	for _, f := range []struct {
+		name  string
+		value *string
+		field *string
+	}{
+		{"ntfy", ntfy, &n.Ntfy},
+		{"ntfy-token", ntfyToken, &n.NtfyToken},
+		{"gotify", gotify, &n.Gotify},
+		{"gotify-token", gotifyToken, &n.GotifyToken},
+	} {
+		if flagPassed(fs, f.name) {
+			*f.field, changed = *f.value, true
+		}
+	}
+	if n.Gotify != "" && n.GotifyToken == "" {
+		fmt.Println("--gotify needs --gotify-token")
+		return 2
+	}
+	if changed {
+		if err := n.save(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if *test {
+		if n.empty() {
+			fmt.Println("no notification targets are set")
+			return 1
+		}
+		if errs := n.send("diy-docker test notification", "Failures of detached containers will be reported here."); len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Println(err)
+			}
+			return 1
+		}
+		return 0
+	}
+	if changed {
+		return 0
+	}
+	if n.empty() {
+		fmt.Println("Notifications are off")
+		return 0
+	}
+	if n.Desktop {
+		fmt.Println("desktop: notify-send")
+	}
+	if n.Ntfy != "" {
+		fmt.Printf("ntfy: %s\n", n.Ntfy)
+	}
+	if n.Gotify != "" {
+		fmt.Printf("gotify: %s\n", n.Gotify)
+	}
+	return 0
+}
@@ -0,0 +1,457 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// The runtime's hooks around a fork, which syscall.ForkExec brackets its
+// own with. Between them the child may only make raw system calls: it has
+// a single thread, no scheduler and a stack that can't grow.
+//
+//go:linkname runtime_BeforeFork syscall.runtime_BeforeFork
+func runtime_BeforeFork()
+
+//go:linkname runtime_AfterFork syscall.runtime_AfterFork
+func runtime_AfterFork()
+
+//go:linkname runtime_AfterForkInChild syscall.runtime_AfterForkInChild
+func runtime_AfterForkInChild()
+
+// The steps of nsenterChild, which it reports failures against.
+const (
+	nsenterLabel = iota + 1
+	nsenterJoinCgroup
+	nsenterSetns
+	nsenterFork
+	nsenterStdio
+	nsenterSetpgid
+	nsenterChdir
+	nsenterBoundingSet
+	nsenterSeccomp
+	nsenterKeepCaps
+	nsenterSwitchUser
+	nsenterCapset
+	nsenterAmbient
+	nsenterExec
+)
+
+var nsenterSteps = map[uintptr]string{
+	nsenterLabel:       "set exec label",
+	nsenterJoinCgroup:  "join cgroup",
+	nsenterFork:        "fork",
+	nsenterStdio:       "set up stdio",
+	nsenterSetpgid:     "setpgid",
+	nsenterChdir:       "chdir",
+	nsenterBoundingSet: "drop capability from bounding set",
+	nsenterSeccomp:     "install seccomp filter",
+	nsenterKeepCaps:    "keep capabilities",
+	nsenterSwitchUser:  "switch user",
+	nsenterCapset:      "capset",
+	nsenterAmbient:     "raise ambient capability",
+	nsenterExec:        "start command",
+}
+
+// nsenterReport is what nsenterChild writes back: the PID of the process
+// it started, or the step that failed and why. For a failed setns, arg is
+// the index of the namespace.
+type nsenterReport struct {
+	pid, step, arg, errno uintptr
+}
+
+// confinement is what init would do to a command before exec'ing it,
+// worked out ahead so that nsenterChild can do it with raw system calls.
+type confinement struct {
+	privileged  bool
+	label       string
+	dropBounds  []uintptr
+	seccomp     *syscall.SockFprog
+	keepCaps    bool
+	clearGroups bool
+	uid, gid    int
+	// capMask is what limitCapabilities would keep of the effective and
+	// permitted sets, and inheritable what it would make inheritable.
+	capMask, inheritable [2]uint32
+	ambient              []uintptr
+}
+
+// confineLike works out how init confines c's command when it runs as
+// user, for a process joining the running container.
+func confineLike(c *Container, user containerUser) (*confinement, error) {
+	conf := &confinement{
+		privileged:  c.Config.Privileged,
+		label:       c.ProcessLabel,
+		clearGroups: !setgroupsDeniedFor(c.Pid),
+		uid:         user.uid,
+		gid:         user.gid,
+	}
+	caps := capabilitySet(c.Config.CapAdd, c.Config.CapDrop)
+	if c.Config.Seccomp != nil {
+		filterCaps := caps
+		if c.Config.Privileged {
+			filterCaps = capabilitySet([]string{"ALL"}, nil)
+		}
+		filter, err := compileSeccomp(c.Config.Seccomp, filterCaps)
+		if err != nil {
+			return nil, err
+		}
+		conf.seccomp = &syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	}
+	if c.Config.Privileged {
+		return conf, nil
+	}
+	last, err := lastCapability()
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[uint]bool)
+	for name := range caps {
+		allowed[capabilities[name]] = true
+	}
+	for c := uint(0); c <= last; c++ {
+		if !allowed[c] {
+			conf.dropBounds = append(conf.dropBounds, uintptr(c))
+		}
+	}
+	ambient := ambientCapabilities(c.Config.CapAdd, user)
+	conf.keepCaps = len(ambient) > 0
+	conf.capMask, conf.inheritable = capabilityMask(caps), capabilityMask(ambient)
+	for name := range ambient {
+		conf.ambient = append(conf.ambient, uintptr(capabilities[name]))
+	}
+	return conf, nil
+}
+
+// nsenterArgs is everything nsenterChild needs, made ready beforehand since
+// it can't allocate.
+type nsenterArgs struct {
+	*confinement
+	labelPath, labelValue *byte
+	labelLen              uintptr
+	cgroupProcs           int
+	namespaces            []int
+	files                 []int
+	dir, path             *byte
+	argv, envp            []*byte
+	report                int
+	setns                 uintptr
+}
+
+// spawnInNamespaces starts the command at path, in the container's
+// filesystem, inside all the namespaces of pid, its mount namespace
+// included, and returns the process, which is our child. It runs in dir
+// with argv and env, confined by conf. The process is put in cgroup, unless
+// it is empty, and in a process group of its own, and gets files as its
+// descriptors from 0 up.
+//
+// A multithreaded process can't join a mount namespace, which is why this
+// forks a child that stays single-threaded, as the one syscall.ForkExec
+// makes does, to join them. Joining a PID namespace only moves the
+// children of the caller, so the child forks again, with CLONE_PARENT to
+// make the process ours. Nothing from the container's filesystem runs
+// until the command itself, which is exec'd once the process is confined.
+func spawnInNamespaces(pid int, cgroup, path, dir string, argv, env []string, conf *confinement, files []*os.File) (*os.Process, error) {
+	a := &nsenterArgs{confinement: conf, cgroupProcs: -1, report: -1}
+	defer a.close()
+	var ok bool
+	if a.setns, ok = setnsTrap[runtime.GOARCH]; !ok {
+		return nil, fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	namespaces := containerNamespaces()
+	for _, ns := range namespaces {
+		target := fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name)
+		same, err := sameNamespace(target, "/proc/self/ns/"+ns.name)
+		if err != nil {
+			return nil, err
+		}
+		fd := -1
+		if !same {
+			if fd, err = syscall.Open(target, syscall.O_RDONLY|syscall.O_CLOEXEC, 0); err != nil {
+				return nil, fmt.Errorf("open %s namespace: %v", ns.name, err)
+			}
+		}
+		a.namespaces = append(a.namespaces, fd)
+	}
+	if cgroup != "" {
+		fd, err := syscall.Open(cgroup+"/cgroup.procs", syscall.O_WRONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("open cgroup: %v", err)
+		}
+		a.cgroupProcs = fd
+	}
+	// The files are moved out of the way of the descriptors they become,
+	// and are closed in the process when it execs.
+	for _, f := range files {
+		fd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_DUPFD_CLOEXEC, uintptr(len(files)))
+		if errno != 0 {
+			return nil, fmt.Errorf("dup: %v", errno)
+		}
+		a.files = append(a.files, int(fd))
+	}
+	var err error
+	if conf.label != "" {
+		// The label is set while the host's /proc is still there to set it
+		// through, and carries over to the second fork.
+		if a.labelPath, err = syscall.BytePtrFromString("/proc/thread-self/attr/exec"); err != nil {
+			return nil, err
+		}
+		if a.labelValue, err = syscall.BytePtrFromString(conf.label); err != nil {
+			return nil, err
+		}
+		a.labelLen = uintptr(len(conf.label))
+	}
+	if a.dir, err = syscall.BytePtrFromString(dir); err != nil {
+		return nil, err
+	}
+	if a.path, err = syscall.BytePtrFromString(path); err != nil {
+		return nil, err
+	}
+	if a.argv, err = syscall.SlicePtrFromStrings(argv); err != nil {
+		return nil, err
+	}
+	if a.envp, err = syscall.SlicePtrFromStrings(env); err != nil {
+		return nil, err
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return nil, fmt.Errorf("pipe: %v", err)
+	}
+	a.report = p[1]
+	report := os.NewFile(uintptr(p[0]), "report")
+	defer report.Close()
+
+	syscall.ForkLock.Lock()
+	runtime_BeforeFork()
+	child, _, errno := syscall.RawSyscall6(syscall.SYS_CLONE, uintptr(syscall.SIGCHLD), 0, 0, 0, 0, 0)
+	if errno == 0 && child == 0 {
+		runtime_AfterForkInChild()
+		nsenterChild(a)
+	}
+	runtime_AfterFork()
+	syscall.ForkLock.Unlock()
+	if errno != 0 {
+		return nil, fmt.Errorf("fork: %v", errno)
+	}
+	syscall.Close(a.report)
+	a.report = -1
+
+	r, err := readNsenterReport(report)
+	reap(int(child))
+	if err != nil {
+		return nil, err
+	}
+	if r.pid == 0 {
+		return nil, r.err(namespaces)
+	}
+	// The process reports only if it fails to exec; otherwise the pipe
+	// is closed when it does.
+	if failed, err := readNsenterReport(report); err != nil || failed.step != 0 {
+		reap(int(r.pid))
+		if err != nil {
+			return nil, err
+		}
+		return nil, failed.err(namespaces)
+	}
+	return os.FindProcess(int(r.pid))
+}
+
+// containerNamespaces are the namespaces spawnInNamespaces joins, in the
+// order it joins them. The user namespace comes first, since joining the
+// others of a rootless container takes the capabilities it gives, and the
+// mount namespace last, since joining it changes what the namespaces under
+// /proc refer to.
+func containerNamespaces() []namespaceType {
+	namespaces := []namespaceType{{"user", syscall.CLONE_NEWUSER}}
+	namespaces = append(namespaces, execNamespaces...)
+	return append(namespaces, namespaceType{"mnt", syscall.CLONE_NEWNS})
+}
+
+// reap waits for a child that spawnInNamespaces has no further use for.
+func reap(pid int) {
+	var ws syscall.WaitStatus
+	for {
+		if _, err := syscall.Wait4(pid, &ws, 0, nil); err != syscall.EINTR {
+			return
+		}
+	}
+}
+
+// readNsenterReport reads a report off the pipe. A pipe closed without one
+// gives the zero report.
+func readNsenterReport(f *os.File) (nsenterReport, error) {
+	var r nsenterReport
+	buf := (*[unsafe.Sizeof(r)]byte)(unsafe.Pointer(&r))[:]
+	n, err := f.Read(buf)
+	if n == 0 {
+		return nsenterReport{}, nil
+	}
+	if err != nil || n != len(buf) {
+		return r, fmt.Errorf("read from child: short report")
+	}
+	return r, nil
+}
+
+func (r nsenterReport) err(namespaces []namespaceType) error {
+	errno := syscall.Errno(r.errno)
+	switch r.step {
+	case nsenterSetns:
+		return fmt.Errorf("join %s namespace: %v", namespaces[r.arg].name, errno)
+	case nsenterBoundingSet, nsenterAmbient:
+		return fmt.Errorf("%s %d: %v", nsenterSteps[r.step], r.arg, errno)
+	case nsenterExec:
+		// Wrapped, so that commandErrorCode can tell a missing command.
+		return fmt.Errorf("%s: %w", nsenterSteps[r.step], errno)
+	default:
+		return fmt.Errorf("%s: %v", nsenterSteps[r.step], errno)
+	}
+}
+
+func (a *nsenterArgs) close() {
+	for _, fd := range append(append([]int{a.cgroupProcs, a.report}, a.namespaces...), a.files...) {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// nsenterChild runs in the child spawnInNamespaces forks, and never
+// returns. Like the runtime's own child of a fork, it must not allocate or
+// call anything that could grow its stack. The process it forks confines
+// itself in the order init does, and reports a failure on the way.
+//
+//go:nosplit
+//go:norace
+func nsenterChild(a *nsenterArgs) {
+	var r nsenterReport
+	var errno syscall.Errno
+	var labelFd uintptr
+	cwd := atFdcwd
+	var hdr struct {
+		version uint32
+		pid     int32
+	}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	if a.labelPath != nil {
+		labelFd, _, errno = syscall.RawSyscall6(syscall.SYS_OPENAT, uintptr(cwd), uintptr(unsafe.Pointer(a.labelPath)), syscall.O_WRONLY|syscall.O_CLOEXEC, 0, 0, 0)
+		if errno == 0 {
+			_, _, errno = syscall.RawSyscall(syscall.SYS_WRITE, labelFd, uintptr(unsafe.Pointer(a.labelValue)), a.labelLen)
+			syscall.RawSyscall(syscall.SYS_CLOSE, labelFd, 0, 0)
+		}
+		if errno != 0 {
+			r.step = nsenterLabel
+			goto fail
+		}
+	}
+	if a.cgroupProcs >= 0 {
+		// Writing 0 moves the writer.
+		zero := byte('0')
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_WRITE, uintptr(a.cgroupProcs), uintptr(unsafe.Pointer(&zero)), 1); errno != 0 {
+			r.step = nsenterJoinCgroup
+			goto fail
+		}
+	}
+	for i, fd := range a.namespaces {
+		if fd < 0 {
+			continue
+		}
+		if _, _, errno = syscall.RawSyscall(a.setns, uintptr(fd), 0, 0); errno != 0 {
+			r.step, r.arg = nsenterSetns, uintptr(i)
+			goto fail
+		}
+	}
+	r.pid, _, errno = syscall.RawSyscall6(syscall.SYS_CLONE, uintptr(syscall.CLONE_PARENT|syscall.SIGCHLD), 0, 0, 0, 0, 0)
+	if errno != 0 {
+		r.step = nsenterFork
+		goto fail
+	}
+	if r.pid != 0 {
+		syscall.RawSyscall(syscall.SYS_WRITE, uintptr(a.report), uintptr(unsafe.Pointer(&r)), unsafe.Sizeof(r))
+		syscall.RawSyscall(syscall.SYS_EXIT_GROUP, 0, 0, 0)
+	}
+
+	// This is the process, in the container's PID namespace.
+	for i, fd := range a.files {
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_DUP3, uintptr(fd), uintptr(i), 0); errno != 0 {
+			r.step = nsenterStdio
+			goto fail
+		}
+	}
+	if _, _, errno = syscall.RawSyscall(syscall.SYS_SETPGID, 0, 0, 0); errno != 0 {
+		r.step = nsenterSetpgid
+		goto fail
+	}
+	if _, _, errno = syscall.RawSyscall(syscall.SYS_CHDIR, uintptr(unsafe.Pointer(a.dir)), 0, 0); errno != 0 {
+		r.step = nsenterChdir
+		goto fail
+	}
+	for _, c := range a.dropBounds {
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, c, 0); errno != 0 && errno != syscall.EINVAL {
+			r.step, r.arg = nsenterBoundingSet, c
+			goto fail
+		}
+	}
+	if a.seccomp != nil {
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP, seccompModeFilter, uintptr(unsafe.Pointer(a.seccomp))); errno != 0 {
+			r.step = nsenterSeccomp
+			goto fail
+		}
+	}
+	if a.keepCaps {
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+			r.step = nsenterKeepCaps
+			goto fail
+		}
+	}
+	if a.clearGroups {
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+			r.step = nsenterSwitchUser
+			goto fail
+		}
+	}
+	if _, _, errno = syscall.RawSyscall(syscall.SYS_SETGID, uintptr(a.gid), 0, 0); errno != 0 {
+		r.step = nsenterSwitchUser
+		goto fail
+	}
+	if _, _, errno = syscall.RawSyscall(syscall.SYS_SETUID, uintptr(a.uid), 0, 0); errno != 0 {
+		r.step = nsenterSwitchUser
+		goto fail
+	}
+	if !a.privileged {
+		hdr.version = linuxCapabilityVersion3
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			r.step = nsenterCapset
+			goto fail
+		}
+		for i := range data {
+			data[i].effective &= a.capMask[i]
+			data[i].permitted &= a.capMask[i]
+			data[i].inheritable = a.inheritable[i] & data[i].permitted
+		}
+		if _, _, errno = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			r.step = nsenterCapset
+			goto fail
+		}
+		for _, c := range a.ambient {
+			if _, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, c, 0, 0, 0); errno != 0 {
+				r.step, r.arg = nsenterAmbient, c
+				goto fail
+			}
+		}
+	}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(a.path)), uintptr(unsafe.Pointer(&a.argv[0])), uintptr(unsafe.Pointer(&a.envp[0])))
+	r.step = nsenterExec
+fail:
+	r.pid, r.errno = 0, uintptr(errno)
+	syscall.RawSyscall(syscall.SYS_WRITE, uintptr(a.report), uintptr(unsafe.Pointer(&r)), unsafe.Sizeof(r))
+	syscall.RawSyscall(syscall.SYS_EXIT_GROUP, exitCannotInvoke, 0, 0)
+}
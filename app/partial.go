@@ -0,0 +1,289 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// pathSelection is the paths a partial pull extracts, cleaned and
+// absolute.
+type pathSelection []string
+
+func parsePullPaths(specs []string) (pathSelection, error) {
+	var paths pathSelection
+	for _, p := range specs {
+		if !path.IsAbs(p) {
+			return nil, fmt.Errorf("invalid --path %q: must be absolute", p)
+		}
+		paths = append(paths, path.Clean(p))
+	}
+	return paths, nil
+}
+
+// selects reports whether name, an absolute path in the image, is one of
+// the paths, is below one, or is a directory leading to one, which is
+// kept for its mode and owner.
+func (paths pathSelection) selects(name string) bool {
+	for _, p := range paths {
+		if name == p || p == "/" || strings.HasPrefix(name, p+"/") || strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// pullPaths extracts only the selected paths of the image into dir, layer
+// by layer, without unpacking the rest or storing the image. Layers the
+// store already has are read from it; the others are streamed from the
+// registry and filtered as they arrive, so they are never written to disk
+// whole. A stream that fails can't be resumed and fails the pull. A
+// streamed layer is only verified once it has been read, so the layers
+// are extracted next to dir and only moved into it once every one has
+// been, leaving dir as it was if any fails.
+func (d *DockerImageClient) pullPaths(ctx context.Context, paths pathSelection, dir string, status func(string)) error {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	_, manifest, err := d.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	if err := d.getConfig(ctx, manifest.Config.Digest); err != nil {
+		return err
+	}
+	if err := d.checkPlatform(manifest.Config.Digest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	// On the same filesystem as dir, so that moving the files is a rename.
+	staging, err := os.MkdirTemp(path.Dir(path.Clean(dir)), "."+path.Base(dir)+".pull-")
+	if err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	skippedLinks := 0
+	for _, layer := range manifest.Layers {
+		status(shortDigest(layer.Digest) + ": Extracting")
+		n, err := d.extractSelected(ctx, layer.Digest, paths, staging)
+		if err != nil {
+			return fmt.Errorf("extract layer %s: %v", shortDigest(layer.Digest), err)
+		}
+		skippedLinks += n
+	}
+	if err := moveInto(staging, dir); err != nil {
+		return err
+	}
+	if skippedLinks > 0 {
+		status(fmt.Sprintf("Left out %d hard links to files outside the selected paths", skippedLinks))
+	}
+	return nil
+}
+
+// extractSelected extracts the selected paths of one layer into dir and
+// applies its whiteouts to what earlier layers put there. A whiteout only
+// covers the layers below, so they are applied once the layer's own files
+// are in place, sparing those. It returns how many hard links it left out
+// because what they link to isn't selected.
+func (d *DockerImageClient) extractSelected(ctx context.Context, digest string, paths pathSelection, dir string) (int, error) {
+	blob, err := d.openBlob(ctx, digest)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	r, err := decompressLayer(blob)
+	if err != nil {
+		return 0, err
+	}
+	// written has what the layer put in dir and the directories leading
+	// to it, which an opaque whiteout in the same layer leaves alone.
+	written := make(map[string]bool)
+	var whiteouts, opaque []string
+	skippedLinks := 0
+	keep := func(hdr *tar.Header) bool {
+		name := path.Clean("/" + hdr.Name)
+		parent, base := path.Split(name)
+		switch {
+		case base == whiteoutOpaque:
+			if paths.selects(path.Clean(parent)) {
+				opaque = append(opaque, path.Clean(parent))
+			}
+			return false
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if deleted := path.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)); paths.selects(deleted) {
+				whiteouts = append(whiteouts, deleted)
+			}
+			return false
+		case !paths.selects(name):
+			return false
+		case hdr.Typeflag == tar.TypeLink && !paths.selects(path.Clean("/"+hdr.Linkname)):
+			skippedLinks++
+			return false
+		case (hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock) && os.Geteuid() != 0:
+			// Only root can make device nodes, which inspecting an
+			// image can do without.
+			return false
+		}
+		for p := name; p != "/" && !written[p]; p = path.Dir(p) {
+			written[p] = true
+		}
+		return true
+	}
+	if err := unpackTar(r, dir, keep); err != nil {
+		return 0, err
+	}
+	for _, p := range whiteouts {
+		target, err := securePath(dir, p)
+		if err != nil {
+			return 0, fmt.Errorf("resolve %s: %v", p, err)
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return 0, fmt.Errorf("remove: %v", err)
+		}
+	}
+	for _, p := range opaque {
+		target, err := securePath(dir, p)
+		if err != nil {
+			return 0, fmt.Errorf("resolve %s: %v", p, err)
+		}
+		entries, err := os.ReadDir(target)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("read dir: %v", err)
+		}
+		for _, e := range entries {
+			if written[path.Join(p, e.Name())] {
+				continue
+			}
+			if err := os.RemoveAll(path.Join(target, e.Name())); err != nil {
+				return 0, fmt.Errorf("remove: %v", err)
+			}
+		}
+	}
+	// Read to the end so that the digest covers the whole blob.
+	if _, err := io.Copy(io.Discard, blob); err != nil {
+		return 0, fmt.Errorf("read layer: %v", err)
+	}
+	if err := blob.verify(); err != nil {
+		return 0, err
+	}
+	return skippedLinks, nil
+}
+
+// moveInto moves what is in src into dst, merging directories both have
+// and replacing anything else of dst's that is in the way.
+func moveInto(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("read dir: %v", err)
+	}
+	for _, e := range entries {
+		from, to := path.Join(src, e.Name()), path.Join(dst, e.Name())
+		if fi, err := os.Lstat(to); err == nil && fi.IsDir() && e.IsDir() {
+			if err := moveInto(from, to); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.RemoveAll(to); err != nil {
+			return fmt.Errorf("remove: %v", err)
+		}
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("move: %v", err)
+		}
+	}
+	return nil
+}
+
+// streamedBlob reads a blob and checks once it has been read whole that it
+// has the digest it was asked for by.
+type streamedBlob struct {
+	r      io.Reader
+	hash   hash.Hash
+	digest string
+	close  func()
+}
+
+func (b *streamedBlob) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *streamedBlob) Close() error {
+	b.close()
+	return nil
+}
+
+func (b *streamedBlob) verify() error {
+	if b.hash == nil {
+		return nil
+	}
+	if got := "sha256:" + hex.EncodeToString(b.hash.Sum(nil)); got != b.digest {
+		return fmt.Errorf("%w: expected %s, got %s", errDigestMismatch, b.digest, got)
+	}
+	return nil
+}
+
+// openBlob reads a blob from the store if it has it, since it was verified
+// on the way in, or else straight from the registry.
+func (d *DockerImageClient) openBlob(ctx context.Context, digest string) (*streamedBlob, error) {
+	if d.store.hasBlob(digest) {
+		f, err := os.Open(d.store.blobPath(digest))
+		if err != nil {
+			return nil, fmt.Errorf("read blob: %v", err)
+		}
+		return &streamedBlob{r: f, digest: digest, close: func() { f.Close() }}, nil
+	}
+	// As in fetchBlob, the request is cancelled if nothing arrives for
+	// blobStallTimeout.
+	ctx, cancel := context.WithCancelCause(ctx)
+	stall := time.AfterFunc(blobStallTimeout, func() { cancel(errBlobStalled) })
+	closeAll := func() {
+		stall.Stop()
+		cancel(nil)
+	}
+	url := fmt.Sprintf(dockerBlobsURL, d.registry, d.name, digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("new request: %v", err)
+	}
+	for k, v := range d.authHeaders() {
+		req.Header.Set(k, v)
+	}
+	resp, err := d.http.Do(req)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("do request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		closeAll()
+		return nil, &httpStatusError{resp.StatusCode}
+	}
+	b := &streamedBlob{digest: digest, close: func() {
+		resp.Body.Close()
+		closeAll()
+	}}
+	var body io.Reader = &stallReader{ctx: ctx, r: resp.Body, stall: stall}
+	if algo, _, _ := strings.Cut(digest, ":"); algo == "sha256" {
+		b.hash = sha256.New()
+		body = io.TeeReader(body, b.hash)
+	}
+	b.r = body
+	return b, nil
+}
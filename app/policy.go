@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Policy actions.
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// imagePolicy says which images the daemon pulls and runs. Its rules are
+// tried in order against the image's qualified reference, such as
+// docker.io/library/alpine:3.19, and the first that matches decides.
+// Images no rule matches get Default, which is allow unless set.
+type imagePolicy struct {
+	Default string       `json:"default,omitempty"`
+	Rules   []policyRule `json:"rules"`
+}
+
+type policyRule struct {
+	Action string `json:"action"`
+	// Match is a glob, in which * doesn't match /, and Regex a regular
+	// expression matched against the whole reference. A rule has one of
+	// them.
+	Match string `json:"match,omitempty"`
+	Regex string `json:"regex,omitempty"`
+	// RequireDigest allows only references pinned by digest.
+	RequireDigest bool `json:"requireDigest,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func loadImagePolicy(file string) (*imagePolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %v", err)
+	}
+	var p imagePolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("decode policy %s: %v", file, err)
+	}
+	switch p.Default {
+	case "":
+		p.Default = policyAllow
+	case policyAllow, policyDeny:
+	default:
+		return nil, fmt.Errorf("invalid policy default %q: expected %s or %s", p.Default, policyAllow, policyDeny)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Action != policyAllow && r.Action != policyDeny {
+			return nil, fmt.Errorf("invalid policy rule %d: action must be %s or %s", i+1, policyAllow, policyDeny)
+		}
+		if (r.Match == "") == (r.Regex == "") {
+			return nil, fmt.Errorf("invalid policy rule %d: expected one of match and regex", i+1)
+		}
+		if r.Match != "" {
+			if _, err := path.Match(r.Match, ""); err != nil {
+				return nil, fmt.Errorf("invalid policy rule %d: %v", i+1, err)
+			}
+		} else if _, err := regexp.Compile(r.Regex); err != nil {
+			return nil, fmt.Errorf("invalid policy rule %d: %v", i+1, err)
+		} else {
+			r.re = regexp.MustCompile("^(?:" + r.Regex + ")$")
+		}
+	}
+	return &p, nil
+}
+
+// policyRef spells ref out in full for policy rules to match, with the
+// registry it comes from, which is always Docker Hub.
+func policyRef(ref string) string {
+	name, reference := parseImageRef(ref)
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return canonicalRef("docker.io/"+name, reference)
+}
+
+func (r *policyRule) matches(ref string) bool {
+	if r.re != nil {
+		return r.re.MatchString(ref)
+	}
+	ok, _ := path.Match(r.Match, ref)
+	return ok
+}
+
+// check returns an error saying why ref isn't allowed, or nil if it is.
+// rule is the number of the rule that decided, or 0 for the default.
+func (p *imagePolicy) check(ref string) (rule int, err error) {
+	q := policyRef(ref)
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.matches(q) {
+			continue
+		}
+		if r.Action == policyDeny {
+			return i + 1, fmt.Errorf("%s is denied by policy rule %d", q, i+1)
+		}
+		if r.RequireDigest && !strings.Contains(q, "@") {
+			return i + 1, fmt.Errorf("%s must be pinned by digest by policy rule %d", q, i+1)
+		}
+		return i + 1, nil
+	}
+	if p.Default == policyDeny {
+		return 0, fmt.Errorf("%s is not allowed by policy", q)
+	}
+	return 0, nil
+}
+
+// checkPolicy checks that r may pull or run ref, recording a denial in
+// the event log. A daemon without a policy allows everything.
+func (d *daemon) checkPolicy(r *http.Request, ref, operation string) error {
+	if d.policy == nil {
+		return nil
+	}
+	rule, err := d.policy.check(ref)
+	if err == nil {
+		return nil
+	}
+	attrs := map[string]string{"operation": operation, "reason": err.Error()}
+	if rule > 0 {
+		attrs["rule"] = strconv.Itoa(rule)
+	}
+	if uid, ok := r.Context().Value(clientKey{}).(int); ok {
+		attrs["uid"] = strconv.Itoa(uid)
+	}
+	recordEvent(eventImage, eventDeny, normalizeRef(ref), attrs)
+	return err
+}
@@ -0,0 +1,451 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const poolSocketName = "pool.sock"
+
+func poolSocket() string {
+	return path.Join(stateDir(), poolSocketName)
+}
+
+// poolRequest is what run sends the pool to claim a sandbox. A foreground
+// run passes its standard input, output and error along with it.
+type poolRequest struct {
+	Config ContainerConfig `json:"config"`
+}
+
+// poolReply answers a poolRequest, first with the claimed container and,
+// for a foreground run, later with its exit code.
+type poolReply struct {
+	ID       string `json:"id,omitempty"`
+	Pid      int    `json:"pid,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// pool keeps sandboxes for a set of images ready to go: containers whose
+// rootfs is unpacked and whose init is already running in its namespaces,
+// with networking set up, waiting to be told what to run. Claiming one
+// leaves only the mounts and the exec to do.
+type pool struct {
+	store    *imageStore
+	size     int
+	network  string
+	rootless bool
+
+	mu      sync.Mutex
+	closed  bool
+	warm    map[string][]*pendingInit
+	running sync.WaitGroup
+}
+
+// poolCmd runs the pool in the foreground until it is interrupted, serving
+// run on a socket in the state directory.
+func poolCmd(args []string) int {
+	fs := flag.NewFlagSet("pool", flag.ContinueOnError)
+	size := fs.Int("size", 2, "number of warm sandboxes to keep per image")
+	network := fs.String("network", networkHost, "network mode of the sandboxes: bridge, host or none")
+	rootless := fs.Bool("rootless", os.Geteuid() != 0, "run the sandboxes in user namespaces")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || *size < 1 {
+		fmt.Println("usage: pool [--size N] [--network MODE] [--rootless] <image>...")
+		return 2
+	}
+	if err := validateNetworkMode(*network); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if *network == networkBridge && os.Geteuid() != 0 {
+		fmt.Println("bridge networking requires root")
+		return 2
+	}
+	sigs, stopNotify := notifySignals()
+	defer stopNotify()
+	recoverContainers()
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	l, err := listenPool()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.Remove(poolSocket())
+	p := &pool{
+		store:    store,
+		size:     *size,
+		network:  *network,
+		rootless: *rootless,
+		warm:     make(map[string][]*pendingInit),
+	}
+	for _, image := range fs.Args() {
+		for i := 0; i < *size; i++ {
+			if err := p.addSandbox(image); err != nil {
+				fmt.Println(err)
+				l.Close()
+				p.shutdown()
+				return 1
+			}
+		}
+	}
+	fmt.Printf("Serving %d warm sandboxes for each of %d images on %s\n", *size, fs.NArg(), poolSocket())
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			break
+		}
+		go p.serve(conn)
+	}
+	p.shutdown()
+	return 0
+}
+
+// listenPool takes over the pool socket unless another pool is serving it.
+func listenPool() (*net.UnixListener, error) {
+	addr := &net.UnixAddr{Name: poolSocket(), Net: "unix"}
+	if conn, err := net.DialUnix("unix", nil, addr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a pool is already running on %s", addr.Name)
+	}
+	os.Remove(addr.Name)
+	l, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %v", err)
+	}
+	return l, nil
+}
+
+// addSandbox prepares one more warm sandbox for image.
+func (p *pool) addSandbox(image string) error {
+	c, err := newContainer(ContainerConfig{Image: image, Network: p.network, Rootless: p.rootless})
+	if err != nil {
+		return err
+	}
+	w, err := p.prepare(c)
+	if err != nil {
+		c.remove()
+		return fmt.Errorf("prepare sandbox for %s: %v", image, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		w.abort()
+		c.remove()
+		return nil
+	}
+	p.warm[image] = append(p.warm[image], w)
+	return nil
+}
+
+func (p *pool) prepare(c *Container) (*pendingInit, error) {
+	img, err := ensureImage(context.Background(), p.store, c.Config.Image, PullOptions{Quiet: true, MaxConcurrentDownloads: defaultMaxConcurrentDownloads}, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.store.markUsed(img)
+	if err := p.store.unpack(img, c.Rootfs); err != nil {
+		return nil, err
+	}
+	config, err := p.store.imageConfig(img)
+	if err != nil {
+		return nil, err
+	}
+	c.ImageID = img.ID()
+	c.ImageConfig = *config
+	c.Status = statusWarm
+	return spawnInit(c, nil, nil, nil, nil)
+}
+
+// take hands out a warm sandbox that can run cfg, if there is one. The
+// namespaces a sandbox was created with can't be changed afterwards.
+func (p *pool) take(cfg *ContainerConfig) *pendingInit {
+	if cfg.Network != p.network || cfg.Rootless != p.rootless || cfg.JoinNamespaces != "" || cfg.RootfsTmpfs || cfg.RootfsPath != "" || cfg.PreserveFDs > 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	warm := p.warm[cfg.Image]
+	if p.closed || len(warm) == 0 {
+		return nil
+	}
+	p.warm[cfg.Image] = warm[1:]
+	p.running.Add(1)
+	return warm[0]
+}
+
+func (p *pool) serve(conn *net.UnixConn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	req, stdio, err := readPoolRequest(conn)
+	defer func() {
+		for _, f := range stdio {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		enc.Encode(poolReply{Error: err.Error()})
+		return
+	}
+	w := p.take(&req.Config)
+	if w == nil {
+		enc.Encode(poolReply{Error: "no warm sandbox"})
+		return
+	}
+	defer p.running.Done()
+	go func() {
+		if err := p.addSandbox(req.Config.Image); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	p.run(w, req.Config, stdio, enc)
+}
+
+// readPoolRequest reads a request and the files passed with it.
+func readPoolRequest(conn *net.UnixConn) (*poolRequest, []*os.File, error) {
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read request: %v", err)
+	}
+	var files []*os.File
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			return nil, nil, fmt.Errorf("read request: bad control message")
+		}
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("read request: %v", err)
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "stdio"))
+		}
+	}
+	var req poolRequest
+	if err := json.NewDecoder(io.MultiReader(bytes.NewReader(buf[:n]), conn)).Decode(&req); err != nil {
+		return nil, files, fmt.Errorf("read request: %v", err)
+	}
+	if !req.Config.Detach && len(files) != 3 {
+		return nil, files, fmt.Errorf("read request: expected 3 file descriptors, got %d", len(files))
+	}
+	return &req, files, nil
+}
+
+// run gives a claimed sandbox cfg to run and waits on it, the way run or
+// the shim would have.
+func (p *pool) run(w *pendingInit, cfg ContainerConfig, stdio []*os.File, enc *json.Encoder) {
+	c := w.c
+	fail := func(err error) {
+		w.abort()
+		c.remove()
+		enc.Encode(poolReply{Error: err.Error()})
+	}
+	unlock, err := c.lockSupervisor()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer unlock()
+	c.Config = cfg
+	if err := c.assignName(cfg.Name); err != nil {
+		fail(err)
+		return
+	}
+	if err := c.assignLabels(); err != nil {
+		fail(err)
+		return
+	}
+	shell, err := applyImageConfig(&c.Config, &c.ImageConfig)
+	if err == nil {
+		err = checkShell(shell, c.Rootfs)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := assignHostPorts(c); err != nil {
+		fail(err)
+		return
+	}
+	recordContainerEvent(c, eventCreate, nil)
+	if err := prepareRootfs(c.Config.Command, c.Rootfs); err != nil {
+		fail(err)
+		return
+	}
+	if err := writeResolvConf(c); err != nil {
+		fail(err)
+		return
+	}
+	logger, err := newContainerLogger(c)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer logger.Close()
+	// A foreground run's output goes to its caller as well as the log.
+	var stdin *os.File
+	var teeOut, teeErr io.Writer
+	if cfg.Detach {
+		devNull, err := os.Open(os.DevNull)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer devNull.Close()
+		stdin = devNull
+	} else {
+		stdin, teeOut, teeErr = stdio[0], stdio[1], stdio[2]
+	}
+	stdout, waitStdout, err := pipeTo(logger.stream("stdout", teeOut))
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer waitStdout()
+	stderr, waitStderr, err := pipeTo(logger.stream("stderr", teeErr))
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer waitStderr()
+	if err := w.setStdio(stdin, stdout, stderr); err != nil {
+		fail(err)
+		return
+	}
+	c.Status = statusRunning
+	c.StartedAt = time.Now()
+	// Init reads the config from disk once it is released.
+	if err := c.save(); err != nil {
+		fail(err)
+		return
+	}
+	if err := w.release(nil); err != nil {
+		fail(err)
+		return
+	}
+	recordContainerEvent(c, eventStart, nil)
+	enc.Encode(poolReply{ID: c.ID, Pid: c.Pid})
+	stopPublish, err := publishPorts(c)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		w.cmd.Process.Kill()
+		stopPublish = func() {}
+	}
+	stopHealth := monitorHealth(c)
+	stopMemory := monitorMemory(c)
+	stopTimeout := enforceTimeout(w.cmd.Process, cfg.Timeout, time.Duration(cfg.StopTimeout)*time.Second)
+	w.cmd.Wait()
+	c.TimedOut = stopTimeout()
+	stopHealth()
+	stopMemory()
+	if c.TimedOut {
+		fmt.Fprintf(stderr, "container %s timed out after %s\n", c.shortID(), cfg.Timeout)
+	}
+	// Everything the container wrote is logged and passed on before its
+	// exit is reported.
+	waitStdout()
+	waitStderr()
+	stopPublish()
+	code := exitCode(w.cmd.ProcessState)
+	if c.TimedOut {
+		code = exitTimedOut
+	}
+	recordExit(c, code)
+	c.releaseResources()
+	if cfg.AutoRemove {
+		c.remove()
+	} else {
+		c.markExited(code)
+	}
+	if !cfg.Detach {
+		enc.Encode(poolReply{ExitCode: &code})
+	}
+}
+
+// shutdown gets rid of the warm sandboxes and waits for the containers the
+// pool handed out to exit.
+func (p *pool) shutdown() {
+	p.mu.Lock()
+	p.closed = true
+	warm := p.warm
+	p.warm = nil
+	p.mu.Unlock()
+	for _, sandboxes := range warm {
+		for _, w := range sandboxes {
+			w.abort()
+			w.c.remove()
+		}
+	}
+	p.running.Wait()
+}
+
+// runPooled runs cfg in a warm sandbox if a pool is serving one for its
+// image, and reports false if there was none to be had, in which case the
+// caller starts the container itself.
+func runPooled(cfg *ContainerConfig, sigs <-chan os.Signal, timer *startupTimer) (int, bool) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: poolSocket(), Net: "unix"})
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+	data, err := json.Marshal(poolRequest{Config: *cfg})
+	if err != nil {
+		return 0, false
+	}
+	var rights []byte
+	if !cfg.Detach {
+		rights = syscall.UnixRights(0, 1, 2)
+	}
+	if _, _, err := conn.WriteMsgUnix(data, rights, nil); err != nil {
+		return 0, false
+	}
+	dec := json.NewDecoder(conn)
+	var reply poolReply
+	if err := dec.Decode(&reply); err != nil || reply.Error != "" {
+		return 0, false
+	}
+	timer.mark("pool")
+	timer.report(os.Stderr)
+	if cfg.Detach {
+		fmt.Println(reply.ID)
+		return 0, true
+	}
+	proc, err := os.FindProcess(reply.Pid)
+	if err != nil {
+		fmt.Println(err)
+		return 1, true
+	}
+	stopForward := forwardSignals(sigs, proc, time.Duration(cfg.StopTimeout)*time.Second)
+	defer stopForward()
+	reply = poolReply{}
+	if err := dec.Decode(&reply); err != nil || reply.ExitCode == nil {
+		fmt.Println("lost connection to the pool")
+		return 1, true
+	}
+	return *reply.ExitCode, true
+}
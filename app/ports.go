@@ -0,0 +1,497 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyDialTimeout = 5 * time.Second
+
+// -P, and -p without a host port, publish on host ports picked from a
+// range that can be set in the environment as FIRST-LAST.
+const (
+	defaultPortRange = "49153-65535"
+	portRangeEnv     = "DIY_DOCKER_PORT_RANGE"
+)
+
+// udpFlowTimeout is how long a UDP flow through a published port is kept
+// without traffic, since nothing else says when it has ended.
+const udpFlowTimeout = 90 * time.Second
+
+// PortMapping publishes a container port on the host. Protocol is tcp, udp
+// or sctp, and is empty for tcp in containers created before it existed.
+type PortMapping struct {
+	HostIP        string `json:"hostIp,omitempty"`
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+func (p PortMapping) proto() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+// publishable reports whether ports of proto can be published.
+func publishable(proto string) bool {
+	return proto == "tcp" || proto == "udp" || proto == "sctp"
+}
+
+// parsePortMapping parses a -p flag of the form
+// [[hostIP:]hostPort:]containerPort[/protocol]. Either port may be a range
+// FIRST-LAST, and each port of the container's range is published on the
+// port in the same place in the host's. A host port of 0, or none, leaves
+// it to be picked when the container is created. The protocol is tcp
+// unless it says udp or sctp.
+func parsePortMapping(spec string) ([]PortMapping, error) {
+	parts := strings.Split(spec, ":")
+	var hostIP, hostPorts string
+	switch len(parts) {
+	case 1:
+	case 2:
+		hostPorts, parts = parts[0], parts[1:]
+	case 3:
+		hostIP, hostPorts, parts = parts[0], parts[1], parts[2:]
+		if net.ParseIP(hostIP) == nil {
+			return nil, fmt.Errorf("invalid port mapping %q: bad host IP %q", spec, hostIP)
+		}
+	default:
+		return nil, fmt.Errorf("invalid port mapping %q: expected [[hostIP:]hostPort:]containerPort[/protocol]", spec)
+	}
+	containerPorts, proto, ok := strings.Cut(parts[0], "/")
+	if !ok {
+		proto = "tcp"
+	}
+	if !publishable(proto) {
+		return nil, fmt.Errorf("invalid port mapping %q: bad protocol %q", spec, proto)
+	}
+	first, last, err := parsePortRange(containerPorts, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port mapping %q: %v", spec, err)
+	}
+	hostFirst, hostLast := 0, 0
+	if hostPorts != "" {
+		if hostFirst, hostLast, err = parsePortRange(hostPorts, true); err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q: %v", spec, err)
+		}
+	}
+	if hostFirst != 0 && hostLast-hostFirst != last-first {
+		return nil, fmt.Errorf("invalid port mapping %q: the host and container port ranges differ in size", spec)
+	}
+	var mappings []PortMapping
+	for port := first; port <= last; port++ {
+		m := PortMapping{HostIP: hostIP, ContainerPort: port, Protocol: proto}
+		if hostFirst != 0 {
+			m.HostPort = hostFirst + port - first
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// parsePortRange parses a port or a range of them. Port 0, for any free
+// port, is only allowed on its own and where allowZero says so.
+func parsePortRange(s string, allowZero bool) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	lo, err := parsePort(first, allowZero && !isRange)
+	if err != nil || !isRange {
+		return lo, lo, err
+	}
+	hi, err := parsePort(last, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func parsePort(s string, allowZero bool) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 || port == 0 && !allowZero {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return port, nil
+}
+
+func (p PortMapping) String() string {
+	hostIP := p.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s->%d/%s", net.JoinHostPort(hostIP, strconv.Itoa(p.HostPort)), p.ContainerPort, p.proto())
+}
+
+// exposedPorts returns the image's exposed ports as sorted container port
+// and protocol pairs such as 80/tcp. EXPOSE without a protocol means TCP.
+func exposedPorts(img *ImageConfig) []string {
+	var ports []string
+	for p := range img.Config.ExposedPorts {
+		if !strings.Contains(p, "/") {
+			p += "/tcp"
+		}
+		ports = append(ports, p)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// ports describes c's ports the way docker ps does: each published port
+// with the host address it is reachable on, then the exposed ports that
+// aren't published.
+func (c *Container) ports() []string {
+	var parts []string
+	published := make(map[string]bool)
+	for _, p := range c.Config.Ports {
+		parts = append(parts, p.String())
+		published[fmt.Sprintf("%d/%s", p.ContainerPort, p.proto())] = true
+	}
+	for _, p := range exposedPorts(&c.ImageConfig) {
+		if !published[p] {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// hostPortRange returns the range -P picks host ports from.
+func hostPortRange() (int, int, error) {
+	spec := os.Getenv(portRangeEnv)
+	if spec == "" {
+		spec = defaultPortRange
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	lo, err1 := strconv.Atoi(first)
+	hi, err2 := strconv.Atoi(last)
+	if !ok || err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid %s %q: expected FIRST-LAST", portRangeEnv, spec)
+	}
+	return lo, hi, nil
+}
+
+// assignHostPorts picks host ports for c's ports published without one and,
+// for -P, gives each port c's image exposes that isn't already published a
+// host port of its own. Ports held by other containers that haven't exited
+// are skipped, as are ports something else on the host is listening on,
+// each protocol having ports of its own. The mappings are saved with c
+// before the lock is released, so that containers started at the same time
+// don't pick the same port.
+func assignHostPorts(c *Container) error {
+	unassigned := false
+	for _, p := range c.Config.Ports {
+		unassigned = unassigned || p.HostPort == 0
+	}
+	if !unassigned && !c.Config.PublishAll {
+		return nil
+	}
+	lo, hi, err := hostPortRange()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockState("ports")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+	// Both are keyed by port/protocol.
+	used := make(map[string]bool)
+	published := make(map[string]bool)
+	for _, p := range c.Config.Ports {
+		used[fmt.Sprintf("%d/%s", p.HostPort, p.proto())] = true
+		published[fmt.Sprintf("%d/%s", p.ContainerPort, p.proto())] = true
+	}
+	for _, other := range containers {
+		if other.ID == c.ID || other.Status == statusExited {
+			continue
+		}
+		for _, p := range other.Config.Ports {
+			used[fmt.Sprintf("%d/%s", p.HostPort, p.proto())] = true
+		}
+	}
+	next := map[string]int{}
+	pick := func(proto string) (int, error) {
+		port := max(next[proto], lo)
+		for port <= hi && (used[fmt.Sprintf("%d/%s", port, proto)] || !hostPortFree(port, proto)) {
+			port++
+		}
+		if port > hi {
+			return 0, fmt.Errorf("no free host ports left in %d-%d", lo, hi)
+		}
+		used[fmt.Sprintf("%d/%s", port, proto)] = true
+		next[proto] = port + 1
+		return port, nil
+	}
+	for i, p := range c.Config.Ports {
+		if p.HostPort != 0 {
+			continue
+		}
+		if c.Config.Ports[i].HostPort, err = pick(p.proto()); err != nil {
+			return err
+		}
+	}
+	if c.Config.PublishAll {
+		for _, exposed := range exposedPorts(&c.ImageConfig) {
+			port, proto, _ := strings.Cut(exposed, "/")
+			containerPort, err := strconv.Atoi(port)
+			if err != nil || !publishable(proto) || published[exposed] {
+				continue
+			}
+			hostPort, err := pick(proto)
+			if err != nil {
+				return err
+			}
+			c.Config.Ports = append(c.Config.Ports, PortMapping{HostPort: hostPort, ContainerPort: containerPort, Protocol: proto})
+			published[exposed] = true
+		}
+	}
+	return c.save()
+}
+
+// hostPortFree reports whether nothing on the host listens on port with
+// proto. An SCTP port in use is only found out when it is published.
+func hostPortFree(port int, proto string) bool {
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	switch proto {
+	case "tcp":
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return false
+		}
+		l.Close()
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+// publishPorts listens on each published host port and relays connections,
+// or datagrams for UDP, to the container's bridge address. It must be
+// called by the process that waits on the container, which calls the
+// returned function once the container has exited to stop listening. The
+// embedded resolver, if the container has one, starts and stops with the
+// proxies.
+func publishPorts(c *Container) (func(), error) {
+	var proxies []interface{ close() }
+	stop := func() {
+		for _, p := range proxies {
+			p.close()
+		}
+		c.closeResolver()
+	}
+	if c.resolver != nil {
+		c.resolver.serve()
+	}
+	for _, m := range c.Config.Ports {
+		addr := net.JoinHostPort(m.HostIP, strconv.Itoa(m.HostPort))
+		target := net.JoinHostPort(c.Network.IPAddress, strconv.Itoa(m.ContainerPort))
+		if m.proto() == "udp" {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				stop()
+				return nil, fmt.Errorf("publish %s: %v", m, err)
+			}
+			p := &udpProxy{conn: conn, target: target, flows: make(map[string]net.Conn)}
+			proxies = append(proxies, p)
+			go p.serve()
+			continue
+		}
+		listen, dial := net.Listen, dialTCP
+		if m.proto() == "sctp" {
+			listen, dial = listenSCTP, dialSCTP
+		}
+		l, err := listen(m.proto(), addr)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("publish %s: %v", m, err)
+		}
+		p := &portProxy{
+			listener: l,
+			target:   target,
+			dial:     dial,
+			conns:    make(map[net.Conn]bool),
+		}
+		proxies = append(proxies, p)
+		go p.serve()
+	}
+	return stop, nil
+}
+
+// portProxy relays the connections of a published TCP or SCTP port.
+type portProxy struct {
+	listener net.Listener
+	target   string
+	dial     func(addr string, timeout time.Duration) (net.Conn, error)
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+}
+
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (p *portProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.relay(conn)
+	}
+}
+
+// relay copies data both ways between a host connection and the container,
+// passing half-closes along so that request/response protocols that rely on
+// EOF still work.
+func (p *portProxy) relay(client net.Conn) {
+	defer client.Close()
+	backend, err := p.dial(p.target, proxyDialTimeout)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+	if !p.track(client, backend) {
+		return
+	}
+	defer p.untrack(client, backend)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backend, client)
+		backend.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(client, backend)
+	client.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// track records open connections so that close can cut them off. It
+// reports false if the proxy has already been closed.
+func (p *portProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = true
+	}
+	return true
+}
+
+func (p *portProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+func (p *portProxy) close() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// udpProxy relays the datagrams of a published UDP port. Each client gets
+// a socket of its own towards the container, so that what the container
+// sends back can be told apart and returned to the client it is for.
+type udpProxy struct {
+	conn   net.PacketConn
+	target string
+	mu     sync.Mutex
+	// flows has the socket of each client, by address.
+	flows map[string]net.Conn
+}
+
+func (p *udpProxy) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		backend, err := p.flow(client)
+		if err != nil {
+			continue
+		}
+		backend.SetReadDeadline(time.Now().Add(udpFlowTimeout))
+		backend.Write(buf[:n])
+	}
+}
+
+// flow returns client's socket towards the container, opening one and
+// relaying what comes back on it if client is new.
+func (p *udpProxy) flow(client net.Addr) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flows == nil {
+		return nil, net.ErrClosed
+	}
+	if backend, ok := p.flows[client.String()]; ok {
+		return backend, nil
+	}
+	backend, err := net.Dial("udp", p.target)
+	if err != nil {
+		return nil, err
+	}
+	p.flows[client.String()] = backend
+	go p.reply(client, backend)
+	return backend, nil
+}
+
+// reply sends what the container sends on backend back to client, until
+// the flow has been idle in both directions for udpFlowTimeout.
+func (p *udpProxy) reply(client net.Addr, backend net.Conn) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.flows, client.String())
+		p.mu.Unlock()
+		backend.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		backend.SetReadDeadline(time.Now().Add(udpFlowTimeout))
+		if _, err := p.conn.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+func (p *udpProxy) close() {
+	p.conn.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, backend := range p.flows {
+		backend.Close()
+	}
+	p.flows = nil
+}
@@ -8,21 +8,44 @@ import (
 	"io"
 	"os"
 	"path"
+	"runtime"
 	"syscall"
 )
 
-func chroot(command, dir string) error {
-	err := copyFile(command, path.Join(dir, command))
-	if err != nil {
-		return fmt.Errorf("copy file: %v", err)
+// prepareRootfs creates the paths the command expects in dir. A command
+// given as an absolute host path that the image lacks is copied in from the
+// host. Switching root happens in the container's init process so that
+// the parent keeps its view of the host and can clean dir up afterwards.
+func prepareRootfs(command, dir string) error {
+	return copyHostCommand(command, dir)
+}
+
+// checkShell checks that the shell a shell-form command runs in is in the
+// rootfs, so that a missing one is an error rather than the host's being
+// copied in by prepareRootfs. A shell without a path is left to be looked
+// up in the container's PATH.
+func checkShell(shell, rootfs string) error {
+	if !path.IsAbs(shell) {
+		return nil
 	}
-	err = os.MkdirAll(path.Join(dir, "dev/null"), 0755)
-	if err != nil {
-		return fmt.Errorf("mkdir: %v", err)
+	if _, err := os.Lstat(path.Join(rootfs, shell)); err != nil {
+		return fmt.Errorf("the image's command is in shell form, but the image has no %s to run it", shell)
 	}
-	err = syscall.Chroot(dir)
-	if err != nil {
-		return fmt.Errorf("chroot: %v", err)
+	return nil
+}
+
+func copyHostCommand(command, dir string) error {
+	if !path.IsAbs(command) {
+		return nil
+	}
+	if _, err := os.Lstat(path.Join(dir, command)); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(command); err != nil {
+		return nil
+	}
+	if err := copyFile(command, path.Join(dir, command)); err != nil {
+		return fmt.Errorf("copy file: %v", err)
 	}
 	return nil
 }
@@ -64,3 +87,262 @@ func copyFile(src, dest string) error {
 
 	return nil
 }
+
+// Values the parent sends over the sync pipe to release init.
+const (
+	syncContinue byte = iota
+	// syncReexec asks init to exec itself again first, to gain the
+	// capabilities it lacked because its user namespace had no ID mappings
+	// when it was started.
+	syncReexec
+	// syncStdio carries three file descriptors that init takes as its
+	// standard input, output and error before waiting for the next message.
+	syncStdio
+)
+
+// syncFd is init's end of the sync socket. It follows the file
+// descriptors passed to the container, if there are any.
+var syncFd = firstPreservedFd
+
+// statusFd is init's end of the status pipe, which the parent uses to time
+// init's progress. It is closed when init execs the container command.
+var statusFd = syncFd + 1
+
+// initReexecEnv tells a re-executed init that it has already been released.
+const initReexecEnv = "_DIY_DOCKER_INIT_REEXEC"
+
+// initCmd runs as PID 1 in the container's new namespaces. It finishes
+// setting up the filesystem from inside the mount namespace and then execs
+// the container command in its place. Its exit code, should it fail to get
+// that far, follows Docker: 125 for a failure to set up the container, 126
+// for a command that can't be run and 127 for one that doesn't exist.
+func initCmd(args []string) int {
+	if len(args) != 1 {
+		return 2
+	}
+	// Capabilities are per thread and exec takes the calling thread's, so
+	// everything up to exec has to happen on the same one.
+	runtime.LockOSThread()
+	preserved := preservedFds()
+	syncFd, statusFd = firstPreservedFd+preserved, firstPreservedFd+preserved+1
+	if os.Getenv(initReexecEnv) == "" {
+		msg, err := waitForParent()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+		if msg == syncReexec {
+			err := syscall.Exec("/proc/self/exe", os.Args, append(os.Environ(), initReexecEnv+"=1"))
+			fmt.Fprintf(os.Stderr, "re-exec init: %v\n", err)
+			return exitRunError
+		}
+	}
+	os.Unsetenv(initReexecEnv)
+	syscall.CloseOnExec(statusFd)
+	c, err := loadContainer(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	// Checked while /proc is still reachable.
+	clearGroups := !setgroupsDenied()
+	if err := setExecLabel(c.ProcessLabel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	caps := capabilitySet(c.Config.CapAdd, c.Config.CapDrop)
+	if !c.Config.Privileged {
+		if err := dropBoundingSet(caps); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+	}
+	if err := setupRootfs(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	syscall.Write(statusFd, []byte{0})
+	user, err := lookupUser(c.Config.User)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	if err := enterWorkingDir(c.Config.WorkingDir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	// Installing the filter needs CAP_SYS_ADMIN, which switching users or
+	// limiting capabilities may take away.
+	if c.Config.Seccomp != nil {
+		filterCaps := caps
+		if c.Config.Privileged {
+			filterCaps = capabilitySet([]string{"ALL"}, nil)
+		}
+		filter, err := compileSeccomp(c.Config.Seccomp, filterCaps)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+		if err := installSeccomp(filter); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+	}
+	var ambient map[string]bool
+	if !c.Config.Privileged {
+		ambient = ambientCapabilities(c.Config.CapAdd, user)
+	}
+	if len(ambient) > 0 {
+		if err := keepCapabilities(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+	}
+	if err := switchUser(user, clearGroups); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	if !c.Config.Privileged {
+		if err := limitCapabilities(caps, ambient); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+		if err := raiseAmbient(ambient); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+	}
+	// The rootfs is the root by now, and the command is looked up in the
+	// container's PATH rather than the one init inherited.
+	env := containerEnv(append(c.Config.Env, listenEnv(c, preserved)...), user.home)
+	command, err := lookPathIn("/", c.Config.Command, envPath(env))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return commandErrorCode(err)
+	}
+	argv := append([]string{c.Config.Command}, c.Config.Args...)
+	err = syscall.Exec(command, argv, env)
+	fmt.Fprintf(os.Stderr, "exec: %v\n", err)
+	return commandErrorCode(err)
+}
+
+// waitForParent blocks until the parent has finished setting up the
+// container from the outside and returns the message it was released
+// with. The parent closing the socket without writing means it gave up.
+func waitForParent() (byte, error) {
+	defer syscall.Close(syncFd)
+	msg := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(3*4))
+	for {
+		n, oobn, _, _, err := syscall.Recvmsg(syncFd, msg, oob, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("wait for parent: %v", err)
+		}
+		if msg[0] != syncStdio {
+			return msg[0], nil
+		}
+		if err := adoptStdio(oob[:oobn]); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// adoptStdio installs the file descriptors passed with a syncStdio message
+// as init's standard input, output and error.
+func adoptStdio(oob []byte) error {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil || len(msgs) != 1 {
+		return fmt.Errorf("receive stdio: bad control message")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 3 {
+		return fmt.Errorf("receive stdio: bad file descriptors")
+	}
+	for i, fd := range fds {
+		if err := syscall.Dup3(fd, i, 0); err != nil {
+			return fmt.Errorf("receive stdio: %v", err)
+		}
+		syscall.Close(fd)
+	}
+	return nil
+}
+
+func setupRootfs(c *Container) error {
+	if err := relabelContainer(c); err != nil {
+		return err
+	}
+	// Keep the mounts below from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %v", err)
+	}
+	// pivot_root needs the new root to be a mount point.
+	if err := syscall.Mount(c.Rootfs, c.Rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount rootfs: %v", err)
+	}
+	if err := mountKernelFS(c); err != nil {
+		return err
+	}
+	// Volumes go on top, so that they can be mounted under /dev too, and
+	// under a tmpfs.
+	if err := setupDev(c.Rootfs); err != nil {
+		return err
+	}
+	if err := mountTmpfs(c.Rootfs, c.Config.Tmpfs); err != nil {
+		return err
+	}
+	if err := bindMounts(c.Rootfs, c.Config.Mounts, c.Config.Owner != 0); err != nil {
+		return err
+	}
+	// Only the rootfs mount itself is made read-only, which leaves /dev,
+	// tmpfs mounts and writable volumes as they are. Mount points have all
+	// been created by now.
+	if c.Config.ReadOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", c.Rootfs, "", flags, ""); err != nil {
+			return fmt.Errorf("remount rootfs read-only: %v", err)
+		}
+	}
+	return pivotRoot(c.Rootfs)
+}
+
+// pivotRoot makes rootfs the root of the mount namespace and detaches the
+// old root. Unlike chroot, which a root process can escape and which leaves
+// the host's mounts in place, this leaves nothing of the host filesystem
+// reachable from the container. Stacking the old root under the new one
+// and unmounting it avoids needing a directory to put it in.
+func pivotRoot(rootfs string) error {
+	if err := os.Chdir(rootfs); err != nil {
+		return fmt.Errorf("chdir: %v", err)
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir: %v", err)
+	}
+	return nil
+}
+
+// enterWorkingDir changes into dir inside the container, creating it first
+// if the image doesn't have it.
+func enterWorkingDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %v", dir, err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("chdir %s: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// How pull progress is shown. Auto picks tty on a terminal that can move
+// the cursor and plain otherwise. JSON writes one object per line to
+// stdout, for programs that show progress their own way.
+const (
+	progressAuto  = "auto"
+	progressPlain = "plain"
+	progressTTY   = "tty"
+	progressJSON  = "json"
+)
+
+// On a terminal the layer lines are redrawn every progressInterval. In a
+// log, such as a CI job's, a line goes out for each downloading layer every
+// progressLogInterval instead.
+const (
+	progressInterval    = 100 * time.Millisecond
+	progressLogInterval = 5 * time.Second
+)
+
+// pullProgress reports per-layer pull progress. On a terminal it keeps one
+// line per layer up to date; otherwise it logs a line, or with JSON an
+// event, whenever a layer changes state, and periodically for layers that
+// are downloading. A nil *pullProgress reports nothing.
+type pullProgress struct {
+	out    io.Writer
+	mode   string
+	mu     sync.Mutex
+	layers []*layerProgress
+	drawn  int
+	// frame is what was drawn last, so that an unchanged frame isn't
+	// drawn again.
+	frame string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type layerProgress struct {
+	id      string
+	total   int64
+	current int64
+	resumed int64
+	status  string
+	started time.Time
+	// loggedStatus and loggedBytes are what was last logged, so that a log
+	// doesn't repeat itself.
+	loggedStatus string
+	loggedBytes  int64
+}
+
+// progressEvent is a line of --progress json. Current and Total are the
+// bytes of the layer downloaded so far and in all, and are 0 for events
+// about the pull as a whole, which have no ID.
+type progressEvent struct {
+	ID      string `json:"id,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current"`
+	Total   int64  `json:"total"`
+}
+
+func validateProgressMode(mode string) error {
+	switch mode {
+	case "", progressAuto, progressPlain, progressTTY, progressJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid --progress %q: expected %s, %s, %s or %s", mode, progressAuto, progressPlain, progressTTY, progressJSON)
+	}
+}
+
+func newPullProgress(mode string, quiet bool) *pullProgress {
+	if quiet {
+		return nil
+	}
+	switch mode {
+	case progressJSON:
+		return &pullProgress{out: os.Stdout, mode: mode}
+	case progressPlain, progressTTY:
+		return &pullProgress{out: os.Stderr, mode: mode}
+	}
+	// A dumb terminal can't move the cursor, so it gets the log.
+	mode = progressPlain
+	if isTerminal(os.Stderr) && os.Getenv("TERM") != "dumb" {
+		mode = progressTTY
+	}
+	return &pullProgress{out: os.Stderr, mode: mode}
+}
+
+// printPullStatus reports how a pull went once it is done, as text or, for
+// --progress json, as an event without a layer.
+func printPullStatus(mode, status string) {
+	if mode != progressJSON {
+		fmt.Println(status)
+		return
+	}
+	data, _ := json.Marshal(progressEvent{Status: status})
+	fmt.Println(string(data))
+}
+
+// add registers a layer so that it is listed, in order, before any data
+// arrives for it.
+func (p *pullProgress) add(digest string, total int64) *layerProgress {
+	if p == nil {
+		return nil
+	}
+	l := &layerProgress{id: shortDigest(digest), total: total, status: "Waiting"}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layers = append(p.layers, l)
+	// Output starts with the first layer, since a pull that fails before
+	// getting that far has nothing to show.
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.renderLoop(p.stop, p.done)
+	}
+	return l
+}
+
+func (p *pullProgress) setStatus(l *layerProgress, status string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if status == "Downloading" {
+		l.started = time.Now()
+	}
+	l.status = status
+	if p.mode != progressTTY && status != l.loggedStatus {
+		p.logLine(l)
+	}
+}
+
+// logLine logs l's line, or its event, and remembers what it said. The
+// caller must hold p.mu.
+func (p *pullProgress) logLine(l *layerProgress) {
+	if p.mode == progressJSON {
+		data, _ := json.Marshal(progressEvent{ID: l.id, Status: l.status, Current: l.current, Total: l.total})
+		fmt.Fprintln(p.out, string(data))
+	} else {
+		fmt.Fprintln(p.out, l.line())
+	}
+	l.loggedStatus = l.status
+	l.loggedBytes = l.current
+}
+
+// resume starts a (re)download of l from offset bytes in.
+func (p *pullProgress) resume(l *layerProgress, offset int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	l.current = offset
+	l.resumed = offset
+	p.mu.Unlock()
+	p.setStatus(l, "Downloading")
+}
+
+// reader counts the bytes read from r towards l.
+func (p *pullProgress) reader(l *layerProgress, r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p, l: l}
+}
+
+func (p *pullProgress) advance(l *layerProgress, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l.current += int64(n)
+}
+
+// close draws the final state and stops the render loop.
+func (p *pullProgress) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (p *pullProgress) renderLoop(stop, done chan struct{}) {
+	defer close(done)
+	interval := progressLogInterval
+	if p.mode != progressPlain {
+		interval = progressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.render()
+		case <-stop:
+			if p.mode == progressTTY {
+				p.render()
+			}
+			return
+		}
+	}
+}
+
+// render brings the output up to date. On a terminal it redraws every
+// layer line in place by moving the cursor back up over the lines drawn
+// last time, cut to the width of the terminal so that none of them wraps
+// onto a line of its own. Otherwise it logs the layers that have made
+// progress since they were last logged.
+func (p *pullProgress) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mode != progressTTY {
+		for _, l := range p.layers {
+			if l.status == "Downloading" && l.current != l.loggedBytes {
+				p.logLine(l)
+			}
+		}
+		return
+	}
+	width := terminalWidth(p.out)
+	var frame strings.Builder
+	for _, l := range p.layers {
+		line := l.line()
+		if width > 0 && len(line) >= width {
+			line = line[:width-1]
+		}
+		fmt.Fprintf(&frame, "\x1b[2K%s\n", line)
+	}
+	if frame.String() == p.frame {
+		return
+	}
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA", p.drawn)
+	}
+	io.WriteString(p.out, frame.String())
+	p.frame = frame.String()
+	p.drawn = len(p.layers)
+}
+
+func (l *layerProgress) line() string {
+	if l.status != "Downloading" {
+		return fmt.Sprintf("%s: %s", l.id, l.status)
+	}
+	line := fmt.Sprintf("%s: %s %s/%s", l.id, l.status, formatBytes(l.current), formatBytes(l.total))
+	if l.total > 0 {
+		line += fmt.Sprintf(" %3d%%", l.current*100/l.total)
+	}
+	if elapsed := time.Since(l.started).Seconds(); elapsed > 0 {
+		line += fmt.Sprintf(" %s/s", formatBytes(int64(float64(l.current-l.resumed)/elapsed)))
+	}
+	return line
+}
+
+type progressReader struct {
+	r io.Reader
+	p *pullProgress
+	l *layerProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.p.advance(r.l, n)
+	}
+	return n, err
+}
+
+func shortDigest(digest string) string {
+	if len(digest) > 7 && digest[:7] == "sha256:" {
+		digest = digest[7:]
+	}
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return digest
+}
+
+// formatBytes renders n with decimal units, as docker does.
+func formatBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+// terminalWidth returns the number of columns of the terminal w writes to,
+// or 0 if it doesn't know.
+func terminalWidth(w io.Writer) int {
+	f, ok := w.(*os.File)
+	if !ok {
+		return 0
+	}
+	var ws struct{ rows, cols, x, y uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0
+	}
+	return int(ws.cols)
+}
+
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
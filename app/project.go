@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// projectEnv sets the default project, like COMPOSE_PROJECT_NAME.
+const projectEnv = "DIY_DOCKER_PROJECT"
+
+var projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// addProjectFlag registers --project on fs. Containers created in a project
+// are only listed by commands run in the same project, so that several apps
+// can share a host without seeing each other's containers.
+func addProjectFlag(fs *flag.FlagSet) *string {
+	return fs.String("project", os.Getenv(projectEnv), "project to scope containers to (default $"+projectEnv+")")
+}
+
+func validateProject(name string) error {
+	if name != "" && !projectNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid project name %q: must be lowercase letters, digits, '-' and '_'", name)
+	}
+	return nil
+}
+
+// inProject reports whether c belongs to project. An empty project matches
+// every container.
+func (c *Container) inProject(project string) bool {
+	return project == "" || c.Config.Project == project
+}
@@ -0,0 +1,361 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// blobGracePeriod protects blobs written recently from image prune. A pull
+// stores an image's blobs before it records the image, and a pull that
+// finds a layer already there relies on it staying, so a blob nothing
+// refers to yet may be about to be.
+const blobGracePeriod = time.Hour
+
+// imageCmd manages the image store.
+func imageCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: image <ls|prune|copy> [args...]")
+		return 2
+	}
+	switch args[0] {
+	case "ls":
+		return imagesCmd(args[1:])
+	case "prune":
+		return imagePruneCmd(args[1:])
+	case "copy":
+		return imageCopyCmd(args[1:])
+	default:
+		fmt.Printf("unknown image command: %s\n", args[0])
+		return 2
+	}
+}
+
+// containerPruneCmd removes every exited container. Created containers are
+// kept, since they may be being set up to start.
+func containerPruneCmd(args []string) int {
+	fs := flag.NewFlagSet("container prune", flag.ContinueOnError)
+	project := addProjectFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: container prune [--project NAME]")
+		return 2
+	}
+	if err := validateProject(*project); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	reclaimed, err := pruneContainers(*project)
+	fmt.Printf("Total reclaimed space: %s\n", formatBytes(reclaimed))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// imagePruneCmd deletes the blobs no stored image refers to, and with -a
+// first forgets the images no container was created from.
+func imagePruneCmd(args []string) int {
+	fs := flag.NewFlagSet("image prune", flag.ContinueOnError)
+	all := fs.Bool("a", false, "also remove images no container uses")
+	maxSize := fs.String("max-size", "", "remove the least recently used images no container uses until the store fits in this size, such as 10g")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: image prune [-a] [--max-size SIZE]")
+		return 2
+	}
+	var limit int64
+	if *maxSize != "" {
+		var err error
+		if limit, err = parseByteSize(*maxSize); err != nil || limit <= 0 {
+			fmt.Printf("invalid --max-size %q\n", *maxSize)
+			return 2
+		}
+	}
+	reclaimed, err := pruneImages(*all, limit)
+	fmt.Printf("Total reclaimed space: %s\n", formatBytes(reclaimed))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// systemPruneCmd prunes containers and then images, so that the images of
+// the removed containers can go too with -a.
+func systemPruneCmd(args []string) int {
+	fs := flag.NewFlagSet("system prune", flag.ContinueOnError)
+	all := fs.Bool("a", false, "also remove images no container uses")
+	project := addProjectFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: system prune [-a] [--project NAME]")
+		return 2
+	}
+	if err := validateProject(*project); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	reclaimed, err := pruneContainers(*project)
+	if err == nil {
+		var n int64
+		n, err = pruneImages(*all, 0)
+		reclaimed += n
+	}
+	fmt.Printf("Total reclaimed space: %s\n", formatBytes(reclaimed))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// pruneContainers removes the exited containers in project, printing their
+// IDs, and returns how much space their directories took.
+func pruneContainers(project string) (int64, error) {
+	containers, err := listContainers()
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	printed := false
+	for _, c := range containers {
+		if c.Status != statusExited || !c.inProject(project) {
+			continue
+		}
+		size := c.diskUsage()
+		if err := c.remove(); err != nil {
+			return reclaimed, err
+		}
+		if !printed {
+			fmt.Println("Deleted Containers:")
+			printed = true
+		}
+		fmt.Println(c.ID)
+		reclaimed += size
+	}
+	return reclaimed, nil
+}
+
+// pruneImages deletes the blobs that no stored image refers to, counting
+// references by digest, so a layer shared by several images stays until
+// the last of them is gone. With all, images that no container was created
+// from are forgotten first. With maxSize, so are as many of those as it
+// takes, least recently used first, for the blobs left to fit in maxSize.
+func pruneImages(all bool, maxSize int64) (int64, error) {
+	s, err := openImageStore()
+	if err != nil {
+		return 0, err
+	}
+	var used map[string]bool
+	if all || maxSize > 0 {
+		containers, err := listContainers()
+		if err != nil {
+			return 0, err
+		}
+		used = make(map[string]bool)
+		for _, c := range containers {
+			used[c.ImageID] = true
+			if c.Config.Image != "" {
+				used[normalizeRef(c.Config.Image)] = true
+			}
+		}
+	}
+	// The daemon's tenants pull into the same blobs.
+	tenantRefs := make(map[string]int)
+	tenants, err := s.tenantStores()
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tenants {
+		repos, err := t.readRepositories()
+		if err != nil {
+			return 0, err
+		}
+		for _, img := range repos {
+			for _, digest := range img.blobs() {
+				tenantRefs[digest]++
+			}
+		}
+	}
+	var untagged []string
+	refs := maps.Clone(tenantRefs)
+	err = s.updateRepositories(func(repos map[string]*Image) error {
+		for ref, img := range repos {
+			if all && !used[ref] && !used[img.ID()] {
+				delete(repos, ref)
+				untagged = append(untagged, ref)
+			}
+		}
+		if maxSize > 0 {
+			untagged = append(untagged, s.evictImages(repos, used, tenantRefs, maxSize)...)
+		}
+		for _, img := range repos {
+			for _, digest := range img.blobs() {
+				refs[digest]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range untagged {
+		fmt.Printf("Untagged: %s\n", ref)
+	}
+	var reclaimed int64
+	dir := path.Join(s.dir, "blobs")
+	algos, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("read blobs: %v", err)
+	}
+	for _, algo := range algos {
+		entries, err := os.ReadDir(path.Join(dir, algo.Name()))
+		if err != nil {
+			return reclaimed, fmt.Errorf("read blobs: %v", err)
+		}
+		for _, e := range entries {
+			// Partial downloads are kept for the next pull to resume.
+			if strings.HasSuffix(e.Name(), ".partial") {
+				continue
+			}
+			digest := algo.Name() + ":" + e.Name()
+			if refs[digest] > 0 {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil || time.Since(fi.ModTime()) < blobGracePeriod {
+				continue
+			}
+			if err := os.Remove(s.blobPath(digest)); err != nil {
+				return reclaimed, fmt.Errorf("remove blob: %v", err)
+			}
+			fmt.Printf("Deleted: %s\n", digest)
+			reclaimed += fi.Size()
+		}
+	}
+	return reclaimed, nil
+}
+
+// evictImages forgets the least recently used images in repos that no
+// container was created from, until the blobs the rest refer to, along with
+// those of the tenants in tenantRefs, take up at most maxSize. It returns
+// the refs it forgot.
+func (s *imageStore) evictImages(repos map[string]*Image, used map[string]bool, tenantRefs map[string]int, maxSize int64) []string {
+	refs := maps.Clone(tenantRefs)
+	sizes := make(map[string]int64)
+	var total int64
+	count := func(digest string) {
+		if _, ok := sizes[digest]; !ok {
+			if fi, err := os.Stat(s.blobPath(digest)); err == nil {
+				sizes[digest] = fi.Size()
+			}
+			total += sizes[digest]
+		}
+	}
+	for digest := range tenantRefs {
+		count(digest)
+	}
+	var candidates []*Image
+	for ref, img := range repos {
+		for _, digest := range img.blobs() {
+			count(digest)
+			refs[digest]++
+		}
+		if !used[ref] && !used[img.ID()] {
+			candidates = append(candidates, img)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed().Before(candidates[j].lastUsed()) })
+	var evicted []string
+	for _, img := range candidates {
+		if total <= maxSize {
+			break
+		}
+		// An image whose blobs all have other users would free nothing.
+		own := make(map[string]int)
+		for _, digest := range img.blobs() {
+			own[digest]++
+		}
+		frees := false
+		for digest, n := range own {
+			frees = frees || refs[digest] == n
+		}
+		if !frees {
+			continue
+		}
+		delete(repos, img.Ref)
+		evicted = append(evicted, img.Ref)
+		for _, digest := range img.blobs() {
+			if refs[digest]--; refs[digest] == 0 {
+				total -= sizes[digest]
+			}
+		}
+	}
+	return evicted
+}
+
+// diskUsage is what c takes up on disk: its directory, and its rootfs
+// where that lives elsewhere.
+func (c *Container) diskUsage() int64 {
+	size := diskUsage(c.dir())
+	if c.separateRootfs() {
+		size += diskUsage(c.Rootfs)
+	}
+	return size
+}
+
+// diskUsage adds up the sizes of the files under root, counting files with
+// several links once and not descending into other filesystems.
+func diskUsage(root string) int64 {
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return 0
+	}
+	dev := rootInfo.Sys().(*syscall.Stat_t).Dev
+	seen := make(map[uint64]bool)
+	var total int64
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if d.IsDir() && st.Dev != dev {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if st.Nlink > 1 {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		total += fi.Size()
+		return nil
+	})
+	return total
+}
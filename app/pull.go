@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// pullCmd pulls an image into the store. With --path, it extracts only the
+// paths given into the -o directory instead, leaving the store without the
+// image.
+func pullCmd(args []string) int {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	var opts PullOptions
+	addPullFlags(fs, &opts)
+	var pathSpecs stringsFlag
+	fs.Var(&pathSpecs, "path", "extract only this path of the image, with what is below it, into the -o directory (repeatable)")
+	output := fs.String("o", "", "directory to extract the --path paths into")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: pull [options] [--path PATH... -o DIR] <image>")
+		return 2
+	}
+	if (len(pathSpecs) > 0) != (*output != "") {
+		fmt.Println("--path and -o go together")
+		return 2
+	}
+	paths, err := parsePullPaths(pathSpecs)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	old, err := store.lookup(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	client, err := newPullClient(fs.Arg(0), store, opts)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	// Stop the downloads on Ctrl-C so that what has arrived is flushed
+	// for the next pull to resume.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(paths) > 0 {
+		status := func(s string) {
+			if !opts.Quiet {
+				printPullStatus(opts.Progress, s)
+			}
+		}
+		if err := client.pullPaths(ctx, paths, *output, status); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		printPullStatus(opts.Progress, "Status: Extracted "+strings.Join(paths, ", ")+" of "+canonicalRef(client.name, client.reference)+" into "+*output)
+		return 0
+	}
+	img, err := client.Pull(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	printPullStatus(opts.Progress, "Digest: "+img.Digest)
+	if old != nil && old.Digest == img.Digest {
+		printPullStatus(opts.Progress, "Status: Image is up to date for "+img.Ref)
+	} else {
+		printPullStatus(opts.Progress, "Status: Downloaded newer image for "+img.Ref)
+	}
+	return 0
+}
+
+// ensureImage returns the stored image for ref, pulling it first if the
+// store doesn't have it yet.
+func ensureImage(ctx context.Context, store *imageStore, ref string, opts PullOptions, timer *startupTimer) (*Image, error) {
+	img, err := store.lookup(ref)
+	timer.mark("resolve")
+	if err != nil {
+		return nil, err
+	}
+	if img != nil {
+		return img, nil
+	}
+	client, err := newPullClient(ref, store, opts)
+	if err != nil {
+		return nil, err
+	}
+	img, err = client.Pull(ctx)
+	timer.mark("pull")
+	return img, err
+}
@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A container's writable layer can be a whole image's worth of files, and
+// deleting it can take minutes. Rather than have rm wait for that, what is
+// to be deleted is renamed into deletingDirName, which is instant, and a
+// reaper process deletes it in the background.
+const deletingDirName = "deleting"
+
+// reapWorkers is how many files are unlinked at once. Unlinking is mostly
+// the filesystem freeing inodes, which it can do for several at a time.
+var reapWorkers = max(4, runtime.NumCPU())
+
+func deletingDir() string {
+	return path.Join(stateDir(), deletingDirName)
+}
+
+// discardDir deletes dir in the background, leaving nothing at dir by the
+// time it returns. A dir that can't be moved out of the way, being on
+// another filesystem, say, is deleted then and there.
+func discardDir(dir string) error {
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(deletingDir(), 0700); err != nil {
+		return deleteTree(dir)
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	if err := os.Rename(dir, path.Join(deletingDir(), path.Base(dir)+"-"+hex.EncodeToString(b))); err != nil {
+		return deleteTree(dir)
+	}
+	startReaper()
+	return nil
+}
+
+// startReaper starts a detached reaper to empty deletingDir. If it can't
+// be started, what it would have deleted waits for the next one.
+func startReaper() {
+	reaper := exec.Command("/proc/self/exe", "reap")
+	reaper.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := reaper.Start(); err == nil {
+		reaper.Process.Release()
+	}
+}
+
+// reapCmd is the internal entry point of the reaper. Reapers take turns, so
+// that each has the disk to itself, and each deletes whatever is in
+// deletingDir by the time it gets its turn, which takes care of anything
+// an earlier one left behind.
+func reapCmd(args []string) int {
+	if len(args) != 0 {
+		return 2
+	}
+	unlock, err := lockState("reap")
+	if err != nil {
+		return 1
+	}
+	defer unlock()
+	entries, err := os.ReadDir(deletingDir())
+	if err != nil {
+		return 1
+	}
+	code := 0
+	for _, e := range entries {
+		if err := deleteTree(path.Join(deletingDir(), e.Name())); err != nil {
+			code = 1
+		}
+	}
+	return code
+}
+
+// deleteTree deletes dir and everything in it. It walks the tree on its own
+// and has reapWorkers unlink the files it finds, then removes the emptied
+// directories deepest first. On btrfs a subvolume is deleted whole, which
+// takes no time at all. Whatever that leaves is handed to os.RemoveAll.
+func deleteTree(dir string) error {
+	btrfs := onBtrfs(dir)
+	var eg errgroup.Group
+	eg.SetLimit(reapWorkers)
+	var dirs []string
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			eg.Go(func() error {
+				return syscall.Unlink(p)
+			})
+			return nil
+		}
+		if btrfs && deleteSubvolume(p) == nil {
+			return fs.SkipDir
+		}
+		dirs = append(dirs, p)
+		return nil
+	})
+	eg.Wait()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		syscall.Rmdir(dirs[i])
+	}
+	return os.RemoveAll(dir)
+}
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	// btrfsFirstFreeObjectID is the inode number of the root directory of
+	// every subvolume.
+	btrfsFirstFreeObjectID = 256
+	// btrfsIocSnapDestroy is _IOW(0x94, 15, struct btrfs_ioctl_vol_args).
+	btrfsIocSnapDestroy = 0x5000940f
+)
+
+// btrfsVolArgs is struct btrfs_ioctl_vol_args.
+type btrfsVolArgs struct {
+	fd   int64
+	name [4088]byte
+}
+
+func onBtrfs(p string) bool {
+	var st syscall.Statfs_t
+	return syscall.Statfs(p, &st) == nil && st.Type == btrfsSuperMagic
+}
+
+// deleteSubvolume deletes p if it is a btrfs subvolume. Doing so takes root,
+// or a filesystem mounted with user_subvol_rm_allowed.
+func deleteSubvolume(p string) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return err
+	}
+	if st.Ino != btrfsFirstFreeObjectID {
+		return errors.New("not a subvolume")
+	}
+	parent, err := os.Open(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	var args btrfsVolArgs
+	copy(args.name[:len(args.name)-1], path.Base(p))
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, parent.Fd(), btrfsIocSnapDestroy, uintptr(unsafe.Pointer(&args))); errno != 0 {
+		return errno
+	}
+	return nil
+}
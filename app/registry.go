@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// dockerHubURL is the registry library images are pulled from when no
+// mirror is configured or the mirror fails.
+const dockerHubURL = "https://registry.hub.docker.com"
+
+// parseRegistryMirror checks a --registry-mirror URL and returns it
+// without a trailing slash.
+func parseRegistryMirror(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("invalid --registry-mirror %q: expected a URL such as https://mirror.example.com", mirror)
+	}
+	return strings.TrimSuffix(mirror, "/"), nil
+}
+
+// newRegistryHTTPClient returns a client that gives up on a registry that
+// doesn't answer. It sets no overall timeout, since a large layer may
+// rightly take minutes; stalled downloads are caught by fetchBlob instead.
+// Proxies are taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newRegistryHTTPClient(o PullOptions) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = responseHeaderTimeout
+	if len(o.CACerts) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, f := range o.CACerts {
+			pem, err := os.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("read CA certificate: %v", err)
+			}
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("read CA certificate: no certificates in %s", f)
+			}
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	if len(o.InsecureRegistries) == 0 {
+		return &http.Client{Transport: t}, nil
+	}
+	insecure := t.Clone()
+	insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	hosts := make([]string, len(o.InsecureRegistries))
+	for i, r := range o.InsecureRegistries {
+		hosts[i] = registryHost(r)
+	}
+	return &http.Client{Transport: &registryTransport{secure: t, insecure: insecure, insecureHosts: hosts}}, nil
+}
+
+// registryTransport skips verifying the certificates of the hosts given
+// with --insecure-registry and only theirs.
+type registryTransport struct {
+	secure, insecure http.RoundTripper
+	insecureHosts    []string
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if slices.Contains(t.insecureHosts, req.URL.Hostname()) {
+		return t.insecure.RoundTrip(req)
+	}
+	return t.secure.RoundTrip(req)
+}
+
+// registryHost returns the host of an --insecure-registry value, which may
+// be given as a host, host:port or URL.
+func registryHost(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Host
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"syscall"
+)
+
+// Kinds of host resources a container can own.
+const (
+	resourceVeth   = "veth"
+	resourceMount  = "mount"
+	resourceCgroup = "cgroup"
+	// resourceConntrack is the connection tracking entries of a bridge
+	// address, which are flushed once the container is done with it.
+	resourceConntrack = "conntrack"
+)
+
+// Resource is something a container created on the host that outlives its
+// processes unless it is torn down, such as the host end of a veth pair or
+// a mount made in the host's mount namespace. Mounts made inside the
+// container's mount namespace go away with it and are not tracked.
+type Resource struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// track records a resource in the container's manifest. It is called
+// before the resource is created, so that a crash in between leaves
+// something to clean up rather than a leak.
+func (c *Container) track(kind, id string) error {
+	c.Resources = append(c.Resources, Resource{Kind: kind, ID: id})
+	return c.save()
+}
+
+// releaseResources tears down the container's resources, newest first, and
+// drops them from the manifest. Resources that are already gone count as
+// released; ones that fail stay listed so that a later attempt can retry.
+func (c *Container) releaseResources() error {
+	if len(c.Resources) == 0 {
+		return nil
+	}
+	var errs []error
+	var kept []Resource
+	for i := len(c.Resources) - 1; i >= 0; i-- {
+		r := c.Resources[i]
+		if err := releaseResource(r); err != nil {
+			errs = append(errs, fmt.Errorf("release %s %s: %v", r.Kind, r.ID, err))
+			kept = append([]Resource{r}, kept...)
+		}
+	}
+	c.Resources = kept
+	if err := c.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func releaseResource(r Resource) error {
+	switch r.Kind {
+	case resourceVeth:
+		if _, err := net.InterfaceByName(r.ID); err != nil {
+			return nil
+		}
+		return runCommand("ip", "link", "del", r.ID)
+	case resourceMount:
+		mounts, err := readMountpoints()
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(mounts, r.ID) {
+			return nil
+		}
+		return syscall.Unmount(r.ID, syscall.MNT_DETACH)
+	case resourceCgroup:
+		return removeCgroup(r.ID)
+	case resourceConntrack:
+		return flushConntrack(r.ID)
+	default:
+		return fmt.Errorf("unknown resource kind")
+	}
+}
+
+// recoverContainers releases what containers left behind when nothing was
+// around to clean up after them, for example because their shim or the
+// foreground run waiting on them was killed. Their records still say
+// running, which loading corrects in memory and this makes last, removing
+// those that asked to be removed. Warm sandboxes of a pool that died are
+// removed altogether.
+func recoverContainers() {
+	containers, err := listContainers()
+	if err != nil {
+		return
+	}
+	for _, c := range containers {
+		switch {
+		case c.abandoned && !c.supervised():
+			recoverAbandoned(c.ID)
+		case c.Status == statusWarm && !c.active():
+			c.releaseResources()
+			c.remove()
+		case c.Status == statusExited && len(c.Resources) > 0:
+			c.releaseResources()
+		}
+	}
+}
+
+// recoverAbandoned settles a container whose process died along with its
+// supervisor. The record is read again now that there is certainly no
+// supervisor, since one may have recorded the exit and let go of its lock
+// after the first read.
+func recoverAbandoned(id string) {
+	c, err := loadContainer(id)
+	if err != nil || !c.abandoned {
+		return
+	}
+	recordExit(c, c.ExitCode)
+	c.releaseResources()
+	if c.Config.AutoRemove {
+		c.remove()
+		return
+	}
+	c.markExited(c.ExitCode)
+}
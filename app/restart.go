@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restart policies, as in Docker.
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// The shim waits before restarting a container, doubling the delay after
+// each restart in a row up to a limit. A container that stayed up for a
+// while is taken to have recovered, and the delay starts over.
+const (
+	restartDelayMin   = 100 * time.Millisecond
+	restartDelayMax   = time.Minute
+	restartResetAfter = 10 * time.Second
+)
+
+// RestartPolicy says when the shim restarts the container after it exits.
+type RestartPolicy struct {
+	Name string `json:"name,omitempty"`
+	// MaxRetries limits the restarts of on-failure, with 0 for no limit.
+	MaxRetries int `json:"maxRetries,omitempty"`
+}
+
+// parseRestartPolicy parses --restart no|on-failure[:max]|always.
+func parseRestartPolicy(value string) (RestartPolicy, error) {
+	name, max, hasMax := strings.Cut(value, ":")
+	policy := RestartPolicy{Name: name}
+	switch name {
+	case restartNo, restartAlways:
+		if hasMax {
+			return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: only %s takes a maximum", value, restartOnFailure)
+		}
+	case restartOnFailure:
+		if !hasMax {
+			break
+		}
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 0 {
+			return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: the maximum must be a number of retries", value)
+		}
+		policy.MaxRetries = n
+	default:
+		return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: expected %s, %s[:max] or %s", value, restartNo, restartOnFailure, restartAlways)
+	}
+	return policy, nil
+}
+
+func (p RestartPolicy) enabled() bool {
+	return p.Name != "" && p.Name != restartNo
+}
+
+func (p RestartPolicy) String() string {
+	if p.Name == restartOnFailure && p.MaxRetries > 0 {
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	}
+	if p.Name == "" {
+		return restartNo
+	}
+	return p.Name
+}
+
+// shouldRestart reports whether a container that exited with code after
+// restarts restarts is to be started again.
+func (p RestartPolicy) shouldRestart(code, restarts int) bool {
+	switch p.Name {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return code != 0 && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	default:
+		return false
+	}
+}
+
+// stoppedFileName marks a container that was stopped by hand. It is a file
+// of its own rather than part of the record because the shim saves the
+// record from its own copy, which would undo the mark.
+const stoppedFileName = "stopped"
+
+// markStopped keeps c's restart policy from starting it again.
+func (c *Container) markStopped() error {
+	if err := os.WriteFile(path.Join(c.dir(), stoppedFileName), nil, 0644); err != nil {
+		return fmt.Errorf("mark stopped: %v", err)
+	}
+	return nil
+}
+
+// stoppedManually reports whether c was stopped, or removed altogether,
+// since it was started.
+func (c *Container) stoppedManually() bool {
+	_, err := os.Stat(path.Join(c.dir(), stoppedFileName))
+	if err == nil {
+		return true
+	}
+	_, err = os.Stat(c.dir())
+	return os.IsNotExist(err)
+}
+
+// awaitRestart decides whether the shim starts c again after it exited
+// with code, and if so waits out delay first. It gives up if c was stopped
+// or removed in the meantime.
+func awaitRestart(c *Container, code int, delay time.Duration) bool {
+	if c.stoppedManually() || !c.Config.Restart.shouldRestart(code, c.RestartCount) {
+		return false
+	}
+	c.Status = statusRestarting
+	c.ExitCode = code
+	c.FinishedAt = time.Now()
+	if err := c.save(); err != nil {
+		return false
+	}
+	time.Sleep(delay)
+	if c.stoppedManually() {
+		return false
+	}
+	c.RestartCount++
+	return true
+}
@@ -0,0 +1,927 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func runCmd(args []string) int {
+	cfg, err := parseRunArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	return runContainer(cfg)
+}
+
+// runContainer creates a container from cfg, pulls its image and either
+// runs it in the foreground or hands it to a shim when cfg.Detach is set.
+// A warm sandbox from a running pool is used instead if one fits.
+//
+// A foreground run exits with the container's exit code. Its own errors go
+// to stderr and exit with 125, so that stdout carries only what the
+// container wrote.
+func runContainer(cfg *ContainerConfig) int {
+	sigs, stopNotify := notifySignals()
+	defer stopNotify()
+	timer := newStartupTimer(cfg.TimeStartup)
+	// A pooled container is waited on by the pool, so what it used can
+	// only be told by running it here.
+	if !cfg.TimeUsage {
+		if code, ok := runPooled(cfg, sigs, timer); ok {
+			return code
+		}
+	}
+	recoverContainers()
+	c, err := newContainer(*cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	if c.preserved, err = inheritFiles(cfg.PreserveFDs); err != nil {
+		c.remove()
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	// The lock is let go of last, once the container is settled one way or
+	// the other.
+	unlock, err := c.lockSupervisor()
+	if err != nil {
+		c.remove()
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	defer unlock()
+	keep := false
+	defer func() {
+		if !keep {
+			c.remove()
+		}
+	}()
+	if cfg.RootfsTmpfs {
+		if err := mountRootfsTmpfs(c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+	}
+	store, err := openImageStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	type pullResult struct {
+		img    *Image
+		config *ImageConfig
+		err    error
+	}
+	pulled := make(chan pullResult, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		img, config, err := provisionRootfs(ctx, store, c, cfg.Pull, timer)
+		pulled <- pullResult{img, config, err}
+	}()
+	var res pullResult
+	select {
+	case res = <-pulled:
+	case sig := <-sigs:
+		return 128 + int(sig.(syscall.Signal))
+	}
+	if res.err != nil {
+		fmt.Fprintln(os.Stderr, res.err)
+		return exitRunError
+	}
+	if err := configureContainer(c, res.img, res.config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	timer.mark("rootfs")
+	// A signal that came while the rootfs was set up stops the run before
+	// the container starts rather than being its first.
+	select {
+	case sig := <-sigs:
+		return 128 + int(sig.(syscall.Signal))
+	default:
+	}
+	if cfg.Detach {
+		if err := startShim(c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitRunError
+		}
+		keep = true
+		// The shim reports the remaining phases in the container's log.
+		timer.mark("shim")
+		timer.report(os.Stderr)
+		fmt.Println(c.ID)
+		return 0
+	}
+	logger, err := newContainerLogger(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	defer logger.Close()
+	stdout, stderr := logger.stream("stdout", os.Stdout), logger.stream("stderr", os.Stderr)
+	defer stdout.Close()
+	defer stderr.Close()
+	cmd, err := startContainer(c, os.Stdin, stdout, stderr, timer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cmd start: %v\n", err)
+		return exitRunError
+	}
+	// However the run ends from here on, the container goes with it and
+	// leaves nothing on the host.
+	waited := false
+	defer func() {
+		if !waited {
+			cmd.Process.Kill()
+			cmd.Wait()
+			c.releaseResources()
+		}
+	}()
+	timer.report(os.Stderr)
+	stopPublish, err := publishPorts(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRunError
+	}
+	stopHealth := monitorHealth(c)
+	stopMemory := monitorMemory(c)
+	stopForward := forwardSignals(sigs, cmd.Process, time.Duration(cfg.StopTimeout)*time.Second)
+	stopTimeout := enforceTimeout(cmd.Process, cfg.Timeout, time.Duration(cfg.StopTimeout)*time.Second)
+	cmd.Wait()
+	waited = true
+	c.TimedOut = stopTimeout()
+	stopForward()
+	stopHealth()
+	stopMemory()
+	stopPublish()
+	code := exitCode(cmd.ProcessState)
+	if c.TimedOut {
+		fmt.Fprintf(os.Stderr, "container %s timed out after %s\n", c.shortID(), cfg.Timeout)
+		code = exitTimedOut
+	}
+	recordExit(c, code)
+	if cfg.TimeUsage {
+		newUsageReport(c, cmd.ProcessState).write(os.Stderr)
+	}
+	c.releaseResources()
+	if !cfg.AutoRemove {
+		keep = true
+		c.markExited(code)
+	}
+	return code
+}
+
+// provisionRootfs pulls c's image if need be and unpacks it into c's
+// rootfs, returning it along with its config. A container on a directory
+// has neither.
+func provisionRootfs(ctx context.Context, store *imageStore, c *Container, pull PullOptions, timer *startupTimer) (*Image, *ImageConfig, error) {
+	if c.Config.RootfsPath != "" {
+		return nil, &ImageConfig{}, nil
+	}
+	img, err := ensureImage(ctx, store, c.Config.Image, pull, timer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.unpack(img, c.Rootfs); err != nil {
+		return nil, nil, err
+	}
+	// Root unpacks the image as it is, which a container whose root is a
+	// daemon client wouldn't own.
+	if c.Config.Rootless && c.Config.Owner != 0 {
+		if err := shiftOwnership(c, c.Rootfs); err != nil {
+			return nil, nil, fmt.Errorf("shift rootfs ownership: %v", err)
+		}
+	}
+	// Failing to record the use only makes the image look older to image
+	// prune --max-size.
+	store.markUsed(img)
+	config, err := store.imageConfig(img)
+	timer.mark("unpack")
+	return img, config, err
+}
+
+// configureContainer records the image c was created from, fills in c's
+// config from it and finishes c's rootfs, leaving c ready to start.
+func configureContainer(c *Container, img *Image, config *ImageConfig) error {
+	if img != nil {
+		c.ImageID = img.ID()
+	}
+	c.ImageConfig = *config
+	shell, err := applyImageConfig(&c.Config, config)
+	if err != nil {
+		return err
+	}
+	if err := assignHostPorts(c); err != nil {
+		return err
+	}
+	if err := c.save(); err != nil {
+		return err
+	}
+	recordContainerEvent(c, eventCreate, nil)
+	if err := checkShell(shell, c.Rootfs); err != nil {
+		return err
+	}
+	// A directory rootfs belongs to the user and is left as it is.
+	if c.Config.RootfsPath == "" {
+		if err := prepareRootfs(c.Config.Command, c.Rootfs); err != nil {
+			return err
+		}
+	}
+	return writeResolvConf(c)
+}
+
+// parseRunFlags parses run's arguments as they are, without the image's
+// default run options.
+func parseRunFlags(args []string) (*ContainerConfig, error) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	stopTimeout := fs.Int("stop-timeout", 10, "seconds to wait for the container to exit after a signal before killing it")
+	timeout := fs.Duration("timeout", 0, "stop the container once it has run this long, exiting with 124 (default no limit)")
+	detach := fs.Bool("d", false, "run the container in the background and print its ID")
+	name := fs.String("name", "", "name of the container (default a generated one)")
+	preserveFds := fs.Int("preserve-fds", 0, "pass the container this many file descriptors from 3 on, besides stdio (sockets systemd passed in LISTEN_FDS are passed anyway)")
+	var pull PullOptions
+	addPullFlags(fs, &pull)
+	var volumes, envs, envFiles, publish, capAdd, capDrop, securityOpts, logOpts, annotations, deviceRules, tmpfsSpecs stringsFlag
+	fs.Var(&volumes, "v", "bind mount a host path: /host:/container[:ro] (repeatable)")
+	fs.Var(&tmpfsSpecs, "tmpfs", "mount a tmpfs: /container[:OPTIONS], with options such as size=64m, mode=1777 or exec (repeatable)")
+	readOnly := fs.Bool("read-only", false, "mount the rootfs read-only")
+	bindMissing := fs.String("bind-missing", bindMissingError, "what to do about a -v host path that doesn't exist: error or create it as a directory")
+	bindOwner := fs.String("bind-owner", "", "owner of the host directories --bind-missing create makes: UID[:GID]")
+	fs.Var(&envs, "e", "set an environment variable: KEY=VALUE, or KEY to copy it from the host (repeatable)")
+	fs.Var(&envFiles, "env-file", "read environment variables from a file (repeatable)")
+	workdir := fs.String("w", "", "working directory inside the container")
+	entrypoint := fs.String("entrypoint", "", "run this in place of the image's ENTRYPOINT, dropping its CMD: an executable, a JSON array such as '[\"sh\", \"-c\"]', or \"\" to clear it")
+	user := fs.String("u", "", "user to run as: name|uid[:group|gid]")
+	network := fs.String("network", networkHost, "network mode: bridge, host or none")
+	project := addProjectFlag(fs)
+	fs.Var(&capAdd, "cap-add", "add a Linux capability, or ALL, which a non-root -u user also gets as an ambient capability (repeatable)")
+	fs.Var(&capDrop, "cap-drop", "drop a Linux capability, or ALL (repeatable)")
+	privileged := fs.Bool("privileged", false, "keep all capabilities and disable seccomp")
+	memoryReservation := fs.String("memory-reservation", "", "memory the kernel leaves the container when it reclaims memory, such as 256m (cgroup v2 memory.low)")
+	memoryHigh := fs.String("memory-high", "", "memory above which the container is throttled and a memory_high event recorded, such as 1g (cgroup v2 memory.high)")
+	fs.Var(&deviceRules, "device-cgroup-rule", "allow access to devices: TYPE MAJOR:MINOR ACCESS, as in \"c 1:3 rwm\" (repeatable)")
+	fs.Var(&securityOpts, "security-opt", "security option: seccomp=<profile.json>, seccomp=unconfined, label=disable or label=level:LEVEL (repeatable)")
+	restart := fs.String("restart", restartNo, "restart the container when it exits: no, on-failure[:max] or always (needs -d)")
+	autoRemove := fs.Bool("rm", true, "remove the container when it exits (detached containers are kept unless set explicitly)")
+	logDriver := fs.String("log-driver", logDriverJSONFile, "where the container's output is logged: json-file or none")
+	fs.Var(&logOpts, "log-opt", "log driver option: max-size=SIZE or max-file=N (repeatable)")
+	timeStartup := fs.Bool("time-startup", false, "print how long each phase of starting the container took")
+	timeUsage := fs.Bool("time", false, "print the wall time, CPU time, memory and I/O the container used once it exits, as time(1) does")
+	rootfs := fs.String("rootfs", "", "where the rootfs lives: tmpfs[:size] unpacks the image into memory, and a directory is used as is, with no image")
+	rootless := fs.Bool("rootless", os.Geteuid() != 0, "run in a user namespace with container root mapped to the calling user")
+	fs.Var(&publish, "p", "publish a container port on the host: [[hostIP:]hostPort:]containerPort[/udp|/sctp], where ports may be FIRST-LAST ranges and host port 0 or none picks a free one (repeatable)")
+	publishAll := fs.Bool("P", false, "publish every port the image exposes on a host port from "+portRangeEnv+" (default "+defaultPortRange+")")
+	healthCmd := fs.String("health-cmd", "", "command to run with /bin/sh -c to check the container is healthy, in place of the image's")
+	healthInterval := fs.Duration("health-interval", 0, "time between healthchecks (default the image's, or 30s)")
+	healthTimeout := fs.Duration("health-timeout", 0, "time a healthcheck may take before it counts as failed (default the image's, or 30s)")
+	healthStartPeriod := fs.Duration("health-start-period", 0, "time after starting during which failed healthchecks don't count")
+	healthRetries := fs.Int("health-retries", 0, "failed healthchecks in a row before the container is unhealthy (default the image's, or 3)")
+	noHealthcheck := fs.Bool("no-healthcheck", false, "disable the image's healthcheck")
+	fs.Var(&annotations, "annotation", "attach metadata for external tools: KEY=VALUE (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := validateNetworkMode(*network); err != nil {
+		return nil, err
+	}
+	if *timeout < 0 {
+		return nil, fmt.Errorf("invalid --timeout %s: must not be negative", *timeout)
+	}
+	if *preserveFds < 0 {
+		return nil, fmt.Errorf("invalid --preserve-fds %d: must not be negative", *preserveFds)
+	}
+	listenFds, listenFdNames, _ := socketActivation()
+	if err := checkPreservedFds(max(*preserveFds, listenFds)); err != nil {
+		return nil, err
+	}
+	// A detached container's log is only useful if it outlives it.
+	if *detach && !flagPassed(fs, "rm") {
+		*autoRemove = false
+	}
+	if err := validateProject(*project); err != nil {
+		return nil, err
+	}
+	restartPolicy, err := parseRestartPolicy(*restart)
+	if err != nil {
+		return nil, err
+	}
+	// Only a detached container has a shim around to restart it.
+	if restartPolicy.enabled() && !*detach {
+		return nil, fmt.Errorf("--restart %s needs -d", restartPolicy)
+	}
+	if restartPolicy.enabled() && *autoRemove {
+		return nil, fmt.Errorf("--restart and --rm can't be combined")
+	}
+	// Only a foreground run is around to see the container exit.
+	if *timeUsage && *detach {
+		return nil, fmt.Errorf("--time can't be combined with -d")
+	}
+	if err := validateContainerName(*name); err != nil {
+		return nil, err
+	}
+	addCaps, err := parseCapabilities(capAdd)
+	if err != nil {
+		return nil, err
+	}
+	dropCaps, err := parseCapabilities(capDrop)
+	if err != nil {
+		return nil, err
+	}
+	seccomp, err := parseSecurityOpts(securityOpts, *privileged)
+	if err != nil {
+		return nil, err
+	}
+	if seccomp != nil {
+		caps := capabilitySet(addCaps, dropCaps)
+		if _, err := compileSeccomp(seccomp, caps); err != nil {
+			return nil, fmt.Errorf("seccomp profile: %v", err)
+		}
+	}
+	devices, err := parseDeviceRules(deviceRules)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) > 0 && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("device cgroup rules require root")
+	}
+	memory, err := parseMemoryLimits(*memoryReservation, *memoryHigh)
+	if err != nil {
+		return nil, err
+	}
+	var ports []PortMapping
+	for _, spec := range publish {
+		p, err := parsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p...)
+	}
+	if (len(ports) > 0 || *publishAll) && *network != networkBridge {
+		return nil, fmt.Errorf("publishing ports requires --network bridge")
+	}
+	if *network == networkBridge && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("bridge networking requires root")
+	}
+	logConfig, err := parseLogConfig(*logDriver, logOpts)
+	if err != nil {
+		return nil, err
+	}
+	rootfsOpt, err := parseRootfsFlag(*rootfs)
+	if err != nil {
+		return nil, err
+	}
+	if rootfsOpt.Tmpfs && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("a tmpfs rootfs requires root")
+	}
+	var env []string
+	for _, file := range envFiles {
+		fileEnv, err := parseEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+	for _, e := range envs {
+		if kv, ok := resolveEnv(e); ok {
+			env = append(env, kv)
+		}
+	}
+	if *healthInterval < 0 || *healthTimeout < 0 || *healthStartPeriod < 0 || *healthRetries < 0 {
+		return nil, fmt.Errorf("healthcheck durations and retries can't be negative")
+	}
+	var healthcheck *HealthConfig
+	if *noHealthcheck {
+		if *healthCmd != "" || *healthInterval != 0 || *healthTimeout != 0 || *healthStartPeriod != 0 || *healthRetries != 0 {
+			return nil, fmt.Errorf("--no-healthcheck conflicts with the --health flags")
+		}
+		healthcheck = &HealthConfig{Test: []string{"NONE"}}
+	} else if *healthCmd != "" || *healthInterval != 0 || *healthTimeout != 0 || *healthStartPeriod != 0 || *healthRetries != 0 {
+		healthcheck = &HealthConfig{
+			Interval:    *healthInterval,
+			Timeout:     *healthTimeout,
+			StartPeriod: *healthStartPeriod,
+			Retries:     *healthRetries,
+		}
+		if *healthCmd != "" {
+			healthcheck.Test = []string{"CMD-SHELL", *healthCmd}
+		}
+	}
+	annotationMap, err := parseAnnotations(annotations)
+	if err != nil {
+		return nil, err
+	}
+	if *workdir != "" && !path.IsAbs(*workdir) {
+		return nil, fmt.Errorf("working directory %q must be absolute", *workdir)
+	}
+	var mounts []Mount
+	for _, v := range volumes {
+		m, err := parseVolume(v)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	tmpfs, err := parseTmpfsMounts(tmpfsSpecs, mounts)
+	if err != nil {
+		return nil, err
+	}
+	bindPolicy, err := parseBindPolicy(*bindMissing, *bindOwner)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() < 1 {
+		return nil, fmt.Errorf("usage: run [options] <image> [command] [args...]\n       run --rootfs /path [options] <command> [args...]")
+	}
+	// A container on a directory rootfs has no image, so the command comes
+	// first.
+	image, commandLine := "", fs.Args()
+	if rootfsOpt.Path == "" {
+		image, commandLine = fs.Arg(0), fs.Args()[1:]
+	}
+	var entrypointArgv []string
+	if flagPassed(fs, "entrypoint") {
+		if entrypointArgv, err = parseEntrypoint(*entrypoint); err != nil {
+			return nil, err
+		}
+	}
+	var command string
+	var commandArgs []string
+	if len(commandLine) > 0 {
+		command = commandLine[0]
+		commandArgs = commandLine[1:]
+	}
+	// Checked last, since it may create host directories.
+	if err := validateMounts(mounts, bindPolicy); err != nil {
+		return nil, err
+	}
+	cfg := &ContainerConfig{
+		Name:          *name,
+		Image:         image,
+		Command:       command,
+		Args:          commandArgs,
+		StopTimeout:   *stopTimeout,
+		Timeout:       *timeout,
+		Detach:        *detach,
+		PreserveFDs:   max(*preserveFds, listenFds),
+		ListenFDs:     listenFds,
+		ListenFDNames: listenFdNames,
+		AutoRemove:    *autoRemove,
+		Restart:       restartPolicy,
+		Log:           logConfig,
+		RootfsTmpfs:   rootfsOpt.Tmpfs,
+		RootfsSize:    rootfsOpt.Size,
+		RootfsPath:    rootfsOpt.Path,
+		ReadOnly:      *readOnly,
+		Tmpfs:         tmpfs,
+		Pull:          pull,
+		Mounts:        mounts,
+		Env:           env,
+		WorkingDir:    *workdir,
+		User:          *user,
+		Entrypoint:    entrypointArgv,
+		Network:       *network,
+		Ports:         ports,
+		PublishAll:    *publishAll,
+		Project:       *project,
+		Rootless:      *rootless,
+		CapAdd:        addCaps,
+		CapDrop:       dropCaps,
+		Privileged:    *privileged,
+		Seccomp:       seccomp,
+		DeviceRules:   devices,
+		Memory:        memory,
+		TimeStartup:   *timeStartup,
+		TimeUsage:     *timeUsage,
+		Healthcheck:   healthcheck,
+		Annotations:   annotationMap,
+	}
+	if err := parseLabelOpts(securityOpts, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyImageConfig fills in what the user left unset from the image config
+// the way Docker does: the command is the Entrypoint followed by the Cmd,
+// a command given on the command line replaces the image's Cmd, and image
+// Env comes first so that -e can override it. --entrypoint replaces the
+// image's Entrypoint and drops its Cmd, which would make no sense as
+// arguments to something else.
+//
+// A shell-form Entrypoint or Cmd, a string rather than an array, is run
+// by the image's Shell, /bin/sh -c by default, the way docker build
+// writes it into the config. The Cmd and arguments still follow a
+// shell-form Entrypoint, where sh -c takes them as $0 and the positional
+// parameters, so they are ignored unless the command uses them, as in
+// Docker. It returns the shell the command runs in, or "" if it doesn't
+// need one.
+func applyImageConfig(cfg *ContainerConfig, img *ImageConfig) (string, error) {
+	shell := img.Config.Shell
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	entrypoint, cmd := img.Config.Entrypoint, img.Config.Cmd
+	if cfg.Entrypoint != nil {
+		entrypoint, cmd = imageCommand{Argv: cfg.Entrypoint}, imageCommand{}
+		if len(cfg.Entrypoint) == 1 && cfg.Entrypoint[0] == "" {
+			entrypoint = imageCommand{}
+		}
+	}
+	argv := append([]string{}, entrypoint.argv(shell)...)
+	usesShell := entrypoint.ShellForm
+	if cfg.Command != "" {
+		argv = append(argv, cfg.Command)
+		argv = append(argv, cfg.Args...)
+	} else {
+		argv = append(argv, cmd.argv(shell)...)
+		usesShell = usesShell || cmd.ShellForm
+	}
+	if len(argv) == 0 {
+		return "", fmt.Errorf("no command specified")
+	}
+	cfg.Command, cfg.Args = argv[0], argv[1:]
+	cfg.Env = mergeEnv(img.Config.Env, cfg.Env)
+	if cfg.WorkingDir == "" {
+		cfg.WorkingDir = img.Config.WorkingDir
+	}
+	if cfg.User == "" {
+		cfg.User = img.Config.User
+	}
+	if !usesShell {
+		return "", nil
+	}
+	return shell[0], nil
+}
+
+// parseEntrypoint parses --entrypoint. Like an exec-form ENTRYPOINT, the
+// value is never split on spaces: it is a single executable, or a JSON
+// array of the executable and its arguments. An empty value clears the
+// image's.
+func parseEntrypoint(value string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		return []string{value}, nil
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(value), &argv); err != nil {
+		return nil, fmt.Errorf("invalid --entrypoint %q: %v", value, err)
+	}
+	if len(argv) == 0 {
+		argv = []string{""}
+	}
+	return argv, nil
+}
+
+// parseAnnotations parses --annotation KEY=VALUE flags. A key given twice
+// keeps the last value, as later flags override earlier ones elsewhere.
+func parseAnnotations(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	annotations := make(map[string]string)
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid annotation %q: expected KEY=VALUE", spec)
+		}
+		annotations[key] = value
+	}
+	return annotations, nil
+}
+
+// flagPassed reports whether the flag was set on the command line rather
+// than left at its default.
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// stringsFlag collects the values of a repeatable flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// startContainer starts the container's init process and releases it to
+// exec the command, recording the container as running. Init replaces
+// itself with the container command, so the recorded PID is the command's.
+func startContainer(c *Container, stdin io.Reader, stdout, stderr io.Writer, timer *startupTimer) (*exec.Cmd, error) {
+	c.Status = statusRunning
+	c.StartedAt = time.Now()
+	c.TimedOut = false
+	p, err := spawnInit(c, stdin, stdout, stderr, timer)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.release(timer); err != nil {
+		return nil, err
+	}
+	recordContainerEvent(c, eventStart, nil)
+	return p.cmd, nil
+}
+
+// pendingInit is a container whose init process has been started and set
+// up from the outside but is still waiting to be released.
+type pendingInit struct {
+	c       *Container
+	cmd     *exec.Cmd
+	sync    *os.File
+	status  *os.File
+	message byte
+}
+
+// spawnInit starts the container's init process in new PID and mount
+// namespaces, plus a network namespace unless it uses host networking and a
+// user namespace when it is rootless. A container configured to join
+// another's namespaces gets only a new mount namespace.
+//
+// Init waits for a message on the sync socket before it execs the command,
+// which gives us the chance to set up its namespaces from the outside. It
+// reports its own progress on the status pipe: a byte once the rootfs is
+// mounted, and end of file once it has exec'd.
+func spawnInit(c *Container, stdin io.Reader, stdout, stderr io.Writer, timer *startupTimer) (*pendingInit, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socketpair: %v", err)
+	}
+	syncParent, syncChild := os.NewFile(uintptr(fds[0]), "sync"), os.NewFile(uintptr(fds[1]), "sync")
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		syncParent.Close()
+		syncChild.Close()
+		return nil, fmt.Errorf("pipe: %v", err)
+	}
+	p := &pendingInit{c: c, sync: syncParent, status: statusR, message: syncContinue}
+	cmd := exec.Command("/proc/self/exe", "init", c.ID)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Init is root in a rootless container and would otherwise look for the
+	// state in root's default location.
+	cmd.Env = append(os.Environ(), stateDirEnv+"="+stateDir())
+	// The container's file descriptors are passed first, so that they keep
+	// their numbers through to the command.
+	passFiles(cmd, c.preserved, syncChild, statusW)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | networkCloneflags(c.Config.Network),
+		Setpgid:    true,
+	}
+	// A foreground container, or a warm sandbox, has nobody but us to wait
+	// on it, so it is killed if we are rather than left running with no
+	// one to clean up after it. The signal is tied to the thread that
+	// starts init, which is why a container joining another's namespaces,
+	// started from a thread that is thrown away, goes without.
+	if !c.Config.Detach && c.Config.JoinNamespaces == "" {
+		cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	}
+	p.cmd = cmd
+	lateIDMaps := false
+	if c.Config.Rootless && c.Config.JoinNamespaces == "" {
+		lateIDMaps = setUserNamespace(cmd.SysProcAttr, c)
+	}
+	if c.Config.JoinNamespaces == "" {
+		err = cmd.Start()
+	} else {
+		var target *Container
+		target, err = loadContainer(c.Config.JoinNamespaces)
+		if err == nil && !target.running() {
+			err = fmt.Errorf("container %s is not running", target.shortID())
+		}
+		if err == nil {
+			cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWNS
+			err = startInNamespacesOf(target.Pid, cmd)
+		}
+	}
+	syncChild.Close()
+	statusW.Close()
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	c.Pid = cmd.Process.Pid
+	timer.mark("start")
+	if lateIDMaps {
+		if err := mapIDs(c); err != nil {
+			p.abort()
+			return nil, fmt.Errorf("setup user namespace: %v", err)
+		}
+		p.message = syncReexec
+	}
+	if err := setupNetwork(c); err != nil {
+		p.abort()
+		return nil, fmt.Errorf("setup network: %v", err)
+	}
+	timer.mark("network")
+	if err := c.save(); err != nil {
+		p.abort()
+		return nil, err
+	}
+	return p, nil
+}
+
+// setStdio replaces init's standard input, output and error, which it was
+// started with, by passing it the given files.
+func (p *pendingInit) setStdio(stdin, stdout, stderr *os.File) error {
+	rights := syscall.UnixRights(int(stdin.Fd()), int(stdout.Fd()), int(stderr.Fd()))
+	if err := syscall.Sendmsg(int(p.sync.Fd()), []byte{syncStdio}, rights, nil, 0); err != nil {
+		return fmt.Errorf("pass stdio to init: %v", err)
+	}
+	return nil
+}
+
+// release puts init in the container's cgroup, lets it go on to exec the
+// container command and saves the container's state. The cgroup is set up
+// here rather than when init is spawned because a warm sandbox only learns
+// its configuration when it is claimed.
+func (p *pendingInit) release(timer *startupTimer) error {
+	defer p.close()
+	if err := setupCgroup(p.c); err != nil {
+		p.abort()
+		return fmt.Errorf("setup cgroup: %v", err)
+	}
+	timer.mark("cgroup")
+	// The resolver listens before the command runs, so that its first
+	// queries wait to be answered rather than being refused.
+	if err := p.c.openResolver(); err != nil {
+		p.abort()
+		return err
+	}
+	if _, err := p.sync.Write([]byte{p.message}); err != nil {
+		return fmt.Errorf("release init: %v", err)
+	}
+	if timer != nil {
+		if _, err := p.status.Read(make([]byte, 1)); err == nil {
+			timer.mark("mount")
+			p.status.Read(make([]byte, 1))
+		}
+		timer.mark("exec")
+	}
+	return p.c.save()
+}
+
+// abort kills init before it was released and tears down what was set up
+// for it.
+func (p *pendingInit) abort() {
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.close()
+	p.c.closeResolver()
+	p.c.releaseResources()
+}
+
+func (p *pendingInit) close() {
+	p.sync.Close()
+	p.status.Close()
+}
+
+// startShim hands a prepared container over to a detached copy of this
+// binary, which runs it with output going to the container's log file.
+func startShim(c *Container) error {
+	shim := exec.Command("/proc/self/exe", "shim", c.ID)
+	shim.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	passFiles(shim, c.preserved)
+	if err := shim.Start(); err != nil {
+		return fmt.Errorf("start shim: %v", err)
+	}
+	return shim.Process.Release()
+}
+
+// shimCmd is the internal entry point of a detached container's supervisor.
+func shimCmd(args []string) int {
+	if len(args) != 1 {
+		return 2
+	}
+	c, err := loadContainer(args[0])
+	if err != nil {
+		return 1
+	}
+	// The shim holds on to the file descriptors it was passed, so that a
+	// restarted container gets them too.
+	if c.preserved, err = inheritFiles(preservedFds()); err != nil {
+		return 1
+	}
+	os.Unsetenv(preservedFdsEnv)
+	unlock, err := c.lockSupervisor()
+	if err != nil {
+		return 1
+	}
+	defer unlock()
+	logger, err := newContainerLogger(c)
+	if err != nil {
+		return 1
+	}
+	defer logger.Close()
+	stdout, stderr := logger.stream("stdout", nil), logger.stream("stderr", nil)
+	defer stdout.Close()
+	defer stderr.Close()
+	delay := restartDelayMin
+	for {
+		code := superviseContainer(c, stdout, stderr)
+		if !c.Config.Restart.enabled() {
+			break
+		}
+		if time.Since(c.StartedAt) >= restartResetAfter {
+			delay = restartDelayMin
+		}
+		if !awaitRestart(c, code, delay) {
+			break
+		}
+		delay = min(2*delay, restartDelayMax)
+	}
+	if c.Config.AutoRemove {
+		c.remove()
+		return 0
+	}
+	c.markExited(c.ExitCode)
+	return 0
+}
+
+// superviseContainer runs c once on behalf of the shim and returns its exit
+// code, which is also left in c.ExitCode.
+func superviseContainer(c *Container, stdout, stderr io.Writer) int {
+	timer := newStartupTimer(c.Config.TimeStartup)
+	cmd, err := startContainer(c, nil, stdout, stderr, timer)
+	if err != nil {
+		fmt.Fprintf(stderr, "cmd start: %v\n", err)
+		c.ExitCode = exitRunError
+		return c.ExitCode
+	}
+	timer.report(stderr)
+	stopPublish, err := publishPorts(c)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		cmd.Process.Kill()
+		stopPublish = func() {}
+	}
+	stopHealth := monitorHealth(c)
+	stopMemory := monitorMemory(c)
+	stopTimeout := enforceTimeout(cmd.Process, c.Config.Timeout, time.Duration(c.Config.StopTimeout)*time.Second)
+	cmd.Wait()
+	c.TimedOut = stopTimeout()
+	stopHealth()
+	stopMemory()
+	stopPublish()
+	c.ExitCode = exitCode(cmd.ProcessState)
+	if c.TimedOut {
+		fmt.Fprintf(stderr, "container %s timed out after %s\n", c.shortID(), c.Config.Timeout)
+		c.ExitCode = exitTimedOut
+	}
+	recordExit(c, c.ExitCode)
+	c.releaseResources()
+	return c.ExitCode
+}
+
+// Exit codes for a container that never got to run its command, the same
+// ones Docker uses.
+const (
+	exitRunError     = 125
+	exitCannotInvoke = 126
+	exitNotFound     = 127
+)
+
+// commandErrorCode maps a failure to find or exec a command to the exit
+// code a shell would use.
+func commandErrorCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, syscall.ENOENT) {
+		return exitNotFound
+	}
+	return exitCannotInvoke
+}
+
+// exitCode reports a process's exit status the way a shell does, using
+// 128+n for a process killed by signal n. A process that was never waited
+// for counts as having failed to run.
+func exitCode(state *os.ProcessState) int {
+	if state == nil {
+		return exitRunError
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
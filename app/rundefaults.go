@@ -0,0 +1,199 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// runDefaultsFileName holds the operator's default run options, kept in
+// the state directory so that run and the daemon both go by them.
+const runDefaultsFileName = "run-defaults.json"
+
+// runDefaultsLabel is the image label holding the image's own default run
+// options, as a JSON array of run flags.
+const runDefaultsLabel = "io.diy-docker.run-defaults"
+
+// labelRunFlags are the run flags an image label may set. An image is no
+// more trusted than what it runs, so it can narrow its sandbox or settle
+// how it runs but not reach the host: no mounts, capabilities, devices or
+// ports.
+var labelRunFlags = []string{
+	"cap-drop", "read-only", "tmpfs", "e", "w", "u", "stop-timeout", "timeout",
+	"health-cmd", "health-interval", "health-timeout", "health-start-period", "health-retries",
+	"annotation", "log-driver", "log-opt",
+}
+
+// runDefaults are default run options by image. Every rule that matches an
+// image adds its options, in order, and the image's label adds its own
+// after them. Flags on the command line come last: those that take one
+// value override the defaults, and repeatable ones add to them.
+type runDefaults struct {
+	Rules []runDefaultsRule `json:"rules"`
+}
+
+type runDefaultsRule struct {
+	// Match is a glob matched against the image's qualified reference, as
+	// in the daemon's policy. A rule without one applies to every image.
+	Match   string   `json:"match,omitempty"`
+	Options []string `json:"options"`
+}
+
+func runDefaultsPath() string {
+	return path.Join(stateDir(), runDefaultsFileName)
+}
+
+func loadRunDefaults() (*runDefaults, error) {
+	var d runDefaults
+	data, err := os.ReadFile(runDefaultsPath())
+	if os.IsNotExist(err) {
+		return &d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read run defaults: %v", err)
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("decode %s: %v", runDefaultsPath(), err)
+	}
+	for i, r := range d.Rules {
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid run defaults rule %d: %v", i+1, err)
+		}
+	}
+	return &d, nil
+}
+
+// runDefaultsFor returns the default run options of img, pulled as ref.
+func runDefaultsFor(store *imageStore, img *Image, ref string) ([]string, error) {
+	d, err := loadRunDefaults()
+	if err != nil {
+		return nil, err
+	}
+	var options []string
+	q := policyRef(ref)
+	for _, r := range d.Rules {
+		if ok, _ := path.Match(r.Match, q); ok || r.Match == "" {
+			options = append(options, r.Options...)
+		}
+	}
+	config, err := store.imageConfig(img)
+	if err != nil {
+		return nil, err
+	}
+	label, ok := config.Config.Labels[runDefaultsLabel]
+	if !ok {
+		return options, nil
+	}
+	var labelOptions []string
+	if err := json.Unmarshal([]byte(label), &labelOptions); err != nil {
+		return nil, fmt.Errorf("invalid %s label on %s: %v", runDefaultsLabel, ref, err)
+	}
+	for _, opt := range labelOptions {
+		if !strings.HasPrefix(opt, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(opt, "-"), "=")
+		if !slices.Contains(labelRunFlags, name) {
+			return nil, fmt.Errorf("the %s label on %s may not set %s", runDefaultsLabel, ref, opt)
+		}
+	}
+	return append(options, labelOptions...), nil
+}
+
+// parseRunDefaults parses the default options for the image ref on their
+// own, which they must be able to be.
+func parseRunDefaults(defaults []string, ref string) (*ContainerConfig, error) {
+	cfg, err := parseRunFlags(append(slices.Clip(defaults), ref))
+	if err == nil && (cfg.Image != ref || cfg.Command != "") {
+		err = fmt.Errorf("expected only flags")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("default run options for %s: %v", ref, err)
+	}
+	return cfg, nil
+}
+
+// parseRunArgs parses run's arguments on top of the default run options
+// for the image. Its label is read from the store, so an image that isn't
+// there yet is pulled first.
+func parseRunArgs(args []string) (*ContainerConfig, error) {
+	cfg, err := parseRunFlags(args)
+	if err != nil || cfg.RootfsPath != "" {
+		return cfg, err
+	}
+	store, err := openImageStore()
+	if err != nil {
+		return nil, err
+	}
+	img, err := ensureImage(context.Background(), store, cfg.Image, cfg.Pull, nil)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := runDefaultsFor(store, img, cfg.Image)
+	if err != nil || len(defaults) == 0 {
+		return cfg, err
+	}
+	if _, err := parseRunDefaults(defaults, cfg.Image); err != nil {
+		return nil, err
+	}
+	return parseRunFlags(append(slices.Clip(defaults), args...))
+}
+
+// applyRunDefaults puts the default run options of a container created
+// through the API under what the request asked for. The request has no
+// flags to tell what was set, so a default fills in a field left empty,
+// and adds to one that is a list.
+func applyRunDefaults(cfg, defaults *ContainerConfig) {
+	cfg.Env = append(slices.Clip(defaults.Env), cfg.Env...)
+	for _, m := range defaults.Mounts {
+		if !slices.ContainsFunc(cfg.Mounts, func(o Mount) bool { return o.Destination == m.Destination }) {
+			cfg.Mounts = append(cfg.Mounts, m)
+		}
+	}
+	for _, m := range defaults.Tmpfs {
+		if !slices.ContainsFunc(cfg.Tmpfs, func(o TmpfsMount) bool { return o.Destination == m.Destination }) {
+			cfg.Tmpfs = append(cfg.Tmpfs, m)
+		}
+	}
+	// A capability the request adds isn't dropped by default, nor one it
+	// drops added.
+	for _, c := range defaults.CapAdd {
+		if !slices.Contains(cfg.CapAdd, c) && !slices.Contains(cfg.CapDrop, c) {
+			cfg.CapAdd = append(cfg.CapAdd, c)
+		}
+	}
+	for _, c := range defaults.CapDrop {
+		if !slices.Contains(cfg.CapDrop, c) && !slices.Contains(cfg.CapAdd, c) {
+			cfg.CapDrop = append(cfg.CapDrop, c)
+		}
+	}
+	cfg.DeviceRules = append(cfg.DeviceRules, defaults.DeviceRules...)
+	for k, v := range defaults.Annotations {
+		if _, ok := cfg.Annotations[k]; !ok {
+			if cfg.Annotations == nil {
+				cfg.Annotations = make(map[string]string)
+			}
+			cfg.Annotations[k] = v
+		}
+	}
+	cfg.ReadOnly = cfg.ReadOnly || defaults.ReadOnly
+	if cfg.User == "" {
+		cfg.User = defaults.User
+	}
+	if cfg.WorkingDir == "" {
+		cfg.WorkingDir = defaults.WorkingDir
+	}
+	if cfg.Healthcheck == nil {
+		cfg.Healthcheck = defaults.Healthcheck
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+}
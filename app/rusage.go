@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// usageReport is what a foreground container used over its run, for
+// --time. The process figures come from wait4, which counts the
+// container's init along with every descendant it reaped, and so every
+// process of the container. The cgroup's figures are added where the
+// container has one.
+type usageReport struct {
+	wall, user, sys time.Duration
+	// maxRSS is the largest resident set of any one of the processes.
+	maxRSS int64
+	// readBytes and writtenBytes are what went to and from storage,
+	// without what the page cache served.
+	readBytes, writtenBytes int64
+	// cgroupCPU is the cgroup's CPU time, and cgroupPeak the most memory
+	// its processes used together, where the memory controller is
+	// enabled.
+	cgroupCPU  time.Duration
+	cgroupPeak int64
+}
+
+// newUsageReport gathers what c used, once its process has exited with
+// state. It must be called before c's cgroup is removed.
+func newUsageReport(c *Container, state *os.ProcessState) *usageReport {
+	r := &usageReport{
+		wall: time.Since(c.StartedAt),
+		user: state.UserTime(),
+		sys:  state.SystemTime(),
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// ru_maxrss is in kilobytes, and the block counts in 512-byte
+		// units.
+		r.maxRSS = ru.Maxrss * 1024
+		r.readBytes = ru.Inblock * 512
+		r.writtenBytes = ru.Oublock * 512
+	}
+	if c.Cgroup != "" {
+		if usec, ok := cgroupStat(c.Cgroup, "cpu.stat", "usage_usec"); ok {
+			r.cgroupCPU = time.Duration(usec) * time.Microsecond
+		}
+		r.cgroupPeak, _ = readCgroupInt(c.Cgroup, "memory.peak")
+	}
+	return r
+}
+
+// cgroupStat reads key from a flat keyed cgroup file such as cpu.stat.
+func cgroupStat(cgroup, file, key string) (int64, bool) {
+	data, err := os.ReadFile(path.Join(cgroup, file))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if k, v, ok := strings.Cut(line, " "); ok && k == key {
+			n, err := strconv.ParseInt(v, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// write prints the report as a table, in the order time(1) does.
+func (r *usageReport) write(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(tw, "real\t%s\n", formatSeconds(r.wall))
+	fmt.Fprintf(tw, "user\t%s\n", formatSeconds(r.user))
+	fmt.Fprintf(tw, "sys\t%s\n", formatSeconds(r.sys))
+	if r.cgroupCPU > 0 {
+		fmt.Fprintf(tw, "cgroup cpu\t%s\n", formatSeconds(r.cgroupCPU))
+	}
+	fmt.Fprintf(tw, "max rss\t%s\n", formatBytes(r.maxRSS))
+	if r.cgroupPeak > 0 {
+		fmt.Fprintf(tw, "cgroup peak memory\t%s\n", formatBytes(r.cgroupPeak))
+	}
+	fmt.Fprintf(tw, "read\t%s\n", formatBytes(r.readBytes))
+	fmt.Fprintf(tw, "written\t%s\n", formatBytes(r.writtenBytes))
+	tw.Flush()
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3fs", d.Seconds())
+}
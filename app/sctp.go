@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ipprotoSCTP is IPPROTO_SCTP, which the syscall package lacks.
+const ipprotoSCTP = 132
+
+// Go has no SCTP of its own, but a one-to-one style SCTP socket is used
+// the way a TCP one is. The sockets are made here and handed to net, whose
+// TCP listener and connections work on them as they are, CloseWrite
+// included.
+
+// listenSCTP listens for SCTP associations on addr. It has the signature
+// of net.Listen, whose network it ignores.
+func listenSCTP(_, addr string) (net.Listener, error) {
+	sa, err := sctpSockaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, ipprotoSCTP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// net takes a duplicate of the socket.
+	f := os.NewFile(uintptr(fd), "sctp:"+addr)
+	defer f.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
+
+// dialSCTP sets up an SCTP association with addr, giving up after timeout.
+func dialSCTP(addr string, timeout time.Duration) (net.Conn, error) {
+	sa, err := sctpSockaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, ipprotoSCTP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// Being non-blocking, the socket goes to the runtime's poller, which
+	// the wait for the association below relies on.
+	f := os.NewFile(uintptr(fd), "sctp:"+addr)
+	defer f.Close()
+	err = syscall.Connect(fd, sa)
+	if err == syscall.EINPROGRESS {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		f.SetWriteDeadline(time.Now().Add(timeout))
+		var connectErr error
+		// Connecting again reports how the first attempt went once it
+		// has finished.
+		if err := rc.Write(func(fd uintptr) bool {
+			connectErr = syscall.Connect(int(fd), sa)
+			return connectErr != syscall.EALREADY && connectErr != syscall.EINPROGRESS
+		}); err != nil {
+			return nil, fmt.Errorf("connect: %v", err)
+		}
+		err = connectErr
+		if err == syscall.EISCONN {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("connect", err)
+	}
+	return net.FileConn(f)
+}
+
+// sctpSockaddr resolves addr, which must be an IPv4 address and a port.
+// No address means any.
+func sctpSockaddr(addr string) (*syscall.SockaddrInet4, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrInet4{}
+	if sa.Port, err = strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("bad port %q", port)
+	}
+	if host == "" {
+		return sa, nil
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %q: only IPv4 is supported", host)
+	}
+	copy(sa.Addr[:], ip)
+	return sa, nil
+}
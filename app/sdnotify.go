@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdNotifier tells systemd how the daemon is doing when it runs as a
+// service of Type=notify: that it is ready once it serves the API, that
+// it is still alive while it does, and that it is stopping. Outside
+// systemd, it does nothing.
+type systemdNotifier struct {
+	conn *net.UnixConn
+	// watchdog is how often systemd expects to hear from us, zero unless
+	// the service has WatchdogSec set.
+	watchdog time.Duration
+}
+
+// newSystemdNotifier picks up the socket systemd passed in NOTIFY_SOCKET.
+// The variables are unset so that the containers the daemon starts, which
+// inherit its environment, don't report on its behalf. WATCHDOG_PID says
+// which process the watchdog is for, as LISTEN_PID does for socket
+// activation.
+func newSystemdNotifier() *systemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	watchdogPid := os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	n := &systemdNotifier{}
+	if socket == "" {
+		return n
+	}
+	// A socket in the abstract namespace is given with a leading @.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return n
+	}
+	n.conn = conn
+	if usec > 0 && (watchdogPid == "" || watchdogPid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// send writes state, such as READY=1, to systemd. What it can't send is
+// dropped: systemd notices soon enough when it doesn't hear from us.
+func (n *systemdNotifier) send(state string) {
+	if n.conn != nil {
+		n.conn.Write([]byte(state))
+	}
+}
+
+// ready says the daemon is serving the API, and starts the watchdog
+// keepalives if systemd wants them. They are sent twice as often as
+// needed, as sd_watchdog_enabled advises. The function it returns says
+// the daemon is stopping and stops them.
+func (n *systemdNotifier) ready(status string) func() {
+	n.send("READY=1\nSTATUS=" + status)
+	done := make(chan struct{})
+	if n.watchdog > 0 {
+		go func() {
+			t := time.NewTicker(n.watchdog / 2)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					n.send("WATCHDOG=1")
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return func() {
+		close(done)
+		n.send("STOPPING=1")
+		if n.conn != nil {
+			n.conn.Close()
+		}
+	}
+}
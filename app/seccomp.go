@@ -0,0 +1,371 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// auditArches are the AUDIT_ARCH_* values the kernel reports for syscalls
+// made with each architecture's native calling convention.
+var auditArches = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+// SeccompProfile is a syscall filter in the format Docker uses for
+// --security-opt seccomp=profile.json. Only the native architecture is
+// filtered; syscalls made through any other ABI, such as 32-bit x86 on
+// amd64, kill the process.
+type SeccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint32          `json:"defaultErrnoRet,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls"`
+}
+
+type SeccompSyscall struct {
+	Names    []string      `json:"names,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Action   string        `json:"action"`
+	ErrnoRet *uint32       `json:"errnoRet,omitempty"`
+	Args     []SeccompArg  `json:"args,omitempty"`
+	Includes SeccompFilter `json:"includes,omitempty"`
+	Excludes SeccompFilter `json:"excludes,omitempty"`
+}
+
+type SeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// SeccompFilter lists the capabilities and architectures a rule's includes
+// or excludes refer to. MinKernel is accepted but not checked: rules
+// that use it allow newer syscalls, which older kernels reject anyway.
+type SeccompFilter struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// defaultSeccompProfile blocks syscalls that let a container reach outside
+// itself: loading kernels and modules, changing the host clock, mounting,
+// tracing other processes and the like. As with Docker, adding the
+// capability that guards a syscall also lifts its filter.
+func defaultSeccompProfile() *SeccompProfile {
+	blockUnless := func(caps []string, names ...string) SeccompSyscall {
+		return SeccompSyscall{Names: names, Action: "SCMP_ACT_ERRNO", Excludes: SeccompFilter{Caps: caps}}
+	}
+	return &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []SeccompSyscall{
+			{Names: []string{"kexec_load", "kexec_file_load", "add_key", "keyctl", "request_key", "uselib", "create_module", "get_kernel_syms", "query_module", "nfsservctl", "_sysctl", "vm86", "vm86old"}, Action: "SCMP_ACT_ERRNO"},
+			blockUnless([]string{"CAP_SYS_ADMIN"}, "mount", "umount2", "pivot_root", "setns", "unshare", "swapon", "swapoff", "quotactl", "lookup_dcookie", "name_to_handle_at", "fanotify_init", "fsopen", "fsconfig", "fsmount", "fspick", "move_mount", "open_tree", "mount_setattr"),
+			blockUnless([]string{"CAP_SYS_MODULE"}, "init_module", "finit_module", "delete_module"),
+			blockUnless([]string{"CAP_SYS_BOOT"}, "reboot"),
+			blockUnless([]string{"CAP_SYS_PTRACE"}, "ptrace", "process_vm_readv", "process_vm_writev", "kcmp", "userfaultfd"),
+			blockUnless([]string{"CAP_SYS_TIME"}, "settimeofday", "clock_settime", "adjtimex", "clock_adjtime", "stime"),
+			blockUnless([]string{"CAP_SYS_PACCT"}, "acct"),
+			blockUnless([]string{"CAP_SYS_RAWIO"}, "iopl", "ioperm"),
+			blockUnless([]string{"CAP_SYSLOG"}, "syslog"),
+			blockUnless([]string{"CAP_DAC_READ_SEARCH"}, "open_by_handle_at"),
+			blockUnless([]string{"CAP_SYS_ADMIN", "CAP_BPF"}, "bpf"),
+			blockUnless([]string{"CAP_SYS_ADMIN", "CAP_PERFMON"}, "perf_event_open"),
+		},
+	}
+}
+
+// loadSeccompProfile reads a Docker-format profile from file.
+func loadSeccompProfile(file string) (*SeccompProfile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read seccomp profile: %v", err)
+	}
+	var p SeccompProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("decode seccomp profile %s: %v", file, err)
+	}
+	return &p, nil
+}
+
+// parseSecurityOpts handles --security-opt. Containers get the default
+// profile unless one is named or seccomp is turned off with
+// seccomp=unconfined; privileged containers run unconfined unless a profile
+// is named.
+func parseSecurityOpts(opts []string, privileged bool) (*SeccompProfile, error) {
+	profile := defaultSeccompProfile()
+	if privileged {
+		profile = nil
+	}
+	for _, opt := range opts {
+		key, value, ok := strings.Cut(opt, "=")
+		if key == "label" {
+			// Handled by parseLabelOpts.
+			continue
+		}
+		if !ok || key != "seccomp" || value == "" {
+			return nil, fmt.Errorf("invalid security option %q", opt)
+		}
+		if value == "unconfined" {
+			profile = nil
+			continue
+		}
+		p, err := loadSeccompProfile(value)
+		if err != nil {
+			return nil, err
+		}
+		profile = p
+	}
+	return profile, nil
+}
+
+// bpfProgram assembles a classic BPF program with forward jumps to labels,
+// which are resolved once the whole program is known.
+type bpfProgram struct {
+	insns  []syscall.SockFilter
+	labels map[string]int
+	jumps  []bpfJump
+}
+
+type bpfJump struct {
+	insn   int
+	jt, jf string
+}
+
+func (p *bpfProgram) stmt(code uint16, k uint32) {
+	p.insns = append(p.insns, syscall.SockFilter{Code: code, K: k})
+}
+
+// jump adds a conditional jump. An empty label means the next instruction.
+func (p *bpfProgram) jump(code uint16, k uint32, jt, jf string) {
+	p.jumps = append(p.jumps, bpfJump{len(p.insns), jt, jf})
+	p.stmt(syscall.BPF_JMP|code|syscall.BPF_K, k)
+}
+
+func (p *bpfProgram) label(name string) {
+	p.labels[name] = len(p.insns)
+}
+
+func (p *bpfProgram) resolve() ([]syscall.SockFilter, error) {
+	offset := func(from int, label string) (uint8, error) {
+		if label == "" {
+			return 0, nil
+		}
+		to, ok := p.labels[label]
+		if !ok || to <= from || to-from-1 > 255 {
+			return 0, fmt.Errorf("bad jump to %s", label)
+		}
+		return uint8(to - from - 1), nil
+	}
+	for _, j := range p.jumps {
+		var err error
+		if p.insns[j.insn].Jt, err = offset(j.insn, j.jt); err != nil {
+			return nil, err
+		}
+		if p.insns[j.insn].Jf, err = offset(j.insn, j.jf); err != nil {
+			return nil, err
+		}
+	}
+	return p.insns, nil
+}
+
+// compileSeccomp turns a profile into a BPF filter for the host
+// architecture. caps is the container's capability set, which decides
+// which conditional rules apply. Syscalls the architecture doesn't have
+// are skipped, so one profile serves every architecture.
+func compileSeccomp(profile *SeccompProfile, caps map[string]bool) ([]syscall.SockFilter, error) {
+	numbers, ok := syscallNumbers[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	p := &bpfProgram{labels: make(map[string]int)}
+	p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch)
+	p.jump(syscall.BPF_JEQ, auditArches[runtime.GOARCH], "arch-ok", "")
+	p.stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess)
+	p.label("arch-ok")
+	if runtime.GOARCH == "amd64" {
+		// x32 syscalls share the amd64 audit arch but set this bit.
+		p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr)
+		p.jump(syscall.BPF_JGE, 0x40000000, "", "native")
+		p.stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess)
+		p.label("native")
+	}
+	for i, rule := range profile.Syscalls {
+		if !rule.appliesTo(caps) {
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		for j, name := range names {
+			nr, ok := numbers[name]
+			if !ok {
+				continue
+			}
+			next := fmt.Sprintf("rule-%d-%d", i, j)
+			p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr)
+			p.jump(syscall.BPF_JEQ, nr, "", next)
+			for k, arg := range rule.Args {
+				if err := compileArg(p, arg, fmt.Sprintf("%s-arg-%d", next, k), next); err != nil {
+					return nil, fmt.Errorf("syscall %s: %v", name, err)
+				}
+			}
+			p.stmt(syscall.BPF_RET|syscall.BPF_K, action)
+			p.label(next)
+		}
+	}
+	p.stmt(syscall.BPF_RET|syscall.BPF_K, defaultAction)
+	return p.resolve()
+}
+
+// compileArg checks a 64-bit syscall argument against arg, one 32-bit half
+// at a time, and jumps to fail if it doesn't match or falls through to
+// pass if it does.
+func compileArg(p *bpfProgram, arg SeccompArg, pass, fail string) error {
+	if arg.Index > 5 {
+		return fmt.Errorf("bad argument index %d", arg.Index)
+	}
+	lo := uint32(seccompDataArgs + 8*arg.Index)
+	hi := lo + 4
+	load := func(off uint32) { p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, off) }
+	vHi, vLo := uint32(arg.Value>>32), uint32(arg.Value)
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		load(hi)
+		p.jump(syscall.BPF_JEQ, vHi, "", fail)
+		load(lo)
+		p.jump(syscall.BPF_JEQ, vLo, "", fail)
+	case "SCMP_CMP_NE":
+		load(hi)
+		p.jump(syscall.BPF_JEQ, vHi, "", pass)
+		load(lo)
+		p.jump(syscall.BPF_JEQ, vLo, fail, "")
+	case "SCMP_CMP_MASKED_EQ":
+		load(hi)
+		p.stmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, vHi)
+		p.jump(syscall.BPF_JEQ, uint32(arg.ValueTwo>>32), "", fail)
+		load(lo)
+		p.stmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, vLo)
+		p.jump(syscall.BPF_JEQ, uint32(arg.ValueTwo), "", fail)
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		load(hi)
+		p.jump(syscall.BPF_JGT, vHi, pass, "")
+		p.jump(syscall.BPF_JEQ, vHi, "", fail)
+		load(lo)
+		cmp := uint16(syscall.BPF_JGT)
+		if arg.Op == "SCMP_CMP_GE" {
+			cmp = syscall.BPF_JGE
+		}
+		p.jump(cmp, vLo, "", fail)
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		load(hi)
+		p.jump(syscall.BPF_JGT, vHi, fail, "")
+		p.jump(syscall.BPF_JEQ, vHi, "", pass)
+		load(lo)
+		cmp := uint16(syscall.BPF_JGE)
+		if arg.Op == "SCMP_CMP_LE" {
+			cmp = syscall.BPF_JGT
+		}
+		p.jump(cmp, vLo, fail, "")
+	default:
+		return fmt.Errorf("unknown comparison %q", arg.Op)
+	}
+	p.label(pass)
+	return nil
+}
+
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = *errnoRet
+	}
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | errno&0xffff, nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace | errno&0xffff, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	default:
+		return 0, fmt.Errorf("unknown seccomp action %q", action)
+	}
+}
+
+// appliesTo reports whether the rule is in effect for a container with caps
+// on this host, following Docker: the container needs every included
+// capability and none of the excluded ones, and the host architecture has
+// to be included, if any are listed, and not excluded.
+func (rule SeccompSyscall) appliesTo(caps map[string]bool) bool {
+	hasCap := func(name string) bool {
+		return caps[strings.TrimPrefix(strings.ToUpper(name), "CAP_")]
+	}
+	for _, c := range rule.Includes.Caps {
+		if !hasCap(c) {
+			return false
+		}
+	}
+	for _, c := range rule.Excludes.Caps {
+		if hasCap(c) {
+			return false
+		}
+	}
+	if len(rule.Includes.Arches) > 0 && !slices.Contains(rule.Includes.Arches, runtime.GOARCH) {
+		return false
+	}
+	return !slices.Contains(rule.Excludes.Arches, runtime.GOARCH)
+}
+
+// installSeccomp loads filter for the calling thread, which exec then
+// passes on to the container command. It needs CAP_SYS_ADMIN, so it has to
+// happen before switching to a non-root user.
+func installSeccomp(filter []syscall.SockFilter) error {
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("install seccomp filter: %v", errno)
+	}
+	return nil
+}
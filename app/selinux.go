@@ -0,0 +1,226 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Labels containers run with on SELinux hosts, as in the lxc_contexts of
+// the targeted policy. Each container adds an MCS category pair of its own
+// to both, which keeps containers out of each other's files even though
+// they share a type.
+const (
+	selinuxProcessLabel = "system_u:system_r:container_t:s0"
+	selinuxFileLabel    = "system_u:object_r:container_file_t:s0"
+	selinuxXattr        = "security.selinux"
+	// selinuxCategories is how many MCS categories the policy defines.
+	selinuxCategories = 1024
+)
+
+// Relabel options of a -v mount: z labels the content for every container
+// to share, Z for this container alone.
+const (
+	relabelShared  = "z"
+	relabelPrivate = "Z"
+)
+
+// selinuxProtectedPaths are host directories that relabeling would leave
+// the host unable to use.
+var selinuxProtectedPaths = []string{
+	"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64",
+	"/media", "/opt", "/proc", "/root", "/run", "/sbin", "/srv", "/sys",
+	"/tmp", "/usr", "/var",
+}
+
+// selinuxEnabled reports whether the host runs SELinux, enforcing or not.
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// parseLabelOpts handles the label= options of --security-opt:
+// label=disable runs the container without a label of its own, and
+// label=level:LEVEL picks its MCS level instead of a random one.
+func parseLabelOpts(opts []string, cfg *ContainerConfig) error {
+	for _, opt := range opts {
+		key, value, _ := strings.Cut(opt, "=")
+		if key != "label" {
+			continue
+		}
+		switch {
+		case value == "disable":
+			cfg.LabelDisable = true
+		case strings.HasPrefix(value, "level:") && len(value) > len("level:"):
+			cfg.LabelLevel = strings.TrimPrefix(value, "level:")
+		default:
+			return fmt.Errorf("invalid security option %q: expected label=disable or label=level:LEVEL", opt)
+		}
+	}
+	return nil
+}
+
+// assignLabels picks the labels c's process and files get on an SELinux
+// host, with a category pair no other container has. Privileged containers
+// and those with label=disable get none and run with the runtime's label.
+func (c *Container) assignLabels() error {
+	c.ProcessLabel, c.MountLabel = "", ""
+	if !selinuxEnabled() || c.Config.Privileged || c.Config.LabelDisable {
+		return nil
+	}
+	level := c.Config.LabelLevel
+	if level == "" {
+		unlock, err := lockState("selinux")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		containers, err := listContainers()
+		if err != nil {
+			return err
+		}
+		taken := make(map[string]bool)
+		for _, other := range containers {
+			if other.ID != c.ID && other.MountLabel != "" {
+				taken[labelLevel(other.MountLabel)] = true
+			}
+		}
+		for level == "" || taken[level] {
+			a, b := rand.IntN(selinuxCategories), rand.IntN(selinuxCategories)
+			if a == b {
+				continue
+			}
+			level = fmt.Sprintf("s0:c%d,c%d", min(a, b), max(a, b))
+		}
+	}
+	c.ProcessLabel = withLevel(selinuxProcessLabel, level)
+	c.MountLabel = withLevel(selinuxFileLabel, level)
+	return c.save()
+}
+
+// withLevel replaces the level, the part from the fourth field on, of
+// label.
+func withLevel(label, level string) string {
+	fields := strings.SplitN(label, ":", 4)
+	return strings.Join(fields[:3], ":") + ":" + level
+}
+
+func labelLevel(label string) string {
+	fields := strings.SplitN(label, ":", 4)
+	if len(fields) < 4 {
+		return ""
+	}
+	return fields[3]
+}
+
+// relabelContainer labels c's rootfs and the sources of its z and Z mounts
+// so that its process may use them. A rootfs that already has the label at
+// its top is taken to have been labelled when the container first started.
+// A directory rootfs belongs to the user and is left alone, as Docker does
+// with volumes that aren't marked for relabeling.
+func relabelContainer(c *Container) error {
+	if c.MountLabel == "" {
+		return nil
+	}
+	if c.Config.RootfsPath == "" && fileLabel(c.Rootfs) != c.MountLabel {
+		if err := relabelTree(c.Rootfs, c.MountLabel); err != nil {
+			return fmt.Errorf("relabel rootfs: %v", err)
+		}
+	}
+	for _, m := range c.Config.Mounts {
+		label := ""
+		switch m.Relabel {
+		case relabelShared:
+			label = selinuxFileLabel
+		case relabelPrivate:
+			label = c.MountLabel
+		default:
+			continue
+		}
+		source, err := filepath.EvalSymlinks(m.Source)
+		if err != nil {
+			return fmt.Errorf("relabel %s: %v", m.Source, err)
+		}
+		if err := relabelTree(source, label); err != nil {
+			return fmt.Errorf("relabel %s: %v", m.Source, err)
+		}
+	}
+	return nil
+}
+
+// relabelTree sets label on root and everything below it, without
+// following symlinks out of it.
+func relabelTree(root, label string) error {
+	value := []byte(label)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return lsetxattr(p, selinuxXattr, value)
+	})
+}
+
+func fileLabel(p string) string {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(p, selinuxXattr, buf)
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimRight(buf[:n], "\x00"))
+}
+
+// lsetxattr sets an extended attribute on p itself rather than on what it
+// links to, which the syscall package has no wrapper for.
+func lsetxattr(p, name string, value []byte) error {
+	pathPtr, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return err
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setExecLabel makes the next exec on the calling thread run with label.
+// It needs the host's /proc, so it is done before pivoting into the rootfs.
+func setExecLabel(label string) error {
+	if label == "" {
+		return nil
+	}
+	if err := os.WriteFile("/proc/thread-self/attr/exec", []byte(label), 0); err != nil {
+		return fmt.Errorf("set SELinux label: %v", err)
+	}
+	return nil
+}
+
+// checkRelabel refuses to relabel the host's system directories or the
+// caller's home, which would lock the host out of them.
+func checkRelabel(m Mount) error {
+	if m.Relabel == "" {
+		return nil
+	}
+	source := path.Clean(m.Source)
+	home, _ := os.UserHomeDir()
+	if slices.Contains(selinuxProtectedPaths, source) || (home != "" && source == path.Clean(home)) {
+		return fmt.Errorf("relabeling %s would keep the host from using it: mount a directory below it instead", source)
+	}
+	return nil
+}
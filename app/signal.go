@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// forwardSignals relays signals received by the parent to the process group
+// of proc. If the process is still alive stopTimeout after the first signal,
+// the group is killed with SIGKILL. The returned function stops forwarding.
+func forwardSignals(sigs <-chan os.Signal, proc *os.Process, stopTimeout time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		var kill <-chan time.Time
+		for {
+			select {
+			case sig := <-sigs:
+				syscall.Kill(-proc.Pid, sig.(syscall.Signal))
+				if kill == nil {
+					kill = time.After(stopTimeout)
+				}
+			case <-kill:
+				syscall.Kill(-proc.Pid, syscall.SIGKILL)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// exitTimedOut is the exit code of a container or exec'd command stopped
+// for running past its --timeout, the one timeout(1) uses.
+const exitTimedOut = 124
+
+// enforceTimeout sends SIGTERM to the process group of proc once timeout
+// has passed, and SIGKILL if it is still alive stopTimeout after that. The
+// returned function stops it, reporting whether the time ran out. A
+// timeout of 0 is none.
+func enforceTimeout(proc *os.Process, timeout, stopTimeout time.Duration) func() bool {
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	expired := make(chan bool, 1)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+			expired <- false
+			return
+		}
+		syscall.Kill(-proc.Pid, syscall.SIGTERM)
+		timer.Reset(stopTimeout)
+		select {
+		case <-timer.C:
+			syscall.Kill(-proc.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+		expired <- true
+	}()
+	return func() bool {
+		close(done)
+		return <-expired
+	}
+}
+
+func notifySignals() (chan os.Signal, func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	return sigs, func() { signal.Stop(sigs) }
+}
@@ -0,0 +1,383 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// specOCIVersion is the version of the OCI runtime spec runtimeSpec is laid
+// out after.
+const specOCIVersion = "1.0.2"
+
+// runtimeSpec is the sandbox a container's config makes, laid out like an
+// OCI runtime spec so that the two can be read the same way. It is worked
+// out from the record the way init sets the container up, so it is there
+// before the container starts; once it runs, Live has what the kernel
+// says the command actually got.
+type runtimeSpec struct {
+	OCIVersion  string            `json:"ociVersion"`
+	Process     specProcess       `json:"process"`
+	Root        specRoot          `json:"root"`
+	Mounts      []specMount       `json:"mounts"`
+	Linux       specLinux         `json:"linux"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Live        *specLive         `json:"live,omitempty"`
+}
+
+type specProcess struct {
+	Args         []string         `json:"args"`
+	Env          []string         `json:"env"`
+	Cwd          string           `json:"cwd"`
+	User         specUser         `json:"user"`
+	Capabilities specCapabilities `json:"capabilities"`
+	SelinuxLabel string           `json:"selinuxLabel,omitempty"`
+}
+
+// specUser is who the command runs as. The IDs are only known once the
+// user is looked up in the rootfs, so they are left out if that fails.
+type specUser struct {
+	UID      *int   `json:"uid,omitempty"`
+	GID      *int   `json:"gid,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type specCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Permitted   []string `json:"permitted"`
+	Inheritable []string `json:"inheritable"`
+	Ambient     []string `json:"ambient"`
+}
+
+type specRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type specMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type specLinux struct {
+	Namespaces  []specNamespace `json:"namespaces"`
+	UIDMappings []specIDMapping `json:"uidMappings,omitempty"`
+	GIDMappings []specIDMapping `json:"gidMappings,omitempty"`
+	Devices     []specDevice    `json:"devices"`
+	Resources   *specResources  `json:"resources,omitempty"`
+	CgroupsPath string          `json:"cgroupsPath,omitempty"`
+	Seccomp     *SeccompProfile `json:"seccomp,omitempty"`
+	MountLabel  string          `json:"mountLabel,omitempty"`
+	// MaskedPaths and ReadonlyPaths are what mountKernelFS hides and
+	// protects of /proc and /sys.
+	MaskedPaths   []string `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string `json:"readonlyPaths,omitempty"`
+}
+
+// specNamespace is a namespace the container gets a new one of, or with a
+// Path, one it joins.
+type specNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type specIDMapping struct {
+	ContainerID int `json:"containerID"`
+	HostID      int `json:"hostID"`
+	Size        int `json:"size"`
+}
+
+type specDevice struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Major    int64  `json:"major"`
+	Minor    int64  `json:"minor"`
+	FileMode uint32 `json:"fileMode"`
+}
+
+// specResources has the device rules of the container's cgroup. There is
+// none for a privileged container or one started by an unprivileged user.
+type specResources struct {
+	Devices []DeviceRule `json:"devices"`
+}
+
+// specLive is what a running container's command has, read from /proc.
+type specLive struct {
+	Pid          int              `json:"pid"`
+	Mounts       []specMount      `json:"mounts"`
+	Capabilities specCapabilities `json:"capabilities"`
+}
+
+// containerSpec works out the spec of c.
+func containerSpec(c *Container) *runtimeSpec {
+	spec := &runtimeSpec{
+		OCIVersion:  specOCIVersion,
+		Root:        specRoot{Path: c.Rootfs, Readonly: c.Config.ReadOnly},
+		Annotations: c.Config.Annotations,
+	}
+	user, err := lookupUserIn(c.Rootfs, c.Config.User)
+	spec.Process = specProcess{
+		Args:         append([]string{c.Config.Command}, c.Config.Args...),
+		Cwd:          "/",
+		User:         specUser{Username: c.Config.User},
+		SelinuxLabel: c.ProcessLabel,
+	}
+	if err == nil {
+		spec.Process.User.UID, spec.Process.User.GID = &user.uid, &user.gid
+		spec.Process.Env = containerEnv(c.Config.Env, user.home)
+	} else {
+		spec.Process.Env = c.Config.Env
+	}
+	if c.Config.WorkingDir != "" {
+		spec.Process.Cwd = c.Config.WorkingDir
+	}
+	spec.Process.Capabilities = specCapabilitiesOf(c, user)
+	spec.Mounts = specMounts(c)
+	spec.Linux = specLinux{
+		Namespaces:  specNamespaces(c),
+		CgroupsPath: c.Cgroup,
+		Seccomp:     c.Config.Seccomp,
+		MountLabel:  c.MountLabel,
+	}
+	if !c.Config.Privileged {
+		spec.Linux.MaskedPaths, spec.Linux.ReadonlyPaths = maskedPaths, readOnlyPaths
+	}
+	if c.Config.Rootless && c.Config.JoinNamespaces == "" {
+		uids, gids := idMappings(c)
+		spec.Linux.UIDMappings, spec.Linux.GIDMappings = specIDMappings(uids), specIDMappings(gids)
+	}
+	for _, d := range defaultDevices {
+		spec.Linux.Devices = append(spec.Linux.Devices, specDevice{Path: "/dev/" + d.name, Type: "c", Major: int64(d.major), Minor: int64(d.minor), FileMode: d.mode})
+	}
+	if !c.Config.Privileged && os.Geteuid() == 0 {
+		spec.Linux.Resources = &specResources{Devices: append(append([]DeviceRule{}, defaultDeviceRules...), c.Config.DeviceRules...)}
+	}
+	if c.running() {
+		spec.Live = liveSpec(c.Pid)
+	}
+	return spec
+}
+
+// specCapabilitiesOf follows what init does with capabilities: the bounding
+// set is cut down to the container's, and a command run as anyone but root
+// keeps only the ambient ones across exec.
+func specCapabilitiesOf(c *Container, user containerUser) specCapabilities {
+	if c.Config.Privileged {
+		all := capabilityNames(capabilitySet([]string{"ALL"}, nil))
+		caps := specCapabilities{Bounding: all, Effective: all, Permitted: all, Inheritable: []string{}, Ambient: []string{}}
+		if user.uid != 0 {
+			caps.Effective, caps.Permitted = []string{}, []string{}
+		}
+		return caps
+	}
+	keep := capabilityNames(capabilitySet(c.Config.CapAdd, c.Config.CapDrop))
+	ambient := capabilityNames(ambientCapabilities(c.Config.CapAdd, user))
+	caps := specCapabilities{Bounding: keep, Effective: keep, Permitted: keep, Inheritable: ambient, Ambient: ambient}
+	if user.uid != 0 {
+		caps.Effective, caps.Permitted = ambient, ambient
+	}
+	return caps
+}
+
+func capabilityNames(set map[string]bool) []string {
+	names := []string{}
+	for name := range set {
+		names = append(names, "CAP_"+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// specMounts lists the mounts setupRootfs makes, in the order it makes
+// them.
+func specMounts(c *Container) []specMount {
+	sysOptions := []string{"nosuid", "nodev", "noexec", "ro"}
+	if c.Config.Privileged {
+		sysOptions[3] = "rw"
+	}
+	mounts := []specMount{
+		{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "nodev", "noexec"}},
+		{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: sysOptions},
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+		{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+		{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "nodev", "noexec", "mode=1777", "size=65536k"}},
+	}
+	for _, m := range c.Config.Tmpfs {
+		var opts []string
+		if flags, data, err := m.mountOptions(); err == nil {
+			opts = mountFlagNames(flags)
+			if data != "" {
+				opts = append(opts, strings.Split(data, ",")...)
+			}
+		}
+		mounts = append(mounts, specMount{Destination: m.Destination, Type: "tmpfs", Source: "tmpfs", Options: opts})
+	}
+	for _, m := range c.Config.Mounts {
+		mode := "rw"
+		if m.ReadOnly {
+			mode = "ro"
+		}
+		mounts = append(mounts, specMount{Destination: m.Destination, Type: "bind", Source: m.Source, Options: []string{"rbind", mode}})
+	}
+	return mounts
+}
+
+// mountFlags are the mount flags mountFlagNames knows, by the names mount(8)
+// gives them.
+var mountFlags = []struct {
+	flag uintptr
+	name string
+}{
+	{syscall.MS_RDONLY, "ro"},
+	{syscall.MS_NOSUID, "nosuid"},
+	{syscall.MS_NODEV, "nodev"},
+	{syscall.MS_NOEXEC, "noexec"},
+}
+
+func mountFlagNames(flags uintptr) []string {
+	var names []string
+	if flags&syscall.MS_RDONLY == 0 {
+		names = append(names, "rw")
+	}
+	for _, f := range mountFlags {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// specNamespaces lists the namespaces spawnInit gives the container: new
+// ones, or the mount namespace alone when it joins another container's.
+func specNamespaces(c *Container) []specNamespace {
+	if c.Config.JoinNamespaces != "" {
+		namespaces := []specNamespace{{Type: "mount"}}
+		target, err := loadContainer(c.Config.JoinNamespaces)
+		for _, ns := range execNamespaces {
+			n := specNamespace{Type: ns.name}
+			if n.Type == "net" {
+				n.Type = "network"
+			}
+			if err == nil && target.running() {
+				n.Path = fmt.Sprintf("/proc/%d/ns/%s", target.Pid, ns.name)
+			}
+			namespaces = append(namespaces, n)
+		}
+		return namespaces
+	}
+	namespaces := []specNamespace{{Type: "pid"}, {Type: "mount"}}
+	if networkCloneflags(c.Config.Network) != 0 {
+		namespaces = append(namespaces, specNamespace{Type: "network"})
+	}
+	if c.Config.Rootless {
+		namespaces = append(namespaces, specNamespace{Type: "user"})
+	}
+	return namespaces
+}
+
+func specIDMappings(maps []syscall.SysProcIDMap) []specIDMapping {
+	var mappings []specIDMapping
+	for _, m := range maps {
+		mappings = append(mappings, specIDMapping{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return mappings
+}
+
+// liveSpec reads the mount table and capabilities of pid. It returns nil if
+// the process has gone.
+func liveSpec(pid int) *specLive {
+	mounts, err := readMountinfo(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		return nil
+	}
+	caps, err := readCapabilities(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	return &specLive{Pid: pid, Mounts: mounts, Capabilities: caps}
+}
+
+// readMountinfo parses a mountinfo file, in which the mount points are as
+// the process sees them.
+func readMountinfo(file string) ([]specMount, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []specMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The optional fields end with a lone "-", after which come the
+		// filesystem type, source and superblock options.
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 0 || len(fields) < sep+4 {
+			continue
+		}
+		opts := strings.Split(fields[5], ",")
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			if opt != "rw" && opt != "ro" {
+				opts = append(opts, opt)
+			}
+		}
+		mounts = append(mounts, specMount{
+			Destination: unescapeMountinfo(fields[4]),
+			Type:        fields[sep+1],
+			Source:      unescapeMountinfo(fields[sep+2]),
+			Options:     opts,
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// readCapabilities reads the capability sets in a /proc/<pid>/status file.
+func readCapabilities(file string) (specCapabilities, error) {
+	var caps specCapabilities
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return caps, err
+	}
+	sets := map[string]*[]string{
+		"CapBnd": &caps.Bounding,
+		"CapEff": &caps.Effective,
+		"CapPrm": &caps.Permitted,
+		"CapInh": &caps.Inheritable,
+		"CapAmb": &caps.Ambient,
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		set, known := sets[key]
+		if !ok || !known {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return caps, fmt.Errorf("parse %s: %v", key, err)
+		}
+		names := make(map[string]bool)
+		for name, n := range capabilities {
+			if mask&(1<<n) != 0 {
+				names[name] = true
+			}
+		}
+		*set = capabilityNames(names)
+	}
+	return caps, nil
+}
@@ -0,0 +1,470 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStateDir   = "/var/lib/diy-docker"
+	stateDirEnv       = "DIY_DOCKER_ROOT"
+	containerFileName = "container.json"
+	logFileName       = "container.log"
+
+	statusCreated = "created"
+	statusRunning = "running"
+	statusExited  = "exited"
+	// statusRestarting is a container waiting to be restarted by its
+	// restart policy.
+	statusRestarting = "restarting"
+	// statusWarm is a pool sandbox waiting to be claimed.
+	statusWarm = "warm"
+)
+
+// ContainerConfig is what the user asked for on the command line. It is
+// persisted so that a detached container can be started by the shim.
+type ContainerConfig struct {
+	// Name is unique among containers. One is generated if none is given.
+	Name        string   `json:"name,omitempty"`
+	Image       string   `json:"image"`
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	StopTimeout int      `json:"stopTimeout"`
+	// Timeout stops the container once it has run this long, 0 being no
+	// limit.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Detach  bool          `json:"detach"`
+	// PreserveFDs is how many file descriptors from 3 on the container is
+	// passed by the run that created it. ListenFDs of them are sockets
+	// systemd passed to the run, which the command is told about as in
+	// socket activation, with ListenFDNames their names.
+	PreserveFDs   int    `json:"preserveFds,omitempty"`
+	ListenFDs     int    `json:"listenFds,omitempty"`
+	ListenFDNames string `json:"listenFdNames,omitempty"`
+	// DNSUpstreams are the embedded resolver's upstreams when the container
+	// was created, which a bridged container's DNS goes to instead of the
+	// host's nameservers.
+	DNSUpstreams []string    `json:"dnsUpstreams,omitempty"`
+	Pull         PullOptions `json:"-"`
+	Mounts       []Mount     `json:"mounts"`
+	Env          []string    `json:"env"`
+	WorkingDir   string      `json:"workingDir"`
+	User         string      `json:"user"`
+	// Entrypoint replaces the image's ENTRYPOINT, or clears it if it is
+	// [""], as in Docker's API. Either way the image's CMD is dropped too.
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	// RootfsTmpfs unpacks the image into a tmpfs that is discarded when
+	// the container exits, limited to RootfsSize if that is set.
+	RootfsTmpfs bool   `json:"rootfsTmpfs,omitempty"`
+	RootfsSize  string `json:"rootfsSize,omitempty"`
+	// RootfsPath runs the container on an existing directory instead of
+	// an image. The directory is the user's and is never removed.
+	RootfsPath string `json:"rootfsPath,omitempty"`
+	// ReadOnly mounts the rootfs read-only, leaving Tmpfs mounts and
+	// volumes as places the container can write to.
+	ReadOnly bool         `json:"readOnly,omitempty"`
+	Tmpfs    []TmpfsMount `json:"tmpfs,omitempty"`
+	// Restart says whether the container is started again when it exits.
+	Restart RestartPolicy `json:"restart"`
+	// AutoRemove deletes the container once it has exited instead of
+	// keeping its record and rootfs around.
+	AutoRemove bool `json:"autoRemove,omitempty"`
+	// Log says whether and how the container's output is logged.
+	Log LogConfig `json:"log"`
+	// JoinNamespaces is the ID of a running container whose PID, network,
+	// IPC and UTS namespaces this one shares.
+	JoinNamespaces string `json:"joinNamespaces,omitempty"`
+	// Network is one of bridge, host or none.
+	Network string        `json:"network"`
+	Ports   []PortMapping `json:"ports,omitempty"`
+	// PublishAll publishes the ports the image exposes as well, on host
+	// ports that are picked when the container is created and added to
+	// Ports.
+	PublishAll bool   `json:"publishAll,omitempty"`
+	Project    string `json:"project,omitempty"`
+	// Rootless runs the container in a new user namespace, with its root
+	// mapped to the user who started it.
+	Rootless bool `json:"rootless,omitempty"`
+	// CapAdd and CapDrop adjust the default capability set. Privileged
+	// containers keep every capability instead.
+	CapAdd     []string `json:"capAdd,omitempty"`
+	CapDrop    []string `json:"capDrop,omitempty"`
+	Privileged bool     `json:"privileged,omitempty"`
+	// Seccomp is the syscall filter installed before the command runs, or
+	// nil for none.
+	Seccomp *SeccompProfile `json:"seccomp,omitempty"`
+	// DeviceRules allow the container devices beyond the default ones.
+	DeviceRules []DeviceRule `json:"deviceRules,omitempty"`
+	// Memory are the container's soft memory limits, which its cgroup
+	// enforces.
+	Memory MemoryLimits `json:"memory"`
+	// LabelDisable runs the container without an SELinux label of its
+	// own. LabelLevel sets the MCS level of the label it gets instead of
+	// a random one.
+	LabelDisable bool   `json:"labelDisable,omitempty"`
+	LabelLevel   string `json:"labelLevel,omitempty"`
+	// TimeStartup reports how long each phase of starting took.
+	TimeStartup bool `json:"timeStartup,omitempty"`
+	// TimeUsage reports what a foreground run used once it is over.
+	TimeUsage bool `json:"-"`
+	// Healthcheck overrides fields of the image's HEALTHCHECK.
+	Healthcheck *HealthConfig `json:"healthcheck,omitempty"`
+	// Annotations are metadata for tools outside the runtime, such as
+	// monitoring or billing. The runtime keeps them but never reads them.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Owner is the uid of the daemon client that created the container
+	// when the daemon scopes containers by user, and 0 otherwise.
+	// OwnerGid is its gid. Root in the container of a client other than
+	// root is the client on the host.
+	Owner    int `json:"owner,omitempty"`
+	OwnerGid int `json:"ownerGid,omitempty"`
+}
+
+// Container is the state record kept for every container under the state
+// directory.
+type Container struct {
+	ID          string          `json:"id"`
+	Pid         int             `json:"pid"`
+	Config      ContainerConfig `json:"config"`
+	ImageID     string          `json:"imageId"`
+	ImageConfig ImageConfig     `json:"imageConfig"`
+	Rootfs      string          `json:"rootfs"`
+	// ProcessLabel and MountLabel are the SELinux labels of the container's
+	// process and files, set on SELinux hosts only.
+	ProcessLabel string `json:"processLabel,omitempty"`
+	MountLabel   string `json:"mountLabel,omitempty"`
+	// Cgroup is the container's cgroup, which holds its device filter and
+	// its memory limits. It is set only when the runtime runs as root.
+	Cgroup string `json:"cgroup,omitempty"`
+	// Network is set once a bridged container has been given an address.
+	Network *NetworkSettings `json:"network,omitempty"`
+	// Resources lists what the container created on the host and must be
+	// torn down once it is gone.
+	Resources  []Resource `json:"resources,omitempty"`
+	Status     string     `json:"status"`
+	ExitCode   int        `json:"exitCode"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt time.Time  `json:"finishedAt"`
+	// RestartCount is how many times the restart policy restarted the
+	// container.
+	RestartCount int `json:"restartCount,omitempty"`
+	// TimedOut is set when the container was stopped for running past its
+	// timeout, which makes its exit code exitTimedOut.
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// abandoned is set on loading a container whose record says running
+	// but whose process is gone.
+	abandoned bool
+	// preserved are the file descriptors to pass to the container, which
+	// only the run that created it and its shim have.
+	preserved []*os.File
+	// resolver is the embedded resolver, which only the process that waits
+	// on the container has.
+	resolver *resolver
+}
+
+// stateDir is where containers and images are kept. Unprivileged users
+// can't write to the system-wide default, so theirs lives in their home.
+func stateDir() string {
+	if dir := os.Getenv(stateDirEnv); dir != "" {
+		return dir
+	}
+	if os.Geteuid() == 0 {
+		return defaultStateDir
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return path.Join(dir, "diy-docker")
+	}
+	home, _ := os.UserHomeDir()
+	return path.Join(home, ".local/share/diy-docker")
+}
+
+func containersDir() string {
+	return path.Join(stateDir(), "containers")
+}
+
+func (c *Container) dir() string {
+	return path.Join(containersDir(), c.ID)
+}
+
+func (c *Container) logPath() string {
+	return path.Join(c.dir(), logFileName)
+}
+
+func (c *Container) shortID() string {
+	return c.ID[:12]
+}
+
+func newContainer(cfg ContainerConfig) (*Container, error) {
+	id, err := newContainerID()
+	if err != nil {
+		return nil, err
+	}
+	c := &Container{
+		ID:        id,
+		Config:    cfg,
+		Status:    statusCreated,
+		CreatedAt: time.Now(),
+	}
+	c.Rootfs = containerRootfs(id)
+	if cfg.RootfsPath != "" {
+		c.Rootfs = cfg.RootfsPath
+	}
+	if err := os.MkdirAll(c.dir(), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	if err := os.MkdirAll(c.Rootfs, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	if err := c.assignName(cfg.Name); err != nil {
+		c.removeDirs()
+		return nil, err
+	}
+	if err := c.assignLabels(); err != nil {
+		c.removeDirs()
+		return nil, err
+	}
+	return c, nil
+}
+
+// removeDirs removes what newContainer created for c when setting it up
+// fails halfway.
+func (c *Container) removeDirs() {
+	if c.separateRootfs() {
+		os.RemoveAll(c.Rootfs)
+	}
+	os.RemoveAll(c.dir())
+}
+
+func newContainerID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// save writes the record atomically so that readers never see a partial file.
+func (c *Container) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal container: %v", err)
+	}
+	tmp := path.Join(c.dir(), containerFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write container: %v", err)
+	}
+	if err := os.Rename(tmp, path.Join(c.dir(), containerFileName)); err != nil {
+		return fmt.Errorf("write container: %v", err)
+	}
+	return nil
+}
+
+// remove deletes the container's directory, in the background, releasing
+// whatever it still holds first so that nothing is mounted below it.
+func (c *Container) remove() error {
+	c.releaseResources()
+	if c.separateRootfs() {
+		if err := discardDir(c.Rootfs); err != nil {
+			return fmt.Errorf("remove container: %v", err)
+		}
+	}
+	if err := discardDir(c.dir()); err != nil {
+		return fmt.Errorf("remove container: %v", err)
+	}
+	// A warm sandbox was never anyone's container.
+	if c.Status != statusWarm {
+		recordContainerEvent(c, eventRemove, nil)
+	}
+	return nil
+}
+
+func loadContainer(id string) (*Container, error) {
+	data, err := os.ReadFile(path.Join(containersDir(), id, containerFileName))
+	if err != nil {
+		return nil, fmt.Errorf("read container: %v", err)
+	}
+	var c Container
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("decode container: %v", err)
+	}
+	c.refreshStatus()
+	return &c, nil
+}
+
+// refreshStatus marks a running container as exited when its process is
+// gone, which happens if whoever was waiting on it died first.
+func (c *Container) refreshStatus() {
+	if c.Status != statusRunning || c.Pid == 0 {
+		return
+	}
+	if !processAlive(c.Pid) {
+		c.Status = statusExited
+		c.ExitCode = -1
+		c.abandoned = true
+	}
+}
+
+// supervisorLockFileName is the lock the process waiting on a container
+// holds for as long as it does.
+const supervisorLockFileName = "supervisor.lock"
+
+// lockSupervisor marks the caller as c's supervisor until it calls the
+// returned function or dies. The kernel drops the lock however the process
+// goes, so a container whose supervisor was killed can be told apart from
+// one whose supervisor hasn't caught up with its exit yet.
+func (c *Container) lockSupervisor() (func(), error) {
+	lock, err := os.OpenFile(path.Join(c.dir(), supervisorLockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open supervisor lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("lock supervisor: %v", err)
+	}
+	return func() { lock.Close() }, nil
+}
+
+// supervised reports whether some process holds c's supervisor lock.
+func (c *Container) supervised() bool {
+	lock, err := os.Open(path.Join(c.dir(), supervisorLockFileName))
+	if err != nil {
+		return false
+	}
+	defer lock.Close()
+	return syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+}
+
+// lockState takes an exclusive lock on the named lock file in the state
+// directory and returns a function that releases it.
+func lockState(name string) (func(), error) {
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	lock, err := os.OpenFile(path.Join(stateDir(), name+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("lock %s: %v", name, err)
+	}
+	return func() { lock.Close() }, nil
+}
+
+// processAlive reports whether pid exists and hasn't exited. A zombie is
+// dead even though signalling it still succeeds, which matters when the
+// container's parent died and nothing reaps it.
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesised command name, which may itself
+	// contain spaces and parentheses.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+// markExited records that the container's process exited with code.
+func (c *Container) markExited(code int) error {
+	c.Status = statusExited
+	c.ExitCode = code
+	c.FinishedAt = time.Now()
+	return c.save()
+}
+
+func (c *Container) running() bool {
+	return c.Status == statusRunning
+}
+
+// active reports whether the container's processes are up, including a
+// warm sandbox that hasn't been given anything to run yet.
+func (c *Container) active() bool {
+	return c.running() || c.Status == statusWarm && processAlive(c.Pid)
+}
+
+func listContainers() ([]*Container, error) {
+	entries, err := os.ReadDir(containersDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state dir: %v", err)
+	}
+	var containers []*Container
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		c, err := loadContainer(e.Name())
+		if err != nil {
+			continue
+		}
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].CreatedAt.After(containers[j].CreatedAt)
+	})
+	return containers, nil
+}
+
+// findContainer resolves a full ID, a name or a unique ID prefix, in that
+// order, so that a name that looks like an ID prefix still finds its
+// container.
+func findContainer(ref string) (*Container, error) {
+	containers, err := listContainers()
+	if err != nil {
+		return nil, err
+	}
+	return matchContainer(containers, ref)
+}
+
+// matchContainer resolves ref among containers the way findContainer does.
+func matchContainer(containers []*Container, ref string) (*Container, error) {
+	// Docker prints names with a leading slash.
+	ref = strings.TrimPrefix(ref, "/")
+	for _, c := range containers {
+		if c.ID == ref {
+			return c, nil
+		}
+	}
+	for _, c := range containers {
+		if ref != "" && c.Config.Name == ref {
+			return c, nil
+		}
+	}
+	var matches []*Container
+	for _, c := range containers {
+		if ref != "" && strings.HasPrefix(c.ID, ref) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", ref)
+	case 1:
+		return matches[0], nil
+	}
+	ids := make([]string, len(matches))
+	for i, c := range matches {
+		ids[i] = c.shortID()
+	}
+	return nil, fmt.Errorf("multiple containers match prefix %q: %s", ref, strings.Join(ids, ", "))
+}
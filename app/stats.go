@@ -0,0 +1,291 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat. The kernel
+// reports them in USER_HZ, which is 100 on every architecture Linux
+// supports.
+const clockTicks = 100
+
+const statsInterval = time.Second
+
+// ContainerStats is a container's resource usage as stats reports it.
+type ContainerStats struct {
+	ID string `json:"id"`
+	// CPUPercent is CPU time used over the sampling interval as a share of
+	// one CPU, so a container keeping two CPUs busy shows 200%.
+	CPUPercent    float64 `json:"cpuPercent"`
+	MemoryUsage   int64   `json:"memoryUsage"`
+	MemoryLimit   int64   `json:"memoryLimit"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	// MemoryReservation and MemoryHigh are the container's soft memory
+	// limits, 0 where it has none, and MemoryThrottled how many times it
+	// was throttled for going above MemoryHigh.
+	MemoryReservation int64 `json:"memoryReservation,omitempty"`
+	MemoryHigh        int64 `json:"memoryHigh,omitempty"`
+	MemoryThrottled   int64 `json:"memoryThrottled"`
+	Pids              int   `json:"pids"`
+}
+
+// usageSample is a container's cumulative usage at one point in time.
+type usageSample struct {
+	at     time.Time
+	cpu    time.Duration
+	memory int64
+	pids   int
+	// throttled is the memory.events high counter of the container's
+	// cgroup.
+	throttled int64
+}
+
+// statsCmd shows the resource usage of running containers, refreshing once
+// a second, or with --no-stream prints one snapshot as JSON. CPU time and
+// the number of PIDs come from the container's cgroup, which counts what
+// exited processes used as well. Container cgroups only have the memory
+// controller enabled for containers with soft memory limits, so memory is
+// summed from /proc over the processes in each container's PID namespace,
+// and the memory limit is the host's memory. Containers with soft limits
+// have their memory usage read from their cgroup instead, along with how
+// often they were throttled. Containers without a cgroup have all their
+// figures taken from /proc.
+func statsCmd(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	noStream := fs.Bool("no-stream", false, "print a single snapshot as JSON and exit")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var containers []*Container
+	if fs.NArg() == 0 {
+		all, err := listContainers()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, c := range all {
+			if c.running() {
+				containers = append(containers, c)
+			}
+		}
+	}
+	for _, id := range fs.Args() {
+		c, err := findContainer(id)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if !c.running() {
+			fmt.Printf("container %s is not running\n", c.shortID())
+			return 1
+		}
+		containers = append(containers, c)
+	}
+	limit, err := hostMemory()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	prev := sampleAll(containers)
+	for {
+		time.Sleep(statsInterval)
+		cur := sampleAll(containers)
+		stats := []ContainerStats{}
+		for i, c := range containers {
+			if prev[i] == nil || cur[i] == nil {
+				continue
+			}
+			stats = append(stats, usageStats(c, prev[i], cur[i], limit))
+		}
+		if *noStream {
+			data, err := json.MarshalIndent(stats, "", "  ")
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			fmt.Println(string(data))
+			return 0
+		}
+		// Clear the screen and redraw from the top.
+		fmt.Print("\x1b[H\x1b[2J")
+		printStats(os.Stdout, stats)
+		prev = cur
+	}
+}
+
+func printStats(out io.Writer, stats []ContainerStats) {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tCPU %\tMEM USAGE / LIMIT\tMEM %\tMEM HIGH\tTHROTTLED\tPIDS")
+	for _, s := range stats {
+		high, throttled := "-", "-"
+		if s.MemoryHigh > 0 {
+			high, throttled = formatBytes(s.MemoryHigh), strconv.FormatInt(s.MemoryThrottled, 10)
+		}
+		fmt.Fprintf(w, "%s\t%.2f%%\t%s / %s\t%.2f%%\t%s\t%s\t%d\n", s.ID[:12], s.CPUPercent,
+			formatBytes(s.MemoryUsage), formatBytes(s.MemoryLimit), s.MemoryPercent, high, throttled, s.Pids)
+	}
+	w.Flush()
+}
+
+func usageStats(c *Container, prev, cur *usageSample, limit int64) ContainerStats {
+	s := ContainerStats{
+		ID:                c.ID,
+		MemoryUsage:       cur.memory,
+		MemoryLimit:       limit,
+		Pids:              cur.pids,
+		MemoryReservation: c.Config.Memory.Reservation,
+		MemoryHigh:        c.Config.Memory.High,
+		MemoryThrottled:   cur.throttled,
+	}
+	if elapsed := cur.at.Sub(prev.at); elapsed > 0 && cur.cpu >= prev.cpu {
+		s.CPUPercent = float64(cur.cpu-prev.cpu) / float64(elapsed) * 100
+	}
+	if limit > 0 {
+		s.MemoryPercent = float64(cur.memory) / float64(limit) * 100
+	}
+	return s
+}
+
+// sampleAll samples each container, leaving nil for those that have
+// exited since.
+func sampleAll(containers []*Container) []*usageSample {
+	samples := make([]*usageSample, len(containers))
+	for i, c := range containers {
+		samples[i], _ = sampleUsage(c)
+	}
+	return samples
+}
+
+// sampleUsage adds up the CPU time and resident memory of the processes in
+// c. Pages that processes share are counted once for each of them, unless
+// c has soft memory limits, whose cgroup's own count is taken instead.
+// Where c has a cgroup, its CPU time and PIDs are taken from that.
+func sampleUsage(c *Container) (*usageSample, error) {
+	pids, err := containerPids(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &usageSample{at: time.Now()}
+	for _, pid := range pids {
+		ticks, err := processCPUTicks(pid)
+		if err != nil {
+			// Exited since it was listed.
+			continue
+		}
+		rss, err := processRSS(pid)
+		if err != nil {
+			continue
+		}
+		s.cpu += time.Duration(ticks) * time.Second / clockTicks
+		s.memory += rss
+		s.pids++
+	}
+	if c.Cgroup == "" {
+		return s, nil
+	}
+	// cpu.stat has usage_usec whichever controllers are enabled.
+	if usec, ok := cgroupStat(c.Cgroup, "cpu.stat", "usage_usec"); ok {
+		s.cpu = time.Duration(usec) * time.Microsecond
+	}
+	if n, ok := cgroupPids(c.Cgroup); ok {
+		s.pids = n
+	}
+	if c.Config.Memory.set() {
+		if usage, err := readCgroupInt(c.Cgroup, "memory.current"); err == nil {
+			s.memory = usage
+		}
+		s.throttled = memoryEvents(c.Cgroup)["high"]
+	}
+	return s, nil
+}
+
+// cgroupPids counts the tasks in cgroup: pids.current where the pids
+// controller is enabled, and the processes in cgroup.procs otherwise.
+func cgroupPids(cgroup string) (int, bool) {
+	if n, err := readCgroupInt(cgroup, "pids.current"); err == nil {
+		return int(n), true
+	}
+	data, err := os.ReadFile(path.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return 0, false
+	}
+	return len(strings.Fields(string(data))), true
+}
+
+// processCPUTicks returns the user and system time pid has used.
+func processCPUTicks(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name in parentheses may contain spaces, so the fields are
+	// counted from the closing one. utime and stime are fields 14 and 15.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("parse /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("parse /proc/%d/stat", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return utime + stime, nil
+}
+
+// processRSS returns the resident memory of pid in bytes.
+func processRSS(pid int) (int64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("parse /proc/%d/statm", pid)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// hostMemory returns the host's total memory in bytes.
+func hostMemory() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("read meminfo: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse meminfo: %v", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("parse meminfo: no MemTotal")
+}
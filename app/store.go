@@ -0,0 +1,368 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const repositoriesFileName = "repositories.json"
+
+// Image is a pulled image as recorded in the local store. Its blobs
+// (manifest, config and layers) live in the store's blob directory, keyed by
+// digest, so that images sharing layers only keep one copy.
+type Image struct {
+	// Ref is the normalized name:tag or name@digest the image was pulled as.
+	Ref string `json:"ref"`
+	// Digest is what Ref resolved to in the registry. For multi-arch images
+	// this is the index, not the platform-specific manifest.
+	Digest   string    `json:"digest"`
+	Manifest string    `json:"manifest"`
+	Config   string    `json:"config"`
+	Layers   []string  `json:"layers"`
+	PulledAt time.Time `json:"pulledAt"`
+	// LastUsed is when a container was last created from the image, which
+	// is what image prune --max-size goes by.
+	LastUsed time.Time `json:"lastUsed,omitempty"`
+}
+
+// ID is the image's config digest, as with Docker.
+func (img *Image) ID() string {
+	return img.Config
+}
+
+// blobs lists the digests of everything img is made of.
+func (img *Image) blobs() []string {
+	return append([]string{img.Digest, img.Manifest, img.Config}, img.Layers...)
+}
+
+// lastUsed returns when img was last used, counting being pulled as a use,
+// so that an image nothing has run yet isn't the first to go.
+func (img *Image) lastUsed() time.Time {
+	if img.LastUsed.After(img.PulledAt) {
+		return img.LastUsed
+	}
+	return img.PulledAt
+}
+
+type imageStore struct {
+	dir string
+	// repositories is the file that maps refs to images. Each tenant of
+	// the daemon has its own, see forTenant.
+	repositories string
+}
+
+func openImageStore() (*imageStore, error) {
+	dir := path.Join(stateDir(), "images")
+	s := &imageStore{dir: dir, repositories: path.Join(dir, repositoriesFileName)}
+	if err := os.MkdirAll(path.Join(s.dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	return s, nil
+}
+
+// parseImageRef splits name[:tag][@digest] into the repository name and the
+// tag or digest to resolve, defaulting to the latest tag.
+func parseImageRef(ref string) (name, reference string) {
+	if name, digest, ok := strings.Cut(ref, "@"); ok {
+		name, _, _ = strings.Cut(name, ":")
+		return name, digest
+	}
+	name, tag, ok := strings.Cut(ref, ":")
+	if !ok {
+		tag = "latest"
+	}
+	return name, tag
+}
+
+func canonicalRef(name, reference string) string {
+	if strings.Contains(reference, ":") {
+		return name + "@" + reference
+	}
+	return name + ":" + reference
+}
+
+func normalizeRef(ref string) string {
+	return canonicalRef(parseImageRef(ref))
+}
+
+func (s *imageStore) blobPath(digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return path.Join(s.dir, "blobs", algo, hex)
+}
+
+// partialPath is where a blob is downloaded to before it is verified:
+// beside where it goes, or in the directory tmpDirEnv names. Leaving it in
+// place after a failure lets the next pull resume it.
+func (s *imageStore) partialPath(digest string) string {
+	if tmp := os.Getenv(tmpDirEnv); tmp != "" {
+		algo, hex, _ := strings.Cut(digest, ":")
+		return path.Join(tmp, algo+"-"+hex+".partial")
+	}
+	return s.blobPath(digest) + ".partial"
+}
+
+func (s *imageStore) hasBlob(digest string) bool {
+	_, err := os.Stat(s.blobPath(digest))
+	return err == nil
+}
+
+func (s *imageStore) readBlob(digest string) ([]byte, error) {
+	data, err := os.ReadFile(s.blobPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("read blob: %v", err)
+	}
+	return data, nil
+}
+
+// writeBlob stores data under its digest after checking that they match.
+func (s *imageStore) writeBlob(digest string, data []byte) error {
+	if got := digestOf(data); got != digest {
+		return fmt.Errorf("%w: expected %s, got %s", errDigestMismatch, digest, got)
+	}
+	tmp := s.partialPath(digest)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write blob: %v", err)
+	}
+	return s.commitBlob(digest)
+}
+
+// commitBlob moves a verified partial download into place.
+func (s *imageStore) commitBlob(digest string) error {
+	if err := os.Rename(s.partialPath(digest), s.blobPath(digest)); err != nil {
+		return fmt.Errorf("commit blob: %v", err)
+	}
+	return nil
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// lookup returns the image stored under ref, or nil if there is none.
+func (s *imageStore) lookup(ref string) (*Image, error) {
+	repos, err := s.readRepositories()
+	if err != nil {
+		return nil, err
+	}
+	return repos[normalizeRef(ref)], nil
+}
+
+func (s *imageStore) list() ([]*Image, error) {
+	repos, err := s.readRepositories()
+	if err != nil {
+		return nil, err
+	}
+	images := make([]*Image, 0, len(repos))
+	for _, img := range repos {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Ref < images[j].Ref })
+	return images, nil
+}
+
+// put records img under its ref, replacing whatever the ref pointed to.
+func (s *imageStore) put(img *Image) error {
+	return s.updateRepositories(func(repos map[string]*Image) error {
+		repos[img.Ref] = img
+		return nil
+	})
+}
+
+// markUsed records that a container is being created from img.
+func (s *imageStore) markUsed(img *Image) error {
+	now := time.Now()
+	img.LastUsed = now
+	return s.updateRepositories(func(repos map[string]*Image) error {
+		if stored := repos[img.Ref]; stored != nil && stored.ID() == img.ID() {
+			stored.LastUsed = now
+		}
+		return nil
+	})
+}
+
+// imageSize adds up the sizes of img's layers as stored, compressed.
+func (s *imageStore) imageSize(img *Image) int64 {
+	var size int64
+	for _, layer := range img.Layers {
+		if fi, err := os.Stat(s.blobPath(layer)); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// updateRepositories applies fn to the ref index under an exclusive lock so
+// that concurrent pulls don't drop each other's entries.
+func (s *imageStore) updateRepositories(fn func(map[string]*Image) error) error {
+	lock, err := os.OpenFile(path.Join(s.dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open lock: %v", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("lock image store: %v", err)
+	}
+	repos, err := s.readRepositories()
+	if err != nil {
+		return err
+	}
+	if err := fn(repos); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal repositories: %v", err)
+	}
+	tmp := s.repositories + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write repositories: %v", err)
+	}
+	if err := os.Rename(tmp, s.repositories); err != nil {
+		return fmt.Errorf("write repositories: %v", err)
+	}
+	return nil
+}
+
+func (s *imageStore) readRepositories() (map[string]*Image, error) {
+	repos := make(map[string]*Image)
+	data, err := os.ReadFile(s.repositories)
+	if os.IsNotExist(err) {
+		return repos, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read repositories: %v", err)
+	}
+	if err := json.Unmarshal(data, &repos); err != nil {
+		return nil, fmt.Errorf("decode repositories: %v", err)
+	}
+	return repos, nil
+}
+
+func (s *imageStore) imageConfig(img *Image) (*ImageConfig, error) {
+	data, err := s.readBlob(img.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("decode config: %v", err)
+	}
+	return &config, nil
+}
+
+// unpack extracts the image's layers into rootfs. Layers are applied in
+// order, since later ones overwrite files from earlier ones.
+func (s *imageStore) unpack(img *Image, rootfs string) error {
+	for _, layer := range img.Layers {
+		if err := extractLayer(s.blobPath(layer), rootfs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Layers mark files deleted from the layers below with an empty file named
+// after them with this prefix, and a directory whose earlier contents are
+// all gone with whiteoutOpaque.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+func extractLayer(fileName, dir string) error {
+	if err := applyWhiteouts(fileName, dir); err != nil {
+		return err
+	}
+	return unpackLayer(fileName, dir)
+}
+
+// applyWhiteouts deletes what the layer's whiteouts mark as deleted from
+// the layers already extracted into dir.
+func applyWhiteouts(fileName, dir string) error {
+	r, err := openLayer(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read layer: %v", err)
+		}
+		parent, base := path.Split(path.Clean("/" + hdr.Name))
+		if !strings.HasPrefix(base, whiteoutPrefix) {
+			continue
+		}
+		target, err := securePath(dir, parent)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %v", hdr.Name, err)
+		}
+		if base == whiteoutOpaque {
+			entries, err := os.ReadDir(target)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("read dir: %v", err)
+			}
+			for _, e := range entries {
+				if err := os.RemoveAll(path.Join(target, e.Name())); err != nil {
+					return fmt.Errorf("remove: %v", err)
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(path.Join(target, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+			return fmt.Errorf("remove: %v", err)
+		}
+	}
+}
+
+// openLayer opens a layer blob for reading as a tar stream, whether or not
+// it is gzipped.
+func openLayer(fileName string) (io.ReadCloser, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("read layer: %v", err)
+	}
+	r, err := decompressLayer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// decompressLayer returns the tar of the layer read from r, which may be
+// gzipped or not.
+func decompressLayer(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("read layer: %v", err)
+	}
+	return gz, nil
+}
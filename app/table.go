@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ANSI colors for table cells.
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// table lays out listings such as ps's and images' in columns the way
+// tabwriter does, three spaces apart. Unlike tabwriter it knows how wide a
+// colored cell is, and its rows can be sorted by keys that aren't shown as
+// they are printed, such as sizes and times.
+type table struct {
+	header []string
+	rows   []*tableRow
+}
+
+type tableRow struct {
+	cells  []string
+	colors []string
+	keys   map[string]interface{}
+}
+
+func newTable(header ...string) *table {
+	return &table{header: header}
+}
+
+// add appends a row of cells, one per column.
+func (t *table) add(cells ...string) *tableRow {
+	r := &tableRow{cells: cells, colors: make([]string, len(cells)), keys: make(map[string]interface{})}
+	t.rows = append(t.rows, r)
+	return r
+}
+
+// color has column col of r printed in color, if the table is printed in
+// color at all.
+func (r *tableRow) color(col int, color string) *tableRow {
+	r.colors[col] = color
+	return r
+}
+
+// key sets what r is sorted by for name: a string, an int64 or a time.
+func (r *tableRow) key(name string, v interface{}) *tableRow {
+	r.keys[name] = v
+	return r
+}
+
+// sort orders the rows by their key for name, smallest, earliest or first
+// in the alphabet first, or the other way round if reverse is set. Rows
+// that are equal keep their order.
+func (t *table) sort(name string, reverse bool) {
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		a, b := t.rows[i].keys[name], t.rows[j].keys[name]
+		if reverse {
+			a, b = b, a
+		}
+		switch a := a.(type) {
+		case string:
+			return a < b.(string)
+		case int64:
+			return a < b.(int64)
+		case time.Time:
+			return a.Before(b.(time.Time))
+		}
+		return false
+	})
+}
+
+// write prints the table to out, in color if color is set.
+func (t *table) write(out io.Writer, color bool) {
+	widths := make([]int, len(t.header))
+	for _, r := range append([]*tableRow{{cells: t.header}}, t.rows...) {
+		for i, cell := range r.cells {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	var b strings.Builder
+	line := func(r *tableRow) {
+		for i, cell := range r.cells {
+			if color && r.colors != nil && r.colors[i] != "" {
+				fmt.Fprintf(&b, "\x1b[%sm%s\x1b[0m", r.colors[i], cell)
+			} else {
+				b.WriteString(cell)
+			}
+			if i < len(r.cells)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+3))
+			}
+		}
+		b.WriteString("\n")
+	}
+	line(&tableRow{cells: t.header})
+	for _, r := range t.rows {
+		line(r)
+	}
+	io.WriteString(out, b.String())
+}
+
+// useColor reports whether listings printed to f are colored: only on a
+// terminal that can show color, unless NO_COLOR says not to or
+// FORCE_COLOR says to anyway, as https://no-color.org and others have it.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if force := os.Getenv("FORCE_COLOR"); force != "" && force != "0" {
+		return true
+	}
+	return isTerminal(f) && os.Getenv("TERM") != "dumb"
+}
@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// tenantsDirName holds the image index of each tenant under the image
+// store. Their blobs are kept with everyone else's.
+const tenantsDirName = "tenants"
+
+// tenant is the user a daemon request comes from, as the kernel reports
+// the process at the other end of the socket. Root is the operator of the
+// host and sees everything, as do all requests to a daemon that doesn't
+// scope by user.
+type tenant struct {
+	uid, gid int
+}
+
+func (t tenant) root() bool {
+	return t.uid == 0
+}
+
+// owns reports whether c belongs to t.
+func (t tenant) owns(c *Container) bool {
+	return t.root() || c.Config.Owner == t.uid
+}
+
+// Context keys of what a daemon connection records about its peer:
+// clientKey has its uid and tenantKey the tenant it is, when the daemon
+// scopes by user.
+type (
+	clientKey struct{}
+	tenantKey struct{}
+)
+
+// connContext is the daemon's http.Server ConnContext. It records who is
+// at the other end of conn, closing it if that can't be found out.
+func (d *daemon) connContext(ctx context.Context, conn net.Conn) context.Context {
+	t, err := peerTenant(conn)
+	if err != nil {
+		fmt.Println(err)
+		conn.Close()
+		// The server then fails to read the closed connection, which
+		// is the end of it.
+		return ctx
+	}
+	ctx = context.WithValue(ctx, clientKey{}, t.uid)
+	if d.multiUser {
+		ctx = context.WithValue(ctx, tenantKey{}, t)
+	}
+	return ctx
+}
+
+func peerTenant(conn net.Conn) (tenant, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return tenant{}, fmt.Errorf("peer credentials: not a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return tenant{}, fmt.Errorf("peer credentials: %v", err)
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return tenant{}, fmt.Errorf("peer credentials: %v", err)
+	}
+	if credErr != nil {
+		return tenant{}, fmt.Errorf("peer credentials: %v", credErr)
+	}
+	return tenant{uid: int(cred.Uid), gid: int(cred.Gid)}, nil
+}
+
+// requestTenant returns who r comes from. Without a tenant recorded for
+// its connection, the daemon doesn't scope by user and r is root's.
+func requestTenant(r *http.Request) tenant {
+	t, _ := r.Context().Value(tenantKey{}).(tenant)
+	return t
+}
+
+// forTenant returns the store as t sees it: root's is the store itself,
+// and everyone else has an index of their own over the shared blobs.
+func (s *imageStore) forTenant(t tenant) (*imageStore, error) {
+	if t.root() {
+		return s, nil
+	}
+	dir := path.Join(s.dir, tenantsDirName, strconv.Itoa(t.uid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	return &imageStore{dir: s.dir, repositories: path.Join(dir, repositoriesFileName)}, nil
+}
+
+// tenantStores returns the store as each tenant who has pulled into it
+// sees it.
+func (s *imageStore) tenantStores() ([]*imageStore, error) {
+	entries, err := os.ReadDir(path.Join(s.dir, tenantsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read tenants: %v", err)
+	}
+	var stores []*imageStore
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil || !e.IsDir() {
+			continue
+		}
+		stores = append(stores, &imageStore{dir: s.dir, repositories: path.Join(s.dir, tenantsDirName, e.Name(), repositoriesFileName)})
+	}
+	return stores, nil
+}
+
+// checkTenantConfig refuses what would let t's container reach beyond
+// what t could reach on the host: extra privileges, devices, reserved
+// memory and bind mounts of paths t doesn't own. The bind sources are
+// checked again where they are mounted, since they could be swapped in
+// the meantime; this only makes a bad one fail the create.
+func checkTenantConfig(cfg *ContainerConfig, t tenant) error {
+	if t.root() {
+		return nil
+	}
+	if cfg.Privileged {
+		return fmt.Errorf("privileged containers require root")
+	}
+	if len(cfg.CapAdd) > 0 {
+		return fmt.Errorf("adding capabilities requires root")
+	}
+	if len(cfg.DeviceRules) > 0 {
+		return fmt.Errorf("device cgroup rules require root")
+	}
+	// Memory set aside for t's container is taken from everyone else's.
+	if cfg.Memory.Reservation > 0 {
+		return fmt.Errorf("memory reservations require root")
+	}
+	for _, m := range cfg.Mounts {
+		source, err := filepath.EvalSymlinks(m.Source)
+		if err != nil {
+			return fmt.Errorf("bind source %s can't be used: %v", m.Source, err)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(source, &st); err != nil {
+			return fmt.Errorf("bind source %s can't be used: %v", m.Source, err)
+		}
+		if int(st.Uid) != t.uid {
+			return fmt.Errorf("bind source %s is not yours", m.Source)
+		}
+	}
+	return nil
+}
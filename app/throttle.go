@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter gives each client of the daemon, told apart by uid, a bucket
+// of rate requests a second that holds up to a second's worth, so that
+// short bursts go through and sustained floods don't.
+type rateLimiter struct {
+	rate    float64
+	mu      sync.Mutex
+	buckets map[int]*tokenBucket
+	// limited counts the requests turned away, for the metrics.
+	limited int64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, buckets: make(map[int]*tokenBucket)}
+}
+
+func (l *rateLimiter) burst() float64 {
+	return math.Max(1, math.Ceil(l.rate))
+}
+
+// take spends one of client's tokens. If there are none, it returns how
+// long until there is one.
+func (l *rateLimiter) take(client int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst(), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst(), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		l.limited++
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// admission caps how many of the daemon's expensive requests, pulls and
+// container creations, run at once. Those over the cap wait their turn,
+// up to maxQueued of them, and the rest are turned away.
+type admission struct {
+	maxActive, maxQueued int
+	mu                   sync.Mutex
+	cond                 *sync.Cond
+	active, queued       int
+	// full counts the requests turned away, for the metrics.
+	full int64
+}
+
+func newAdmission(maxActive, maxQueued int) *admission {
+	a := &admission{maxActive: maxActive, maxQueued: maxQueued}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// enter waits for a free slot. It fails if the queue is full, or if r is
+// abandoned while it waits.
+func (a *admission) enter(r *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxActive <= 0 || a.active < a.maxActive {
+		a.active++
+		return nil
+	}
+	if a.queued >= a.maxQueued {
+		a.full++
+		return fmt.Errorf("too many requests: %d running and %d waiting", a.active, a.queued)
+	}
+	a.queued++
+	defer func() { a.queued-- }()
+	// A cancelled request has to be woken to notice.
+	stop := context.AfterFunc(r.Context(), func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.cond.Broadcast()
+	})
+	defer stop()
+	for a.active >= a.maxActive {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		a.cond.Wait()
+	}
+	a.active++
+	return nil
+}
+
+func (a *admission) leave() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	// Waiters that have given up take their wakeup with them, so all of
+	// them are woken.
+	a.cond.Broadcast()
+}
+
+// limited wraps a handler for an expensive request so that it waits for
+// an admission slot.
+func (d *daemon) limited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := d.admission.enter(r); err != nil {
+			apiError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		defer d.admission.leave()
+		h(w, r)
+	}
+}
+
+// rateLimit turns away the requests of clients that have used up their
+// rate, telling them when to try again.
+func (d *daemon) rateLimit(next http.Handler) http.Handler {
+	if d.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _ := r.Context().Value(clientKey{}).(int)
+		if ok, wait := d.limiter.take(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			apiError(w, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded: try again in %s", wait.Round(time.Millisecond)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metrics reports how busy the expensive requests keep the daemon and how
+// many requests it has turned away.
+func (d *daemon) metrics(w http.ResponseWriter, r *http.Request) {
+	a := d.admission
+	a.mu.Lock()
+	m := map[string]interface{}{
+		"Active":    a.active,
+		"Queued":    a.queued,
+		"MaxActive": a.maxActive,
+		"MaxQueued": a.maxQueued,
+		"QueueFull": a.full,
+	}
+	a.mu.Unlock()
+	if l := d.limiter; l != nil {
+		l.mu.Lock()
+		m["RateLimit"] = l.rate
+		m["RateLimited"] = l.limited
+		l.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, m)
+}
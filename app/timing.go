@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// startupTimer records how long each phase of starting a container takes,
+// for --time-startup. A nil *startupTimer records nothing.
+type startupTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []startupPhase
+}
+
+type startupPhase struct {
+	name     string
+	duration time.Duration
+}
+
+func newStartupTimer(enabled bool) *startupTimer {
+	if !enabled {
+		return nil
+	}
+	now := time.Now()
+	return &startupTimer{start: now, last: now}
+}
+
+// mark ends the current phase, naming it after what just finished.
+func (t *startupTimer) mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, startupPhase{name, now.Sub(t.last)})
+	t.last = now
+}
+
+// report writes the phases recorded so far as a table.
+func (t *startupTimer) report(w io.Writer) {
+	if t == nil {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tDURATION")
+	for _, p := range t.phases {
+		fmt.Fprintf(tw, "%s\t%s\n", p.name, formatDuration(p.duration))
+	}
+	fmt.Fprintf(tw, "total\t%s\n", formatDuration(t.last.Sub(t.start)))
+	tw.Flush()
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,229 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// rm moves containers to the trash rather than deleting them, record and
+// writable layer alike, so that one removed by mistake can be restored
+// until its retention runs out.
+const (
+	trashDirName          = "trash"
+	trashFileName         = "trash.json"
+	defaultTrashRetention = 24 * time.Hour
+)
+
+func trashDir() string {
+	return path.Join(stateDir(), trashDirName)
+}
+
+// trashRecord is kept in a container's directory while it is in the trash.
+type trashRecord struct {
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type trashedContainer struct {
+	c      *Container
+	record trashRecord
+}
+
+func (t *trashedContainer) dir() string {
+	return path.Join(trashDir(), t.c.ID)
+}
+
+// moveToTrash takes c out of the containers, keeping it for retention. What
+// c had on the host has to be released first.
+func (c *Container) moveToTrash(retention time.Duration) error {
+	if err := os.MkdirAll(trashDir(), 0755); err != nil {
+		return fmt.Errorf("mkdir: %v", err)
+	}
+	now := time.Now()
+	data, err := json.Marshal(trashRecord{DeletedAt: now, ExpiresAt: now.Add(retention)})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(c.dir(), trashFileName), data, 0644); err != nil {
+		return fmt.Errorf("write trash record: %v", err)
+	}
+	if err := os.Rename(c.dir(), path.Join(trashDir(), c.ID)); err != nil {
+		return fmt.Errorf("move to trash: %v", err)
+	}
+	recordContainerEvent(c, eventRemove, map[string]string{"trash": "true"})
+	return nil
+}
+
+// listTrash returns the containers in the trash, most recently removed
+// first.
+func listTrash() ([]*trashedContainer, error) {
+	entries, err := os.ReadDir(trashDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read trash: %v", err)
+	}
+	var trashed []*trashedContainer
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := path.Join(trashDir(), e.Name())
+		var t trashedContainer
+		data, err := os.ReadFile(path.Join(dir, containerFileName))
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(data, &t.c); err != nil {
+			continue
+		}
+		if data, err = os.ReadFile(path.Join(dir, trashFileName)); err != nil {
+			continue
+		}
+		if err := json.Unmarshal(data, &t.record); err != nil {
+			continue
+		}
+		trashed = append(trashed, &t)
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].record.DeletedAt.After(trashed[j].record.DeletedAt)
+	})
+	return trashed, nil
+}
+
+// purgeTrash deletes the containers whose retention has run out, or all of
+// them if all is set.
+func purgeTrash(all bool) error {
+	trashed, err := listTrash()
+	if err != nil {
+		return err
+	}
+	for _, t := range trashed {
+		if !all && time.Now().Before(t.record.ExpiresAt) {
+			continue
+		}
+		if t.c.separateRootfs() {
+			if err := discardDir(t.c.Rootfs); err != nil {
+				return fmt.Errorf("purge %s: %v", t.c.shortID(), err)
+			}
+		}
+		if err := discardDir(t.dir()); err != nil {
+			return fmt.Errorf("purge %s: %v", t.c.shortID(), err)
+		}
+	}
+	return nil
+}
+
+// restoreFromTrash puts the container ref names back among the others,
+// under name if it is set. Its name has to be free again.
+func restoreFromTrash(ref, name string) (*Container, error) {
+	trashed, err := listTrash()
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]*Container, len(trashed))
+	for i, t := range trashed {
+		containers[i] = t.c
+	}
+	match, err := matchContainer(containers, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(containersDir(), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %v", err)
+	}
+	from := path.Join(trashDir(), match.ID)
+	if err := os.Rename(from, match.dir()); err != nil {
+		return nil, fmt.Errorf("restore: %v", err)
+	}
+	c, err := loadContainer(match.ID)
+	if err == nil {
+		if name == "" {
+			name = c.Config.Name
+		}
+		err = c.assignName(name)
+	}
+	if err != nil {
+		os.Rename(match.dir(), from)
+		return nil, err
+	}
+	os.Remove(path.Join(c.dir(), trashFileName))
+	recordContainerEvent(c, eventRestore, nil)
+	return c, nil
+}
+
+func containerRestoreCmd(args []string) int {
+	fs := flag.NewFlagSet("container restore", flag.ContinueOnError)
+	name := fs.String("name", "", "restore the container under this name instead of its own")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: container restore [--name NAME] <id>")
+		return 2
+	}
+	if err := validateContainerName(*name); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if err := purgeTrash(false); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	c, err := restoreFromTrash(fs.Arg(0), *name)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(c.name())
+	return 0
+}
+
+// containerTrashCmd lists the containers in the trash, or empties it.
+func containerTrashCmd(args []string) int {
+	fs := flag.NewFlagSet("container trash", flag.ContinueOnError)
+	empty := fs.Bool("empty", false, "delete everything in the trash for good")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("usage: container trash [--empty]")
+		return 2
+	}
+	if err := purgeTrash(*empty); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *empty {
+		return 0
+	}
+	trashed, err := listTrash()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	table := newTable("CONTAINER ID", "IMAGE", "REMOVED", "PURGED IN", "NAMES")
+	for _, t := range trashed {
+		image := t.c.Config.Image
+		if image == "" {
+			image = t.c.Config.RootfsPath
+		}
+		table.add(t.c.shortID(), image, since(t.record.DeletedAt)+" ago", until(t.record.ExpiresAt), t.c.name())
+	}
+	table.write(os.Stdout, false)
+	return 0
+}
+
+// until is since for a time to come.
+func until(t time.Time) string {
+	return formatAge(time.Until(t))
+}
@@ -0,0 +1,317 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// unpackWorkers is how many files of a layer are written at once. Layers of
+// many small files, node_modules for one, spend their time creating files
+// rather than reading the layer, which only one goroutine can do.
+var unpackWorkers = max(4, runtime.NumCPU())
+
+// maxQueuedFile is the largest file read into memory to be written by a
+// worker. Bigger ones are written as they are read, which keeps what
+// unpacking holds in memory to unpackWorkers of these.
+const maxQueuedFile = 1 << 20
+
+// layerUnpacker extracts a layer's entries into root in the order they come
+// in the layer, except that small files are written by a pool of workers.
+// Directories are made before anything is put in them, and anything that
+// would touch a file still being written waits for the workers to finish.
+type layerUnpacker struct {
+	root string
+	eg   *errgroup.Group
+	ctx  context.Context
+	// queued has the files handed to the workers since they last finished.
+	queued map[string]bool
+	// parents caches where the layer's directories are in root, which only
+	// changes when a symlink or directory is replaced.
+	parents map[string]string
+	// dirs get their modes and times once everything is in them.
+	dirs []layerDir
+}
+
+type layerDir struct {
+	target string
+	hdr    *tar.Header
+}
+
+// unpackLayer extracts the layer in fileName into root, leaving out its
+// whiteouts, which applyWhiteouts has dealt with. Paths are resolved within
+// root, so that the layer's symlinks can't lead it out.
+func unpackLayer(fileName, root string) error {
+	r, err := openLayer(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return unpackTar(r, root, nil)
+}
+
+// unpackTar extracts the uncompressed layer read from r into root as
+// unpackLayer does. If keep isn't nil, it is shown every entry, whiteouts
+// included, and only those it keeps are extracted.
+func unpackTar(r io.Reader, root string, keep func(*tar.Header) bool) error {
+	u := &layerUnpacker{root: root, parents: make(map[string]string)}
+	u.reset()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			u.flush()
+			return fmt.Errorf("read layer: %v", err)
+		}
+		// A worker that failed cancels the rest.
+		if u.ctx.Err() != nil {
+			break
+		}
+		if keep != nil && !keep(hdr) {
+			continue
+		}
+		if err := u.entry(tr, hdr); err != nil {
+			u.flush()
+			return fmt.Errorf("unpack %s: %v", hdr.Name, err)
+		}
+	}
+	if err := u.flush(); err != nil {
+		return err
+	}
+	for i := len(u.dirs) - 1; i >= 0; i-- {
+		d := u.dirs[i]
+		// Something later in the layer may have taken its place.
+		if fi, err := os.Lstat(d.target); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := applyHeader(d.target, d.hdr); err != nil {
+			return fmt.Errorf("unpack %s: %v", d.hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+func (u *layerUnpacker) reset() {
+	u.eg, u.ctx = errgroup.WithContext(context.Background())
+	u.eg.SetLimit(unpackWorkers)
+	u.queued = make(map[string]bool)
+}
+
+// flush waits for the files handed to the workers to be written.
+func (u *layerUnpacker) flush() error {
+	err := u.eg.Wait()
+	u.reset()
+	return err
+}
+
+func (u *layerUnpacker) entry(tr *tar.Reader, hdr *tar.Header) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		if hdr.Typeflag == tar.TypeDir {
+			u.dirs = append(u.dirs, layerDir{u.root, hdr})
+		}
+		return nil
+	}
+	parent, base := path.Split(name)
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return nil
+	}
+	dir, err := u.parent(parent)
+	if err != nil {
+		return err
+	}
+	target := path.Join(dir, base)
+	if u.queued[target] {
+		if err := u.flush(); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		fi, err := os.Lstat(target)
+		if err == nil && !fi.IsDir() {
+			if err := u.replace(target); err != nil {
+				return err
+			}
+		}
+		if err != nil || !fi.IsDir() {
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+		}
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+		u.dirs = append(u.dirs, layerDir{target, hdr})
+		return nil
+	case tar.TypeReg:
+		if err := u.replace(target); err != nil {
+			return err
+		}
+		if hdr.Size > maxQueuedFile {
+			return writeLayerFile(target, hdr, tr)
+		}
+		data := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(tr, data); err != nil {
+			return err
+		}
+		u.queued[target] = true
+		u.eg.Go(func() error {
+			if err := writeLayerFile(target, hdr, bytes.NewReader(data)); err != nil {
+				return fmt.Errorf("unpack %s: %v", hdr.Name, err)
+			}
+			return nil
+		})
+		return nil
+	case tar.TypeSymlink:
+		if err := u.replace(target); err != nil {
+			return err
+		}
+		clear(u.parents)
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return applyHeader(target, hdr)
+	case tar.TypeLink:
+		linkParent, linkBase := path.Split(path.Clean("/" + hdr.Linkname))
+		dir, err := u.parent(linkParent)
+		if err != nil {
+			return err
+		}
+		source := path.Join(dir, linkBase)
+		if u.queued[source] {
+			if err := u.flush(); err != nil {
+				return err
+			}
+		}
+		if err := u.replace(target); err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := u.replace(target); err != nil {
+			return err
+		}
+		mode := uint32(hdr.Mode) & 07777
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			mode |= syscall.S_IFBLK
+		default:
+			mode |= syscall.S_IFIFO
+		}
+		if err := syscall.Mknod(target, mode, mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))); err != nil {
+			return fmt.Errorf("mknod: %v", err)
+		}
+		return applyHeader(target, hdr)
+	}
+	return nil
+}
+
+// parent returns where the layer's directory p is in root, making it if a
+// lower layer doesn't have it and the layer names it only by what is in it.
+func (u *layerUnpacker) parent(p string) (string, error) {
+	if dir, ok := u.parents[p]; ok {
+		return dir, nil
+	}
+	dir, err := securePath(u.root, p)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	u.parents[p] = dir
+	return dir, nil
+}
+
+// replace removes whatever a lower layer has at target for the layer's
+// entry to take its place, as Docker does. A directory is replaced with
+// everything in it, so any of that still being written is waited for.
+func (u *layerUnpacker) replace(target string) error {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := u.flush(); err != nil {
+			return err
+		}
+	}
+	if fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 {
+		clear(u.parents)
+	}
+	return os.RemoveAll(target)
+}
+
+func writeLayerFile(target string, hdr *tar.Header, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return applyHeader(target, hdr)
+}
+
+// applyHeader gives target the owner, mode and modification time hdr
+// records for it.
+func applyHeader(target string, hdr *tar.Header) error {
+	// Ownership only carries over for root; anyone else gets the files.
+	os.Lchown(target, hdr.Uid, hdr.Gid)
+	if hdr.Typeflag == tar.TypeSymlink {
+		return lchtimes(target, hdr.ModTime)
+	}
+	// The mode again, since the umask applied when the file was created
+	// and chown clears the setuid and setgid bits.
+	if err := os.Chmod(target, hdr.FileInfo().Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// Arguments of utimensat not in the syscall package.
+const (
+	atFdcwd           = -100
+	atSymlinkNofollow = 0x100
+)
+
+// lchtimes sets the access and modification times of target, and of the
+// link itself if it is a symlink.
+func lchtimes(target string, t time.Time) error {
+	p, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	ts := []syscall.Timespec{syscall.NsecToTimespec(t.UnixNano()), syscall.NsecToTimespec(t.UnixNano())}
+	dirfd := atFdcwd
+	if _, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0); errno != 0 {
+		return &os.PathError{Op: "lchtimes", Path: target, Err: errno}
+	}
+	return nil
+}
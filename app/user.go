@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// containerUser is the identity the container command runs as.
+type containerUser struct {
+	uid  int
+	gid  int
+	home string
+}
+
+// lookupUser resolves a -u value of the form user[:group] against the
+// passwd and group files of the current root, so it must run once the
+// container's root is in place. Numeric IDs don't need to exist in the
+// image.
+func lookupUser(spec string) (containerUser, error) {
+	return lookupUserIn("/", spec)
+}
+
+// lookupUserIn is lookupUser against the files of the rootfs at root.
+func lookupUserIn(root, spec string) (containerUser, error) {
+	u := containerUser{home: "/"}
+	if spec == "" {
+		spec = "0"
+	}
+	name, group, hasGroup := strings.Cut(spec, ":")
+	entry, err := findEntry(root, "/etc/passwd", name)
+	switch {
+	case err == nil:
+		u.uid, _ = strconv.Atoi(entry[2])
+		u.gid, _ = strconv.Atoi(entry[3])
+		if len(entry) > 5 {
+			u.home = entry[5]
+		}
+	case isNumeric(name):
+		u.uid, _ = strconv.Atoi(name)
+		u.gid = u.uid
+		if u.uid == 0 {
+			u.home = "/root"
+		}
+	default:
+		return u, fmt.Errorf("unable to find user %s: %v", name, err)
+	}
+	if !hasGroup {
+		return u, nil
+	}
+	entry, err = findEntry(root, "/etc/group", group)
+	switch {
+	case err == nil:
+		u.gid, _ = strconv.Atoi(entry[2])
+	case isNumeric(group):
+		u.gid, _ = strconv.Atoi(group)
+	default:
+		return u, fmt.Errorf("unable to find group %s: %v", group, err)
+	}
+	return u, nil
+}
+
+// findEntry returns the colon-separated fields of the line in file, in the
+// rootfs at root, whose name (first field) or ID (third field) equals key.
+func findEntry(root, file, key string) ([]string, error) {
+	resolved, err := securePath(root, file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[0] == key || fields[2] == key {
+			return fields, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no matching entries in %s", file)
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// switchUser drops the calling process to u. Supplementary groups are
+// cleared so that none of root's leak into the container. A user namespace
+// that forbids setgroups has none to leak, so clearGroups is false there.
+// The kernel forgets the parent death signal when the uid changes, so it
+// is set again afterwards.
+func switchUser(u containerUser, clearGroups bool) error {
+	var deathSig int32
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_GET_PDEATHSIG, uintptr(unsafe.Pointer(&deathSig)), 0); errno != 0 {
+		return fmt.Errorf("get parent death signal: %v", errno)
+	}
+	if clearGroups {
+		if err := syscall.Setgroups(nil); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+	}
+	if err := syscall.Setgid(u.gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(u.uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	if deathSig != 0 {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(deathSig), 0); errno != 0 {
+			return fmt.Errorf("set parent death signal: %v", errno)
+		}
+	}
+	return nil
+}
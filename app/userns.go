@@ -0,0 +1,184 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// idMappings works out how IDs in rootless container c map to the host.
+// Root in the container is the user it belongs to: the daemon client that
+// created it, or else the calling user. If /etc/subuid and /etc/subgid
+// grant that user a range of subordinate IDs, and we are able to install
+// it, IDs from 1 upwards map onto that range so that images with several
+// users work; otherwise the container only has root.
+func idMappings(c *Container) (uids, gids []syscall.SysProcIDMap) {
+	uid, gid := os.Geteuid(), os.Getegid()
+	if c.Config.Owner != 0 {
+		uid, gid = c.Config.Owner, c.Config.OwnerGid
+	}
+	uids = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	gids = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	if !canMapRanges() {
+		return uids, gids
+	}
+	name := strconv.Itoa(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	if start, count, ok := subordinateRange("/etc/subuid", name, uid); ok {
+		uids = append(uids, syscall.SysProcIDMap{ContainerID: 1, HostID: start, Size: count})
+	}
+	if start, count, ok := subordinateRange("/etc/subgid", name, uid); ok {
+		gids = append(gids, syscall.SysProcIDMap{ContainerID: 1, HostID: start, Size: count})
+	}
+	return uids, gids
+}
+
+// canMapRanges reports whether we can map more than our own ID: root can
+// write any mapping, everyone else needs the setuid shadow-utils helpers.
+func canMapRanges() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	_, errU := exec.LookPath("newuidmap")
+	_, errG := exec.LookPath("newgidmap")
+	return errU == nil && errG == nil
+}
+
+// subordinateRange finds the first range granted to the user in an
+// /etc/subuid style file, which may name the user or give their UID.
+func subordinateRange(file, name string, uid int) (start, count int, ok bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(uid)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 == nil && err2 == nil && count > 0 {
+			return start, count, true
+		}
+	}
+	return 0, 0, false
+}
+
+// setUserNamespace adds a new user namespace to attr. Mappings we may
+// write ourselves are installed before init execs, which it needs in order
+// to have capabilities in the namespace. Ranges that need newuidmap and
+// newgidmap can only be installed once init is running; setUserNamespace
+// then reports true and the caller must call mapIDs after the start and
+// have init re-exec itself.
+func setUserNamespace(attr *syscall.SysProcAttr, c *Container) (late bool) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	uids, gids := idMappings(c)
+	if os.Geteuid() != 0 && (len(uids) > 1 || len(gids) > 1) {
+		return true
+	}
+	attr.UidMappings = uids
+	attr.GidMappings = gids
+	// An unprivileged process may only write gid_map once setgroups has
+	// been disabled for the namespace.
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	if os.Geteuid() == 0 {
+		// Root in the container may be some other user on the host, which
+		// init has to become before it execs or it loses its capabilities
+		// in the namespace. That also drops our supplementary groups.
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+	return false
+}
+
+// mapIDs installs the ID mappings of c's user namespace with the setuid
+// shadow-utils helpers.
+func mapIDs(c *Container) error {
+	pid := c.Pid
+	uids, gids := idMappings(c)
+	if err := runCommand("newuidmap", mappingArgs(pid, uids)...); err != nil {
+		return err
+	}
+	return runCommand("newgidmap", mappingArgs(pid, gids)...)
+}
+
+// shiftOwnership gives everything under dir, which is c's rootfs as the
+// image has it, the host IDs its owners map to in c's user namespace, so
+// that root in the container owns what root in the image does even when
+// it isn't root on the host. IDs the namespace doesn't map are left alone.
+func shiftOwnership(c *Container, dir string) error {
+	uids, gids := idMappings(c)
+	// Hard links are only shifted once.
+	shifted := make(map[uint64]bool)
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			return err
+		}
+		if st.Nlink > 1 && !d.IsDir() {
+			if shifted[st.Ino] {
+				return nil
+			}
+			shifted[st.Ino] = true
+		}
+		if err := os.Lchown(p, hostID(uids, int(st.Uid)), hostID(gids, int(st.Gid))); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		// chown clears the setuid and setgid bits.
+		return syscall.Chmod(p, st.Mode&07777)
+	})
+}
+
+// hostID is the host ID that id in a user namespace with maps is.
+func hostID(maps []syscall.SysProcIDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	return id
+}
+
+func mappingArgs(pid int, maps []syscall.SysProcIDMap) []string {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	return args
+}
+
+// setgroupsDenied reports whether setgroups has been disabled in our user
+// namespace, which is the case for a rootless container with a single
+// mapped group.
+func setgroupsDenied() bool {
+	return setgroupsDeniedIn("/proc/self")
+}
+
+// setgroupsDeniedFor is setgroupsDenied for the user namespace of pid.
+func setgroupsDeniedFor(pid int) bool {
+	return setgroupsDeniedIn("/proc/" + strconv.Itoa(pid))
+}
+
+func setgroupsDeniedIn(proc string) bool {
+	data, err := os.ReadFile(proc + "/setgroups")
+	return err == nil && strings.TrimSpace(string(data)) == "deny"
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Work directories can be moved off the state directory, to a faster disk,
+// say. Both have to be on the same filesystem as the state directory all
+// the same: what is downloaded is renamed into the image store once it has
+// been verified, and a removed container's rootfs is renamed out of the way
+// to be deleted in the background, and renames can't cross filesystems.
+const (
+	// tmpDirEnv is where blobs are downloaded and other files are written
+	// before being moved into the image store.
+	tmpDirEnv = "DIY_DOCKER_TMPDIR"
+	// rootfsDirEnv is where containers' rootfses are unpacked, in place of
+	// each container's own directory.
+	rootfsDirEnv = "DIY_DOCKER_ROOTFS_DIR"
+)
+
+// tmpDir returns where files bound for the image store in dir are written
+// first.
+func tmpDir(dir string) string {
+	if tmp := os.Getenv(tmpDirEnv); tmp != "" {
+		return tmp
+	}
+	return dir
+}
+
+// containerRootfs returns where the image of the container with the given ID
+// is unpacked.
+func containerRootfs(id string) string {
+	if dir := os.Getenv(rootfsDirEnv); dir != "" {
+		return path.Join(dir, id)
+	}
+	return path.Join(containersDir(), id, "rootfs")
+}
+
+// separateRootfs reports whether c's rootfs is ours and lives outside c's
+// directory, which means it has to be removed on its own.
+func (c *Container) separateRootfs() bool {
+	return c.Config.RootfsPath == "" && c.Rootfs != path.Join(c.dir(), "rootfs")
+}
+
+// checkWorkDirs makes sure the work directories set in the environment can
+// be used, creating them if need be, so that a misplaced one is found out
+// at once rather than by the first rename to fail with EXDEV.
+func checkWorkDirs() error {
+	for _, d := range []struct{ env, target, what string }{
+		{tmpDirEnv, path.Join(stateDir(), "images"), "downloads are moved into the image store once verified"},
+		{rootfsDirEnv, stateDir(), "removed containers are moved out of the way to be deleted"},
+	} {
+		dir := os.Getenv(d.env)
+		if dir == "" {
+			continue
+		}
+		if !path.IsAbs(dir) {
+			return fmt.Errorf("%s=%s: must be an absolute path", d.env, dir)
+		}
+		for _, p := range []string{dir, d.target} {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return fmt.Errorf("mkdir: %v", err)
+			}
+		}
+		err := tryRename(dir, d.target)
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("%s=%s is on a different filesystem from the state directory %s, and %s, which can't be done across filesystems. Pick a directory on the same filesystem, or move the state directory there with %s", d.env, dir, stateDir(), d.what, stateDirEnv)
+		}
+		if err != nil {
+			return fmt.Errorf("%s=%s: %v", d.env, dir, err)
+		}
+	}
+	return nil
+}
+
+// tryRename renames a file from one directory to the other to see that it
+// can be done. Even directories of the same filesystem can't be renamed
+// between if they are mounted apart, as with bind mounts, which comparing
+// the devices they are on wouldn't tell.
+func tryRename(from, to string) error {
+	f, err := os.CreateTemp(from, ".rename-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	moved := path.Join(to, path.Base(f.Name()))
+	if err := os.Rename(f.Name(), moved); err != nil {
+		return err
+	}
+	return os.Remove(moved)
+}